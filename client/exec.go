@@ -47,6 +47,11 @@ type ExecOptions struct {
 	GroupID *int
 	Group   string
 
+	// Optional resource limits, mapping resource names such as "nofile" to
+	// limits such as "1024", "1024:4096" (soft and hard limits), or
+	// "unlimited". These are merged on top of the service context's limits.
+	Limits map[string]string
+
 	// Optional timeout for the command execution, after which the process
 	// will be terminated. If zero, no timeout applies.
 	Timeout time.Duration
@@ -88,6 +93,7 @@ type execPayload struct {
 	User           string            `json:"user,omitempty"`
 	GroupID        *int              `json:"group-id,omitempty"`
 	Group          string            `json:"group,omitempty"`
+	Limits         map[string]string `json:"limits,omitempty"`
 	Terminal       bool              `json:"terminal,omitempty"`
 	Interactive    bool              `json:"interactive,omitempty"`
 	SplitStderr    bool              `json:"split-stderr,omitempty"`
@@ -137,6 +143,7 @@ func (client *Client) Exec(opts *ExecOptions) (*ExecProcess, error) {
 		User:           opts.User,
 		GroupID:        opts.GroupID,
 		Group:          opts.Group,
+		Limits:         opts.Limits,
 		Terminal:       opts.Terminal,
 		Interactive:    opts.Interactive,
 		SplitStderr:    opts.Stderr != nil,
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"net/url"
+	"time"
 )
 
 var (
@@ -71,3 +72,11 @@ func (p *ExecProcess) WaitStdinDone() {
 }
 
 type ClientWebsocket = clientWebsocket
+
+func FakeFollowReconnectDelay(delay time.Duration) (restore func()) {
+	old := followReconnectDelay
+	followReconnectDelay = delay
+	return func() {
+		followReconnectDelay = old
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"net/url"
+	"time"
+)
+
+type LogTargetsOptions struct {
+	// Names is the list of log target names to query for. A log target is
+	// included in the results if this field is nil or empty slice, or if
+	// one of the values in the slice is equal to the log target's name.
+	Names []string
+}
+
+// LogTargetInfo holds status information for a single log target.
+type LogTargetInfo struct {
+	// Name is the name of this log target, from the layer configuration.
+	Name string `json:"name"`
+
+	// Type is this log target's type, from the layer configuration.
+	Type string `json:"type"`
+
+	// Services is the list of running services whose logs are currently
+	// being forwarded to this log target.
+	Services []string `json:"services"`
+
+	// EntriesSent is the number of log entries sent successfully since the
+	// log target was added to the plan (or Pebble was started).
+	EntriesSent int `json:"entries-sent"`
+
+	// EntriesDropped is the number of log entries discarded without being
+	// sent, for example because the target was unreachable for so long that
+	// its buffer (or spool) was full, or because it rejected them.
+	EntriesDropped int `json:"entries-dropped"`
+
+	// BytesSent is the number of bytes of log data sent successfully.
+	BytesSent int64 `json:"bytes-sent"`
+
+	// LastFlush is the time logs were last sent successfully, or the zero
+	// value if no logs have been sent.
+	LastFlush time.Time `json:"last-flush"`
+
+	// LastError is the error from the last failed attempt to send logs, if
+	// any. Sending has recovered if LastFlush is after LastErrorTime.
+	LastError string `json:"last-error"`
+
+	// LastErrorTime is the time of the last failed attempt to send logs.
+	LastErrorTime time.Time `json:"last-error-time"`
+
+	// RetryDelay is how long Pebble is waiting before retrying after a
+	// failed attempt to send spooled logs, or zero if not retrying.
+	RetryDelay time.Duration `json:"retry-delay"`
+}
+
+type jsonLogTargetInfo struct {
+	LogTargetInfo
+	RetryDelay string `json:"retry-delay"`
+}
+
+// LogTargets fetches status information about specific log targets (or all
+// of them), ordered by log target name.
+func (client *Client) LogTargets(opts *LogTargetsOptions) ([]*LogTargetInfo, error) {
+	query := make(url.Values)
+	if len(opts.Names) > 0 {
+		query["names"] = opts.Names
+	}
+	var jsonTargets []*jsonLogTargetInfo
+	_, err := client.doSync("GET", "/v1/log-targets", query, nil, nil, &jsonTargets)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]*LogTargetInfo, len(jsonTargets))
+	for i, jt := range jsonTargets {
+		targets[i] = &jt.LogTargetInfo
+		targets[i].RetryDelay, _ = time.ParseDuration(jt.RetryDelay)
+	}
+	return targets, nil
+}
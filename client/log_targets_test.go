@@ -0,0 +1,68 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"net/url"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/client"
+)
+
+func (cs *clientSuite) TestLogTargetsGet(c *check.C) {
+	cs.rsp = `{
+		"result": [
+			{"name": "tgt1", "type": "loki", "services": ["svc1", "svc2"],
+			 "entries-sent": 42, "entries-dropped": 0, "bytes-sent": 1234,
+			 "last-flush": "2024-04-01T10:20:30Z"},
+			{"name": "tgt2", "type": "syslog", "services": [],
+			 "entries-sent": 0, "entries-dropped": 7, "bytes-sent": 0,
+			 "last-error": "connection refused",
+			 "last-error-time": "2024-04-01T10:20:31Z", "retry-delay": "4s"}
+		],
+		"status": "OK",
+		"status-code": 200,
+		"type": "sync"
+	}`
+
+	opts := client.LogTargetsOptions{
+		Names: []string{"tgt1", "tgt2"},
+	}
+	targets, err := cs.cli.LogTargets(&opts)
+	c.Assert(err, check.IsNil)
+	c.Assert(targets, check.DeepEquals, []*client.LogTargetInfo{{
+		Name:        "tgt1",
+		Type:        "loki",
+		Services:    []string{"svc1", "svc2"},
+		EntriesSent: 42,
+		BytesSent:   1234,
+		LastFlush:   time.Date(2024, 4, 1, 10, 20, 30, 0, time.UTC),
+	}, {
+		Name:           "tgt2",
+		Type:           "syslog",
+		Services:       []string{},
+		EntriesDropped: 7,
+		LastError:      "connection refused",
+		LastErrorTime:  time.Date(2024, 4, 1, 10, 20, 31, 0, time.UTC),
+		RetryDelay:     4 * time.Second,
+	}})
+	c.Assert(cs.req.Method, check.Equals, "GET")
+	c.Assert(cs.req.URL.Path, check.Equals, "/v1/log-targets")
+	c.Assert(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"names": {"tgt1", "tgt2"},
+	})
+}
@@ -21,17 +21,27 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"strconv"
 	"time"
 )
 
-// This needs to be the size of daemon.logReaderSize, plus extra to handle the
-// timestamp, service name, and JSON syntax.
+// This is the size of daemon.logReaderSize, plus extra to handle the
+// timestamp, service name, and JSON syntax. Longer logs (such as multi-line
+// logs) are still read, but need an extra allocation.
 const (
 	logReaderSize = 5 * 1024
 )
 
+// followReconnectDelay is how long FollowLogs waits before reconnecting
+// after the connection to the daemon is lost.
+var followReconnectDelay = time.Second
+
+// errConnectionLost is returned by logs when following and the daemon closes
+// the connection.
+var errConnectionLost = errors.New("connection to daemon lost")
+
 type LogsOptions struct {
 	// WriteLog is called to write a single log to the output (required).
 	WriteLog func(entry LogEntry) error
@@ -43,7 +53,39 @@ type LogsOptions struct {
 	// N defines the number of log lines to return from the buffer. In follow
 	// mode, the default is zero, in non-follow mode it's server-defined
 	// (currently 30). Set to -1 to return the entire buffer.
+	//
+	// If Since or Until is set, the default is to return all logs in the
+	// time range, otherwise N limits the logs to the most recent N in the
+	// range.
 	N int
+
+	// If set, Since requests only logs written at or after this time. For
+	// services with persistent log storage, this may include logs older than
+	// those held in memory. To request logs from a duration ago, use
+	// time.Now().Add(-duration).
+	Since time.Time
+
+	// If set, Until requests only logs written at or before this time. It
+	// cannot be used with FollowLogs.
+	Until time.Time
+
+	// If set, Level requests only structured logs at this level or a more
+	// severe one (one of "trace", "debug", "info", "warning", "error" or
+	// "fatal"). Logs without a level are excluded.
+	Level string
+
+	// If set, Stream requests only logs written to this stream of the
+	// services' output, "stdout" or "stderr".
+	Stream string
+
+	// If set, Grep requests only logs whose message matches this regular
+	// expression (in Go's regexp syntax).
+	Grep string
+
+	// If set, Cursor requests only logs after the one with this cursor (see
+	// LogEntry.Cursor), for example to resume fetching logs after an earlier
+	// call. FollowLogs uses this to reconnect automatically.
+	Cursor string
 }
 
 // LogEntry is the struct passed to the WriteLog function.
@@ -51,6 +93,17 @@ type LogEntry struct {
 	Time    time.Time `json:"time"`
 	Service string    `json:"service"`
 	Message string    `json:"message"`
+
+	// Stream is the stream the log was written to, "stdout" or "stderr".
+	Stream string `json:"stream,omitempty"`
+
+	// Level and Fields are only set for services with structured logs
+	// (see the log-format service option).
+	Level  string            `json:"level,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+
+	// Cursor identifies the log's position, for use with LogsOptions.Cursor.
+	Cursor string `json:"cursor,omitempty"`
 }
 
 // Logs fetches previously-written logs from the given services.
@@ -59,9 +112,36 @@ func (client *Client) Logs(opts *LogsOptions) error {
 }
 
 // FollowLogs requests logs from the given services and follows them until the
-// context is cancelled.
+// context is cancelled. If the connection to the daemon is lost, FollowLogs
+// reconnects and resumes after the last log received, so no logs are missed
+// or repeated.
 func (client *Client) FollowLogs(ctx context.Context, opts *LogsOptions) error {
-	return client.logs(ctx, opts, true)
+	resumeOpts := *opts
+	resumeOpts.WriteLog = func(entry LogEntry) error {
+		err := opts.WriteLog(entry)
+		if err == nil && entry.Cursor != "" {
+			resumeOpts.Cursor = entry.Cursor
+		}
+		return err
+	}
+	for {
+		err := client.logs(ctx, &resumeOpts, true)
+		if ctx.Err() != nil {
+			// Cancelled, possibly while reconnecting.
+			return nil
+		}
+		if !errors.Is(err, errConnectionLost) {
+			return err
+		}
+		// The daemon closed the connection (for example, it's restarting),
+		// so reconnect and resume from the last log received.
+		select {
+		case <-time.After(followReconnectDelay):
+		case <-ctx.Done():
+			return nil
+		}
+		resumeOpts.N = 0
+	}
 }
 
 func (client *Client) logs(ctx context.Context, opts *LogsOptions, follow bool) error {
@@ -72,6 +152,24 @@ func (client *Client) logs(ctx context.Context, opts *LogsOptions, follow bool)
 	if opts.N != 0 {
 		query.Set("n", strconv.Itoa(opts.N))
 	}
+	if !opts.Since.IsZero() {
+		query.Set("since", opts.Since.Format(time.RFC3339Nano))
+	}
+	if !opts.Until.IsZero() {
+		query.Set("until", opts.Until.Format(time.RFC3339Nano))
+	}
+	if opts.Level != "" {
+		query.Set("level", opts.Level)
+	}
+	if opts.Stream != "" {
+		query.Set("stream", opts.Stream)
+	}
+	if opts.Grep != "" {
+		query.Set("grep", opts.Grep)
+	}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
 	if follow {
 		query.Set("follow", "true")
 	}
@@ -86,9 +184,25 @@ func (client *Client) logs(ctx context.Context, opts *LogsOptions, follow bool)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		var serverResp response
+		err := decodeInto(resp.Body, &serverResp)
+		if err != nil {
+			return err
+		}
+		if err := serverResp.err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("cannot get logs: unexpected status code %d", resp.StatusCode)
+	}
+
 	reader := bufio.NewReaderSize(resp.Body, logReaderSize)
 	for {
 		err = decodeLog(reader, opts.WriteLog)
+		if follow && ctx.Err() == nil && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+			// The daemon closed the connection; FollowLogs will reconnect.
+			return errConnectionLost
+		}
 		if errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) {
 			break
 		}
@@ -104,6 +218,13 @@ func (client *Client) logs(ctx context.Context, opts *LogsOptions, follow bool)
 func decodeLog(reader *bufio.Reader, writeLog func(entry LogEntry) error) error {
 	// Read log JSON and newline separator
 	b, err := reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		// Copy the start of the log, as it's overwritten by further reads.
+		b = append([]byte(nil), b...)
+		var rest []byte
+		rest, err = reader.ReadBytes('\n')
+		b = append(b, rest...)
+	}
 	if errors.Is(err, io.EOF) {
 		return io.EOF
 	}
@@ -18,9 +18,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"gopkg.in/check.v1"
 
@@ -112,6 +114,104 @@ func (cs *clientSuite) TestLogsAll(c *check.C) {
 `[1:])
 }
 
+func (cs *clientSuite) TestLogsTimeRange(c *check.C) {
+	cs.rsp = `
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1\n"}
+`[1:]
+	out, writeLog := makeLogWriter()
+	err := cs.cli.Logs(&client.LogsOptions{
+		WriteLog: writeLog,
+		Since:    time.Date(2021, 5, 3, 3, 55, 0, 0, time.UTC),
+		Until:    time.Date(2021, 5, 3, 4, 0, 0, 500000000, time.UTC),
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(cs.req.URL.Path, check.Equals, "/v1/logs")
+	c.Check(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"since": []string{"2021-05-03T03:55:00Z"},
+		"until": []string{"2021-05-03T04:00:00.5Z"},
+	})
+	c.Check(out.String(), check.Equals, `
+2021-05-03T03:55:49.360Z [thing] log 1
+`[1:])
+}
+
+func (cs *clientSuite) TestLogsLevel(c *check.C) {
+	cs.rsp = `
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"failed","level":"error","fields":{"id":"42"}}
+`[1:]
+	var entries []client.LogEntry
+	err := cs.cli.Logs(&client.LogsOptions{
+		WriteLog: func(entry client.LogEntry) error {
+			entries = append(entries, entry)
+			return nil
+		},
+		Level: "warning",
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"level": []string{"warning"},
+	})
+	c.Assert(entries, check.HasLen, 1)
+	c.Check(entries[0].Message, check.Equals, "failed")
+	c.Check(entries[0].Level, check.Equals, "error")
+	c.Check(entries[0].Fields, check.DeepEquals, map[string]string{"id": "42"})
+}
+
+func (cs *clientSuite) TestLogsStream(c *check.C) {
+	cs.rsp = `
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"oops","stream":"stderr"}
+`[1:]
+	var entries []client.LogEntry
+	err := cs.cli.Logs(&client.LogsOptions{
+		WriteLog: func(entry client.LogEntry) error {
+			entries = append(entries, entry)
+			return nil
+		},
+		Stream: "stderr",
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"stream": []string{"stderr"},
+	})
+	c.Assert(entries, check.HasLen, 1)
+	c.Check(entries[0].Message, check.Equals, "oops")
+	c.Check(entries[0].Stream, check.Equals, "stderr")
+}
+
+func (cs *clientSuite) TestLogsGrepCursor(c *check.C) {
+	cs.rsp = `
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"request failed","cursor":"abc"}
+`[1:]
+	var entries []client.LogEntry
+	err := cs.cli.Logs(&client.LogsOptions{
+		WriteLog: func(entry client.LogEntry) error {
+			entries = append(entries, entry)
+			return nil
+		},
+		Grep:   "fail",
+		Cursor: "xyz",
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"grep":   []string{"fail"},
+		"cursor": []string{"xyz"},
+	})
+	c.Assert(entries, check.HasLen, 1)
+	c.Check(entries[0].Message, check.Equals, "request failed")
+	c.Check(entries[0].Cursor, check.Equals, "abc")
+}
+
+func (cs *clientSuite) TestLogsError(c *check.C) {
+	cs.status = http.StatusBadRequest
+	cs.rsp = `{"type":"error","status-code":400,"result":{"message":"invalid grep parameter: oops"}}`
+	_, writeLog := makeLogWriter()
+	err := cs.cli.Logs(&client.LogsOptions{
+		WriteLog: writeLog,
+		Grep:     "(",
+	})
+	c.Assert(err, check.ErrorMatches, "invalid grep parameter: oops")
+}
+
 func (cs *clientSuite) TestLogsLong(c *check.C) {
 	const maxMessageSize = 4 * 1024
 	shortLog1 := `{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1\n"}`
@@ -137,6 +237,20 @@ func (cs *clientSuite) TestLogsLong(c *check.C) {
 	c.Check(out.String(), check.Equals, expected)
 }
 
+func (cs *clientSuite) TestLogsMultiline(c *check.C) {
+	// Multi-line logs can be longer than the client's read buffer.
+	message := strings.Repeat("at foo.bar\\n", 2000)
+	cs.rsp = `{"time":"2021-05-03T03:55:49.460994155Z","service":"java","message":"` + message + `"}` + "\n"
+	out, writeLog := makeLogWriter()
+	err := cs.cli.Logs(&client.LogsOptions{
+		WriteLog: writeLog,
+		N:        -1,
+	})
+	c.Assert(err, check.IsNil)
+	expected := "2021-05-03T03:55:49.460Z [java] " + strings.Repeat("at foo.bar\n", 2000)
+	c.Check(out.String(), check.Equals, expected)
+}
+
 func (cs *clientSuite) TestFollowLogs(c *check.C) {
 	readsChan := make(chan string)
 	cli, err := client.New(nil)
@@ -172,6 +286,53 @@ func (cs *clientSuite) TestFollowLogs(c *check.C) {
 `[1:])
 }
 
+func (cs *clientSuite) TestFollowLogsReconnect(c *check.C) {
+	restore := client.FakeFollowReconnectDelay(time.Millisecond)
+	defer restore()
+
+	var queries []url.Values
+	cli, err := client.New(nil)
+	c.Assert(err, check.IsNil)
+	cli.SetDoer(doerFunc(func(req *http.Request) (*http.Response, error) {
+		queries = append(queries, req.URL.Query())
+		readsChan := make(chan string, 3)
+		if len(queries) == 1 {
+			// The daemon closes the connection after the second log.
+			readsChan <- `{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1\n","cursor":"c1"}` + "\n"
+			readsChan <- `{"time":"2021-05-03T03:55:49.654334232Z","service":"snappass","message":"log two\n","cursor":"c2"}` + "\n"
+			close(readsChan)
+		} else {
+			readsChan <- `{"time":"2021-05-03T03:55:50.076Z","service":"thing","message":"the third\n","cursor":"c3"}` + "\n"
+			readsChan <- ""
+		}
+		rsp := &http.Response{
+			Body:       &followReader{readsChan},
+			Header:     make(http.Header),
+			StatusCode: http.StatusOK,
+		}
+		return rsp, nil
+	}))
+
+	out, writeLog := makeLogWriter()
+	err = cli.FollowLogs(context.Background(), &client.LogsOptions{
+		WriteLog: writeLog,
+		N:        10,
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(queries, check.DeepEquals, []url.Values{{
+		"follow": []string{"true"},
+		"n":      []string{"10"},
+	}, {
+		"follow": []string{"true"},
+		"cursor": []string{"c2"},
+	}})
+	c.Check(out.String(), check.Equals, `
+2021-05-03T03:55:49.360Z [thing] log 1
+2021-05-03T03:55:49.654Z [snappass] log two
+2021-05-03T03:55:50.076Z [thing] the third
+`[1:])
+}
+
 func (cs *clientSuite) TestLogsWriteLogError(c *check.C) {
 	cs.rsp = `{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1\n"}` + "\n"
 	err := cs.cli.Logs(&client.LogsOptions{
@@ -193,7 +354,10 @@ type followReader struct {
 }
 
 func (r *followReader) Read(b []byte) (int, error) {
-	this := <-r.readsChan
+	this, ok := <-r.readsChan
+	if !ok {
+		return 0, io.EOF
+	}
 	if this == "" {
 		return 0, context.Canceled
 	}
@@ -97,6 +97,61 @@ type ServiceInfo struct {
 	Startup      ServiceStartup `json:"startup"`
 	Current      ServiceStatus  `json:"current"`
 	CurrentSince time.Time      `json:"current-since"`
+
+	// LogsSuppressed is the number of lines of the service's output dropped
+	// by its log-rate-limit.
+	LogsSuppressed int64 `json:"logs-suppressed,omitempty"`
+
+	// LastRun, LastExitCode, and NextRun are only set for services with a
+	// schedule. LastExitCode is nil until the last run has finished.
+	LastRun      time.Time `json:"last-run"`
+	LastExitCode *int      `json:"last-exit-code,omitempty"`
+	NextRun      time.Time `json:"next-run"`
+
+	// Usage is the resource usage of the service's cgroup. It's nil unless
+	// Pebble manages cgroups.
+	Usage *ServiceUsage `json:"usage,omitempty"`
+
+	// StatusText is the last status sent by a service using the sd_notify
+	// protocol, if any.
+	StatusText string `json:"status-text,omitempty"`
+}
+
+// ServiceUsage is the resource usage of a service.
+type ServiceUsage struct {
+	// MemoryCurrent is the memory currently used, in bytes.
+	MemoryCurrent int64 `json:"memory-current"`
+
+	// CPUUsage is the total CPU time used.
+	CPUUsage time.Duration `json:"cpu-usage"`
+
+	// OOMKills is the number of processes killed by the OOM killer because
+	// the service reached its memory-max limit.
+	OOMKills int64 `json:"oom-kills"`
+}
+
+type jsonServiceUsage struct {
+	MemoryCurrent int64  `json:"memory-current"`
+	CPUUsage      string `json:"cpu-usage"`
+	OOMKills      int64  `json:"oom-kills"`
+}
+
+func (u *ServiceUsage) UnmarshalJSON(data []byte) error {
+	var ju jsonServiceUsage
+	err := json.Unmarshal(data, &ju)
+	if err != nil {
+		return err
+	}
+	cpuUsage, err := time.ParseDuration(ju.CPUUsage)
+	if err != nil {
+		return fmt.Errorf("invalid cpu-usage %q: %w", ju.CPUUsage, err)
+	}
+	*u = ServiceUsage{
+		MemoryCurrent: ju.MemoryCurrent,
+		CPUUsage:      cpuUsage,
+		OOMKills:      ju.OOMKills,
+	}
+	return nil
 }
 
 // ServiceStartup defines the different startup modes for a service.
@@ -111,10 +166,11 @@ const (
 type ServiceStatus string
 
 const (
-	StatusActive   ServiceStatus = "active"
-	StatusBackoff  ServiceStatus = "backoff"
-	StatusError    ServiceStatus = "error"
-	StatusInactive ServiceStatus = "inactive"
+	StatusActive    ServiceStatus = "active"
+	StatusBackoff   ServiceStatus = "backoff"
+	StatusError     ServiceStatus = "error"
+	StatusInactive  ServiceStatus = "inactive"
+	StatusCompleted ServiceStatus = "completed"
 )
 
 // Services fetches information about specific services (or all of them),
@@ -88,7 +88,9 @@ func (cs *clientSuite) TestServicesGet(c *check.C) {
 	cs.rsp = `{
 		"result": [
 			{"name": "svc1", "startup": "enabled", "current": "inactive"},
-			{"name": "svc2", "startup": "disabled", "current": "active", "current-since": "2022-04-28T17:05:23Z"}
+			{"name": "svc2", "startup": "disabled", "current": "active", "current-since": "2022-04-28T17:05:23Z", "logs-suppressed": 42,
+			 "usage": {"memory-current": 1048576, "cpu-usage": "1.5s", "oom-kills": 2}, "status-text": "Ready"},
+			{"name": "svc3", "startup": "disabled", "current": "inactive", "last-run": "2022-04-28T03:00:00Z", "last-exit-code": 1, "next-run": "2022-04-29T03:00:00Z"}
 		],
 		"status": "OK",
 		"status-code": 200,
@@ -100,9 +102,12 @@ func (cs *clientSuite) TestServicesGet(c *check.C) {
 	}
 	services, err := cs.cli.Services(&opts)
 	c.Assert(err, check.IsNil)
+	exitCode := 1
 	c.Assert(services, check.DeepEquals, []*client.ServiceInfo{
 		{Name: "svc1", Startup: client.StartupEnabled, Current: client.StatusInactive},
-		{Name: "svc2", Startup: client.StartupDisabled, Current: client.StatusActive, CurrentSince: time.Date(2022, 4, 28, 17, 5, 23, 0, time.UTC)},
+		{Name: "svc2", Startup: client.StartupDisabled, Current: client.StatusActive, CurrentSince: time.Date(2022, 4, 28, 17, 5, 23, 0, time.UTC), LogsSuppressed: 42,
+			Usage: &client.ServiceUsage{MemoryCurrent: 1048576, CPUUsage: 1500 * time.Millisecond, OOMKills: 2}, StatusText: "Ready"},
+		{Name: "svc3", Startup: client.StartupDisabled, Current: client.StatusInactive, LastRun: time.Date(2022, 4, 28, 3, 0, 0, 0, time.UTC), LastExitCode: &exitCode, NextRun: time.Date(2022, 4, 29, 3, 0, 0, 0, time.UTC)},
 	})
 	c.Assert(cs.req.Method, check.Equals, "GET")
 	c.Assert(cs.req.URL.Path, check.Equals, "/v1/services")
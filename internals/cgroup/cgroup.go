@@ -0,0 +1,402 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package cgroup places services in their own cgroup v2 groups, so that
+// their memory, CPU and process usage can be limited and reported, and all
+// of their processes can be killed.
+//
+// Pebble must own the cgroup it was started in (for example, because it's a
+// container's init process, or because it was started by systemd with
+// Delegate=yes). NewTree reorganises that cgroup as follows:
+//
+//	<pebble's cgroup>/daemon           Pebble itself, and commands it runs
+//	<pebble's cgroup>/services/<name>  each service's processes
+package cgroup
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	daemonGroup   = "daemon"
+	servicesGroup = "services"
+
+	// cpuMaxPeriod is the period used for cpu.max, in microseconds.
+	cpuMaxPeriod = 100000
+)
+
+// controllers are the controllers enabled for the services' groups.
+var controllers = []string{"cpu", "memory", "pids"}
+
+var (
+	root           = "/sys/fs/cgroup"
+	procSelfCgroup = "/proc/self/cgroup"
+
+	// useCgroupFD is true if processes are started directly in their group
+	// (see syscall.SysProcAttr.UseCgroupFD), rather than moved into it
+	// after they've started.
+	useCgroupFD = true
+
+	// writeFlags are the flags used to open a cgroup's interface files for
+	// writing. The files can't be created in the cgroup filesystem.
+	writeFlags = os.O_WRONLY | os.O_TRUNC
+)
+
+// ErrUnavailable is returned by NewTree if the unified (v2) cgroup hierarchy
+// isn't available.
+var ErrUnavailable = errors.New("cgroup v2 is not available")
+
+// FakeRoot makes the package use root as the cgroup filesystem, and the
+// cgroup at the given path (such as "/") as Pebble's own cgroup. Interface
+// files are created when they're written, and processes are moved into
+// their group after they've started. It's for use in tests.
+func FakeRoot(fakeRoot, path string) (restore func()) {
+	oldRoot, oldProcSelfCgroup, oldUseCgroupFD, oldWriteFlags := root, procSelfCgroup, useCgroupFD, writeFlags
+	root = fakeRoot
+	procSelfCgroup = filepath.Join(fakeRoot, "self-cgroup")
+	useCgroupFD = false
+	writeFlags |= os.O_CREATE
+	err := os.WriteFile(procSelfCgroup, []byte("0::"+path+"\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	return func() {
+		root, procSelfCgroup, useCgroupFD, writeFlags = oldRoot, oldProcSelfCgroup, oldUseCgroupFD, oldWriteFlags
+	}
+}
+
+// Tree is the cgroup subtree that Pebble manages.
+type Tree struct {
+	path string
+}
+
+// NewTree sets up Pebble's own cgroup to hold the services' groups: it
+// moves the processes in it to a "daemon" leaf group, and enables the
+// controllers that are available for a "services" group and its children.
+func NewTree() (*Tree, error) {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		return nil, ErrUnavailable
+	}
+	self, err := ownCgroup()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(root, self)
+	if filepath.Base(path) == daemonGroup && isDir(filepath.Join(path, "..", servicesGroup)) {
+		// Pebble has been restarted in place, so it's already set up.
+		return &Tree{path: filepath.Dir(path)}, nil
+	}
+
+	daemonPath := filepath.Join(path, daemonGroup)
+	err = mkdir(daemonPath)
+	if err != nil {
+		return nil, err
+	}
+	procs, err := readProcs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, pid := range procs {
+		err := writeFile(filepath.Join(daemonPath, "cgroup.procs"), strconv.Itoa(pid))
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			return nil, fmt.Errorf("cannot move process %d to cgroup: %w", pid, err)
+		}
+	}
+
+	servicesPath := filepath.Join(path, servicesGroup)
+	err = enableControllers(path)
+	if err != nil {
+		return nil, err
+	}
+	err = mkdir(servicesPath)
+	if err != nil {
+		return nil, err
+	}
+	err = enableControllers(servicesPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Tree{path: path}, nil
+}
+
+// ownCgroup returns the path of the calling process's cgroup in the unified
+// hierarchy.
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile(procSelfCgroup)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", ErrUnavailable
+}
+
+// enableControllers enables the available controllers for the children of
+// the group at path.
+func enableControllers(path string) error {
+	data, err := os.ReadFile(filepath.Join(path, "cgroup.controllers"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	available := strings.Fields(string(data))
+	var enable []string
+	for _, controller := range controllers {
+		for _, a := range available {
+			if a == controller {
+				enable = append(enable, "+"+controller)
+			}
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	err = writeFile(filepath.Join(path, "cgroup.subtree_control"), strings.Join(enable, " "))
+	if err != nil {
+		return fmt.Errorf("cannot enable cgroup controllers: %w", err)
+	}
+	return nil
+}
+
+// Service returns the group for the named service, creating it if needed.
+func (t *Tree) Service(name string) (*Group, error) {
+	path := filepath.Join(t.path, servicesGroup, name)
+	err := mkdir(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Group{path: path}, nil
+}
+
+// Group is a service's cgroup.
+type Group struct {
+	path string
+}
+
+// Path returns the path of the group's directory.
+func (g *Group) Path() string {
+	return g.path
+}
+
+// Limits are the resource limits of a group. Zero values mean no limit (or
+// the default CPU weight).
+type Limits struct {
+	// MemoryMax is the memory usage limit, in bytes.
+	MemoryMax int64
+	// CPUWeight is the relative share of CPU time, from 1 to 10000.
+	CPUWeight int
+	// CPUMax is the maximum CPU time, as a number of CPUs.
+	CPUMax float64
+	// PidsMax is the maximum number of processes (and threads).
+	PidsMax int
+}
+
+// SetLimits sets the group's limits, resetting those not set.
+func (g *Group) SetLimits(limits *Limits) error {
+	values := []struct {
+		file, name string
+		isSet      bool
+		value      string
+	}{{
+		"memory.max", "memory-max",
+		limits.MemoryMax > 0, strconv.FormatInt(limits.MemoryMax, 10),
+	}, {
+		"cpu.weight", "cpu-weight",
+		limits.CPUWeight > 0, strconv.Itoa(limits.CPUWeight),
+	}, {
+		"cpu.max", "cpu-max",
+		limits.CPUMax > 0, fmt.Sprintf("%d %d", int64(math.Ceil(limits.CPUMax*cpuMaxPeriod)), cpuMaxPeriod),
+	}, {
+		"pids.max", "pids-max",
+		limits.PidsMax > 0, strconv.Itoa(limits.PidsMax),
+	}}
+	for _, v := range values {
+		value := v.value
+		if !v.isSet {
+			value = "max"
+			if v.file == "cpu.weight" {
+				value = "100"
+			}
+		}
+		err := writeFile(filepath.Join(g.path, v.file), value)
+		if errors.Is(err, fs.ErrNotExist) {
+			if v.isSet {
+				controller, _, _ := strings.Cut(v.file, ".")
+				return fmt.Errorf("cannot set %s: %s controller not available", v.name, controller)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("cannot set %s: %w", v.name, err)
+		}
+	}
+	return nil
+}
+
+// Command sets up cmd so that its process is started in the group. The
+// returned function must be called once cmd has been started (or has failed
+// to start).
+func (g *Group) Command(cmd *exec.Cmd) (started func(), err error) {
+	if !useCgroupFD {
+		return func() {
+			if cmd.Process != nil {
+				_ = writeFile(filepath.Join(g.path, "cgroup.procs"), strconv.Itoa(cmd.Process.Pid)+"\n")
+			}
+		}, nil
+	}
+	f, err := os.Open(g.path)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(f.Fd())
+	return func() { f.Close() }, nil
+}
+
+// Kill sends SIGKILL to all the processes in the group.
+func (g *Group) Kill() error {
+	killPath := filepath.Join(g.path, "cgroup.kill")
+	if _, err := os.Stat(killPath); err == nil {
+		return writeFile(killPath, "1")
+	}
+	// cgroup.kill requires Linux 5.14, so fall back to killing the
+	// processes one by one (though more may be forked meanwhile).
+	procs, err := readProcs(g.path)
+	if err != nil {
+		return err
+	}
+	for _, pid := range procs {
+		err := syscall.Kill(pid, syscall.SIGKILL)
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats is the resource usage of a group.
+type Stats struct {
+	// MemoryCurrent is the memory used, in bytes.
+	MemoryCurrent int64
+	// CPUUsage is the total CPU time used.
+	CPUUsage time.Duration
+	// OOMKills is the number of processes killed by the OOM killer because
+	// the group reached its memory-max limit.
+	OOMKills int64
+}
+
+// Stats returns the group's resource usage. Usage that can't be determined
+// (because the relevant controller isn't enabled) is reported as zero.
+func (g *Group) Stats() (*Stats, error) {
+	var stats Stats
+	data, err := os.ReadFile(filepath.Join(g.path, "memory.current"))
+	if err == nil {
+		stats.MemoryCurrent, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("cannot read memory usage: %w", err)
+	}
+	usage, err := readKey(filepath.Join(g.path, "cpu.stat"), "usage_usec")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CPU usage: %w", err)
+	}
+	stats.CPUUsage = time.Duration(usage) * time.Microsecond
+	stats.OOMKills, err = readKey(filepath.Join(g.path, "memory.events"), "oom_kill")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read OOM kills: %w", err)
+	}
+	return &stats, nil
+}
+
+// readKey reads the value of key from a flat keyed file such as cpu.stat,
+// returning zero if the file or key doesn't exist.
+func readKey(path, key string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), " ")
+		if ok && k == key {
+			return strconv.ParseInt(v, 10, 64)
+		}
+	}
+	return 0, nil
+}
+
+// readProcs returns the PIDs of the processes in the group at path.
+func readProcs(path string) ([]int, error) {
+	data, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PID %q in %s", field, path)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+func writeFile(path, data string) error {
+	f, err := os.OpenFile(path, writeFlags, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func mkdir(path string) error {
+	err := os.Mkdir(path, 0755)
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("cannot create cgroup: %w", err)
+	}
+	return nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
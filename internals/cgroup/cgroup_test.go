@@ -0,0 +1,169 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cgroup_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internals/cgroup"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type cgroupSuite struct {
+	root    string
+	restore func()
+}
+
+var _ = Suite(&cgroupSuite{})
+
+func (s *cgroupSuite) SetUpTest(c *C) {
+	s.root = c.MkDir()
+	s.restore = cgroup.FakeRoot(s.root, "/container")
+	s.writeFile(c, "cgroup.controllers", "cpuset cpu io memory pids")
+	s.writeFile(c, "container/cgroup.controllers", "cpu memory pids")
+	s.writeFile(c, "container/cgroup.procs", "1\n42\n")
+}
+
+func (s *cgroupSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+func (s *cgroupSuite) writeFile(c *C, name, data string) {
+	path := filepath.Join(s.root, name)
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(os.WriteFile(path, []byte(data), 0644), IsNil)
+}
+
+func (s *cgroupSuite) readFile(c *C, name string) string {
+	data, err := os.ReadFile(filepath.Join(s.root, name))
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *cgroupSuite) TestNewTree(c *C) {
+	_, err := cgroup.NewTree()
+	c.Assert(err, IsNil)
+
+	// In the fake, each write replaces the file rather than moving a process.
+	c.Check(s.readFile(c, "container/daemon/cgroup.procs"), Equals, "42")
+	c.Check(s.readFile(c, "container/cgroup.subtree_control"), Equals, "+cpu +memory +pids")
+	c.Check(osExists(filepath.Join(s.root, "container/services")), Equals, true)
+}
+
+func (s *cgroupSuite) TestNewTreeRestarted(c *C) {
+	s.restore()
+	s.restore = cgroup.FakeRoot(s.root, "/container/daemon")
+	s.writeFile(c, "container/services/svc/cgroup.procs", "")
+
+	tree, err := cgroup.NewTree()
+	c.Assert(err, IsNil)
+	group, err := tree.Service("svc")
+	c.Assert(err, IsNil)
+	c.Check(group.Path(), Equals, filepath.Join(s.root, "container/services/svc"))
+	c.Check(osExists(filepath.Join(s.root, "container/daemon/daemon")), Equals, false)
+}
+
+func (s *cgroupSuite) TestNewTreeUnavailable(c *C) {
+	c.Assert(os.Remove(filepath.Join(s.root, "cgroup.controllers")), IsNil)
+	_, err := cgroup.NewTree()
+	c.Assert(err, Equals, cgroup.ErrUnavailable)
+}
+
+func (s *cgroupSuite) TestSetLimits(c *C) {
+	tree, err := cgroup.NewTree()
+	c.Assert(err, IsNil)
+	group, err := tree.Service("svc")
+	c.Assert(err, IsNil)
+
+	err = group.SetLimits(&cgroup.Limits{
+		MemoryMax: 64 * 1024 * 1024,
+		CPUWeight: 50,
+		CPUMax:    1.5,
+		PidsMax:   100,
+	})
+	c.Assert(err, IsNil)
+	c.Check(s.readFile(c, "container/services/svc/memory.max"), Equals, "67108864")
+	c.Check(s.readFile(c, "container/services/svc/cpu.weight"), Equals, "50")
+	c.Check(s.readFile(c, "container/services/svc/cpu.max"), Equals, "150000 100000")
+	c.Check(s.readFile(c, "container/services/svc/pids.max"), Equals, "100")
+
+	err = group.SetLimits(&cgroup.Limits{})
+	c.Assert(err, IsNil)
+	c.Check(s.readFile(c, "container/services/svc/memory.max"), Equals, "max")
+	c.Check(s.readFile(c, "container/services/svc/cpu.weight"), Equals, "100")
+	c.Check(s.readFile(c, "container/services/svc/cpu.max"), Equals, "max")
+	c.Check(s.readFile(c, "container/services/svc/pids.max"), Equals, "max")
+}
+
+func (s *cgroupSuite) TestCommandAndKill(c *C) {
+	tree, err := cgroup.NewTree()
+	c.Assert(err, IsNil)
+	group, err := tree.Service("svc")
+	c.Assert(err, IsNil)
+
+	cmd := exec.Command("sleep", "10")
+	started, err := group.Command(cmd)
+	c.Assert(err, IsNil)
+	c.Assert(cmd.Start(), IsNil)
+	started()
+	c.Check(s.readFile(c, "container/services/svc/cgroup.procs"), Equals, strconv.Itoa(cmd.Process.Pid)+"\n")
+
+	// Without cgroup.kill, the processes are killed one by one.
+	err = group.Kill()
+	c.Assert(err, IsNil)
+	done := make(chan error)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		c.Check(err, ErrorMatches, "signal: killed")
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for process to be killed")
+	}
+}
+
+func (s *cgroupSuite) TestStats(c *C) {
+	tree, err := cgroup.NewTree()
+	c.Assert(err, IsNil)
+	group, err := tree.Service("svc")
+	c.Assert(err, IsNil)
+
+	stats, err := group.Stats()
+	c.Assert(err, IsNil)
+	c.Check(stats, DeepEquals, &cgroup.Stats{})
+
+	s.writeFile(c, "container/services/svc/memory.current", "1048576\n")
+	s.writeFile(c, "container/services/svc/cpu.stat", "usage_usec 1500000\nuser_usec 1000000\nsystem_usec 500000\n")
+	s.writeFile(c, "container/services/svc/memory.events", "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n")
+	stats, err = group.Stats()
+	c.Assert(err, IsNil)
+	c.Check(stats, DeepEquals, &cgroup.Stats{
+		MemoryCurrent: 1048576,
+		CPUUsage:      1500 * time.Millisecond,
+		OOMKills:      1,
+	})
+}
+
+func osExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
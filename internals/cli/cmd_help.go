@@ -197,7 +197,7 @@ var HelpCategories = []HelpCategory{{
 }, {
 	Label:       "Services",
 	Description: "manage services",
-	Commands:    []string{"services", "logs", "start", "restart", "signal", "stop", "replan"},
+	Commands:    []string{"services", "logs", "log-targets", "start", "restart", "signal", "stop", "replan"},
 }, {
 	Label:       "Checks",
 	Description: "manage health checks",
@@ -0,0 +1,108 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/canonical/go-flags"
+	"github.com/canonical/x-go/strutil/quantity"
+
+	"github.com/canonical/pebble/client"
+)
+
+const cmdLogTargetsSummary = "Query the status of configured log targets"
+const cmdLogTargetsDescription = `
+The log-targets command lists status information about log forwarding to the
+log targets specified, or to all log targets if none are specified.
+`
+
+type cmdLogTargets struct {
+	client *client.Client
+
+	timeMixin
+	Positional struct {
+		LogTargets []string `positional-arg-name:"<log-target>"`
+	} `positional-args:"yes"`
+}
+
+func init() {
+	AddCommand(&CmdInfo{
+		Name:        "log-targets",
+		Summary:     cmdLogTargetsSummary,
+		Description: cmdLogTargetsDescription,
+		ArgsHelp:    timeArgsHelp,
+		New: func(opts *CmdOptions) flags.Commander {
+			return &cmdLogTargets{client: opts.Client}
+		},
+	})
+}
+
+func (cmd *cmdLogTargets) Execute(args []string) error {
+	if len(args) > 0 {
+		return ErrExtraArgs
+	}
+
+	opts := client.LogTargetsOptions{
+		Names: cmd.Positional.LogTargets,
+	}
+	targets, err := cmd.client.LogTargets(&opts)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		if len(cmd.Positional.LogTargets) == 0 {
+			fmt.Fprintln(Stderr, "Plan has no log targets.")
+		} else {
+			fmt.Fprintln(Stderr, "No matching log targets.")
+		}
+		return nil
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+
+	fmt.Fprintln(w, "Target\tType\tServices\tSent\tDropped\tLast flush\tError")
+
+	for _, target := range targets {
+		services := "-"
+		if len(target.Services) > 0 {
+			services = strings.Join(target.Services, ",")
+		}
+		bytesSent := strings.TrimSpace(quantity.FormatAmount(uint64(target.BytesSent), -1))
+		sent := fmt.Sprintf("%d (%sB)", target.EntriesSent, bytesSent)
+		lastFlush := "-"
+		if !target.LastFlush.IsZero() {
+			lastFlush = cmd.fmtTime(target.LastFlush)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			target.Name, target.Type, services, sent, target.EntriesDropped,
+			lastFlush, targetError(target))
+	}
+	return nil
+}
+
+// targetError returns a description of the error from the last attempt to
+// send logs, or "-" if the target has recovered since then.
+func targetError(target *client.LogTargetInfo) string {
+	if target.LastError == "" || target.LastFlush.After(target.LastErrorTime) {
+		return "-"
+	}
+	if target.RetryDelay > 0 {
+		return fmt.Sprintf("%s (retrying in %s)", target.LastError, target.RetryDelay)
+	}
+	return target.LastError
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cli_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internals/cli"
+)
+
+func (s *PebbleSuite) TestLogTargets(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/log-targets")
+		c.Assert(r.URL.Query(), check.DeepEquals, url.Values{})
+		fmt.Fprint(w, `{
+    "type": "sync",
+    "status-code": 200,
+    "result": [
+		{"name": "tgt1", "type": "loki", "services": ["svc1", "svc2"], "entries-sent": 42,
+		 "entries-dropped": 0, "bytes-sent": 12345, "last-flush": "2022-04-28T17:05:23+12:00"},
+		{"name": "tgt2", "type": "syslog", "services": ["svc1"], "entries-sent": 10,
+		 "entries-dropped": 3, "bytes-sent": 800, "last-flush": "2022-04-28T17:05:23+12:00",
+		 "last-error": "connection refused", "last-error-time": "2022-04-28T17:06:00+12:00",
+		 "retry-delay": "4s"},
+		{"name": "tgt3", "type": "opentelemetry", "services": [], "entries-sent": 0,
+		 "entries-dropped": 0, "bytes-sent": 0}
+	]
+}`)
+	})
+	rest, err := cli.ParserForTest().ParseArgs([]string{"log-targets"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, `
+Target  Type           Services   Sent         Dropped  Last flush  Error
+tgt1    loki           svc1,svc2  42 (12.3kB)  0        2022-04-28  -
+tgt2    syslog         svc1       10 (800B)    3        2022-04-28  connection refused (retrying in 4s)
+tgt3    opentelemetry  -          0 (0B)       0        -           -
+`[1:])
+	c.Check(s.Stderr(), check.Equals, "")
+}
+
+func (s *PebbleSuite) TestLogTargetsNone(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/log-targets")
+		fmt.Fprint(w, `{
+    "type": "sync",
+    "status-code": 200,
+    "result": []
+}`)
+	})
+	rest, err := cli.ParserForTest().ParseArgs([]string{"log-targets"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, "")
+	c.Check(s.Stderr(), check.Equals, "Plan has no log targets.\n")
+}
+
+func (s *PebbleSuite) TestLogTargetsNoMatching(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/log-targets")
+		c.Assert(r.URL.Query(), check.DeepEquals, url.Values{"names": {"foo", "bar"}})
+		fmt.Fprint(w, `{
+    "type": "sync",
+    "status-code": 200,
+    "result": []
+}`)
+	})
+	rest, err := cli.ParserForTest().ParseArgs([]string{"log-targets", "foo", "bar"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, "")
+	c.Check(s.Stderr(), check.Equals, "No matching log targets.\n")
+}
@@ -20,7 +20,10 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/canonical/go-flags"
 
@@ -31,6 +34,21 @@ const cmdLogsSummary = "Fetch service logs"
 const cmdLogsDescription = `
 The logs command fetches buffered logs from the given services (or all services
 if none are specified) and displays them in chronological order.
+
+If --since or --until is specified, all the logs in that time range are shown
+(unless -n is specified). Times may be RFC3339 times or durations before now,
+for example --since 1h for the last hour. For services with persistent log
+storage, this includes logs stored on disk.
+
+For services with structured logs (see the log-format service option), the
+level and fields of each log are also shown, and --level can be used to show
+only logs at that level or a more severe one.
+
+Use --stderr to show only the logs services wrote to their standard error,
+and --grep to show only logs whose message matches a regular expression.
+
+When following logs, the command reconnects automatically if the connection
+to the daemon is lost, without missing or repeating any logs.
 `
 
 type cmdLogs struct {
@@ -39,6 +57,11 @@ type cmdLogs struct {
 	Follow     bool   `short:"f" long:"follow"`
 	Format     string `long:"format"`
 	N          string `short:"n"`
+	Since      string `long:"since"`
+	Until      string `long:"until"`
+	Level      string `long:"level"`
+	Stderr     bool   `long:"stderr"`
+	Grep       string `long:"grep"`
 	Positional struct {
 		Services []string `positional-arg-name:"<service>"`
 	} `positional-args:"yes"`
@@ -53,6 +76,11 @@ func init() {
 			"--follow": "Follow (tail) logs for given services until Ctrl-C is\npressed. If no services are specified, show logs from\nall services running when the command starts.",
 			"--format": "Output format: \"text\" (default) or \"json\" (JSON lines).",
 			"-n":       "Number of logs to show (before following); defaults to 30.\nIf 'all', show all buffered logs.",
+			"--since":  "Only show logs written at or after this time\n(in RFC3339 format, or a duration like 1h30m ago).",
+			"--until":  "Only show logs written at or before this time\n(in RFC3339 format, or a duration like 1h30m ago).",
+			"--level":  "Only show structured logs at this level or above: trace,\ndebug, info, warning, error or fatal.",
+			"--stderr": "Only show logs written to standard error.",
+			"--grep":   "Only show logs whose message matches this regular\nexpression.",
 		},
 		New: func(opts *CmdOptions) flags.Commander {
 			return &cmdLogs{client: opts.Client}
@@ -65,10 +93,32 @@ const (
 )
 
 func (cmd *cmdLogs) Execute(args []string) error {
+	now := time.Now()
+	var since, until time.Time
+	if cmd.Since != "" {
+		var err error
+		since, err = parseLogsTime(cmd.Since, now)
+		if err != nil {
+			return fmt.Errorf("invalid --since time %q (must be in RFC3339 format or a duration)", cmd.Since)
+		}
+	}
+	if cmd.Until != "" {
+		if cmd.Follow {
+			return fmt.Errorf("cannot use --until with --follow")
+		}
+		var err error
+		until, err = parseLogsTime(cmd.Until, now)
+		if err != nil {
+			return fmt.Errorf("invalid --until time %q (must be in RFC3339 format or a duration)", cmd.Until)
+		}
+	}
+
 	var n int
 	switch cmd.N {
 	case "":
-		n = 30
+		if since.IsZero() && until.IsZero() {
+			n = 30
+		}
 	case "all":
 		n = -1
 	default:
@@ -83,8 +133,9 @@ func (cmd *cmdLogs) Execute(args []string) error {
 	switch cmd.Format {
 	case "", "text":
 		writeLog = func(entry client.LogEntry) error {
-			_, err := fmt.Fprintf(Stdout, "%s [%s] %s\n",
-				entry.Time.Format(logTimeFormat), entry.Service, entry.Message)
+			_, err := fmt.Fprintf(Stdout, "%s [%s] %s%s%s\n",
+				entry.Time.Format(logTimeFormat), entry.Service,
+				formatLogLevel(entry.Level), entry.Message, formatLogFields(entry.Fields))
 			return err
 		}
 
@@ -103,11 +154,17 @@ func (cmd *cmdLogs) Execute(args []string) error {
 		WriteLog: writeLog,
 		Services: cmd.Positional.Services,
 		N:        n,
+		Since:    since,
+		Until:    until,
+		Level:    cmd.Level,
+		Grep:     cmd.Grep,
+	}
+	if cmd.Stderr {
+		opts.Stream = "stderr"
 	}
 	var err error
 	if cmd.Follow {
-		// Stop following when Ctrl-C pressed (SIGINT).
-		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		ctx, cancel := followContext()
 		defer cancel()
 		err = cmd.client.FollowLogs(ctx, &opts)
 	} else {
@@ -115,3 +172,54 @@ func (cmd *cmdLogs) Execute(args []string) error {
 	}
 	return err
 }
+
+// followContext returns the context that stops following logs, which is
+// cancelled when Ctrl-C is pressed (SIGINT). It's replaced in tests.
+var followContext = func() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// parseLogsTime parses an RFC3339 time, or a duration before now (for example
+// "1h" for an hour ago).
+func parseLogsTime(s string, now time.Time) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err == nil {
+		return t, nil
+	}
+	d, durationErr := time.ParseDuration(s)
+	if durationErr != nil || d < 0 {
+		return time.Time{}, err
+	}
+	return now.Add(-d), nil
+}
+
+// formatLogLevel returns the level of a structured log as a prefix for its
+// message, for example "ERROR: ".
+func formatLogLevel(level string) string {
+	if level == "" {
+		return ""
+	}
+	return strings.ToUpper(level) + ": "
+}
+
+// formatLogFields returns the fields of a structured log in logfmt format,
+// sorted by name, as a suffix for its message.
+func formatLogFields(fields map[string]string) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		value := fields[name]
+		if value == "" || strings.ContainsAny(value, " \t\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", name, value)
+	}
+	return b.String()
+}
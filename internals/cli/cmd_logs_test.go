@@ -15,9 +15,11 @@
 package cli_test
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	. "gopkg.in/check.v1"
 
@@ -122,6 +124,123 @@ func (s *PebbleSuite) TestLogsAll(c *C) {
 	c.Check(s.Stderr(), Equals, "")
 }
 
+func (s *PebbleSuite) TestLogsTimeRange(c *C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "GET")
+		c.Check(r.URL.Path, Equals, "/v1/logs")
+		c.Check(r.URL.Query(), DeepEquals, url.Values{
+			"since": []string{"2021-05-03T03:00:00Z"},
+			"until": []string{"2021-05-03T04:00:00Z"},
+		})
+		fmt.Fprintf(w, `
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1"}
+`[1:])
+	})
+	rest, err := cli.ParserForTest().ParseArgs([]string{"logs", "--since", "2021-05-03T03:00:00Z", "--until", "2021-05-03T04:00:00Z"})
+	c.Assert(err, IsNil)
+	c.Assert(rest, HasLen, 0)
+	c.Check(s.Stdout(), Equals, `
+2021-05-03T03:55:49.360Z [thing] log 1
+`[1:])
+	c.Check(s.Stderr(), Equals, "")
+}
+
+func (s *PebbleSuite) TestLogsDurationSince(c *C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/v1/logs")
+		since, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("since"))
+		c.Check(err, IsNil)
+		c.Check(time.Since(since) > 90*time.Minute, Equals, true)
+		c.Check(time.Since(since) < 91*time.Minute, Equals, true)
+		fmt.Fprintf(w, `
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1"}
+`[1:])
+	})
+	rest, err := cli.ParserForTest().ParseArgs([]string{"logs", "--since", "1h30m"})
+	c.Assert(err, IsNil)
+	c.Assert(rest, HasLen, 0)
+	c.Check(s.Stdout(), Equals, `
+2021-05-03T03:55:49.360Z [thing] log 1
+`[1:])
+	c.Check(s.Stderr(), Equals, "")
+}
+
+func (s *PebbleSuite) TestLogsInvalidTimeRange(c *C) {
+	_, err := cli.ParserForTest().ParseArgs([]string{"logs", "--since", "yesterday"})
+	c.Assert(err, ErrorMatches, `invalid --since time "yesterday" \(must be in RFC3339 format or a duration\)`)
+
+	_, err = cli.ParserForTest().ParseArgs([]string{"logs", "--until=-1h"})
+	c.Assert(err, ErrorMatches, `invalid --until time "-1h" \(must be in RFC3339 format or a duration\)`)
+
+	_, err = cli.ParserForTest().ParseArgs([]string{"logs", "-f", "--until", "2021-05-03T04:00:00Z"})
+	c.Assert(err, ErrorMatches, `cannot use --until with --follow`)
+}
+
+func (s *PebbleSuite) TestLogsLevel(c *C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "GET")
+		c.Check(r.URL.Path, Equals, "/v1/logs")
+		c.Check(r.URL.Query(), DeepEquals, url.Values{
+			"n":     []string{"30"},
+			"level": []string{"warning"},
+		})
+		fmt.Fprintf(w, `
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1","level":"warning"}
+{"time":"2021-05-03T03:55:49.654334232Z","service":"api","message":"request failed","level":"error","fields":{"path":"/a b","id":"42"}}
+`[1:])
+	})
+	rest, err := cli.ParserForTest().ParseArgs([]string{"logs", "--level", "warning"})
+	c.Assert(err, IsNil)
+	c.Assert(rest, HasLen, 0)
+	c.Check(s.Stdout(), Equals, `
+2021-05-03T03:55:49.360Z [thing] WARNING: log 1
+2021-05-03T03:55:49.654Z [api] ERROR: request failed id=42 path="/a b"
+`[1:])
+	c.Check(s.Stderr(), Equals, "")
+}
+
+func (s *PebbleSuite) TestLogsStderr(c *C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "GET")
+		c.Check(r.URL.Path, Equals, "/v1/logs")
+		c.Check(r.URL.Query(), DeepEquals, url.Values{
+			"n":      []string{"30"},
+			"stream": []string{"stderr"},
+		})
+		fmt.Fprintf(w, `
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"oops","stream":"stderr"}
+`[1:])
+	})
+	rest, err := cli.ParserForTest().ParseArgs([]string{"logs", "--stderr"})
+	c.Assert(err, IsNil)
+	c.Assert(rest, HasLen, 0)
+	c.Check(s.Stdout(), Equals, `
+2021-05-03T03:55:49.360Z [thing] oops
+`[1:])
+	c.Check(s.Stderr(), Equals, "")
+}
+
+func (s *PebbleSuite) TestLogsGrep(c *C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "GET")
+		c.Check(r.URL.Path, Equals, "/v1/logs")
+		c.Check(r.URL.Query(), DeepEquals, url.Values{
+			"n":    []string{"30"},
+			"grep": []string{"fail(ed|ure)"},
+		})
+		fmt.Fprintf(w, `
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"request failed"}
+`[1:])
+	})
+	rest, err := cli.ParserForTest().ParseArgs([]string{"logs", "--grep", "fail(ed|ure)"})
+	c.Assert(err, IsNil)
+	c.Assert(rest, HasLen, 0)
+	c.Check(s.Stdout(), Equals, `
+2021-05-03T03:55:49.360Z [thing] request failed
+`[1:])
+	c.Check(s.Stderr(), Equals, "")
+}
+
 func (s *PebbleSuite) TestLogsInvalidNumber(c *C) {
 	rest, err := cli.ParserForTest().ParseArgs([]string{"logs", "-ninvalid"})
 	c.Assert(err.Error(), Equals, `expected n to be a non-negative integer or "all", not "invalid"`)
@@ -130,21 +249,40 @@ func (s *PebbleSuite) TestLogsInvalidNumber(c *C) {
 
 func (s *PebbleSuite) TestLogsFollow(c *C) {
 	// NOTE: doesn't test actual following behavior -- that's tested in client
-	// tests. This just ensures ?follow=true is passed through.
+	// tests. This just ensures ?follow=true is passed through, and that the
+	// command reconnects when the connection is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	restore := cli.FakeFollowContext(ctx)
+	defer restore()
+
+	requests := 0
 	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
 		c.Check(r.Method, Equals, "GET")
 		c.Check(r.URL.Path, Equals, "/v1/logs")
+		requests++
+		if requests == 1 {
+			c.Check(r.URL.Query(), DeepEquals, url.Values{
+				"n":      []string{"30"},
+				"follow": []string{"true"},
+			})
+			fmt.Fprintf(w, `
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1","cursor":"c1"}
+`[1:])
+			return
+		}
 		c.Check(r.URL.Query(), DeepEquals, url.Values{
-			"n":      []string{"30"},
+			"cursor": []string{"c1"},
 			"follow": []string{"true"},
 		})
-		fmt.Fprintf(w, `
-{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1"}
-`[1:])
+		// Stop following, as if Ctrl-C was pressed.
+		cancel()
+		<-r.Context().Done()
 	})
 	rest, err := cli.ParserForTest().ParseArgs([]string{"logs", "-f"})
 	c.Assert(err, IsNil)
 	c.Assert(rest, HasLen, 0)
+	c.Check(requests, Equals, 2)
 	c.Check(s.Stdout(), Equals, `
 2021-05-03T03:55:49.360Z [thing] log 1
 `[1:])
@@ -16,8 +16,11 @@ package cli
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/canonical/go-flags"
+	"github.com/canonical/x-go/strutil/quantity"
 
 	"github.com/canonical/pebble/client"
 )
@@ -26,12 +29,20 @@ const cmdServicesSummary = "Query the status of configured services"
 const cmdServicesDescription = `
 The services command lists status information about the services specified, or
 about all services if none are specified.
+
+With --verbose, it also shows each service's current memory usage, total CPU
+time, and the number of its processes killed for exceeding its memory-max.
+These are only available when Pebble manages cgroups for services.
+
+The notes column shows the last status sent by services that use the sd_notify
+protocol, if any.
 `
 
 type cmdServices struct {
 	client *client.Client
 
 	timeMixin
+	Verbose    bool `long:"verbose"`
 	Positional struct {
 		Services []string `positional-arg-name:"<service>"`
 	} `positional-args:"yes"`
@@ -42,7 +53,9 @@ func init() {
 		Name:        "services",
 		Summary:     cmdServicesSummary,
 		Description: cmdServicesDescription,
-		ArgsHelp:    timeArgsHelp,
+		ArgsHelp: merge(timeArgsHelp, map[string]string{
+			"--verbose": "Show resource usage",
+		}),
 		New: func(opts *CmdOptions) flags.Commander {
 			return &cmdServices{client: opts.Client}
 		},
@@ -70,17 +83,49 @@ func (cmd *cmdServices) Execute(args []string) error {
 		return nil
 	}
 
+	// Only show the notes column if a service has status text.
+	showNotes := false
+	for _, svc := range services {
+		if svc.StatusText != "" {
+			showNotes = true
+		}
+	}
+
 	w := tabWriter()
 	defer w.Flush()
 
-	fmt.Fprintln(w, "Service\tStartup\tCurrent\tSince")
+	headers := []string{"Service", "Startup", "Current", "Since"}
+	if cmd.Verbose {
+		headers = append(headers, "Memory", "CPU", "OOM kills")
+	}
+	if showNotes {
+		headers = append(headers, "Notes")
+	}
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
 
 	for _, svc := range services {
 		since := "-"
 		if !svc.CurrentSince.IsZero() {
 			since = cmd.fmtTime(svc.CurrentSince)
 		}
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", svc.Name, svc.Startup, svc.Current, since)
+		fields := []string{svc.Name, string(svc.Startup), string(svc.Current), since}
+		if cmd.Verbose {
+			memory, cpu, oomKills := "-", "-", "-"
+			if svc.Usage != nil {
+				memory = strings.TrimSpace(quantity.FormatAmount(uint64(svc.Usage.MemoryCurrent), -1)) + "B"
+				cpu = quantity.FormatDuration(svc.Usage.CPUUsage.Seconds())
+				oomKills = strconv.FormatInt(svc.Usage.OOMKills, 10)
+			}
+			fields = append(fields, memory, cpu, oomKills)
+		}
+		if showNotes {
+			notes := "-"
+			if svc.StatusText != "" {
+				notes = svc.StatusText
+			}
+			fields = append(fields, notes)
+		}
+		fmt.Fprintln(w, strings.Join(fields, "\t"))
 	}
 	return nil
 }
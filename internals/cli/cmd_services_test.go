@@ -51,6 +51,56 @@ svc3     enabled  backoff   -
 	c.Check(s.Stderr(), check.Equals, "")
 }
 
+func (s *PebbleSuite) TestServicesVerbose(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/services")
+		fmt.Fprint(w, `{
+    "type": "sync",
+    "status-code": 200,
+    "result": [
+		{"name": "svc1", "current": "active", "startup": "enabled", "current-since": "2022-04-28T17:05:23+12:00",
+		 "usage": {"memory-current": 52428800, "cpu-usage": "1m30s", "oom-kills": 1}},
+		{"name": "svc2", "current": "inactive", "startup": "enabled"}
+	]
+}`)
+	})
+	rest, err := cli.ParserForTest().ParseArgs([]string{"services", "--verbose"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, `
+Service  Startup  Current   Since       Memory  CPU    OOM kills
+svc1     enabled  active    2022-04-28  52.4MB  1m30s  1
+svc2     enabled  inactive  -           -       -      -
+`[1:])
+	c.Check(s.Stderr(), check.Equals, "")
+}
+
+func (s *PebbleSuite) TestServicesNotes(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/services")
+		fmt.Fprint(w, `{
+    "type": "sync",
+    "status-code": 200,
+    "result": [
+		{"name": "svc1", "current": "active", "startup": "enabled", "current-since": "2022-04-28T17:05:23+12:00",
+		 "status-text": "Processing 10 requests"},
+		{"name": "svc2", "current": "inactive", "startup": "enabled"}
+	]
+}`)
+	})
+	rest, err := cli.ParserForTest().ParseArgs([]string{"services"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, `
+Service  Startup  Current   Since       Notes
+svc1     enabled  active    2022-04-28  Processing 10 requests
+svc2     enabled  inactive  -           -
+`[1:])
+	c.Check(s.Stderr(), check.Equals, "")
+}
+
 func (s *PebbleSuite) TestPlanNoServices(c *check.C) {
 	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
 		c.Assert(r.Method, check.Equals, "GET")
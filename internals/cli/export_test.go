@@ -15,6 +15,7 @@
 package cli
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/canonical/go-flags"
@@ -88,6 +89,18 @@ func FakeIsStdinTTY(t bool) (restore func()) {
 	}
 }
 
+// FakeFollowContext makes "pebble logs --follow" stop following when ctx is
+// cancelled, instead of when Ctrl-C is pressed.
+func FakeFollowContext(ctx context.Context) (restore func()) {
+	oldFollowContext := followContext
+	followContext = func() (context.Context, context.CancelFunc) {
+		return context.WithCancel(ctx)
+	}
+	return func() {
+		followContext = oldFollowContext
+	}
+}
+
 func PebbleMain() (exitCode int) {
 	oldOsExit := osExit
 	osExit = func(code int) {
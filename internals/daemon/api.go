@@ -98,6 +98,10 @@ var API = []*Command{{
 	Path:       "/v1/checks",
 	ReadAccess: UserAccess{},
 	GET:        v1GetChecks,
+}, {
+	Path:       "/v1/log-targets",
+	ReadAccess: UserAccess{},
+	GET:        v1GetLogTargets,
 }, {
 	Path:        "/v1/notices",
 	ReadAccess:  UserAccess{},
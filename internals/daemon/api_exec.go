@@ -24,6 +24,7 @@ import (
 	"github.com/canonical/pebble/internals/overlord/cmdstate"
 	"github.com/canonical/pebble/internals/overlord/state"
 	"github.com/canonical/pebble/internals/plan"
+	"github.com/canonical/pebble/internals/rlimit"
 )
 
 type execPayload struct {
@@ -36,6 +37,7 @@ type execPayload struct {
 	User           string            `json:"user"`
 	GroupID        *int              `json:"group-id"`
 	Group          string            `json:"group"`
+	Limits         map[string]string `json:"limits"`
 	Terminal       bool              `json:"terminal"`
 	Interactive    bool              `json:"interactive"`
 	SplitStderr    bool              `json:"split-stderr"`
@@ -72,11 +74,23 @@ func v1PostExec(c *Command, req *http.Request, _ *UserState) Response {
 		GroupID:     payload.GroupID,
 		Group:       payload.Group,
 		WorkingDir:  payload.WorkingDir,
+		Limits:      payload.Limits,
 	}
 	merged, err := plan.MergeServiceContext(p, payload.ServiceContext, overrides)
 	if err != nil {
 		return BadRequest("%v", err)
 	}
+	// Read the context service's environment files the same way as when
+	// the service is started.
+	environment, err := plan.LoadEnvironment(merged.Environment, merged.EnvironmentFiles, merged.EnvironmentFromFile)
+	if err != nil {
+		return BadRequest("%v", err)
+	}
+
+	err = rlimit.Validate(merged.Limits)
+	if err != nil {
+		return BadRequest("invalid limits: %v", err)
+	}
 
 	// Convert User/UserID and Group/GroupID combinations into raw uid/gid.
 	uid, gid, err := osutil.NormalizeUidGid(merged.UserID, merged.GroupID, merged.User, merged.Group)
@@ -90,11 +104,12 @@ func v1PostExec(c *Command, req *http.Request, _ *UserState) Response {
 
 	args := &cmdstate.ExecArgs{
 		Command:     payload.Command,
-		Environment: merged.Environment,
+		Environment: environment,
 		WorkingDir:  merged.WorkingDir,
 		Timeout:     timeout,
 		UserID:      uid,
 		GroupID:     gid,
+		Limits:      merged.Limits,
 		Terminal:    payload.Terminal,
 		Interactive: payload.Interactive,
 		SplitStderr: payload.SplitStderr,
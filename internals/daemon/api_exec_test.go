@@ -243,6 +243,67 @@ func (s *execSuite) TestContextOverrides(c *C) {
 	c.Check(stderr, Equals, "")
 }
 
+func (s *execSuite) TestContextEnvironmentFiles(c *C) {
+	dir := c.MkDir()
+	envFile := filepath.Join(dir, "env")
+	err := os.WriteFile(envFile, []byte("FOO=file\nBAR=file\n"), 0o600)
+	c.Assert(err, IsNil)
+	secretFile := filepath.Join(dir, "secret")
+	err = os.WriteFile(secretFile, []byte("s3cret\n"), 0o600)
+	c.Assert(err, IsNil)
+	err = s.daemon.overlord.PlanManager().AppendLayer(&plan.Layer{
+		Label: "layer1",
+		Services: map[string]*plan.Service{"svc1": {
+			Name:                "svc1",
+			Override:            "replace",
+			Command:             "dummy",
+			Environment:         map[string]string{"BAR": "bar"},
+			EnvironmentFiles:    []string{envFile},
+			EnvironmentFromFile: map[string]string{"SECRET": secretFile},
+		}},
+	})
+	c.Assert(err, IsNil)
+
+	stdout, stderr, err := s.exec(c, "", &client.ExecOptions{
+		Command:        []string{"/bin/sh", "-c", "echo FOO=$FOO BAR=$BAR SECRET=$SECRET"},
+		ServiceContext: "svc1",
+	})
+	c.Assert(err, IsNil)
+	c.Check(stdout, Equals, "FOO=file BAR=bar SECRET=s3cret\n")
+	c.Check(stderr, Equals, "")
+
+	// The files are read each time a command is run.
+	err = os.Remove(envFile)
+	c.Assert(err, IsNil)
+	_, err = s.client.Exec(&client.ExecOptions{
+		Command:        []string{"/bin/true"},
+		ServiceContext: "svc1",
+	})
+	c.Check(err, ErrorMatches, `.*cannot read environment file ".*/env": no such file or directory`)
+}
+
+func (s *execSuite) TestLimits(c *C) {
+	err := s.daemon.overlord.PlanManager().AppendLayer(&plan.Layer{
+		Label: "layer1",
+		Services: map[string]*plan.Service{"svc1": {
+			Name:     "svc1",
+			Override: "replace",
+			Command:  "dummy",
+			Limits:   map[string]string{"nofile": "100:200", "core": "0"},
+		}},
+	})
+	c.Assert(err, IsNil)
+
+	stdout, stderr, err := s.exec(c, "", &client.ExecOptions{
+		Command:        []string{"/bin/sh", "-c", "echo $(ulimit -Sn) $(ulimit -Hn) $(ulimit -c)"},
+		ServiceContext: "svc1",
+		Limits:         map[string]string{"nofile": "50:200"},
+	})
+	c.Assert(err, IsNil)
+	c.Check(stdout, Equals, "50 200 0\n")
+	c.Check(stderr, Equals, "")
+}
+
 func (s *execSuite) TestCurrentUserGroup(c *C) {
 	current, err := user.Current()
 	c.Assert(err, IsNil)
@@ -438,6 +499,17 @@ func (s *execSuite) TestUserGroupError(c *C) {
 	c.Check(execResp.Result["message"], Matches, ".*must specify user, not just group.*")
 }
 
+func (s *execSuite) TestLimitsInvalid(c *C) {
+	httpResp, execResp := execRequest(c, &client.ExecOptions{
+		Command: []string{"echo", "foo"},
+		Limits:  map[string]string{"files": "10"},
+	})
+	c.Check(httpResp.StatusCode, Equals, http.StatusBadRequest)
+	c.Check(execResp.StatusCode, Equals, http.StatusBadRequest)
+	c.Check(execResp.Type, Equals, "error")
+	c.Check(execResp.Result["message"], Equals, `invalid limits: unknown resource "files"`)
+}
+
 type execResponse struct {
 	StatusCode int                    `json:"status-code"`
 	Type       string                 `json:"type"`
@@ -461,6 +533,7 @@ func execRequest(c *C, opts *client.ExecOptions) (*http.Response, execResponse)
 		User:        opts.User,
 		GroupID:     opts.GroupID,
 		Group:       opts.Group,
+		Limits:      opts.Limits,
 		Terminal:    opts.Terminal,
 		SplitStderr: opts.Stderr != nil,
 		Width:       opts.Width,
@@ -0,0 +1,66 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/canonical/x-go/strutil"
+)
+
+type logTargetInfo struct {
+	Name           string     `json:"name"`
+	Type           string     `json:"type"`
+	Services       []string   `json:"services"`
+	EntriesSent    int        `json:"entries-sent"`
+	EntriesDropped int        `json:"entries-dropped"`
+	BytesSent      int64      `json:"bytes-sent"`
+	LastFlush      *time.Time `json:"last-flush,omitempty"` // pointer as omitempty doesn't work with time.Time directly
+	LastError      string     `json:"last-error,omitempty"`
+	LastErrorTime  *time.Time `json:"last-error-time,omitempty"`
+	RetryDelay     string     `json:"retry-delay,omitempty"`
+}
+
+func v1GetLogTargets(c *Command, r *http.Request, _ *UserState) Response {
+	names := strutil.MultiCommaSeparatedList(r.URL.Query()["names"])
+
+	logMgr := c.d.overlord.LogManager()
+	targets := logMgr.Targets(names)
+
+	infos := []logTargetInfo{} // if no log targets, return [] instead of null
+	for _, target := range targets {
+		info := logTargetInfo{
+			Name:           target.Name,
+			Type:           string(target.Type),
+			Services:       target.Services,
+			EntriesSent:    target.EntriesSent,
+			EntriesDropped: target.EntriesDropped,
+			BytesSent:      target.BytesSent,
+			LastError:      target.LastError,
+		}
+		if !target.LastFlush.IsZero() {
+			info.LastFlush = &target.LastFlush
+		}
+		if !target.LastErrorTime.IsZero() {
+			info.LastErrorTime = &target.LastErrorTime
+		}
+		if target.RetryDelay != 0 {
+			info.RetryDelay = target.RetryDelay.String()
+		}
+		infos = append(infos, info)
+	}
+	return SyncResponse(infos)
+}
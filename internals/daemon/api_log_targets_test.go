@@ -0,0 +1,95 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *apiSuite) TestLogTargetsGet(c *C) {
+	writeTestLayer(s.pebbleDir, `
+services:
+    svc1:
+        override: replace
+        command: sleep 10
+
+log-targets:
+    tgt1:
+        override: replace
+        type: loki
+        location: http://localhost:1/loki/api/v1/push
+        services: [all]
+
+    tgt2:
+        override: replace
+        type: syslog
+        location: udp://localhost:1
+`)
+	s.daemon(c)
+	s.startOverlord()
+
+	// Request with no filters.
+	rsp, body := s.getLogTargets(c, "")
+	c.Check(rsp.Status, Equals, 200)
+	c.Check(rsp.Type, Equals, ResponseTypeSync)
+	c.Check(body["result"], DeepEquals, []interface{}{
+		map[string]interface{}{
+			"name":            "tgt1",
+			"type":            "loki",
+			"services":        []interface{}{},
+			"entries-sent":    0.0,
+			"entries-dropped": 0.0,
+			"bytes-sent":      0.0,
+		},
+		map[string]interface{}{
+			"name":            "tgt2",
+			"type":            "syslog",
+			"services":        []interface{}{},
+			"entries-sent":    0.0,
+			"entries-dropped": 0.0,
+			"bytes-sent":      0.0,
+		},
+	})
+
+	// Request with names filter
+	rsp, body = s.getLogTargets(c, "?names=tgt2,nosuch")
+	c.Check(rsp.Status, Equals, 200)
+	c.Check(rsp.Type, Equals, ResponseTypeSync)
+	results := body["result"].([]interface{})
+	c.Assert(results, HasLen, 1)
+	c.Check(results[0].(map[string]interface{})["name"], Equals, "tgt2")
+
+	// No matching log targets returns an empty list.
+	rsp, body = s.getLogTargets(c, "?names=nosuch")
+	c.Check(rsp.Status, Equals, 200)
+	c.Check(body["result"], DeepEquals, []interface{}{})
+}
+
+func (s *apiSuite) getLogTargets(c *C, query string) (*resp, map[string]interface{}) {
+	req, err := http.NewRequest("GET", "/v1/log-targets"+query, nil)
+	c.Assert(err, IsNil)
+	rsp := v1GetLogTargets(apiCmd("/v1/log-targets"), req, nil).(*resp)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, rsp.Status)
+	var body map[string]interface{}
+	err = json.Unmarshal(rec.Body.Bytes(), &body)
+	c.Check(err, IsNil)
+	return rsp, body
+}
@@ -16,10 +16,12 @@ package daemon
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -40,6 +42,8 @@ const (
 type serviceManager interface {
 	Services(names []string) ([]*servstate.ServiceInfo, error)
 	ServiceLogs(services []string, last int) (map[string]servicelog.Iterator, error)
+	ServiceLogsSince(services []string, since time.Time) (map[string]servicelog.Iterator, error)
+	LogParsers(services []string) map[string]*servicelog.StructuredParser
 }
 
 func v1GetLogs(c *Command, _ *http.Request, _ *UserState) Response {
@@ -67,6 +71,81 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	follow := followStr == "true"
 
+	// Times may be given as RFC3339 times, or as durations before now.
+	now := time.Now()
+	var since, until time.Time
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		str := query.Get(param.name)
+		if str == "" {
+			continue
+		}
+		t, err := parseLogTime(str, now)
+		if err != nil {
+			response := BadRequest("invalid %s parameter: %q (must be an RFC3339 time or a duration)", param.name, str)
+			response.ServeHTTP(w, req)
+			return
+		}
+		*param.value = t
+	}
+	if !until.IsZero() && follow {
+		response := BadRequest("until parameter cannot be used when following logs")
+		response.ServeHTTP(w, req)
+		return
+	}
+	// If "cursor" is specified (the cursor of the last log the client
+	// received), only output logs after that one.
+	cursorStr := query.Get("cursor")
+	var resume *logCursor
+	if cursorStr != "" {
+		var err error
+		resume, err = parseLogCursor(cursorStr)
+		if err != nil {
+			response := BadRequest("invalid cursor parameter: %q", cursorStr)
+			response.ServeHTTP(w, req)
+			return
+		}
+		if since.IsZero() || resume.since().After(since) {
+			since = resume.since()
+		}
+	}
+	cursor := resume.copy()
+	timeRange := !since.IsZero() || !until.IsZero()
+
+	// If "level" is specified, only output structured logs at that level or
+	// more severe.
+	var minLevelRank int
+	if levelStr := query.Get("level"); levelStr != "" {
+		minLevelRank = servicelog.LevelRank(servicelog.NormalizeLevel(levelStr))
+		if minLevelRank == 0 {
+			response := BadRequest("invalid level %q", levelStr)
+			response.ServeHTTP(w, req)
+			return
+		}
+	}
+
+	// If "stream" is specified, only output logs written to that stream.
+	stream := query.Get("stream")
+	if stream != "" && stream != servicelog.StdoutStream && stream != servicelog.StderrStream {
+		response := BadRequest(`stream parameter must be "stdout" or "stderr"`)
+		response.ServeHTTP(w, req)
+		return
+	}
+
+	// If "grep" is specified, only output logs whose message matches it.
+	var grep *regexp.Regexp
+	if grepStr := query.Get("grep"); grepStr != "" {
+		var err error
+		grep, err = regexp.Compile(grepStr)
+		if err != nil {
+			response := BadRequest("invalid grep parameter: %v", err)
+			response.ServeHTTP(w, req)
+			return
+		}
+	}
+
 	var numLogs int
 	nStr := query.Get("n")
 	if nStr != "" {
@@ -77,6 +156,8 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 		numLogs = n
+	} else if timeRange || cursorStr != "" {
+		numLogs = -1 // all logs in the time range or after the cursor
 	} else if follow {
 		numLogs = 0
 	} else {
@@ -97,7 +178,13 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	itsByName, err := r.svcMgr.ServiceLogs(services, numLogs)
+	var itsByName map[string]servicelog.Iterator
+	var err error
+	if timeRange {
+		itsByName, err = r.svcMgr.ServiceLogsSince(services, since)
+	} else {
+		itsByName, err = r.svcMgr.ServiceLogs(services, numLogs)
+	}
 	if err != nil {
 		response := InternalError("cannot fetch log iterators: %v", err)
 		response.ServeHTTP(w, req)
@@ -113,9 +200,9 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	// Use a buffered channel as a FIFO for keeping the latest numLogs logs if
 	// request "n" is set (the default).
-	var fifo chan servicelog.Entry
+	var fifo chan *jsonLog
 	if numLogs > 0 {
-		fifo = make(chan servicelog.Entry, numLogs)
+		fifo = make(chan *jsonLog, numLogs)
 	}
 	flushFifo := func() bool { // helper to flush any logs in the FIFO
 		if numLogs <= 0 || len(fifo) == 0 {
@@ -123,7 +210,7 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 		var err error
 		for len(fifo) > 0 && err == nil {
-			err = encoder.Encode(newJSONLog(<-fifo))
+			err = encoder.Encode(<-fifo)
 		}
 		if err != nil {
 			logger.Noticef("Cannot write logs: %v", err)
@@ -140,8 +227,9 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	errorChan := make(chan error, 1)
 	ctx, cancel := context.WithCancel(req.Context())
 	defer cancel()
+	parsers := r.svcMgr.LogParsers(services)
 	go func() {
-		errorChan <- streamLogs(itsByName, logs, ctx.Done())
+		errorChan <- streamLogs(itsByName, parsers, logs, ctx.Done())
 	}()
 
 	// Main loop: output earliest log per iteration. Stop when request
@@ -171,6 +259,33 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				return
 			}
 
+			// Skip logs outside the requested time range. Logs are ordered
+			// by time, so stop at the first log after "until".
+			if !since.IsZero() && log.Time.Before(since) {
+				continue
+			}
+			if !until.IsZero() && log.Time.After(until) {
+				_ = flushFifo()
+				return
+			}
+			// The cursor tracks all logs, not just those that match the
+			// filters, so it stays valid if the filters change on resume.
+			if resume.sent(log) {
+				// Already seen by the client before it reconnected.
+				continue
+			}
+			cursor.add(log)
+			if minLevelRank > 0 && servicelog.LevelRank(log.Level) < minLevelRank {
+				continue
+			}
+			if stream != "" && log.Stream != stream {
+				continue
+			}
+			if grep != nil && !grep.MatchString(strings.TrimSuffix(log.Message, "\n")) {
+				continue
+			}
+			jsonLog := newJSONLog(log, cursor.String())
+
 			if numLogs > 0 {
 				// Push through FIFO so we only output the most recent "n"
 				// across all services.
@@ -179,12 +294,12 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 					// writing new one so it doesn't block.
 					<-fifo
 				}
-				fifo <- log
+				fifo <- jsonLog
 				continue
 			}
 
 			// Otherwise encode and output log directly.
-			err := encoder.Encode(newJSONLog(log))
+			err := encoder.Encode(jsonLog)
 			if err != nil {
 				logger.Noticef("Cannot write logs: %v", err)
 				return
@@ -204,9 +319,10 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 // streamLogs reads and parses logs from the given services, merging the
-// log streams and ordering by timestamp. It sends the parsed logs to the
-// logs channel, and returns when the done channel is closed.
-func streamLogs(itsByName map[string]servicelog.Iterator, logs chan<- servicelog.Entry, done <-chan struct{}) error {
+// log streams and ordering by timestamp. Logs from services with a structured
+// parser are also parsed by it. It sends the parsed logs to the logs channel,
+// and returns when the done channel is closed.
+func streamLogs(itsByName map[string]servicelog.Iterator, structuredParsers map[string]*servicelog.StructuredParser, logs chan<- servicelog.Entry, done <-chan struct{}) error {
 	// Need to close iterators in same goroutine we're reading them from.
 	defer func() {
 		for _, it := range itsByName {
@@ -236,6 +352,11 @@ func streamLogs(itsByName map[string]servicelog.Iterator, logs chan<- servicelog
 		iterators[i] = itsByName[name]
 		parsers[i] = servicelog.NewParser(iterators[i], logReaderSize)
 	}
+	nextEntry := func(i int) servicelog.Entry {
+		entry := parsers[i].Entry()
+		structuredParsers[services[i]].Parse(&entry)
+		return entry
+	}
 
 	// Slice of next entries for each service
 	nexts := make([]servicelog.Entry, len(services))
@@ -248,13 +369,13 @@ func streamLogs(itsByName map[string]servicelog.Iterator, logs chan<- servicelog
 				continue
 			}
 			if parser.Next() {
-				nexts[i] = parser.Entry()
+				nexts[i] = nextEntry(i)
 			} else if parser.Err() != nil {
 				return fmt.Errorf("error parsing logs: %w", parser.Err())
 			} else if iterators[i].Next(nil) {
 				// Parsed all in parser buffer, but iterator now has more.
 				if parser.Next() {
-					nexts[i] = parser.Entry()
+					nexts[i] = nextEntry(i)
 				}
 			}
 		}
@@ -298,21 +419,186 @@ func streamLogs(itsByName map[string]servicelog.Iterator, logs chan<- servicelog
 
 // Each log is written as a JSON object followed by a newline (JSON Lines):
 //
-// {"time":"2021-04-23T01:28:52.660Z","service":"redis","message":"redis started up"}
-// {"time":"2021-04-23T01:28:52.798Z","service":"thing","message":"did something"}
+// {"time":"2021-04-23T01:28:52.660Z","service":"redis","message":"redis started up","stream":"stdout"}
+// {"time":"2021-04-23T01:28:52.798Z","service":"thing","message":"cannot do something","stream":"stderr"}
+//
+// Structured logs also include their level and extracted fields:
+//
+// {"time":"2021-04-23T01:28:53.012Z","service":"api","message":"request failed","stream":"stdout","level":"error","fields":{"request_id":"42"}}
+//
+// Each log also has an opaque "cursor" field (omitted above), which a client
+// can pass as the "cursor" parameter to resume receiving logs after that one.
 type jsonLog struct {
-	Time    time.Time `json:"time"`
-	Service string    `json:"service"`
-	Message string    `json:"message"`
+	Time    time.Time         `json:"time"`
+	Service string            `json:"service"`
+	Message string            `json:"message"`
+	Stream  string            `json:"stream,omitempty"`
+	Level   string            `json:"level,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	Cursor  string            `json:"cursor,omitempty"`
 }
 
-func newJSONLog(entry servicelog.Entry) *jsonLog {
+func newJSONLog(entry servicelog.Entry, cursor string) *jsonLog {
 	message := strings.TrimSuffix(entry.Message, "\n")
 	return &jsonLog{
 		Time:    entry.Time,
 		Service: entry.Service,
 		Message: message,
+		Stream:  entry.Stream,
+		Level:   entry.Level,
+		Fields:  entry.Fields,
+		Cursor:  cursor,
+	}
+}
+
+// parseLogTime parses an RFC3339 time, or a duration before now (for
+// example "1h" for an hour ago).
+func parseLogTime(s string, now time.Time) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err == nil {
+		return t, nil
+	}
+	d, durationErr := time.ParseDuration(s)
+	if durationErr != nil || d < 0 {
+		return time.Time{}, err
+	}
+	return now.Add(-d), nil
+}
+
+// logCursor records the position of the last log sent for each service: its
+// time and the number of logs sent with that same time (as timestamps only
+// have millisecond precision). A client can resume following logs from a
+// cursor without missing or repeating any, even if logs from different
+// services are received out of order.
+type logCursor struct {
+	positions map[string]*logPosition
+
+	// skipped is the number of logs skipped at each service's position.
+	skipped map[string]int
+}
+
+type logPosition struct {
+	time  time.Time
+	count int
+}
+
+// parseLogCursor decodes a cursor in the format returned by
+// logCursor.String.
+func parseLogCursor(s string) (*logCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var encoded map[string][2]int64
+	err = json.Unmarshal(data, &encoded)
+	if err != nil {
+		return nil, err
+	}
+	c := &logCursor{positions: make(map[string]*logPosition, len(encoded))}
+	for service, pos := range encoded {
+		if pos[1] < 1 {
+			return nil, fmt.Errorf("invalid log count %d", pos[1])
+		}
+		c.positions[service] = &logPosition{
+			time:  time.Unix(0, pos[0]).UTC(),
+			count: int(pos[1]),
+		}
+	}
+	return c, nil
+}
+
+// String encodes the cursor as base64url-encoded JSON, mapping each service
+// name to its position as a [time in Unix nanoseconds, count] pair.
+func (c *logCursor) String() string {
+	encoded := make(map[string][2]int64, len(c.positions))
+	for service, pos := range c.positions {
+		encoded[service] = [2]int64{pos.time.UnixNano(), int64(pos.count)}
+	}
+	data, err := json.Marshal(encoded)
+	if err != nil {
+		// Can't happen as the map will always be marshallable
+		logger.Panicf("cannot marshal log cursor: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// copy returns a copy of the cursor's positions, or an empty cursor if c is
+// nil.
+func (c *logCursor) copy() *logCursor {
+	copied := &logCursor{positions: make(map[string]*logPosition)}
+	if c != nil {
+		for service, pos := range c.positions {
+			posCopy := *pos
+			copied.positions[service] = &posCopy
+		}
+	}
+	return copied
+}
+
+// since returns the time of the earliest position in the cursor.
+func (c *logCursor) since() time.Time {
+	var since time.Time
+	for _, pos := range c.positions {
+		if since.IsZero() || pos.time.Before(since) {
+			since = pos.time
+		}
+	}
+	return since
+}
+
+// latest returns the time of the latest position in the cursor.
+func (c *logCursor) latest() time.Time {
+	var latest time.Time
+	for _, pos := range c.positions {
+		if pos.time.After(latest) {
+			latest = pos.time
+		}
+	}
+	return latest
+}
+
+// sent reports whether the log is at or before the cursor's position for its
+// service, meaning it was already sent. Logs of services not in the cursor
+// were sent if they're before the cursor's latest position. A nil cursor
+// reports that no logs were sent.
+func (c *logCursor) sent(entry servicelog.Entry) bool {
+	if c == nil {
+		return false
+	}
+	pos, ok := c.positions[entry.Service]
+	if !ok {
+		return entry.Time.Before(c.latest())
+	}
+	if entry.Time.Before(pos.time) {
+		return true
+	}
+	if entry.Time.Equal(pos.time) && c.skipped[entry.Service] < pos.count {
+		if c.skipped == nil {
+			c.skipped = make(map[string]int)
+		}
+		c.skipped[entry.Service]++
+		return true
+	}
+	return false
+}
+
+// add moves the cursor's position for the log's service to the log.
+func (c *logCursor) add(entry servicelog.Entry) {
+	pos, ok := c.positions[entry.Service]
+	if !ok {
+		c.positions[entry.Service] = &logPosition{time: entry.Time, count: 1}
+		return
+	}
+	if entry.Time.Equal(pos.time) {
+		pos.count++
+		return
+	}
+	if entry.Time.Before(pos.time) {
+		// A log written out of order, which is before the position anyway.
+		return
 	}
+	pos.time = entry.Time
+	pos.count = 1
 }
 
 func flushWriter(w io.Writer) {
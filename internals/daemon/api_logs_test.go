@@ -41,10 +41,15 @@ type testLogEntry struct {
 	Time    time.Time
 	Service string
 	Message string
+	Stream  string
+	Level   string
+	Fields  map[string]string
+	Cursor  string
 }
 
 type testServiceManager struct {
 	buffers        map[string]*servicelog.RingBuffer
+	parsers        map[string]*servicelog.StructuredParser
 	servicesErr    error
 	serviceLogsErr error
 }
@@ -86,6 +91,14 @@ func (m testServiceManager) ServiceLogs(services []string, last int) (map[string
 	return its, nil
 }
 
+func (m testServiceManager) ServiceLogsSince(services []string, since time.Time) (map[string]servicelog.Iterator, error) {
+	return m.ServiceLogs(services, -1)
+}
+
+func (m testServiceManager) LogParsers(services []string) map[string]*servicelog.StructuredParser {
+	return m.parsers
+}
+
 func (s *logsSuite) TestInvalidFollow(c *C) {
 	rec := s.recordResponse(c, "/v1/logs?follow=invalid", nil)
 	c.Assert(rec.Code, Equals, http.StatusBadRequest)
@@ -102,6 +115,226 @@ func (s *logsSuite) TestInvalidN(c *C) {
 	checkError(c, rec.Body.Bytes(), http.StatusBadRequest, `n must be -1, 0, or a positive integer`)
 }
 
+func (s *logsSuite) TestInvalidTimeRange(c *C) {
+	rec := s.recordResponse(c, "/v1/logs?since=yesterday", nil)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+	checkError(c, rec.Body.Bytes(), http.StatusBadRequest, `invalid since parameter: "yesterday" \(must be an RFC3339 time or a duration\)`)
+
+	rec = s.recordResponse(c, "/v1/logs?until=2021-05-20", nil)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+	checkError(c, rec.Body.Bytes(), http.StatusBadRequest, `invalid until parameter: "2021-05-20" \(must be an RFC3339 time or a duration\)`)
+
+	rec = s.recordResponse(c, "/v1/logs?until=2021-05-20T16:55:00Z&follow=true", nil)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+	checkError(c, rec.Body.Bytes(), http.StatusBadRequest, `until parameter cannot be used when following logs`)
+}
+
+func (s *logsSuite) TestTimeRange(c *C) {
+	rb := servicelog.NewRingBuffer(4096)
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(rb, "2021-05-20T16:55:%02d.000Z [nginx] message %d\n", i, i)
+	}
+	svcMgr := testServiceManager{
+		buffers: map[string]*servicelog.RingBuffer{
+			"nginx": rb,
+		},
+	}
+
+	// All logs in the time range are returned by default.
+	rec := s.recordResponse(c, "/v1/logs?since=2021-05-20T16:55:05Z&until=2021-05-20T16:55:36.5Z", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	logs := decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 32)
+	for i := 0; i < 32; i++ {
+		checkLog(c, logs[i], "nginx", fmt.Sprintf("message %d", i+5))
+	}
+
+	// With n, the most recent logs in the time range are returned.
+	rec = s.recordResponse(c, "/v1/logs?until=2021-05-20T16:55:10Z&n=3", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	logs = decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 3)
+	for i := 0; i < 3; i++ {
+		checkLog(c, logs[i], "nginx", fmt.Sprintf("message %d", i+8))
+	}
+
+	rec = s.recordResponse(c, "/v1/logs?since=2021-05-20T16:55:38Z", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	logs = decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 2)
+	checkLog(c, logs[0], "nginx", "message 38")
+	checkLog(c, logs[1], "nginx", "message 39")
+}
+
+func (s *logsSuite) TestStructuredLogs(c *C) {
+	rb1 := servicelog.NewRingBuffer(4096)
+	lw1 := servicelog.NewFormatWriter(rb1, "api")
+	fmt.Fprintf(lw1, `{"level":"info","msg":"started","port":8080}`+"\n")
+	fmt.Fprintf(lw1, `{"level":"WARN","msg":"slow request","request_id":"r1"}`+"\n")
+	fmt.Fprintf(lw1, "not json\n")
+	rb2 := servicelog.NewRingBuffer(4096)
+	lw2 := servicelog.NewFormatWriter(rb2, "worker")
+	fmt.Fprintf(lw2, "level=error msg=\"job failed\" job=7\n")
+
+	svcMgr := testServiceManager{
+		buffers: map[string]*servicelog.RingBuffer{
+			"api":    rb1,
+			"worker": rb2,
+		},
+		parsers: map[string]*servicelog.StructuredParser{
+			"api":    servicelog.NewStructuredParser("json", []string{"port", "request_id"}),
+			"worker": servicelog.NewStructuredParser("logfmt", []string{"job"}),
+		},
+	}
+	rec := s.recordResponse(c, "/v1/logs?services=api", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	logs := decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 3)
+	c.Check(logs[0].Message, Equals, "started")
+	c.Check(logs[0].Level, Equals, "info")
+	c.Check(logs[0].Fields, DeepEquals, map[string]string{"port": "8080"})
+	c.Check(logs[1].Message, Equals, "slow request")
+	c.Check(logs[1].Level, Equals, "warning")
+	c.Check(logs[1].Fields, DeepEquals, map[string]string{"request_id": "r1"})
+	c.Check(logs[2].Message, Equals, "not json")
+	c.Check(logs[2].Level, Equals, "")
+	c.Check(logs[2].Fields, IsNil)
+
+	// Only logs at or above the requested level are returned.
+	rec = s.recordResponse(c, "/v1/logs?level=warn", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	logs = decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 2)
+	checkLog(c, logs[0], "api", "slow request")
+	checkLog(c, logs[1], "worker", "job failed")
+	c.Check(logs[1].Level, Equals, "error")
+	c.Check(logs[1].Fields, DeepEquals, map[string]string{"job": "7"})
+
+	rec = s.recordResponse(c, "/v1/logs?level=loud", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+	checkError(c, rec.Body.Bytes(), http.StatusBadRequest, `invalid level "loud"`)
+}
+
+func (s *logsSuite) TestStreams(c *C) {
+	rb := servicelog.NewRingBuffer(4096)
+	stdout, stderr := servicelog.NewFormatWriters(rb, "svc1")
+	fmt.Fprintf(stdout, "out 1\n")
+	fmt.Fprintf(stderr, "err 1\n")
+	fmt.Fprintf(stdout, "out 2\n")
+	svcMgr := testServiceManager{
+		buffers: map[string]*servicelog.RingBuffer{"svc1": rb},
+	}
+
+	rec := s.recordResponse(c, "/v1/logs", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	logs := decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 3)
+	checkLog(c, logs[0], "svc1", "out 1")
+	c.Check(logs[0].Stream, Equals, "stdout")
+	checkLog(c, logs[1], "svc1", "err 1")
+	c.Check(logs[1].Stream, Equals, "stderr")
+	checkLog(c, logs[2], "svc1", "out 2")
+	c.Check(logs[2].Stream, Equals, "stdout")
+
+	rec = s.recordResponse(c, "/v1/logs?stream=stderr", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	logs = decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 1)
+	checkLog(c, logs[0], "svc1", "err 1")
+
+	rec = s.recordResponse(c, "/v1/logs?stream=stdin", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+	checkError(c, rec.Body.Bytes(), http.StatusBadRequest, `stream parameter must be "stdout" or "stderr"`)
+}
+
+func (s *logsSuite) TestDurationSince(c *C) {
+	rb := servicelog.NewRingBuffer(4096)
+	old := time.Now().Add(-2 * time.Hour).UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	fmt.Fprintf(rb, "%s [nginx] old message\n", old)
+	fmt.Fprintf(servicelog.NewFormatWriter(rb, "nginx"), "new message\n")
+	svcMgr := testServiceManager{
+		buffers: map[string]*servicelog.RingBuffer{"nginx": rb},
+	}
+
+	rec := s.recordResponse(c, "/v1/logs?since=1h", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	logs := decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 1)
+	checkLog(c, logs[0], "nginx", "new message")
+
+	rec = s.recordResponse(c, "/v1/logs?until=1h", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	logs = decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 1)
+	checkLog(c, logs[0], "nginx", "old message")
+
+	rec = s.recordResponse(c, "/v1/logs?since=-1h", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+	checkError(c, rec.Body.Bytes(), http.StatusBadRequest, `invalid since parameter: "-1h" .*`)
+}
+
+func (s *logsSuite) TestGrep(c *C) {
+	rb := servicelog.NewRingBuffer(4096)
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(rb, "2021-05-20T16:55:%02d.000Z [nginx] message %d\n", i, i)
+	}
+	svcMgr := testServiceManager{
+		buffers: map[string]*servicelog.RingBuffer{"nginx": rb},
+	}
+
+	rec := s.recordResponse(c, "/v1/logs?grep=message+[13]$", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	logs := decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 2)
+	checkLog(c, logs[0], "nginx", "message 1")
+	checkLog(c, logs[1], "nginx", "message 3")
+
+	rec = s.recordResponse(c, "/v1/logs?grep=(", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+	checkError(c, rec.Body.Bytes(), http.StatusBadRequest, `invalid grep parameter: .*`)
+}
+
+func (s *logsSuite) TestCursor(c *C) {
+	rb1 := servicelog.NewRingBuffer(4096)
+	rb2 := servicelog.NewRingBuffer(4096)
+	// Several logs with the same timestamp, to test counting within a
+	// position.
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(rb1, "2021-05-20T16:55:01.000Z [one] one %d\n", i)
+	}
+	fmt.Fprintf(rb2, "2021-05-20T16:55:01.000Z [two] two 0\n")
+	for i := 3; i < 5; i++ {
+		fmt.Fprintf(rb1, "2021-05-20T16:55:02.000Z [one] one %d\n", i)
+	}
+	svcMgr := testServiceManager{
+		buffers: map[string]*servicelog.RingBuffer{
+			"one": rb1,
+			"two": rb2,
+		},
+	}
+
+	rec := s.recordResponse(c, "/v1/logs?n=-1", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	all := decodeLogs(c, rec.Body)
+	c.Assert(all, HasLen, 6)
+
+	// Resuming from each log returns exactly the logs after it.
+	for i, log := range all {
+		c.Assert(log.Cursor, Not(Equals), "")
+		rec = s.recordResponse(c, "/v1/logs?cursor="+log.Cursor, svcMgr)
+		c.Assert(rec.Code, Equals, http.StatusOK)
+		logs := decodeLogs(c, rec.Body)
+		c.Assert(logs, HasLen, len(all)-i-1, Commentf("resuming after log %d", i))
+		for j, l := range logs {
+			checkLog(c, l, all[i+j+1].Service, all[i+j+1].Message)
+		}
+	}
+
+	rec = s.recordResponse(c, "/v1/logs?cursor=foo", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+	checkError(c, rec.Body.Bytes(), http.StatusBadRequest, `invalid cursor parameter: "foo"`)
+}
+
 func (s *logsSuite) TestServicesError(c *C) {
 	svcMgr := testServiceManager{
 		servicesErr: fmt.Errorf("Services error!"),
@@ -31,7 +31,18 @@ func v1GetPlan(c *Command, r *http.Request, _ *UserState) Response {
 	}
 
 	planMgr := overlordPlanManager(c.d.overlord)
-	plan := planMgr.Plan()
+	// Show services with instances as they're defined, rather than their
+	// instances, so that the plan can be used as a layer.
+	plan := planMgr.Plan().WithTemplates()
+
+	// Only admins may see the values of sensitive environment variables
+	// and headers, such as passwords and tokens. If the request's UID is
+	// unknown, treat it as a non-admin request.
+	requestUID, err := uidFromRequest(r)
+	if err != nil || !isAdmin(requestUID, uint32(sysGetuid())) {
+		plan = plan.Redacted()
+	}
+
 	planYAML, err := yaml.Marshal(plan)
 	if err != nil {
 		return InternalError("cannot serialize plan: %v", err)
@@ -33,6 +33,22 @@ type serviceInfo struct {
 	Startup      string     `json:"startup"`
 	Current      string     `json:"current"`
 	CurrentSince *time.Time `json:"current-since,omitempty"` // pointer as omitempty doesn't work with time.Time directly
+
+	LogsSuppressed int64 `json:"logs-suppressed,omitempty"`
+
+	LastRun      *time.Time `json:"last-run,omitempty"`
+	LastExitCode *int       `json:"last-exit-code,omitempty"`
+	NextRun      *time.Time `json:"next-run,omitempty"`
+
+	Usage *serviceUsage `json:"usage,omitempty"`
+
+	StatusText string `json:"status-text,omitempty"`
+}
+
+type serviceUsage struct {
+	MemoryCurrent int64  `json:"memory-current"`
+	CPUUsage      string `json:"cpu-usage"`
+	OOMKills      int64  `json:"oom-kills"`
 }
 
 func v1GetServices(c *Command, r *http.Request, _ *UserState) Response {
@@ -47,13 +63,29 @@ func v1GetServices(c *Command, r *http.Request, _ *UserState) Response {
 	infos := make([]serviceInfo, 0, len(services))
 	for _, svc := range services {
 		info := serviceInfo{
-			Name:    svc.Name,
-			Startup: string(svc.Startup),
-			Current: string(svc.Current),
+			Name:           svc.Name,
+			Startup:        string(svc.Startup),
+			Current:        string(svc.Current),
+			LogsSuppressed: svc.LogsSuppressed,
+			LastExitCode:   svc.LastExitCode,
+			StatusText:     svc.StatusText,
 		}
 		if !svc.CurrentSince.IsZero() {
 			info.CurrentSince = &svc.CurrentSince
 		}
+		if !svc.LastRun.IsZero() {
+			info.LastRun = &svc.LastRun
+		}
+		if !svc.NextRun.IsZero() {
+			info.NextRun = &svc.NextRun
+		}
+		if svc.Usage != nil {
+			info.Usage = &serviceUsage{
+				MemoryCurrent: svc.Usage.MemoryCurrent,
+				CPUUsage:      svc.Usage.CPUUsage.String(),
+				OOMKills:      svc.Usage.OOMKills,
+			}
+		}
 		infos = append(infos, info)
 	}
 	return SyncResponse(infos)
@@ -123,7 +155,9 @@ func v1PostServices(c *Command, r *http.Request, _ *UserState) Response {
 		if err != nil {
 			break
 		}
-		services = intersectOrdered(payload.Services, services)
+		// Restart the instances of a service with instances.
+		requested := overlordPlanManager(c.d.overlord).Plan().ExpandInstanceNames(payload.Services)
+		services = intersectOrdered(requested, services)
 		var stopTasks *state.TaskSet
 		stopTasks, err = servstate.Stop(st, services)
 		if err != nil {
@@ -15,6 +15,9 @@
 package osutil_test
 
 import (
+	"os"
+	"path/filepath"
+
 	. "gopkg.in/check.v1"
 
 	"github.com/canonical/pebble/internals/osutil"
@@ -39,3 +42,48 @@ func (s *envSuite) TestEnviron(c *C) {
 		"TEMP": "",
 	})
 }
+
+func (s *envSuite) TestReadEnvironmentFile(c *C) {
+	path := filepath.Join(c.MkDir(), "env")
+	err := os.WriteFile(path, []byte(`
+# A comment
+FOO=bar
+ export BAR = "with spaces"
+EMPTY=
+QUOTED='a "quoted" value'
+URL=http://localhost/?a=b
+`), 0644)
+	c.Assert(err, IsNil)
+
+	env, err := osutil.ReadEnvironmentFile(path)
+	c.Assert(err, IsNil)
+	c.Check(env, DeepEquals, map[string]string{
+		"FOO":    "bar",
+		"BAR":    "with spaces",
+		"EMPTY":  "",
+		"QUOTED": `a "quoted" value`,
+		"URL":    "http://localhost/?a=b",
+	})
+}
+
+func (s *envSuite) TestReadEnvironmentFileErrors(c *C) {
+	dir := c.MkDir()
+	tests := []struct {
+		content string
+		error   string
+	}{
+		{"FOO=bar\nBAR\n", `line 2: expected KEY=VALUE`},
+		{"1FOO=bar\n", `line 1: invalid variable name "1FOO"`},
+		{"FOO BAR=baz\n", `line 1: invalid variable name "FOO BAR"`},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, "env")
+		err := os.WriteFile(path, []byte(test.content), 0644)
+		c.Assert(err, IsNil)
+		_, err = osutil.ReadEnvironmentFile(path)
+		c.Check(err, ErrorMatches, test.error)
+	}
+
+	_, err := osutil.ReadEnvironmentFile(filepath.Join(dir, "missing"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
@@ -31,6 +31,7 @@ import (
 
 	"github.com/canonical/pebble/internals/logger"
 	"github.com/canonical/pebble/internals/osutil"
+	"github.com/canonical/pebble/internals/plan"
 	"github.com/canonical/pebble/internals/reaper"
 	"github.com/canonical/pebble/internals/servicelog"
 )
@@ -121,6 +122,9 @@ type execChecker struct {
 	groupID     *int
 	group       string
 	workingDir  string
+
+	environmentFiles    []string
+	environmentFromFile map[string]string
 }
 
 func (c *execChecker) check(ctx context.Context) error {
@@ -129,9 +133,15 @@ func (c *execChecker) check(ctx context.Context) error {
 		return fmt.Errorf("cannot parse command: %v", err)
 	}
 
+	// The environment files are read each time the check runs.
+	requested, err := plan.LoadEnvironment(c.environment, c.environmentFiles, c.environmentFromFile)
+	if err != nil {
+		return err
+	}
+
 	// Similar to services and exec, inherit the daemon's environment.
 	environment := osutil.Environ()
-	for k, v := range c.environment {
+	for k, v := range requested {
 		// Requested environment takes precedence.
 		environment[k] = v
 	}
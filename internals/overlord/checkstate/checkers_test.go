@@ -23,6 +23,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/user"
+	"path/filepath"
 	"strconv"
 
 	. "gopkg.in/check.v1"
@@ -218,6 +219,30 @@ func (s *CheckersSuite) TestExec(c *C) {
 	c.Assert(ok, Equals, true)
 	c.Assert(detailsErr.Details(), Equals, "FOO=foo test=parent")
 
+	// Environment files are read each time the check runs
+	envDir := c.MkDir()
+	envFile := filepath.Join(envDir, "env")
+	err = os.WriteFile(envFile, []byte("FOO=file\nBAR=file\n"), 0644)
+	c.Assert(err, IsNil)
+	secretFile := filepath.Join(envDir, "secret")
+	err = os.WriteFile(secretFile, []byte("secret\n"), 0600)
+	c.Assert(err, IsNil)
+	chk = &execChecker{
+		command:             "/bin/sh -c 'echo $FOO $BAR $SECRET; exit 1'",
+		environment:         map[string]string{"BAR": "value"},
+		environmentFiles:    []string{envFile},
+		environmentFromFile: map[string]string{"SECRET": secretFile},
+	}
+	err = chk.check(context.Background())
+	c.Assert(err, ErrorMatches, "exit status 1")
+	detailsErr, ok = err.(*detailsError)
+	c.Assert(ok, Equals, true)
+	c.Assert(detailsErr.Details(), Equals, "file value secret")
+	err = os.Remove(secretFile)
+	c.Assert(err, IsNil)
+	err = chk.check(context.Background())
+	c.Assert(err, ErrorMatches, `cannot read environment variable "SECRET" from file ".*": no such file or directory`)
+
 	// Working directory is passed through
 	workingDir := c.MkDir()
 	chk = &execChecker{
@@ -316,6 +341,9 @@ func (s *CheckersSuite) TestExecContextNoOverride(c *C) {
 			GroupID:     &svcGroupID,
 			Group:       "svcgroup",
 			WorkingDir:  "/working/svc",
+
+			EnvironmentFiles:    []string{"/etc/svc1/env"},
+			EnvironmentFromFile: map[string]string{"s": "/run/secrets/s"},
 		},
 	}}, &plan.Check{
 		Name: "exec",
@@ -334,6 +362,8 @@ func (s *CheckersSuite) TestExecContextNoOverride(c *C) {
 	c.Check(exec.user, Equals, "svcuser")
 	c.Check(exec.groupID, DeepEquals, &svcGroupID)
 	c.Check(exec.workingDir, Equals, "/working/svc")
+	c.Check(exec.environmentFiles, DeepEquals, []string{"/etc/svc1/env"})
+	c.Check(exec.environmentFromFile, DeepEquals, map[string]string{"s": "/run/secrets/s"})
 }
 
 func (s *CheckersSuite) TestExecContextOverride(c *C) {
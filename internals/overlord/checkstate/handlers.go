@@ -82,14 +82,17 @@ func (m *CheckManager) doPerformCheck(task *state.Task, tomb *tombpkg.Tomb) erro
 					// and logs the error to the task log.
 					return err
 				}
-			} else if details.Failures > 0 {
-				m.updateCheckInfo(config, changeID, 0)
-
-				m.state.Lock()
-				task.Logf("succeeded after %s", pluralise(details.Failures, "failure", "failures"))
-				details.Failures = 0
-				task.Set(checkDetailsAttr, &details)
-				m.state.Unlock()
+			} else {
+				m.checkPassed(config.Name)
+				if details.Failures > 0 {
+					m.updateCheckInfo(config, changeID, 0)
+
+					m.state.Lock()
+					task.Logf("succeeded after %s", pluralise(details.Failures, "failure", "failures"))
+					details.Failures = 0
+					task.Set(checkDetailsAttr, &details)
+					m.state.Unlock()
+				}
 			}
 
 		case <-tomb.Dying():
@@ -147,6 +150,7 @@ func (m *CheckManager) doRecoverCheck(task *state.Task, tomb *tombpkg.Tomb) erro
 
 			// Check succeeded, switch to performing a succeeding check.
 			// Check info will be updated with new change ID by changeStatusChanged.
+			m.checkPassed(config.Name)
 			details.Failures = 0 // not strictly needed, but just to be safe
 			details.Proceed = true
 			m.state.Lock()
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 
@@ -45,6 +46,11 @@ type CheckManager struct {
 
 	checksLock sync.Mutex
 	checks     map[string]CheckInfo
+
+	// Checks that have succeeded since they were started or recovered, and
+	// a channel that's closed (and replaced) when this changes.
+	passed        map[string]bool
+	passedChanged chan struct{}
 }
 
 // FailureFunc is the type of function called when a failure action is triggered.
@@ -53,8 +59,10 @@ type FailureFunc func(name string)
 // NewManager creates a new check manager.
 func NewManager(s *state.State, runner *state.TaskRunner) *CheckManager {
 	manager := &CheckManager{
-		state:  s,
-		checks: make(map[string]CheckInfo),
+		state:         s,
+		checks:        make(map[string]CheckInfo),
+		passed:        make(map[string]bool),
+		passedChanged: make(chan struct{}),
 	}
 
 	// Health check changes can be long-running; ensure they don't get pruned.
@@ -264,6 +272,9 @@ func newChecker(config *plan.Check) checker {
 			groupID:     config.Exec.GroupID,
 			group:       config.Exec.Group,
 			workingDir:  config.Exec.WorkingDir,
+
+			environmentFiles:    config.Exec.EnvironmentFiles,
+			environmentFromFile: config.Exec.EnvironmentFromFile,
 		}
 
 	default:
@@ -286,6 +297,9 @@ func mergeServiceContext(p *plan.Plan, config *plan.Check) *plan.Check {
 		GroupID:     config.Exec.GroupID,
 		Group:       config.Exec.Group,
 		WorkingDir:  config.Exec.WorkingDir,
+
+		EnvironmentFiles:    config.Exec.EnvironmentFiles,
+		EnvironmentFromFile: config.Exec.EnvironmentFromFile,
 	}
 	merged, err := plan.MergeServiceContext(p, config.Exec.ServiceContext, overrides)
 	if err != nil {
@@ -299,6 +313,8 @@ func mergeServiceContext(p *plan.Plan, config *plan.Check) *plan.Check {
 	cpy.Exec.Group = merged.Group
 	cpy.Exec.GroupID = merged.GroupID
 	cpy.Exec.WorkingDir = merged.WorkingDir
+	cpy.Exec.EnvironmentFiles = merged.EnvironmentFiles
+	cpy.Exec.EnvironmentFromFile = merged.EnvironmentFromFile
 	return cpy
 }
 
@@ -326,6 +342,7 @@ func (m *CheckManager) updateCheckInfo(config *plan.Check, changeID string, fail
 	status := CheckStatusUp
 	if failures >= config.Threshold {
 		status = CheckStatusDown
+		m.setPassed(config.Name, false)
 	}
 	m.checks[config.Name] = CheckInfo{
 		Name:      config.Name,
@@ -342,6 +359,59 @@ func (m *CheckManager) deleteCheckInfo(name string) {
 	defer m.checksLock.Unlock()
 
 	delete(m.checks, name)
+	m.setPassed(name, false)
+}
+
+// checkPassed records that the check has succeeded, so it's considered up by
+// WaitChecksUp.
+func (m *CheckManager) checkPassed(name string) {
+	m.checksLock.Lock()
+	defer m.checksLock.Unlock()
+
+	m.setPassed(name, true)
+}
+
+// setPassed records whether the check has succeeded, waking up WaitChecksUp
+// callers if that has changed. Not concurrency-safe, please lock
+// m.checksLock before calling.
+func (m *CheckManager) setPassed(name string, passed bool) {
+	if m.passed[name] == passed {
+		return
+	}
+	if passed {
+		m.passed[name] = true
+	} else {
+		delete(m.passed, name)
+	}
+	close(m.passedChanged)
+	m.passedChanged = make(chan struct{})
+}
+
+// WaitChecksUp waits until all the named checks are up, having succeeded at
+// least once since they were started (or last recovered), or until the
+// context is done.
+func (m *CheckManager) WaitChecksUp(ctx context.Context, names []string) error {
+	for {
+		m.checksLock.Lock()
+		var pending []string
+		for _, name := range names {
+			info, ok := m.checks[name]
+			if !ok || info.Status != CheckStatusUp || !m.passed[name] {
+				pending = append(pending, name)
+			}
+		}
+		changed := m.passedChanged
+		m.checksLock.Unlock()
+
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("checks not up: %s", strings.Join(pending, ", "))
+		}
+	}
 }
 
 // CheckInfo provides status information about a single check.
@@ -15,6 +15,7 @@
 package checkstate_test
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -317,6 +318,43 @@ func (s *ManagerSuite) TestFailuresBelowThreshold(c *C) {
 	c.Assert(lastTaskLog(s.overlord.State(), check.ChangeID), Matches, ".* INFO succeeded after 1 failure")
 }
 
+func (s *ManagerSuite) TestWaitChecksUp(c *C) {
+	testPath := c.MkDir() + "/test"
+	s.manager.PlanChanged(&plan.Plan{
+		Checks: map[string]*plan.Check{
+			"chk1": {
+				Name:      "chk1",
+				Period:    plan.OptionalDuration{Value: 20 * time.Millisecond},
+				Timeout:   plan.OptionalDuration{Value: 100 * time.Millisecond},
+				Threshold: 3,
+				Exec: &plan.ExecCheck{
+					Command: fmt.Sprintf(`/bin/sh -c '[ -f %s ]'`, testPath),
+				},
+			},
+		},
+	})
+
+	// The check hasn't succeeded yet, so it isn't considered up (even though
+	// its status is "up" until it reaches the failure threshold).
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := s.manager.WaitChecksUp(ctx, []string{"chk1", "chk2"})
+	c.Assert(err, ErrorMatches, "checks not up: chk1, chk2")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.manager.WaitChecksUp(context.Background(), []string{"chk1"})
+	}()
+	err = os.WriteFile(testPath, nil, 0o644)
+	c.Assert(err, IsNil)
+	select {
+	case err := <-done:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for check to be up")
+	}
+}
+
 func (s *ManagerSuite) TestPlanChangedSmarts(c *C) {
 	s.manager.PlanChanged(&plan.Plan{
 		Checks: map[string]*plan.Check{
@@ -36,6 +36,7 @@ import (
 	"github.com/canonical/pebble/internals/overlord/state"
 	"github.com/canonical/pebble/internals/ptyutil"
 	"github.com/canonical/pebble/internals/reaper"
+	"github.com/canonical/pebble/internals/sandbox"
 	"github.com/canonical/pebble/internals/wsutil"
 )
 
@@ -62,6 +63,7 @@ type execution struct {
 	userID      *int
 	groupID     *int
 	workingDir  string
+	limits      map[string]string
 
 	websockets       map[string]*websocket.Conn
 	websocketsLock   sync.Mutex
@@ -92,6 +94,7 @@ func (m *CommandManager) doExec(task *state.Task, tomb *tomb.Tomb) error {
 		userID:           setup.UserID,
 		groupID:          setup.GroupID,
 		workingDir:       setup.WorkingDir,
+		limits:           setup.Limits,
 		websockets:       make(map[string]*websocket.Conn),
 		ioConnected:      make(chan struct{}),
 		controlConnected: make(chan struct{}),
@@ -374,8 +377,12 @@ func (e *execution) do(ctx context.Context, task *state.Task) error {
 		cmd.SysProcAttr.Setctty = true
 	}
 
-	// Start the command!
-	err = reaper.StartCommand(cmd)
+	// Apply resource limits before the program is executed, and start the
+	// command!
+	err = sandbox.Command(cmd, &sandbox.Options{Limits: e.limits})
+	if err == nil {
+		err = reaper.StartCommand(cmd)
+	}
 	exitCode := -1
 	if err == nil {
 		// Send its PID to the control loop.
@@ -36,6 +36,7 @@ type ExecArgs struct {
 	Timeout     time.Duration
 	UserID      *int
 	GroupID     *int
+	Limits      map[string]string
 	Terminal    bool
 	Interactive bool
 	SplitStderr bool
@@ -63,6 +64,7 @@ type execSetup struct {
 	UserID      *int
 	GroupID     *int
 	WorkingDir  string
+	Limits      map[string]string
 }
 
 // Exec creates a task that will execute the command with the given arguments.
@@ -137,6 +139,7 @@ func Exec(st *state.State, args *ExecArgs) (*state.Task, ExecMetadata, error) {
 		UserID:      args.UserID,
 		GroupID:     args.GroupID,
 		WorkingDir:  workingDir,
+		Limits:      args.Limits,
 	}
 	task.Set("exec-setup", &setup)
 
@@ -0,0 +1,125 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package logstate
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/canonical/pebble/internals/plan"
+	"github.com/canonical/pebble/internals/servicelog"
+)
+
+// logFilter is the compiled form of a log target's filters. A nil *logFilter
+// forwards all logs unchanged.
+type logFilter struct {
+	drop   []*regexp.Regexp
+	keep   []*regexp.Regexp
+	redact []logRedaction
+}
+
+type logRedaction struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// newLogFilter compiles the given filters, returning nil if there are none.
+func newLogFilter(filters *plan.LogFilters) (*logFilter, error) {
+	if filters == nil {
+		return nil, nil
+	}
+	f := &logFilter{}
+	var err error
+	f.drop, err = compilePatterns(filters.Drop)
+	if err != nil {
+		return nil, err
+	}
+	f.keep, err = compilePatterns(filters.Keep)
+	if err != nil {
+		return nil, err
+	}
+	for _, redaction := range filters.Redact {
+		re, err := regexp.Compile(redaction.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter pattern %q: %w", redaction.Pattern, err)
+		}
+		replacement := redaction.Replacement
+		if replacement == "" {
+			replacement = plan.DefaultLogRedaction
+		}
+		f.redact = append(f.redact, logRedaction{re, replacement})
+	}
+	if len(f.drop) == 0 && len(f.keep) == 0 && len(f.redact) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter pattern %q: %w", pattern, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// apply filters the given entry, returning the entry with any redactions
+// applied (to its message and fields), and false if the entry should be
+// dropped. Drop and keep patterns are matched against the message only.
+func (f *logFilter) apply(entry servicelog.Entry) (servicelog.Entry, bool) {
+	if f == nil {
+		return entry, true
+	}
+	for _, re := range f.drop {
+		if re.MatchString(entry.Message) {
+			return entry, false
+		}
+	}
+	if len(f.keep) > 0 && !matchesAny(f.keep, entry.Message) {
+		return entry, false
+	}
+	if len(f.redact) == 0 {
+		return entry, true
+	}
+	var fields map[string]string
+	if entry.Fields != nil {
+		// Copy the fields rather than modifying the entry's map in place.
+		fields = make(map[string]string, len(entry.Fields))
+	}
+	for _, redaction := range f.redact {
+		entry.Message = redaction.re.ReplaceAllString(entry.Message, redaction.replacement)
+	}
+	for name, value := range entry.Fields {
+		for _, redaction := range f.redact {
+			value = redaction.re.ReplaceAllString(value, redaction.replacement)
+		}
+		fields[name] = value
+	}
+	entry.Fields = fields
+	return entry, true
+}
+
+func matchesAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package logstate
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internals/plan"
+	"github.com/canonical/pebble/internals/servicelog"
+)
+
+type filterSuite struct{}
+
+var _ = Suite(&filterSuite{})
+
+func (s *filterSuite) TestNoFilters(c *C) {
+	f, err := newLogFilter(nil)
+	c.Assert(err, IsNil)
+	c.Assert(f, IsNil)
+	f, err = newLogFilter(&plan.LogFilters{})
+	c.Assert(err, IsNil)
+	c.Assert(f, IsNil)
+
+	entry, ok := f.apply(servicelog.Entry{Message: "foo\n"})
+	c.Assert(ok, Equals, true)
+	c.Assert(entry.Message, Equals, "foo\n")
+}
+
+func (s *filterSuite) TestApply(c *C) {
+	f, err := newLogFilter(&plan.LogFilters{
+		Drop: []string{"^DEBUG", "healthz"},
+		Keep: []string{"^(INFO|ERROR) "},
+		Redact: []*plan.LogRedaction{
+			{Pattern: `(password=)\S+`, Replacement: "${1}***"},
+			{Pattern: `[a-z.]+@[a-z.]+`},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	tests := []struct {
+		message  string
+		expected string
+		dropped  bool
+	}{
+		{message: "INFO started\n", expected: "INFO started\n"},
+		{message: "DEBUG INFO started\n", dropped: true},
+		{message: "INFO GET /healthz\n", dropped: true},
+		{message: "WARNING not kept\n", dropped: true},
+		{message: "INFO login password=hunter2 ok\n", expected: "INFO login password=*** ok\n"},
+		{message: "ERROR mail to bob@example.com and amy@example.org\n", expected: "ERROR mail to [REDACTED] and [REDACTED]\n"},
+	}
+	for _, test := range tests {
+		entry, ok := f.apply(servicelog.Entry{Service: "svc1", Message: test.message})
+		c.Check(ok, Equals, !test.dropped, Commentf("message %q", test.message))
+		if ok {
+			c.Check(entry.Message, Equals, test.expected)
+			c.Check(entry.Service, Equals, "svc1")
+		}
+	}
+}
+
+func (s *filterSuite) TestRedactFields(c *C) {
+	f, err := newLogFilter(&plan.LogFilters{
+		Redact: []*plan.LogRedaction{{Pattern: `secret-\w+`}},
+	})
+	c.Assert(err, IsNil)
+
+	fields := map[string]string{"token": "secret-abc", "user": "bob"}
+	entry, ok := f.apply(servicelog.Entry{Message: "login\n", Fields: fields})
+	c.Assert(ok, Equals, true)
+	c.Check(entry.Message, Equals, "login\n")
+	c.Check(entry.Fields, DeepEquals, map[string]string{"token": "[REDACTED]", "user": "bob"})
+	// The original fields aren't modified.
+	c.Check(fields["token"], Equals, "secret-abc")
+}
+
+func (s *filterSuite) TestInvalidPattern(c *C) {
+	_, err := newLogFilter(&plan.LogFilters{Drop: []string{"(foo"}})
+	c.Assert(err, ErrorMatches, `invalid filter pattern "\(foo": .*`)
+}
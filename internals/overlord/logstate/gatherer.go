@@ -17,13 +17,20 @@ package logstate
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"gopkg.in/tomb.v2"
 
 	"github.com/canonical/pebble/internals/logger"
 	"github.com/canonical/pebble/internals/overlord/logstate/loki"
+	"github.com/canonical/pebble/internals/overlord/logstate/opentelemetry"
+	"github.com/canonical/pebble/internals/overlord/logstate/syslog"
 	"github.com/canonical/pebble/internals/plan"
 	"github.com/canonical/pebble/internals/servicelog"
 )
@@ -33,6 +40,11 @@ const (
 	bufferTimeout      = 1 * time.Second
 	maxBufferedEntries = 100
 
+	// These constants control the exponential backoff between attempts to
+	// send spooled logs after a failed flush.
+	minRetryDelay = 1 * time.Second
+	maxRetryDelay = 1 * time.Minute
+
 	// These constants control the maximum time allowed for each teardown step.
 	timeoutCurrentFlush = 1 * time.Second
 	timeoutPullers      = 2 * time.Second
@@ -55,6 +67,12 @@ const (
 //
 // The client may also flush itself when its internal buffer reaches a certain
 // size.
+//
+// If the target has a spool configured, entries are appended to an on-disk
+// spool instead of being added to the client directly. On each flush, the
+// gatherer reads batches from the spool into the client, and only marks them
+// as sent once the client has flushed successfully. After a failed flush, the
+// gatherer retries with exponential backoff.
 // Calling the Stop() method will tear down the logGatherer and all of its
 // associated logPullers. Stop() can be called from an outside goroutine.
 type logGatherer struct {
@@ -73,10 +91,43 @@ type logGatherer struct {
 
 	// Channel used to notify the main loop to set the client's labels
 	setLabels chan svcWithLabels
+	// Channel used to notify the main loop to update the target's filters
+	setFilter chan *logFilter
+	// Filters applied to logs before they're spooled or added to the client.
+	// Only accessed by the main loop (after creation).
+	filter *logFilter
 
 	pullers *pullerGroup
 	// All pullers send logs on this channel, received by main loop
 	entryCh chan servicelog.Entry
+
+	// On-disk spool, or nil if spooling isn't enabled for this target.
+	spool *spool
+	// True if entries read from the spool have been added to the client but
+	// not yet flushed successfully.
+	spoolUnflushed bool
+	// Delay before the next retry after a failed flush of spooled logs, or
+	// zero if the last flush succeeded.
+	retryDelay time.Duration
+	// Services removed from the target whose labels are kept in the client
+	// until the spooled logs have been sent. Only accessed by the main loop.
+	removedServices map[string]bool
+
+	// Delivery statistics, updated by the main loop after each flush and
+	// read by Info.
+	statsMu sync.Mutex
+	stats   gathererStats
+}
+
+type gathererStats struct {
+	sent          int
+	clientDropped int
+	spoolDropped  int
+	bytesSent     int64
+	lastFlush     time.Time
+	lastError     string
+	lastErrorTime time.Time
+	retryDelay    time.Duration
 }
 
 // logGathererOptions allows overriding the newLogClient method and time values
@@ -86,12 +137,20 @@ type logGathererOptions struct {
 	maxBufferedEntries  int
 	timeoutCurrentFlush time.Duration
 	timeoutFinalFlush   time.Duration
+	minRetryDelay       time.Duration
+	maxRetryDelay       time.Duration
+	// directory holding the target's spool, if the target has spool-size set
+	spoolDir string
 	// method to get a new client
 	newClient func(*plan.LogTarget) (logClient, error)
 }
 
-func newLogGatherer(target *plan.LogTarget) (*logGatherer, error) {
-	return newLogGathererInternal(target, &logGathererOptions{})
+// newLogGatherer creates a logGatherer for the given target. If the target
+// has spooling enabled, its spool is kept in a sub-directory of spoolDir.
+func newLogGatherer(target *plan.LogTarget, spoolDir string) (*logGatherer, error) {
+	return newLogGathererInternal(target, &logGathererOptions{
+		spoolDir: filepath.Join(spoolDir, url.PathEscape(target.Name)),
+	})
 }
 
 // newLogGathererInternal contains the actual creation code for a logGatherer.
@@ -99,6 +158,10 @@ func newLogGatherer(target *plan.LogTarget) (*logGatherer, error) {
 // certain configuration values for testing.
 func newLogGathererInternal(target *plan.LogTarget, options *logGathererOptions) (*logGatherer, error) {
 	options = fillDefaultOptions(options)
+	filter, err := newLogFilter(target.Filters)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create log filter: %w", err)
+	}
 	client, err := options.newClient(target)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create log client: %w", err)
@@ -110,8 +173,18 @@ func newLogGathererInternal(target *plan.LogTarget, options *logGathererOptions)
 		targetName: target.Name,
 		client:     client,
 		setLabels:  make(chan svcWithLabels),
+		setFilter:  make(chan *logFilter),
+		filter:     filter,
 		entryCh:    make(chan servicelog.Entry),
 		pullers:    newPullerGroup(target.Name),
+
+		removedServices: make(map[string]bool),
+	}
+	if target.SpoolSize.IsSet && options.spoolDir != "" {
+		g.spool, err = openSpool(options.spoolDir, target.SpoolSize.Value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open log spool: %w", err)
+		}
 	}
 	g.clientCtx, g.clientCancel = context.WithCancel(context.Background())
 	g.tomb.Go(g.loop)
@@ -133,6 +206,12 @@ func fillDefaultOptions(options *logGathererOptions) *logGathererOptions {
 	if options.timeoutFinalFlush == 0 {
 		options.timeoutFinalFlush = timeoutFinalFlush
 	}
+	if options.minRetryDelay == 0 {
+		options.minRetryDelay = minRetryDelay
+	}
+	if options.maxRetryDelay == 0 {
+		options.maxRetryDelay = maxRetryDelay
+	}
 	if options.newClient == nil {
 		options.newClient = newLogClient
 	}
@@ -144,6 +223,18 @@ func fillDefaultOptions(options *logGathererOptions) *logGathererOptions {
 func (g *logGatherer) PlanChanged(pl *plan.Plan, buffers map[string]*servicelog.RingBuffer) {
 	target := pl.LogTargets[g.targetName]
 
+	filter, err := newLogFilter(target.Filters)
+	if err != nil {
+		// Shouldn't happen, as the plan's filters have been validated.
+		logger.Noticef("Internal error: cannot update filters for target %q: %v", g.targetName, err)
+	} else {
+		select {
+		case g.setFilter <- filter:
+		case <-g.tomb.Dying():
+			return
+		}
+	}
+
 	// Remove old pullers
 	for _, svcName := range g.pullers.Services() {
 		svc, svcExists := pl.Services[svcName]
@@ -180,7 +271,7 @@ func (g *logGatherer) PlanChanged(pl *plan.Plan, buffers map[string]*servicelog.
 		// pullers inside ServiceStarted.
 		buffer, svcStarted := buffers[service.Name]
 		if svcStarted {
-			g.pullers.Add(service.Name, buffer, g.entryCh)
+			g.pullers.Add(service.Name, buffer, newStructuredParser(service), g.entryCh)
 		}
 	}
 }
@@ -188,7 +279,13 @@ func (g *logGatherer) PlanChanged(pl *plan.Plan, buffers map[string]*servicelog.
 // ServiceStarted is called by the LogManager on the start of a service which
 // logs to this gatherer's target.
 func (g *logGatherer) ServiceStarted(service *plan.Service, buffer *servicelog.RingBuffer) {
-	g.pullers.Add(service.Name, buffer, g.entryCh)
+	g.pullers.Add(service.Name, buffer, newStructuredParser(service), g.entryCh)
+}
+
+// newStructuredParser returns the parser for the service's structured logs,
+// or nil if its logs aren't structured.
+func newStructuredParser(service *plan.Service) *servicelog.StructuredParser {
+	return servicelog.NewStructuredParser(string(service.LogFormat), service.LogFields)
 }
 
 // evaluateLabels interprets the labels defined in the plan, substituting any
@@ -214,17 +311,32 @@ func (g *logGatherer) loop() error {
 	defer flushTimer.Stop()
 	// Keep track of number of logs written since last flush
 	numWritten := 0
+	// True if logs have been added to the client but not flushed successfully
+	unflushed := false
 
 	flushClient := func(ctx context.Context) {
 		// Mark timer as unset
 		flushTimer.Stop()
+		if g.spool != nil {
+			g.flushSpool(ctx, &flushTimer)
+			return
+		}
 		err := g.client.Flush(ctx)
 		if err != nil {
 			logger.Noticef("Cannot flush logs to target %q: %v", g.targetName, err)
 		}
+		g.updateStats(unflushed, err)
+		if err == nil {
+			unflushed = false
+		}
 		numWritten = 0
 	}
 
+	if g.spool != nil && g.spool.Pending() {
+		// Send logs left in the spool by a previous run.
+		flushTimer.EnsureSet(g.bufferTimeout)
+	}
+
 mainLoop:
 	for {
 		select {
@@ -235,18 +347,48 @@ mainLoop:
 			flushClient(g.clientCtx)
 
 		case args := <-g.setLabels:
+			if g.spool != nil {
+				// Spooled logs may be sent long after they were written, so
+				// keep the labels of removed services around for them.
+				if args.labels == nil {
+					g.removedServices[args.service] = true
+				} else {
+					delete(g.removedServices, args.service)
+					g.client.SetLabels(args.service, args.labels)
+				}
+				g.releaseRemovedLabels()
+				continue
+			}
 			// Before we change the labels, flush any logs currently in the buffer,
 			// so that these logs are sent with the correct (old) labels.
 			flushClient(g.clientCtx)
 			g.client.SetLabels(args.service, args.labels)
 
+		case filter := <-g.setFilter:
+			g.filter = filter
+
 		case entry := <-g.entryCh:
+			entry, ok := g.filter.apply(entry)
+			if !ok {
+				continue
+			}
+			if g.spool != nil {
+				err := g.spool.Append(entry)
+				if err != nil {
+					logger.Noticef("Cannot write logs to spool for target %q: %v", g.targetName, err)
+					continue
+				}
+				// If a retry is scheduled, the timer is already set.
+				flushTimer.EnsureSet(g.bufferTimeout)
+				continue
+			}
 			err := g.client.Add(entry)
 			if err != nil {
 				logger.Noticef("Cannot write logs to target %q: %v", g.targetName, err)
 				continue
 			}
 			numWritten++
+			unflushed = true
 			// Check if buffer is full
 			if numWritten >= g.maxBufferedEntries {
 				flushClient(g.clientCtx)
@@ -262,9 +404,137 @@ mainLoop:
 	ctx, cancel := context.WithTimeout(context.Background(), g.timeoutFinalFlush)
 	defer cancel()
 	flushClient(ctx)
+
+	// Release any connection held open by the client.
+	if closer, ok := g.client.(io.Closer); ok {
+		err := closer.Close()
+		if err != nil {
+			logger.Noticef("Cannot close client for target %q: %v", g.targetName, err)
+		}
+	}
+	if g.spool != nil {
+		err := g.spool.Close()
+		if err != nil {
+			logger.Noticef("Cannot close log spool for target %q: %v", g.targetName, err)
+		}
+	}
 	return nil
 }
 
+// flushSpool sends logs from the spool to the client in batches, until the
+// spool is empty, a flush fails, or ctx is done. If a flush fails, the
+// unsent batch is kept in the client and flushTimer is set to retry it after
+// an exponentially increasing delay.
+func (g *logGatherer) flushSpool(ctx context.Context, flushTimer *timer) {
+	for ctx.Err() == nil {
+		if !g.spoolUnflushed {
+			entries, err := g.spool.Read(g.maxBufferedEntries)
+			if err != nil {
+				logger.Noticef("Cannot read logs from spool for target %q: %v", g.targetName, err)
+			}
+			if len(entries) == 0 {
+				g.releaseRemovedLabels()
+				return
+			}
+			for _, entry := range entries {
+				err := g.client.Add(entry)
+				if err != nil {
+					logger.Noticef("Cannot write logs to target %q: %v", g.targetName, err)
+				}
+			}
+			g.spoolUnflushed = true
+		}
+
+		err := g.client.Flush(ctx)
+		if err != nil {
+			if g.retryDelay == 0 {
+				g.retryDelay = g.minRetryDelay
+			} else {
+				g.retryDelay *= 2
+				if g.retryDelay > g.maxRetryDelay {
+					g.retryDelay = g.maxRetryDelay
+				}
+			}
+			logger.Noticef("Cannot flush logs to target %q (retrying in %s): %v",
+				g.targetName, g.retryDelay, err)
+			g.updateStats(true, err)
+			flushTimer.EnsureSet(g.retryDelay)
+			return
+		}
+		g.spoolUnflushed = false
+		g.retryDelay = 0
+		g.updateStats(true, nil)
+
+		err = g.spool.Commit()
+		if err != nil {
+			logger.Noticef("Cannot update spool for target %q: %v", g.targetName, err)
+		}
+	}
+}
+
+// releaseRemovedLabels releases the labels of services removed from the
+// target, once no spooled logs are left to send with them.
+func (g *logGatherer) releaseRemovedLabels() {
+	if g.spoolUnflushed || g.spool.Pending() {
+		return
+	}
+	for service := range g.removedServices {
+		g.client.SetLabels(service, nil)
+		delete(g.removedServices, service)
+	}
+}
+
+// statsClient is implemented by log clients which can report how many logs
+// they have sent and dropped.
+type statsClient interface {
+	Stats() (sent, dropped int, bytesSent int64)
+}
+
+// updateStats records the result of a flush, and copies the latest counters
+// from the client and spool. If sending is false, the flush had no logs to
+// send, so a success isn't recorded as a flush. It must only be called from
+// the main loop.
+func (g *logGatherer) updateStats(sending bool, err error) {
+	g.statsMu.Lock()
+	defer g.statsMu.Unlock()
+
+	if client, ok := g.client.(statsClient); ok {
+		g.stats.sent, g.stats.clientDropped, g.stats.bytesSent = client.Stats()
+	}
+	if g.spool != nil {
+		g.stats.spoolDropped = g.spool.Dropped()
+	}
+	switch {
+	case err != nil:
+		g.stats.lastError = err.Error()
+		g.stats.lastErrorTime = time.Now()
+	case sending:
+		g.stats.lastFlush = time.Now()
+	}
+	g.stats.retryDelay = g.retryDelay
+}
+
+// Info returns the current status of log forwarding to the gatherer's target.
+// It is safe to call from any goroutine.
+func (g *logGatherer) Info() *TargetInfo {
+	services := g.pullers.Services()
+	sort.Strings(services)
+
+	g.statsMu.Lock()
+	defer g.statsMu.Unlock()
+	return &TargetInfo{
+		Name:           g.targetName,
+		Services:       services,
+		EntriesSent:    g.stats.sent,
+		EntriesDropped: g.stats.clientDropped + g.stats.spoolDropped,
+		BytesSent:      g.stats.bytesSent,
+		LastFlush:      g.stats.lastFlush,
+		LastError:      g.stats.lastError,
+		LastErrorTime:  g.stats.lastErrorTime,
+		RetryDelay:     g.stats.retryDelay,
+	}
+}
+
 // Stop tears down the gatherer and associated resources (pullers, client).
 // This method will block until gatherer teardown is complete.
 //
@@ -368,7 +638,10 @@ func newLogClient(target *plan.LogTarget) (logClient, error) {
 	switch target.Type {
 	case plan.LokiTarget:
 		return loki.NewClient(target), nil
-	//case plan.SyslogTarget: TODO
+	case plan.OpenTelemetryTarget:
+		return opentelemetry.NewClient(target), nil
+	case plan.SyslogTarget:
+		return syslog.NewClient(target)
 	default:
 		return nil, fmt.Errorf("unknown type %q for log target %q", target.Type, target.Name)
 	}
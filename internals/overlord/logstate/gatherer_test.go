@@ -98,6 +98,92 @@ func (s *gathererSuite) TestGathererTimeout(c *C) {
 	}
 }
 
+func (s *gathererSuite) TestGathererFilters(c *C) {
+	received := make(chan []servicelog.Entry, 1)
+	gathererOptions := logGathererOptions{
+		bufferTimeout: 1 * time.Millisecond,
+		newClient: func(target *plan.LogTarget) (logClient, error) {
+			return &testClient{
+				bufferSize: 5,
+				sendCh:     received,
+			}, nil
+		},
+	}
+
+	target := &plan.LogTarget{
+		Name:     "tgt1",
+		Services: []string{"all"},
+		Filters: &plan.LogFilters{
+			Drop:   []string{"debug"},
+			Redact: []*plan.LogRedaction{{Pattern: "secret"}},
+		},
+	}
+	g, err := newLogGathererInternal(target, &gathererOptions)
+	c.Assert(err, IsNil)
+	defer g.Stop()
+
+	testSvc := newTestService("svc1")
+	g.ServiceStarted(testSvc.config, testSvc.ringBuffer)
+
+	testSvc.writeLog("debug line")
+	testSvc.writeLog("the secret is out")
+	select {
+	case <-time.After(1 * time.Second):
+		c.Fatalf("timeout waiting for logs")
+	case logs := <-received:
+		checkLogs(c, logs, []string{"the [REDACTED] is out"})
+	}
+
+	// Filters are updated when the plan changes (the existing puller is kept,
+	// as svc1 still logs to the target).
+	newTarget := target.Copy()
+	newTarget.Filters = nil
+	g.PlanChanged(&plan.Plan{
+		Services:   map[string]*plan.Service{"svc1": testSvc.config},
+		LogTargets: map[string]*plan.LogTarget{"tgt1": newTarget},
+	}, nil)
+
+	testSvc.writeLog("another secret debug line")
+	select {
+	case <-time.After(1 * time.Second):
+		c.Fatalf("timeout waiting for logs")
+	case logs := <-received:
+		checkLogs(c, logs, []string{"another secret debug line"})
+	}
+}
+
+func (s *gathererSuite) TestGathererStructuredLogs(c *C) {
+	received := make(chan []servicelog.Entry, 1)
+	gathererOptions := logGathererOptions{
+		bufferTimeout: 1 * time.Millisecond,
+		newClient: func(target *plan.LogTarget) (logClient, error) {
+			return &testClient{
+				bufferSize: 5,
+				sendCh:     received,
+			}, nil
+		},
+	}
+
+	g, err := newLogGathererInternal(&plan.LogTarget{Name: "tgt1"}, &gathererOptions)
+	c.Assert(err, IsNil)
+	defer g.Stop()
+
+	testSvc := newTestService("svc1")
+	testSvc.config.LogFormat = plan.JSONLogFormat
+	testSvc.config.LogFields = []string{"user"}
+	g.ServiceStarted(testSvc.config, testSvc.ringBuffer)
+
+	testSvc.writeLog(`{"level":"warn","msg":"log line #1","user":"bob"}`)
+	select {
+	case <-time.After(1 * time.Second):
+		c.Fatalf("timeout waiting for logs")
+	case logs := <-received:
+		checkLogs(c, logs, []string{"log line #1"})
+		c.Check(logs[0].Level, Equals, "warning")
+		c.Check(logs[0].Fields, DeepEquals, map[string]string{"user": "bob"})
+	}
+}
+
 func (s *gathererSuite) TestGathererShutdown(c *C) {
 	received := make(chan []servicelog.Entry, 1)
 	gathererOptions := logGathererOptions{
@@ -207,7 +293,7 @@ func (s *gathererSuite) TestRetryLoki(c *C) {
 		reqBody, err := io.ReadAll(r.Body)
 		c.Assert(err, IsNil)
 
-		expected := `{"streams":\[{"stream":{"pebble_service":"svc1"},"values":\[` +
+		expected := `{"streams":\[{"stream":{"pebble_service":"svc1","pebble_stream":"stdout"},"values":\[` +
 			// First two log lines should have been truncated
 			`\["\d+","log line #3"\],` +
 			`\["\d+","log line #4"\],` +
@@ -330,6 +416,55 @@ func (s *gathererSuite) TestConcurrency(c *C) {
 	g.Stop()
 }
 
+func (s *gathererSuite) TestGathererInfo(c *C) {
+	client := &failingClient{failures: 1}
+	gathererOptions := logGathererOptions{
+		bufferTimeout: 1 * time.Millisecond,
+		newClient: func(target *plan.LogTarget) (logClient, error) {
+			return client, nil
+		},
+	}
+	g, err := newLogGathererInternal(&plan.LogTarget{Name: "tgt1"}, &gathererOptions)
+	c.Assert(err, IsNil)
+	defer g.Stop()
+
+	info := g.Info()
+	c.Assert(info.Name, Equals, "tgt1")
+	c.Assert(info.Services, HasLen, 0)
+	c.Assert(info.LastFlush.IsZero(), Equals, true)
+
+	testSvc := newTestService("svc1")
+	g.ServiceStarted(testSvc.config, testSvc.ringBuffer)
+	testSvc.writeLog("log line #1")
+	waitInfo(c, g, func(info *TargetInfo) bool { return info.LastError != "" })
+
+	info = g.Info()
+	c.Assert(info.Services, DeepEquals, []string{"svc1"})
+	c.Assert(info.EntriesSent, Equals, 0)
+	c.Assert(info.LastError, Equals, "server unavailable")
+	c.Assert(info.LastErrorTime.IsZero(), Equals, false)
+	c.Assert(info.LastFlush.IsZero(), Equals, true)
+
+	// The failed logs are kept in the client, and sent on the next flush.
+	testSvc.writeLog("log line #2")
+	waitInfo(c, g, func(info *TargetInfo) bool { return info.EntriesSent == 2 })
+
+	info = g.Info()
+	c.Assert(info.BytesSent, Equals, int64(len("log line #1\n")+len("log line #2\n")))
+	c.Assert(info.EntriesDropped, Equals, 0)
+	c.Assert(info.LastFlush.After(info.LastErrorTime), Equals, true)
+	c.Assert(info.RetryDelay, Equals, time.Duration(0))
+}
+
+func waitInfo(c *C, g *logGatherer, cond func(*TargetInfo) bool) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if cond(g.Info()) {
+			return
+		}
+	}
+	c.Fatalf("timed out waiting for gatherer info, last: %#v", g.Info())
+}
+
 func checkLogs(c *C, received []servicelog.Entry, expected []string) {
 	c.Assert(received, HasLen, len(expected))
 	for i, entry := range received {
@@ -21,5 +21,5 @@ func GetBuffer(c *Client) []LokiEntryWithService {
 }
 
 func GetMessage(e LokiEntryWithService) string {
-	return e.entry[1]
+	return e.entry.line
 }
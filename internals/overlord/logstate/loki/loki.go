@@ -48,7 +48,12 @@ type Client struct {
 	entries []lokiEntryWithService
 
 	// store the custom labels for each service
-	labels map[string]json.RawMessage
+	labels map[string]map[string]string
+
+	// counters reported by Stats
+	numSent    int
+	numDropped int
+	bytesSent  int64
 }
 
 func NewClient(target *plan.LogTarget) *Client {
@@ -68,7 +73,7 @@ func NewClientWithOptions(target *plan.LogTarget, options *ClientOptions) *Clien
 		target:     target,
 		httpClient: &http.Client{Timeout: options.RequestTimeout},
 		buffer:     make([]lokiEntryWithService, 2*options.MaxRequestEntries),
-		labels:     make(map[string]json.RawMessage),
+		labels:     make(map[string]map[string]string),
 	}
 	// c.entries should be backed by the same array as c.buffer
 	c.entries = c.buffer[:0]
@@ -100,13 +105,7 @@ func (c *Client) SetLabels(serviceName string, labels map[string]string) {
 	// Add Loki-specific default labels
 	newLabels["pebble_service"] = serviceName
 
-	// Encode labels now to save time later
-	marshalledLabels, err := json.Marshal(newLabels)
-	if err != nil {
-		// Can't happen as map[string]string will always be marshallable
-		logger.Panicf("Loki client for %q: cannot marshal labels: %v", c.target.Name, err)
-	}
-	c.labels[serviceName] = marshalledLabels
+	c.labels[serviceName] = newLabels
 }
 
 func (c *Client) Add(entry servicelog.Entry) error {
@@ -115,6 +114,7 @@ func (c *Client) Add(entry servicelog.Entry) error {
 		// Zero the removed element to allow garbage collection
 		c.entries[0] = lokiEntryWithService{}
 		c.entries = c.entries[1:]
+		c.numDropped++
 	}
 
 	if len(c.entries) >= cap(c.entries) {
@@ -133,14 +133,26 @@ func (c *Client) Add(entry servicelog.Entry) error {
 	c.entries = append(c.entries, lokiEntryWithService{
 		entry:   encodeEntry(entry),
 		service: entry.Service,
+		stream:  entry.Stream,
 	})
 	return nil
 }
 
 func encodeEntry(entry servicelog.Entry) lokiEntry {
+	var metadata map[string]string
+	if entry.Level != "" || len(entry.Fields) > 0 {
+		metadata = make(map[string]string, len(entry.Fields)+1)
+		for k, v := range entry.Fields {
+			metadata[k] = v
+		}
+		if entry.Level != "" {
+			metadata["level"] = entry.Level
+		}
+	}
 	return lokiEntry{
-		strconv.FormatInt(entry.Time.UnixNano(), 10),
-		strings.TrimSuffix(entry.Message, "\n"),
+		timestamp: strconv.FormatInt(entry.Time.UnixNano(), 10),
+		line:      strings.TrimSuffix(entry.Message, "\n"),
+		metadata:  metadata,
 	}
 }
 
@@ -167,7 +179,14 @@ func (c *Client) Flush(ctx context.Context) error {
 		return err
 	}
 
-	return c.handleServerResponse(resp)
+	return c.handleServerResponse(resp, len(jsonReq))
+}
+
+// Stats returns the number of log entries sent and dropped (because the
+// buffer was full or the server rejected them), and the number of request
+// bytes sent, since the client was created.
+func (c *Client) Stats() (sent, dropped int, bytesSent int64) {
+	return c.numSent, c.numDropped, c.bytesSent
 }
 
 // resetBuffer drops all buffered logs (in the case of a successful send, or an
@@ -181,24 +200,30 @@ func (c *Client) resetBuffer() {
 }
 
 func (c *Client) buildRequest() lokiRequest {
-	// Put entries into service "buckets"
-	bucketedEntries := map[string][]lokiEntry{}
+	// Put entries into service (and output stream) "buckets"
+	bucketedEntries := map[lokiStreamKey][]lokiEntry{}
 	for _, data := range c.entries {
-		bucketedEntries[data.service] = append(bucketedEntries[data.service], data.entry)
+		key := lokiStreamKey{data.service, data.stream}
+		bucketedEntries[key] = append(bucketedEntries[key], data.entry)
 	}
 
-	// Sort service names to guarantee deterministic output
-	var services []string
-	for service := range bucketedEntries {
-		services = append(services, service)
+	// Sort service names and streams to guarantee deterministic output
+	var keys []lokiStreamKey
+	for key := range bucketedEntries {
+		keys = append(keys, key)
 	}
-	sort.Strings(services)
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		return keys[i].stream < keys[j].stream
+	})
 
 	var req lokiRequest
-	for _, service := range services {
-		entries := bucketedEntries[service]
+	for _, key := range keys {
+		entries := bucketedEntries[key]
 		stream := lokiStream{
-			Labels:  c.labels[service],
+			Labels:  c.encodeLabels(key),
 			Entries: entries,
 		}
 		req.Streams = append(req.Streams, stream)
@@ -206,6 +231,34 @@ func (c *Client) buildRequest() lokiRequest {
 	return req
 }
 
+// encodeLabels returns the JSON-encoded labels for the given service and
+// output stream, adding a "pebble_stream" label if the stream is known.
+func (c *Client) encodeLabels(key lokiStreamKey) json.RawMessage {
+	labels, ok := c.labels[key.service]
+	if !ok {
+		return nil
+	}
+	if key.stream != "" {
+		streamLabels := make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			streamLabels[k] = v
+		}
+		streamLabels["pebble_stream"] = key.stream
+		labels = streamLabels
+	}
+	marshalledLabels, err := json.Marshal(labels)
+	if err != nil {
+		// Can't happen as map[string]string will always be marshallable
+		logger.Panicf("Loki client for %q: cannot marshal labels: %v", c.target.Name, err)
+	}
+	return marshalledLabels
+}
+
+type lokiStreamKey struct {
+	service string
+	stream  string
+}
+
 type lokiRequest struct {
 	Streams []lokiStream `json:"streams"`
 }
@@ -215,17 +268,32 @@ type lokiStream struct {
 	Entries []lokiEntry     `json:"values"`
 }
 
-type lokiEntry [2]string
+// lokiEntry is a single log line, encoded as a [timestamp, line] array, or
+// as [timestamp, line, metadata] if the log has structured metadata (its
+// level and fields).
+type lokiEntry struct {
+	timestamp string
+	line      string
+	metadata  map[string]string
+}
+
+func (e lokiEntry) MarshalJSON() ([]byte, error) {
+	if len(e.metadata) == 0 {
+		return json.Marshal([2]string{e.timestamp, e.line})
+	}
+	return json.Marshal([]interface{}{e.timestamp, e.line, e.metadata})
+}
 
 type lokiEntryWithService struct {
 	entry   lokiEntry
 	service string
+	stream  string
 }
 
 // handleServerResponse determines what to do based on the response from the
 // Loki server. 4xx and 5xx responses indicate errors, so in this case, we will
 // bubble up the error to the caller.
-func (c *Client) handleServerResponse(resp *http.Response) error {
+func (c *Client) handleServerResponse(resp *http.Response, requestSize int) error {
 	defer func() {
 		// Drain request body to allow connection reuse
 		// see https://pkg.go.dev/net/http#Response.Body
@@ -237,6 +305,8 @@ func (c *Client) handleServerResponse(resp *http.Response) error {
 	switch {
 	case code == http.StatusOK || code == http.StatusNoContent:
 		// Success - safe to drop logs
+		c.numSent += len(c.entries)
+		c.bytesSent += int64(requestSize)
 		c.resetBuffer()
 		return nil
 
@@ -248,6 +318,7 @@ func (c *Client) handleServerResponse(resp *http.Response) error {
 		// Other 4xx codes indicate a client problem, so drop the logs (retrying won't help)
 		logger.Noticef("Target %q: request failed with status %d, dropping %d logs",
 			c.target.Name, code, len(c.entries))
+		c.numDropped += len(c.entries)
 		c.resetBuffer()
 		return errFromResponse(resp)
 
@@ -301,6 +301,100 @@ func (*suite) TestLabels(c *C) {
 	}
 }
 
+func (*suite) TestStructuredMetadata(c *C) {
+	expected := compactJSON(`
+{"streams": [{
+	"stream": {"pebble_service": "svc1"},
+	"values": [
+		[ "1696306833000000000", "request failed", {"level": "error", "request_id": "r1"} ],
+		[ "1696306834000000000", "plain" ]
+	]
+}]}`)
+
+	received := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqBody, err := io.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		c.Assert(string(reqBody), Equals, string(expected))
+		close(received)
+	}))
+	defer server.Close()
+
+	client := loki.NewClient(&plan.LogTarget{Location: server.URL})
+	client.SetLabels("svc1", map[string]string{})
+	err := client.Add(servicelog.Entry{
+		Service: "svc1",
+		Time:    time.Date(2023, 10, 3, 4, 20, 33, 0, time.UTC),
+		Message: "request failed\n",
+		Level:   "error",
+		Fields:  map[string]string{"request_id": "r1"},
+	})
+	c.Assert(err, IsNil)
+	err = client.Add(servicelog.Entry{
+		Service: "svc1",
+		Time:    time.Date(2023, 10, 3, 4, 20, 34, 0, time.UTC),
+		Message: "plain\n",
+	})
+	c.Assert(err, IsNil)
+
+	err = client.Flush(context.Background())
+	c.Assert(err, IsNil)
+	select {
+	case <-received:
+	case <-time.After(1 * time.Second):
+		c.Fatal("timed out waiting for request")
+	}
+}
+
+func (*suite) TestStreamLabel(c *C) {
+	expected := compactJSON(`
+{"streams": [{
+	"stream": {"pebble_service": "svc1", "pebble_stream": "stderr"},
+	"values": [
+		[ "1696306834000000000", "oops" ]
+	]
+}, {
+	"stream": {"pebble_service": "svc1", "pebble_stream": "stdout"},
+	"values": [
+		[ "1696306833000000000", "hello" ]
+	]
+}]}`)
+
+	received := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqBody, err := io.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		c.Assert(string(reqBody), Equals, string(expected))
+		close(received)
+	}))
+	defer server.Close()
+
+	client := loki.NewClient(&plan.LogTarget{Location: server.URL})
+	client.SetLabels("svc1", map[string]string{})
+	err := client.Add(servicelog.Entry{
+		Service: "svc1",
+		Time:    time.Date(2023, 10, 3, 4, 20, 33, 0, time.UTC),
+		Message: "hello\n",
+		Stream:  servicelog.StdoutStream,
+	})
+	c.Assert(err, IsNil)
+	err = client.Add(servicelog.Entry{
+		Service: "svc1",
+		Time:    time.Date(2023, 10, 3, 4, 20, 34, 0, time.UTC),
+		Message: "oops\n",
+		Stream:  servicelog.StderrStream,
+	})
+	c.Assert(err, IsNil)
+
+	err = client.Flush(context.Background())
+	c.Assert(err, IsNil)
+	select {
+	case <-received:
+	case <-time.After(1 * time.Second):
+		c.Fatal("timed out waiting for request")
+	}
+}
+
 // Strips all extraneous whitespace from JSON
 func compactJSON(s string) []byte {
 	var buf bytes.Buffer
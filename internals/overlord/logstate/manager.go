@@ -15,13 +15,22 @@
 package logstate
 
 import (
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/canonical/x-go/strutil"
 
 	"github.com/canonical/pebble/internals/logger"
 	"github.com/canonical/pebble/internals/plan"
 	"github.com/canonical/pebble/internals/servicelog"
 )
 
+// spoolDirName is the sub-directory of the pebble directory where log
+// targets with spooling enabled store their spools.
+const spoolDirName = "log-spool"
+
 type LogManager struct {
 	mu        sync.Mutex
 	gatherers map[string]*logGatherer
@@ -31,11 +40,16 @@ type LogManager struct {
 	newGatherer func(*plan.LogTarget) (*logGatherer, error)
 }
 
-func NewLogManager() *LogManager {
+// NewLogManager creates a LogManager which keeps any log spools under the
+// given pebble directory.
+func NewLogManager(pebbleDir string) *LogManager {
+	spoolDir := filepath.Join(pebbleDir, spoolDirName)
 	return &LogManager{
-		gatherers:   map[string]*logGatherer{},
-		buffers:     map[string]*servicelog.RingBuffer{},
-		newGatherer: newLogGatherer,
+		gatherers: map[string]*logGatherer{},
+		buffers:   map[string]*servicelog.RingBuffer{},
+		newGatherer: func(target *plan.LogTarget) (*logGatherer, error) {
+			return newLogGatherer(target, spoolDir)
+		},
 	}
 }
 
@@ -109,6 +123,53 @@ func (m *LogManager) ServiceStarted(service *plan.Service, buffer *servicelog.Ri
 	}
 }
 
+// TargetInfo holds the status of log forwarding to a single log target.
+type TargetInfo struct {
+	Name     string
+	Type     plan.LogTargetType
+	Services []string
+
+	// Number of log entries sent successfully, and dropped without being
+	// sent (for example, because the target was unreachable for too long).
+	EntriesSent    int
+	EntriesDropped int
+	BytesSent      int64
+
+	// Time of the last flush which sent logs successfully.
+	LastFlush time.Time
+
+	// Error from the last failed flush, and when it occurred.
+	LastError     string
+	LastErrorTime time.Time
+
+	// Delay before the next attempt to send spooled logs, if the last
+	// attempt failed.
+	RetryDelay time.Duration
+}
+
+// Targets returns the status of the log targets in the plan with the given
+// names (or all log targets if names is empty), ordered by name.
+func (m *LogManager) Targets(names []string) []*TargetInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var infos []*TargetInfo
+	for name, gatherer := range m.gatherers {
+		if len(names) > 0 && !strutil.ListContains(names, name) {
+			continue
+		}
+		info := gatherer.Info()
+		if target, ok := m.plan.LogTargets[name]; ok {
+			info.Type = target.Type
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
 // Ensure implements overlord.StateManager.
 func (m *LogManager) Ensure() error {
 	return nil
@@ -44,7 +44,7 @@ func (*managerSuite) TestPlanChange(c *C) {
 			return &testClient{}, nil
 		},
 	}
-	m := NewLogManager()
+	m := NewLogManager(c.MkDir())
 	m.newGatherer = func(t *plan.LogTarget) (*logGatherer, error) {
 		return newLogGathererInternal(t, &gathererOptions)
 	}
@@ -103,6 +103,47 @@ func (*managerSuite) TestPlanChange(c *C) {
 	checkBuffers(c, m.buffers, []string{"svc1", "svc2", "svc4"})
 }
 
+func (*managerSuite) TestTargets(c *C) {
+	gathererOptions := logGathererOptions{
+		newClient: func(target *plan.LogTarget) (logClient, error) {
+			return &testClient{}, nil
+		},
+	}
+	m := NewLogManager(c.MkDir())
+	m.newGatherer = func(t *plan.LogTarget) (*logGatherer, error) {
+		return newLogGathererInternal(t, &gathererOptions)
+	}
+	defer m.Stop()
+
+	svc1 := newTestService("svc1")
+	svc2 := newTestService("svc2")
+	m.PlanChanged(&plan.Plan{
+		Services: map[string]*plan.Service{
+			svc1.name: svc1.config,
+			svc2.name: svc2.config,
+		},
+		LogTargets: map[string]*plan.LogTarget{
+			"tgt2": {Name: "tgt2", Type: plan.SyslogTarget, Services: []string{"svc2"}},
+			"tgt1": {Name: "tgt1", Type: plan.LokiTarget, Services: []string{"all"}},
+		},
+	})
+	m.ServiceStarted(svc1.config, svc1.ringBuffer)
+	m.ServiceStarted(svc2.config, svc2.ringBuffer)
+
+	infos := m.Targets(nil)
+	c.Assert(infos, HasLen, 2)
+	c.Check(infos[0].Name, Equals, "tgt1")
+	c.Check(infos[0].Type, Equals, plan.LokiTarget)
+	c.Check(infos[0].Services, DeepEquals, []string{"svc1", "svc2"})
+	c.Check(infos[1].Name, Equals, "tgt2")
+	c.Check(infos[1].Type, Equals, plan.SyslogTarget)
+	c.Check(infos[1].Services, DeepEquals, []string{"svc2"})
+
+	infos = m.Targets([]string{"tgt2", "nosuch"})
+	c.Assert(infos, HasLen, 1)
+	c.Check(infos[0].Name, Equals, "tgt2")
+}
+
 func checkGatherers(c *C, gatherers map[string]*logGatherer, expected map[string][]string) {
 	c.Assert(gatherers, HasLen, len(expected))
 	for tgtName, svcs := range expected {
@@ -137,7 +178,7 @@ func (s *managerSuite) TestTimelyShutdown(c *C) {
 		},
 	}
 
-	m := NewLogManager()
+	m := NewLogManager(c.MkDir())
 	m.newGatherer = func(t *plan.LogTarget) (*logGatherer, error) {
 		return newLogGathererInternal(t, &gathererOptions)
 	}
@@ -219,7 +260,7 @@ func (s *managerSuite) TestLabels(c *C) {
 		notifySetLabels: make(chan struct{}, 2),
 	}
 
-	m := NewLogManager()
+	m := NewLogManager(c.MkDir())
 	m.newGatherer = func(t *plan.LogTarget) (*logGatherer, error) {
 		return newLogGathererInternal(t, &logGathererOptions{
 			newClient: func(_ *plan.LogTarget) (logClient, error) { return fakeClient, nil },
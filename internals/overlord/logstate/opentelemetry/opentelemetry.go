@@ -0,0 +1,416 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package opentelemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/canonical/pebble/cmd"
+	"github.com/canonical/pebble/internals/logger"
+	"github.com/canonical/pebble/internals/plan"
+	"github.com/canonical/pebble/internals/servicelog"
+)
+
+const (
+	requestTimeout    = 10 * time.Second
+	maxRequestEntries = 100
+
+	// logsPath is the OTLP/HTTP path for logs, appended to the target's
+	// location if it's not already there (see the OTLP exporter
+	// specification).
+	logsPath = "/v1/logs"
+
+	// serviceNameKey is the semantic convention resource attribute naming
+	// the service that produced the logs.
+	serviceNameKey = "service.name"
+
+	// severityInfo is the OTLP SeverityNumber for the INFO level, used for
+	// logs without a level.
+	severityInfo = 9
+)
+
+// severities maps normalized log levels to OTLP SeverityNumber and
+// SeverityText values.
+var severities = map[string]struct {
+	number int
+	text   string
+}{
+	servicelog.LevelTrace:   {1, "TRACE"},
+	servicelog.LevelDebug:   {5, "DEBUG"},
+	servicelog.LevelInfo:    {9, "INFO"},
+	servicelog.LevelWarning: {13, "WARN"},
+	servicelog.LevelError:   {17, "ERROR"},
+	servicelog.LevelFatal:   {21, "FATAL"},
+}
+
+type Client struct {
+	options    *ClientOptions
+	target     *plan.LogTarget
+	httpClient *http.Client
+	url        string
+
+	// To store log entries, keep a buffer of size 2*MaxRequestEntries with a
+	// sliding window 'entries' of size MaxRequestEntries
+	buffer  []otelEntryWithService
+	entries []otelEntryWithService
+
+	// store the resource attributes for each service
+	resources map[string][]keyValue
+
+	// counters reported by Stats
+	numSent    int
+	numDropped int
+	bytesSent  int64
+}
+
+func NewClient(target *plan.LogTarget) *Client {
+	return NewClientWithOptions(target, &ClientOptions{})
+}
+
+// ClientOptions allows overriding default parameters (e.g. for testing)
+type ClientOptions struct {
+	RequestTimeout    time.Duration
+	MaxRequestEntries int
+}
+
+func NewClientWithOptions(target *plan.LogTarget, options *ClientOptions) *Client {
+	options = fillDefaultOptions(options)
+	c := &Client{
+		options:    options,
+		target:     target,
+		httpClient: &http.Client{Timeout: options.RequestTimeout},
+		url:        logsURL(target.Location),
+		buffer:     make([]otelEntryWithService, 2*options.MaxRequestEntries),
+		resources:  make(map[string][]keyValue),
+	}
+	// c.entries should be backed by the same array as c.buffer
+	c.entries = c.buffer[:0]
+	return c
+}
+
+// logsURL returns the URL to send logs to, given the location of the target,
+// which may be either the base URL of the OTLP/HTTP receiver or the full URL
+// of its logs endpoint.
+func logsURL(location string) string {
+	location = strings.TrimSuffix(location, "/")
+	if strings.HasSuffix(location, logsPath) {
+		return location
+	}
+	return location + logsPath
+}
+
+func fillDefaultOptions(options *ClientOptions) *ClientOptions {
+	if options.RequestTimeout == 0 {
+		options.RequestTimeout = requestTimeout
+	}
+	if options.MaxRequestEntries == 0 {
+		options.MaxRequestEntries = maxRequestEntries
+	}
+	return options
+}
+
+func (c *Client) SetLabels(serviceName string, labels map[string]string) {
+	if labels == nil {
+		delete(c.resources, serviceName)
+		return
+	}
+
+	// Sort label names to guarantee deterministic output
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	attrs := make([]keyValue, 0, len(labels)+1)
+	attrs = append(attrs, stringKeyValue(serviceNameKey, serviceName))
+	for _, name := range names {
+		attrs = append(attrs, stringKeyValue(name, labels[name]))
+	}
+	c.resources[serviceName] = attrs
+}
+
+func (c *Client) Add(entry servicelog.Entry) error {
+	if n := len(c.entries); n >= c.options.MaxRequestEntries {
+		// 'entries' is full - remove the first element to make room
+		// Zero the removed element to allow garbage collection
+		c.entries[0] = otelEntryWithService{}
+		c.entries = c.entries[1:]
+		c.numDropped++
+	}
+
+	if len(c.entries) >= cap(c.entries) {
+		// Copy all the elements to the start of the buffer
+		copy(c.buffer, c.entries)
+
+		// Reset the view into the buffer
+		c.entries = c.buffer[:len(c.entries):len(c.buffer)]
+
+		// Zero removed elements to allow garbage collection
+		for i := len(c.entries); i < len(c.buffer); i++ {
+			c.buffer[i] = otelEntryWithService{}
+		}
+	}
+
+	c.entries = append(c.entries, otelEntryWithService{
+		entry:   encodeEntry(entry),
+		service: entry.Service,
+	})
+	return nil
+}
+
+func encodeEntry(entry servicelog.Entry) logRecord {
+	timestamp := uint64(entry.Time.UnixNano())
+	record := logRecord{
+		TimeUnixNano:         timestamp,
+		ObservedTimeUnixNano: timestamp,
+		SeverityNumber:       severityInfo,
+		Body: anyValue{
+			StringValue: strings.TrimSuffix(entry.Message, "\n"),
+		},
+	}
+	if entry.Level != "" {
+		// Unrecognized levels are sent as text with an unspecified number.
+		severity, ok := severities[entry.Level]
+		if !ok {
+			severity.text = entry.Level
+		}
+		record.SeverityNumber = severity.number
+		record.SeverityText = severity.text
+	}
+	if entry.Stream != "" {
+		// Semantic convention attribute for the output stream.
+		record.Attributes = append(record.Attributes, stringKeyValue("log.iostream", entry.Stream))
+	}
+	if len(entry.Fields) > 0 {
+		// Sort field names to guarantee deterministic output
+		names := make([]string, 0, len(entry.Fields))
+		for name := range entry.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			record.Attributes = append(record.Attributes, stringKeyValue(name, entry.Fields[name]))
+		}
+	}
+	return record
+}
+
+func (c *Client) Flush(ctx context.Context) error {
+	if len(c.entries) == 0 {
+		return nil // no-op
+	}
+
+	req := c.buildRequest()
+	var body []byte
+	var contentType string
+	if c.target.Encoding == plan.ProtobufEncoding {
+		body = req.marshalProto()
+		contentType = "application/x-protobuf"
+	} else {
+		var err error
+		body, err = json.Marshal(req)
+		if err != nil {
+			return fmt.Errorf("encoding request to JSON: %v", err)
+		}
+		contentType = "application/json"
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating HTTP request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+	httpReq.Header.Set("User-Agent", fmt.Sprintf("pebble/%s", cmd.Version))
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+
+	return c.handleServerResponse(resp, len(body))
+}
+
+// Stats returns the number of log entries sent and dropped (because the
+// buffer was full or the server rejected them), and the number of request
+// bytes sent, since the client was created.
+func (c *Client) Stats() (sent, dropped int, bytesSent int64) {
+	return c.numSent, c.numDropped, c.bytesSent
+}
+
+// resetBuffer drops all buffered logs (in the case of a successful send, or an
+// unrecoverable error).
+func (c *Client) resetBuffer() {
+	// Zero removed elements to allow garbage collection
+	for i := 0; i < len(c.entries); i++ {
+		c.entries[i] = otelEntryWithService{}
+	}
+	c.entries = c.buffer[:0]
+}
+
+func (c *Client) buildRequest() exportLogsRequest {
+	// Put entries into service "buckets"
+	bucketedEntries := map[string][]logRecord{}
+	for _, data := range c.entries {
+		bucketedEntries[data.service] = append(bucketedEntries[data.service], data.entry)
+	}
+
+	// Sort service names to guarantee deterministic output
+	var services []string
+	for service := range bucketedEntries {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	var req exportLogsRequest
+	for _, service := range services {
+		attrs := c.resources[service]
+		if attrs == nil {
+			// SetLabels not yet called for this service - still identify it.
+			attrs = []keyValue{stringKeyValue(serviceNameKey, service)}
+		}
+		req.ResourceLogs = append(req.ResourceLogs, resourceLogs{
+			Resource: resource{Attributes: attrs},
+			ScopeLogs: []scopeLogs{{
+				Scope: instrumentationScope{
+					Name:    "pebble",
+					Version: cmd.Version,
+				},
+				LogRecords: bucketedEntries[service],
+			}},
+		})
+	}
+	return req
+}
+
+// The following types are the OTLP logs protobuf messages, with the tags for
+// their OTLP/JSON encoding, as described in the OTLP specification:
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+// Their binary protobuf encoding is implemented in protobuf.go.
+
+type exportLogsRequest struct {
+	ResourceLogs []resourceLogs `json:"resourceLogs"`
+}
+
+type resourceLogs struct {
+	Resource  resource    `json:"resource"`
+	ScopeLogs []scopeLogs `json:"scopeLogs"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeLogs struct {
+	Scope      instrumentationScope `json:"scope"`
+	LogRecords []logRecord          `json:"logRecords"`
+}
+
+type instrumentationScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type logRecord struct {
+	// 64-bit integers are encoded as decimal strings in OTLP/JSON.
+	TimeUnixNano         uint64     `json:"timeUnixNano,string"`
+	ObservedTimeUnixNano uint64     `json:"observedTimeUnixNano,string"`
+	SeverityNumber       int        `json:"severityNumber,omitempty"`
+	SeverityText         string     `json:"severityText,omitempty"`
+	Body                 anyValue   `json:"body"`
+	Attributes           []keyValue `json:"attributes,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func stringKeyValue(key, value string) keyValue {
+	return keyValue{Key: key, Value: anyValue{StringValue: value}}
+}
+
+type otelEntryWithService struct {
+	entry   logRecord
+	service string
+}
+
+// handleServerResponse determines what to do based on the response from the
+// OTLP server. 4xx and 5xx responses indicate errors, so in this case, we will
+// bubble up the error to the caller.
+func (c *Client) handleServerResponse(resp *http.Response, requestSize int) error {
+	defer func() {
+		// Drain request body to allow connection reuse
+		// see https://pkg.go.dev/net/http#Response.Body
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1024*1024))
+		_ = resp.Body.Close()
+	}()
+
+	code := resp.StatusCode
+	switch {
+	case 200 <= code && code < 300:
+		// Success - safe to drop logs
+		c.numSent += len(c.entries)
+		c.bytesSent += int64(requestSize)
+		c.resetBuffer()
+		return nil
+
+	case code == http.StatusTooManyRequests:
+		// For 429, don't drop logs - just retry later
+		return errFromResponse(resp)
+
+	case 400 <= code && code < 500:
+		// Other 4xx codes indicate a client problem, so drop the logs (retrying won't help)
+		logger.Noticef("Target %q: request failed with status %d, dropping %d logs",
+			c.target.Name, code, len(c.entries))
+		c.numDropped += len(c.entries)
+		c.resetBuffer()
+		return errFromResponse(resp)
+
+	case 500 <= code && code < 600:
+		// 5xx indicates a problem with the server, so don't drop logs (retry later)
+		return errFromResponse(resp)
+
+	default:
+		// Unexpected response - don't drop logs to be safe
+		return fmt.Errorf("unexpected response from server: %v", resp.Status)
+	}
+}
+
+// errFromResponse generates an error from a failed *http.Response.
+// Note: this function reads the response body.
+func errFromResponse(resp *http.Response) error {
+	// Read response body to get more context
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err == nil {
+		logger.Debugf("HTTP %d error, response %q", resp.StatusCode, body)
+	} else {
+		logger.Debugf("HTTP %d error, but cannot read response: %v", resp.StatusCode, err)
+	}
+
+	return fmt.Errorf("server returned HTTP %v", resp.Status)
+}
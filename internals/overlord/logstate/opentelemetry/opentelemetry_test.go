@@ -0,0 +1,378 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package opentelemetry_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/cmd"
+	"github.com/canonical/pebble/internals/overlord/logstate/opentelemetry"
+	"github.com/canonical/pebble/internals/plan"
+	"github.com/canonical/pebble/internals/servicelog"
+)
+
+type suite struct{}
+
+var _ = Suite(&suite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (*suite) TestRequest(c *C) {
+	input := []servicelog.Entry{{
+		Time:    time.Date(2023, 12, 31, 12, 34, 50, 0, time.UTC),
+		Service: "svc1",
+		Message: "log line #1\n",
+	}, {
+		Time:    time.Date(2023, 12, 31, 12, 34, 51, 0, time.UTC),
+		Service: "svc2",
+		Message: "log line #2\n",
+		Stream:  servicelog.StderrStream,
+		Level:   "warning",
+		Fields:  map[string]string{"user": "bob", "id": "42"},
+	}, {
+		Time:    time.Date(2023, 12, 31, 12, 34, 52, 0, time.UTC),
+		Service: "svc1",
+		Message: "log line #3\n",
+		Level:   "verbose",
+	}}
+
+	expected := compactJSON(fmt.Sprintf(`
+{"resourceLogs": [{
+	"resource": {"attributes": [
+		{"key": "service.name", "value": {"stringValue": "svc1"}},
+		{"key": "env", "value": {"stringValue": "prod"}}
+	]},
+	"scopeLogs": [{
+		"scope": {"name": "pebble", "version": %[1]q},
+		"logRecords": [{
+			"timeUnixNano": "1704026090000000000",
+			"observedTimeUnixNano": "1704026090000000000",
+			"severityNumber": 9,
+			"body": {"stringValue": "log line #1"}
+		}, {
+			"timeUnixNano": "1704026092000000000",
+			"observedTimeUnixNano": "1704026092000000000",
+			"severityText": "verbose",
+			"body": {"stringValue": "log line #3"}
+		}]
+	}]
+}, {
+	"resource": {"attributes": [
+		{"key": "service.name", "value": {"stringValue": "svc2"}}
+	]},
+	"scopeLogs": [{
+		"scope": {"name": "pebble", "version": %[1]q},
+		"logRecords": [{
+			"timeUnixNano": "1704026091000000000",
+			"observedTimeUnixNano": "1704026091000000000",
+			"severityNumber": 13,
+			"severityText": "WARN",
+			"body": {"stringValue": "log line #2"},
+			"attributes": [
+				{"key": "log.iostream", "value": {"stringValue": "stderr"}},
+				{"key": "id", "value": {"stringValue": "42"}},
+				{"key": "user", "value": {"stringValue": "bob"}}
+			]
+		}]
+	}]
+}]}`, cmd.Version))
+
+	received := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, http.MethodPost)
+		c.Check(r.URL.Path, Equals, "/v1/logs")
+		c.Check(r.Header.Get("Content-Type"), Equals, "application/json")
+
+		reqBody, err := io.ReadAll(r.Body)
+		c.Check(err, IsNil)
+		c.Check(string(reqBody), Equals, string(expected))
+		close(received)
+	}))
+	defer server.Close()
+
+	client := opentelemetry.NewClient(&plan.LogTarget{Location: server.URL + "/"})
+	client.SetLabels("svc1", map[string]string{"env": "prod"})
+	client.SetLabels("svc2", map[string]string{})
+	for _, entry := range input {
+		err := client.Add(entry)
+		c.Assert(err, IsNil)
+	}
+
+	err := client.Flush(context.Background())
+	c.Assert(err, IsNil)
+	select {
+	case <-received:
+	case <-time.After(1 * time.Second):
+		c.Fatal("timed out waiting for request")
+	}
+}
+
+func (*suite) TestRequestProtobuf(c *C) {
+	received := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/v1/logs")
+		c.Check(r.Header.Get("Content-Type"), Equals, "application/x-protobuf")
+
+		reqBody, err := io.ReadAll(r.Body)
+		c.Check(err, IsNil)
+		received <- reqBody
+	}))
+	defer server.Close()
+
+	client := opentelemetry.NewClient(&plan.LogTarget{
+		Location: server.URL,
+		Encoding: plan.ProtobufEncoding,
+	})
+	client.SetLabels("svc1", map[string]string{"env": "prod"})
+	err := client.Add(servicelog.Entry{
+		Time:    time.Date(2023, 12, 31, 12, 34, 51, 0, time.UTC),
+		Service: "svc1",
+		Message: "log line #1\n",
+		Stream:  servicelog.StderrStream,
+		Level:   "warning",
+	})
+	c.Assert(err, IsNil)
+	err = client.Flush(context.Background())
+	c.Assert(err, IsNil)
+
+	var body []byte
+	select {
+	case body = <-received:
+	case <-time.After(1 * time.Second):
+		c.Fatal("timed out waiting for request")
+	}
+
+	// ExportLogsServiceRequest.resource_logs
+	req := decodeProto(c, body)
+	c.Assert(req[1], HasLen, 1)
+	resourceLogs := decodeProto(c, req[1][0].([]byte))
+
+	// ResourceLogs.resource.attributes
+	resource := decodeProto(c, resourceLogs[1][0].([]byte))
+	c.Assert(resource[1], HasLen, 2)
+	c.Check(decodeKeyValue(c, resource[1][0]), Equals, "service.name=svc1")
+	c.Check(decodeKeyValue(c, resource[1][1]), Equals, "env=prod")
+
+	// ResourceLogs.scope_logs
+	c.Assert(resourceLogs[2], HasLen, 1)
+	scopeLogs := decodeProto(c, resourceLogs[2][0].([]byte))
+	scope := decodeProto(c, scopeLogs[1][0].([]byte))
+	c.Check(string(scope[1][0].([]byte)), Equals, "pebble")
+	c.Check(string(scope[2][0].([]byte)), Equals, cmd.Version)
+
+	// ScopeLogs.log_records
+	c.Assert(scopeLogs[2], HasLen, 1)
+	record := decodeProto(c, scopeLogs[2][0].([]byte))
+	c.Check(record[1], DeepEquals, []any{uint64(1704026091000000000)})
+	c.Check(record[11], DeepEquals, []any{uint64(1704026091000000000)})
+	c.Check(record[2], DeepEquals, []any{uint64(13)})
+	c.Check(string(record[3][0].([]byte)), Equals, "WARN")
+	recordBody := decodeProto(c, record[5][0].([]byte))
+	c.Check(string(recordBody[1][0].([]byte)), Equals, "log line #1")
+	c.Assert(record[6], HasLen, 1)
+	c.Check(decodeKeyValue(c, record[6][0]), Equals, "log.iostream=stderr")
+}
+
+func (*suite) TestLogsPathInLocation(c *C) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.Path
+	}))
+	defer server.Close()
+
+	client := opentelemetry.NewClient(&plan.LogTarget{Location: server.URL + "/otlp/v1/logs"})
+	err := client.Add(servicelog.Entry{
+		Time:    time.Now(),
+		Service: "svc1",
+		Message: "this is a log line\n",
+	})
+	c.Assert(err, IsNil)
+	err = client.Flush(context.Background())
+	c.Assert(err, IsNil)
+	select {
+	case path := <-received:
+		c.Check(path, Equals, "/otlp/v1/logs")
+	case <-time.After(1 * time.Second):
+		c.Fatal("timed out waiting for request")
+	}
+}
+
+func (*suite) TestServerErrors(c *C) {
+	var status int
+	var numRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	client := opentelemetry.NewClient(&plan.LogTarget{Name: "tgt1", Location: server.URL})
+	err := client.Add(servicelog.Entry{
+		Time:    time.Now(),
+		Service: "svc1",
+		Message: "this is a log line\n",
+	})
+	c.Assert(err, IsNil)
+
+	// Retryable errors keep the logs for the next flush.
+	for _, status = range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		err = client.Flush(context.Background())
+		c.Assert(err, ErrorMatches, fmt.Sprintf("server returned HTTP %d .*", status))
+	}
+	c.Assert(numRequests, Equals, 2)
+
+	// Other 4xx errors drop the logs, so the next flush is a no-op.
+	status = http.StatusBadRequest
+	err = client.Flush(context.Background())
+	c.Assert(err, ErrorMatches, "server returned HTTP 400 .*")
+	err = client.Flush(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(numRequests, Equals, 3)
+}
+
+func (*suite) TestServerTimeout(c *C) {
+	stopRequest := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stopRequest
+	}))
+	defer server.Close()
+	defer close(stopRequest)
+
+	client := opentelemetry.NewClientWithOptions(
+		&plan.LogTarget{Location: server.URL},
+		&opentelemetry.ClientOptions{
+			RequestTimeout: 1 * time.Microsecond,
+		},
+	)
+	err := client.Add(servicelog.Entry{
+		Time:    time.Now(),
+		Service: "svc1",
+		Message: "this is a log line\n",
+	})
+	c.Assert(err, IsNil)
+
+	err = client.Flush(context.Background())
+	c.Assert(err, ErrorMatches, ".*context deadline exceeded.*")
+}
+
+func (*suite) TestBufferFull(c *C) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		c.Check(err, IsNil)
+	}))
+	defer server.Close()
+
+	client := opentelemetry.NewClientWithOptions(
+		&plan.LogTarget{Location: server.URL},
+		&opentelemetry.ClientOptions{
+			MaxRequestEntries: 3,
+		},
+	)
+	for i := 1; i <= 7; i++ {
+		err := client.Add(servicelog.Entry{
+			Service: "svc1",
+			Message: fmt.Sprintf("%d", i),
+		})
+		c.Assert(err, IsNil)
+	}
+	err := client.Flush(context.Background())
+	c.Assert(err, IsNil)
+
+	var req struct {
+		ResourceLogs []struct {
+			ScopeLogs []struct {
+				LogRecords []struct {
+					Body struct {
+						StringValue string `json:"stringValue"`
+					} `json:"body"`
+				} `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	err = json.Unmarshal(body, &req)
+	c.Assert(err, IsNil)
+	var messages []string
+	for _, record := range req.ResourceLogs[0].ScopeLogs[0].LogRecords {
+		messages = append(messages, record.Body.StringValue)
+	}
+	c.Assert(messages, DeepEquals, []string{"5", "6", "7"})
+}
+
+// Strips all extraneous whitespace from JSON
+func compactJSON(s string) []byte {
+	var buf bytes.Buffer
+	err := json.Compact(&buf, []byte(s))
+	if err != nil {
+		panic(fmt.Sprintf("error compacting JSON: %v", err))
+	}
+	return buf.Bytes()
+}
+
+// decodeProto decodes the fields of a protobuf message, returning a map from
+// field number to its values: uint64 for varint and fixed64 fields, and
+// []byte for length-delimited fields.
+func decodeProto(c *C, b []byte) map[int][]any {
+	fields := make(map[int][]any)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		c.Assert(n > 0, Equals, true)
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			c.Assert(n > 0, Equals, true)
+			fields[field] = append(fields[field], v)
+			b = b[n:]
+		case 1:
+			c.Assert(len(b) >= 8, Equals, true)
+			fields[field] = append(fields[field], binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			c.Assert(n > 0, Equals, true)
+			b = b[n:]
+			c.Assert(uint64(len(b)) >= size, Equals, true)
+			fields[field] = append(fields[field], b[:size])
+			b = b[size:]
+		default:
+			c.Fatalf("unexpected wire type %d", tag&7)
+		}
+	}
+	return fields
+}
+
+// decodeKeyValue decodes a KeyValue message with a string value, returning
+// it as "key=value".
+func decodeKeyValue(c *C, msg any) string {
+	kv := decodeProto(c, msg.([]byte))
+	value := decodeProto(c, kv[2][0].([]byte))
+	return string(kv[1][0].([]byte)) + "=" + string(value[1][0].([]byte))
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package opentelemetry
+
+import (
+	"encoding/binary"
+)
+
+// This file implements the binary protobuf encoding of the subset of the OTLP
+// logs messages that Pebble sends. The field numbers are those of the
+// messages defined in opentelemetry/proto/collector/logs/v1/logs_service.proto
+// and the files it imports.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func (r *exportLogsRequest) marshalProto() []byte {
+	var b []byte
+	for i := range r.ResourceLogs {
+		b = appendMessage(b, 1, r.ResourceLogs[i].marshalProto())
+	}
+	return b
+}
+
+func (r *resourceLogs) marshalProto() []byte {
+	b := appendMessage(nil, 1, r.Resource.marshalProto())
+	for i := range r.ScopeLogs {
+		b = appendMessage(b, 2, r.ScopeLogs[i].marshalProto())
+	}
+	return b
+}
+
+func (r *resource) marshalProto() []byte {
+	var b []byte
+	for i := range r.Attributes {
+		b = appendMessage(b, 1, r.Attributes[i].marshalProto())
+	}
+	return b
+}
+
+func (s *scopeLogs) marshalProto() []byte {
+	b := appendMessage(nil, 1, s.Scope.marshalProto())
+	for i := range s.LogRecords {
+		b = appendMessage(b, 2, s.LogRecords[i].marshalProto())
+	}
+	return b
+}
+
+func (s *instrumentationScope) marshalProto() []byte {
+	b := appendString(nil, 1, s.Name)
+	b = appendString(b, 2, s.Version)
+	return b
+}
+
+func (r *logRecord) marshalProto() []byte {
+	b := appendFixed64(nil, 1, r.TimeUnixNano)
+	if r.SeverityNumber != 0 {
+		b = appendTag(b, 2, wireVarint)
+		b = binary.AppendUvarint(b, uint64(r.SeverityNumber))
+	}
+	b = appendString(b, 3, r.SeverityText)
+	b = appendMessage(b, 5, r.Body.marshalProto())
+	for i := range r.Attributes {
+		b = appendMessage(b, 6, r.Attributes[i].marshalProto())
+	}
+	b = appendFixed64(b, 11, r.ObservedTimeUnixNano)
+	return b
+}
+
+func (kv *keyValue) marshalProto() []byte {
+	b := appendString(nil, 1, kv.Key)
+	b = appendMessage(b, 2, kv.Value.marshalProto())
+	return b
+}
+
+func (v *anyValue) marshalProto() []byte {
+	// string_value is part of a oneof, so it's encoded even when empty.
+	b := appendTag(nil, 1, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v.StringValue)))
+	return append(b, v.StringValue...)
+}
+
+func appendTag(b []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// appendString appends a string field, omitting it if empty (the proto3
+// default value).
+func appendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendMessage appends an embedded message field, even if empty.
+func appendMessage(b []byte, field int, msg []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
+
+// appendFixed64 appends a fixed64 field, omitting it if zero (the proto3
+// default value).
+func appendFixed64(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
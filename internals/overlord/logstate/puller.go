@@ -27,6 +27,7 @@ import (
 // main control loop.
 type logPuller struct {
 	iterator servicelog.Iterator
+	parser   *servicelog.StructuredParser
 	entryCh  chan<- servicelog.Entry
 
 	tomb tomb.Tomb
@@ -47,8 +48,10 @@ func (p *logPuller) loop() error {
 				return err
 			}
 
+			entry := parser.Entry()
+			p.parser.Parse(&entry)
 			select {
-			case p.entryCh <- parser.Entry():
+			case p.entryCh <- entry:
 			case <-p.tomb.Dying():
 				return nil
 			}
@@ -89,8 +92,9 @@ func newPullerGroup(targetName string) *pullerGroup {
 }
 
 // Add adds a new puller to the group. This puller will read from the given
-// buffer, and send parsed logs on the provided channel.
-func (pg *pullerGroup) Add(serviceName string, buffer *servicelog.RingBuffer, entryCh chan<- servicelog.Entry) {
+// buffer, and send parsed logs on the provided channel. If structuredParser
+// is non-nil, it's also used to parse the logs.
+func (pg *pullerGroup) Add(serviceName string, buffer *servicelog.RingBuffer, structuredParser *servicelog.StructuredParser, entryCh chan<- servicelog.Entry) {
 	pg.mu.Lock()
 	defer pg.mu.Unlock()
 
@@ -100,6 +104,7 @@ func (pg *pullerGroup) Add(serviceName string, buffer *servicelog.RingBuffer, en
 
 	lp := &logPuller{
 		iterator: buffer.TailIterator(),
+		parser:   structuredParser,
 		entryCh:  entryCh,
 	}
 	lp.tomb.Go(lp.loop)
@@ -0,0 +1,372 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package logstate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/canonical/pebble/internals/logger"
+	"github.com/canonical/pebble/internals/osutil"
+	"github.com/canonical/pebble/internals/servicelog"
+)
+
+const (
+	// spoolSegments is the approximate number of segment files the spool's
+	// maximum size is divided into. When the spool is full, the oldest
+	// segment is discarded.
+	spoolSegments = 8
+
+	spoolSegmentSuffix = ".log"
+	spoolCursorFile    = "cursor"
+)
+
+// spool is an on-disk queue of log entries for a single log target. Entries
+// are appended to a series of numbered segment files, and read back from a
+// cursor position. The cursor is only persisted when Commit is called (after
+// the entries have been sent successfully), so entries that were read but not
+// sent are read again after a restart, giving at-least-once delivery.
+//
+// A spool is not safe for concurrent use.
+type spool struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	// Sequence numbers and sizes of the segment files, oldest first. The last
+	// segment is the one being written to.
+	segments []spoolSegment
+	writer   *os.File
+
+	// Position of the next entry to read.
+	readSeq    uint64
+	readOffset int64
+
+	// Number of unsent entries discarded because the spool was full.
+	dropped int
+}
+
+type spoolSegment struct {
+	seq  uint64
+	size int64
+}
+
+// spoolEntry is the on-disk encoding of a servicelog.Entry, one per line.
+type spoolEntry struct {
+	Time    time.Time         `json:"time"`
+	Service string            `json:"service"`
+	Message string            `json:"message"`
+	Stream  string            `json:"stream,omitempty"`
+	Level   string            `json:"level,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// openSpool opens the spool in dir, creating it if necessary. Entries left
+// over from a previous run are kept and will be read first.
+func openSpool(dir string, maxSize int64) (*spool, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	segmentSize := maxSize / spoolSegments
+	if segmentSize < 1 {
+		segmentSize = 1
+	}
+	s := &spool{
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: segmentSize,
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if !strings.HasSuffix(name, spoolSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, spoolSegment{seq: seq, size: info.Size()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].seq < s.segments[j].seq
+	})
+
+	err = s.readCursor()
+	if err != nil {
+		return nil, err
+	}
+
+	// Always start writing to a new segment, so that a partial line left by
+	// a crash is never followed by more entries in the same file.
+	err = s.rotate()
+	if err != nil {
+		return nil, err
+	}
+	if s.readSeq < s.segments[0].seq {
+		s.readSeq, s.readOffset = s.segments[0].seq, 0
+	}
+	return s, nil
+}
+
+func (s *spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d%s", seq, spoolSegmentSuffix))
+}
+
+func (s *spool) readCursor() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, spoolCursorFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Sscanf(string(data), "%d %d", &s.readSeq, &s.readOffset)
+	if err != nil {
+		logger.Noticef("Cannot parse log spool cursor in %q, resending all spooled logs: %v", s.dir, err)
+		s.readSeq, s.readOffset = 0, 0
+	}
+	return nil
+}
+
+// rotate closes the current segment and starts writing to a new one.
+func (s *spool) rotate() error {
+	var seq uint64 = 1
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1].seq + 1
+	}
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if s.writer != nil {
+		_ = s.writer.Close()
+	}
+	s.writer = f
+	s.segments = append(s.segments, spoolSegment{seq: seq})
+	return nil
+}
+
+// Append writes an entry to the end of the spool, discarding the oldest
+// segment if the spool is full.
+func (s *spool) Append(entry servicelog.Entry) error {
+	line, err := json.Marshal(spoolEntry{
+		Time:    entry.Time,
+		Service: entry.Service,
+		Message: entry.Message,
+		Stream:  entry.Stream,
+		Level:   entry.Level,
+		Fields:  entry.Fields,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if s.segments[len(s.segments)-1].size+int64(len(line)) > s.segmentSize &&
+		s.segments[len(s.segments)-1].size > 0 {
+		err := s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	for s.size()+int64(len(line)) > s.maxSize {
+		if len(s.segments) == 1 {
+			// Entry is larger than the whole spool.
+			s.dropped++
+			return nil
+		}
+		err := s.discardOldest()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.writer.Write(line)
+	s.segments[len(s.segments)-1].size += int64(n)
+	return err
+}
+
+func (s *spool) size() int64 {
+	var total int64
+	for _, segment := range s.segments {
+		total += segment.size
+	}
+	return total
+}
+
+// discardOldest removes the oldest segment, counting any unread entries in it
+// as dropped.
+func (s *spool) discardOldest() error {
+	oldest := s.segments[0]
+	if s.readSeq <= oldest.seq {
+		unread, err := s.countLines(oldest.seq, s.readOffset)
+		if err != nil {
+			return err
+		}
+		s.dropped += unread
+		s.readSeq, s.readOffset = s.segments[1].seq, 0
+	}
+	s.segments = s.segments[1:]
+	err := os.Remove(s.segmentPath(oldest.seq))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *spool) countLines(seq uint64, offset int64) (int, error) {
+	f, err := os.Open(s.segmentPath(seq))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		count += bytes.Count(buf[:n], []byte{'\n'})
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+}
+
+// Pending reports whether there are entries which haven't been read yet.
+func (s *spool) Pending() bool {
+	last := s.segments[len(s.segments)-1]
+	return s.readSeq < last.seq || s.readOffset < last.size
+}
+
+// Read reads up to max entries from the read position, and advances the read
+// position past them. The new position is not persisted until Commit is
+// called.
+func (s *spool) Read(max int) ([]servicelog.Entry, error) {
+	var entries []servicelog.Entry
+	for i := 0; i < len(s.segments) && len(entries) < max; i++ {
+		segment := s.segments[i]
+		if segment.seq < s.readSeq {
+			continue
+		}
+		if segment.seq > s.readSeq {
+			s.readSeq, s.readOffset = segment.seq, 0
+		}
+		if s.readOffset >= segment.size {
+			continue
+		}
+		var err error
+		entries, err = s.readSegment(segment, entries, max)
+		if err != nil {
+			return entries, err
+		}
+	}
+	return entries, nil
+}
+
+func (s *spool) readSegment(segment spoolSegment, entries []servicelog.Entry, max int) ([]servicelog.Entry, error) {
+	f, err := os.Open(s.segmentPath(segment.seq))
+	if err != nil {
+		return entries, err
+	}
+	defer f.Close()
+	_, err = f.Seek(s.readOffset, io.SeekStart)
+	if err != nil {
+		return entries, err
+	}
+	r := bufio.NewReader(io.LimitReader(f, segment.size-s.readOffset))
+	for len(entries) < max {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && errors.Is(err, io.EOF) {
+			// Skip anything left in the segment (can only be a partial line).
+			s.readOffset = segment.size
+			return entries, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return entries, err
+		}
+		s.readOffset += int64(len(line))
+
+		var e spoolEntry
+		if jsonErr := json.Unmarshal(line, &e); jsonErr != nil {
+			logger.Noticef("Cannot decode spooled log entry in %q: %v", s.dir, jsonErr)
+			continue
+		}
+		entries = append(entries, servicelog.Entry{
+			Time:    e.Time,
+			Service: e.Service,
+			Message: e.Message,
+			Stream:  e.Stream,
+			Level:   e.Level,
+			Fields:  e.Fields,
+		})
+	}
+	return entries, nil
+}
+
+// Commit persists the read position, and removes any segments that have
+// been read completely.
+func (s *spool) Commit() error {
+	for len(s.segments) > 1 && s.segments[0].seq < s.readSeq {
+		err := os.Remove(s.segmentPath(s.segments[0].seq))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		s.segments = s.segments[1:]
+	}
+	cursor := fmt.Sprintf("%d %d\n", s.readSeq, s.readOffset)
+	return osutil.AtomicWriteFile(filepath.Join(s.dir, spoolCursorFile), []byte(cursor), 0o600, 0)
+}
+
+// Dropped returns the number of unsent entries discarded because the spool
+// was full.
+func (s *spool) Dropped() int {
+	return s.dropped
+}
+
+// Close closes the segment being written to.
+func (s *spool) Close() error {
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Close()
+	s.writer = nil
+	return err
+}
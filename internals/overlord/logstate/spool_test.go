@@ -0,0 +1,323 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package logstate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internals/plan"
+	"github.com/canonical/pebble/internals/servicelog"
+)
+
+type spoolSuite struct{}
+
+var _ = Suite(&spoolSuite{})
+
+func spoolTestEntry(i int) servicelog.Entry {
+	return servicelog.Entry{
+		Time:    time.Date(2024, 1, 2, 3, 4, 5, i, time.UTC),
+		Service: "svc1",
+		Message: fmt.Sprintf("log line #%d\n", i),
+		Stream:  servicelog.StdoutStream,
+	}
+}
+
+func readMessages(c *C, s *spool, max int) []string {
+	entries, err := s.Read(max)
+	c.Assert(err, IsNil)
+	var messages []string
+	for _, entry := range entries {
+		messages = append(messages, entry.Message)
+	}
+	return messages
+}
+
+func (*spoolSuite) TestReadCommit(c *C) {
+	s, err := openSpool(c.MkDir(), 1024*1024)
+	c.Assert(err, IsNil)
+	defer s.Close()
+	c.Assert(s.Pending(), Equals, false)
+
+	for i := 1; i <= 5; i++ {
+		c.Assert(s.Append(spoolTestEntry(i)), IsNil)
+	}
+	c.Assert(s.Pending(), Equals, true)
+
+	entries, err := s.Read(2)
+	c.Assert(err, IsNil)
+	c.Assert(entries, DeepEquals, []servicelog.Entry{spoolTestEntry(1), spoolTestEntry(2)})
+	c.Assert(readMessages(c, s, 10), DeepEquals, []string{"log line #3\n", "log line #4\n", "log line #5\n"})
+	c.Assert(s.Pending(), Equals, false)
+	c.Assert(readMessages(c, s, 10), HasLen, 0)
+}
+
+func (*spoolSuite) TestReopen(c *C) {
+	dir := c.MkDir()
+	s, err := openSpool(dir, 1024*1024)
+	c.Assert(err, IsNil)
+	for i := 1; i <= 4; i++ {
+		c.Assert(s.Append(spoolTestEntry(i)), IsNil)
+	}
+	c.Assert(readMessages(c, s, 2), DeepEquals, []string{"log line #1\n", "log line #2\n"})
+	c.Assert(s.Commit(), IsNil)
+	// Read but not committed, so should be read again after reopening.
+	c.Assert(readMessages(c, s, 1), DeepEquals, []string{"log line #3\n"})
+	c.Assert(s.Close(), IsNil)
+
+	s, err = openSpool(dir, 1024*1024)
+	c.Assert(err, IsNil)
+	defer s.Close()
+	c.Assert(s.Pending(), Equals, true)
+	c.Assert(s.Append(spoolTestEntry(5)), IsNil)
+	c.Assert(readMessages(c, s, 10), DeepEquals, []string{"log line #3\n", "log line #4\n", "log line #5\n"})
+	c.Assert(s.Commit(), IsNil)
+
+	// Fully-read segments are removed on commit.
+	matches, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	c.Assert(err, IsNil)
+	c.Assert(matches, HasLen, 1)
+}
+
+func (*spoolSuite) TestPartialLine(c *C) {
+	dir := c.MkDir()
+	s, err := openSpool(dir, 1024*1024)
+	c.Assert(err, IsNil)
+	c.Assert(s.Append(spoolTestEntry(1)), IsNil)
+	// Simulate a crash in the middle of writing an entry.
+	_, err = s.writer.Write([]byte(`{"time":"2024-01-`))
+	c.Assert(err, IsNil)
+	c.Assert(s.Close(), IsNil)
+
+	s, err = openSpool(dir, 1024*1024)
+	c.Assert(err, IsNil)
+	defer s.Close()
+	c.Assert(s.Append(spoolTestEntry(2)), IsNil)
+	c.Assert(readMessages(c, s, 10), DeepEquals, []string{"log line #1\n", "log line #2\n"})
+}
+
+func (*spoolSuite) TestMaxSize(c *C) {
+	dir := c.MkDir()
+	// Each entry is about 90 bytes, so each segment holds one entry.
+	s, err := openSpool(dir, 8*100)
+	c.Assert(err, IsNil)
+	defer s.Close()
+
+	for i := 1; i <= 20; i++ {
+		c.Assert(s.Append(spoolTestEntry(i)), IsNil)
+	}
+	c.Assert(s.size() <= 800, Equals, true)
+
+	// The oldest entries were dropped, and the rest are kept in order.
+	dropped := s.Dropped()
+	c.Assert(dropped > 0, Equals, true)
+	var expected []string
+	for i := dropped + 1; i <= 20; i++ {
+		expected = append(expected, fmt.Sprintf("log line #%d\n", i))
+	}
+	c.Assert(readMessages(c, s, 100), DeepEquals, expected)
+}
+
+func (*spoolSuite) TestGathererRetry(c *C) {
+	spoolDir := c.MkDir()
+	client := &failingClient{failures: 2}
+	options := func() *logGathererOptions {
+		return &logGathererOptions{
+			bufferTimeout: 1 * time.Millisecond,
+			minRetryDelay: 1 * time.Millisecond,
+			maxRetryDelay: 4 * time.Millisecond,
+			spoolDir:      spoolDir,
+			newClient: func(target *plan.LogTarget) (logClient, error) {
+				return client, nil
+			},
+		}
+	}
+	target := &plan.LogTarget{
+		Name:      "tgt1",
+		SpoolSize: plan.OptionalSize{Value: 1024 * 1024, IsSet: true},
+	}
+
+	g, err := newLogGathererInternal(target, options())
+	c.Assert(err, IsNil)
+	testSvc := newTestService("svc1")
+	g.ServiceStarted(testSvc.config, testSvc.ringBuffer)
+	testSvc.writeLog("log line #1")
+	testSvc.writeLog("log line #2")
+
+	// The first two flushes fail, then the logs are sent on a retry.
+	waitSent(c, client, []string{"log line #1\n", "log line #2\n"})
+	waitInfo(c, g, func(info *TargetInfo) bool { return info.EntriesSent == 2 })
+	c.Assert(g.Info().RetryDelay, Equals, time.Duration(0))
+	c.Assert(testSvc.stop(), IsNil)
+	g.Stop()
+
+	// Simulate a target that is down when the gatherer stops.
+	client = &failingClient{failures: 1000}
+	g, err = newLogGathererInternal(target, options())
+	c.Assert(err, IsNil)
+	testSvc = newTestService("svc1")
+	g.ServiceStarted(testSvc.config, testSvc.ringBuffer)
+	testSvc.writeLog("log line #3")
+	// The retry delay increases up to the maximum.
+	waitInfo(c, g, func(info *TargetInfo) bool { return info.RetryDelay == 4*time.Millisecond })
+	c.Assert(g.Info().LastError, Equals, "server unavailable")
+	c.Assert(testSvc.stop(), IsNil)
+	g.Stop()
+
+	// The unsent log is sent after a restart.
+	client = &failingClient{}
+	g, err = newLogGathererInternal(target, options())
+	c.Assert(err, IsNil)
+	waitSent(c, client, []string{"log line #3\n"})
+	g.Stop()
+
+	_, err = os.Stat(filepath.Join(spoolDir, spoolCursorFile))
+	c.Assert(err, IsNil)
+}
+
+func (*spoolSuite) TestGathererRemovedServiceLabels(c *C) {
+	client := &failingClient{failures: 1000}
+	target := &plan.LogTarget{
+		Name:      "tgt1",
+		Services:  []string{"all"},
+		Labels:    map[string]string{"env": "prod"},
+		SpoolSize: plan.OptionalSize{Value: 1024 * 1024, IsSet: true},
+	}
+	g, err := newLogGathererInternal(target, &logGathererOptions{
+		bufferTimeout: 1 * time.Millisecond,
+		minRetryDelay: 1 * time.Millisecond,
+		maxRetryDelay: 1 * time.Millisecond,
+		spoolDir:      c.MkDir(),
+		newClient: func(target *plan.LogTarget) (logClient, error) {
+			return client, nil
+		},
+	})
+	c.Assert(err, IsNil)
+	defer g.Stop()
+
+	testSvc := newTestService("svc1")
+	pl := &plan.Plan{
+		Services:   map[string]*plan.Service{"svc1": testSvc.config},
+		LogTargets: map[string]*plan.LogTarget{"tgt1": target},
+	}
+	g.PlanChanged(pl, map[string]*servicelog.RingBuffer{"svc1": testSvc.ringBuffer})
+	testSvc.writeLog("log line #1")
+	waitInfo(c, g, func(info *TargetInfo) bool { return info.LastError != "" })
+
+	// Remove the service while its log is still spooled.
+	pl = &plan.Plan{
+		Services:   map[string]*plan.Service{},
+		LogTargets: map[string]*plan.LogTarget{"tgt1": target},
+	}
+	g.PlanChanged(pl, nil)
+	c.Assert(testSvc.stop(), IsNil)
+	client.mu.Lock()
+	client.failures = 0
+	client.mu.Unlock()
+
+	// The spooled log is sent with the service's labels, which are then
+	// released.
+	waitSent(c, client, []string{"log line #1\n"})
+	client.mu.Lock()
+	c.Assert(client.sentLabels, DeepEquals, []map[string]string{{"env": "prod"}})
+	client.mu.Unlock()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		client.mu.Lock()
+		_, ok := client.labels["svc1"]
+		client.mu.Unlock()
+		if !ok {
+			return
+		}
+	}
+	c.Fatalf("timed out waiting for labels of removed service to be released")
+}
+
+func waitSent(c *C, client *failingClient, expected []string) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if len(client.sentMessages()) >= len(expected) {
+			break
+		}
+	}
+	c.Assert(client.sentMessages(), DeepEquals, expected)
+}
+
+// failingClient fails the given number of flushes before succeeding, keeping
+// its buffered logs on failure.
+type failingClient struct {
+	mu         sync.Mutex
+	failures   int
+	buffered   []servicelog.Entry
+	sent       []string
+	sentLabels []map[string]string
+	bytes      int64
+	labels     map[string]map[string]string
+}
+
+func (c *failingClient) SetLabels(serviceName string, labels map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if labels == nil {
+		delete(c.labels, serviceName)
+		return
+	}
+	if c.labels == nil {
+		c.labels = make(map[string]map[string]string)
+	}
+	c.labels[serviceName] = labels
+}
+
+func (c *failingClient) Add(entry servicelog.Entry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buffered = append(c.buffered, entry)
+	return nil
+}
+
+func (c *failingClient) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.buffered) == 0 {
+		return nil
+	}
+	if c.failures > 0 {
+		c.failures--
+		return fmt.Errorf("server unavailable")
+	}
+	for _, entry := range c.buffered {
+		c.sent = append(c.sent, entry.Message)
+		c.sentLabels = append(c.sentLabels, c.labels[entry.Service])
+		c.bytes += int64(len(entry.Message))
+	}
+	c.buffered = nil
+	return nil
+}
+
+func (c *failingClient) Stats() (sent, dropped int, bytesSent int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sent), 0, c.bytes
+}
+
+func (c *failingClient) sentMessages() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.sent...)
+}
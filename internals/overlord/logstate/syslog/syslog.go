@@ -0,0 +1,409 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package syslog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/canonical/pebble/internals/plan"
+	"github.com/canonical/pebble/internals/servicelog"
+)
+
+const (
+	dialTimeout       = 10 * time.Second
+	writeTimeout      = 10 * time.Second
+	maxRequestEntries = 100
+
+	// facilityUser is the facility of each message: "user" (1), as
+	// described in RFC 5424 section 6.2.1.
+	facilityUser = 1
+
+	// severityInfo is the severity of messages without a recognized level:
+	// "informational" (6).
+	severityInfo = 6
+
+	// sdID is the SD-ID used for Pebble's structured data element. The
+	// number after the "@" is Canonical's IANA private enterprise number.
+	sdID = "pebble@28978"
+
+	// Maximum lengths of header fields (RFC 5424 section 6).
+	maxHostnameLen  = 255
+	maxAppNameLen   = 48
+	maxParamNameLen = 32
+)
+
+// severities maps normalized log levels to RFC 5424 severities.
+var severities = map[string]int{
+	servicelog.LevelTrace:   7, // debug
+	servicelog.LevelDebug:   7, // debug
+	servicelog.LevelInfo:    6, // informational
+	servicelog.LevelWarning: 4, // warning
+	servicelog.LevelError:   3, // error
+	servicelog.LevelFatal:   2, // critical
+}
+
+type Client struct {
+	options  *ClientOptions
+	target   *plan.LogTarget
+	network  string
+	address  string
+	hostname string
+
+	conn net.Conn
+
+	// To store log entries, keep a buffer of size 2*MaxRequestEntries with a
+	// sliding window 'entries' of size MaxRequestEntries
+	buffer  []syslogEntry
+	entries []syslogEntry
+
+	// store the encoded structured data for each service
+	structuredData map[string][]byte
+
+	// counters reported by Stats
+	numSent    int
+	numDropped int
+	bytesSent  int64
+}
+
+// ClientOptions allows overriding default parameters (e.g. for testing)
+type ClientOptions struct {
+	DialTimeout       time.Duration
+	WriteTimeout      time.Duration
+	MaxRequestEntries int
+	Hostname          string
+}
+
+func NewClient(target *plan.LogTarget) (*Client, error) {
+	return NewClientWithOptions(target, &ClientOptions{})
+}
+
+func NewClientWithOptions(target *plan.LogTarget, options *ClientOptions) (*Client, error) {
+	options = fillDefaultOptions(options)
+	network, address, err := parseLocation(target.Location)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		options:        options,
+		target:         target,
+		network:        network,
+		address:        address,
+		hostname:       headerField(options.Hostname, maxHostnameLen),
+		buffer:         make([]syslogEntry, 2*options.MaxRequestEntries),
+		structuredData: make(map[string][]byte),
+	}
+	// c.entries should be backed by the same array as c.buffer
+	c.entries = c.buffer[:0]
+	return c, nil
+}
+
+func fillDefaultOptions(options *ClientOptions) *ClientOptions {
+	if options.DialTimeout == 0 {
+		options.DialTimeout = dialTimeout
+	}
+	if options.WriteTimeout == 0 {
+		options.WriteTimeout = writeTimeout
+	}
+	if options.MaxRequestEntries == 0 {
+		options.MaxRequestEntries = maxRequestEntries
+	}
+	if options.Hostname == "" {
+		options.Hostname, _ = os.Hostname()
+	}
+	return options
+}
+
+// parseLocation parses a syslog target location of the form
+// "tcp://host:port", "udp://host:port" or "unix:///path/to/socket", and
+// returns the network and address to pass to net.Dial.
+func parseLocation(location string) (network, address string, err error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid syslog location %q: %v", location, err)
+	}
+	switch u.Scheme {
+	case "tcp", "udp":
+		if u.Host == "" || u.Port() == "" {
+			return "", "", fmt.Errorf("invalid syslog location %q: must include host and port", location)
+		}
+		return u.Scheme, u.Host, nil
+	case "unix", "unixgram":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("invalid syslog location %q: must include socket path", location)
+		}
+		return u.Scheme, u.Path, nil
+	default:
+		return "", "", fmt.Errorf(`invalid syslog location %q: scheme must be "tcp", "udp", "unix" or "unixgram"`, location)
+	}
+}
+
+// SetLabels sets the structured data sent with the given service's logs, or
+// releases it if labels is nil.
+func (c *Client) SetLabels(serviceName string, labels map[string]string) {
+	if labels == nil {
+		delete(c.structuredData, serviceName)
+		return
+	}
+
+	// Sort label names to guarantee deterministic output
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Encode structured data now to save time later
+	var buf bytes.Buffer
+	buf.WriteString("[" + sdID)
+	writeParam(&buf, "pebble_service", serviceName)
+	for _, name := range names {
+		writeParam(&buf, name, labels[name])
+	}
+	buf.WriteByte(']')
+	c.structuredData[serviceName] = buf.Bytes()
+}
+
+// writeParam writes a single SD-PARAM to buf, sanitising the name and
+// escaping the value as required by RFC 5424 section 6.3.3.
+func writeParam(buf *bytes.Buffer, name, value string) {
+	buf.WriteByte(' ')
+	buf.WriteString(paramName(name))
+	buf.WriteString(`="`)
+	for _, r := range value {
+		if r == '"' || r == '\\' || r == ']' {
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(r)
+	}
+	buf.WriteByte('"')
+}
+
+// paramName returns name as a valid SD-NAME: printable US-ASCII other than
+// '=', ' ', ']' and '"', truncated to 32 characters.
+func paramName(name string) string {
+	sanitised := []byte(name)
+	for i, b := range sanitised {
+		if b <= ' ' || b > '~' || b == '=' || b == ']' || b == '"' {
+			sanitised[i] = '_'
+		}
+	}
+	if len(sanitised) > maxParamNameLen {
+		sanitised = sanitised[:maxParamNameLen]
+	}
+	if len(sanitised) == 0 {
+		return "_"
+	}
+	return string(sanitised)
+}
+
+// headerField returns s as a valid RFC 5424 header field: printable US-ASCII
+// with no spaces, truncated to maxLen characters, or the NILVALUE "-" if
+// empty.
+func headerField(s string, maxLen int) string {
+	sanitised := []byte(s)
+	for i, b := range sanitised {
+		if b <= ' ' || b > '~' {
+			sanitised[i] = '_'
+		}
+	}
+	if len(sanitised) > maxLen {
+		sanitised = sanitised[:maxLen]
+	}
+	if len(sanitised) == 0 {
+		return "-"
+	}
+	return string(sanitised)
+}
+
+func (c *Client) Add(entry servicelog.Entry) error {
+	if n := len(c.entries); n >= c.options.MaxRequestEntries {
+		// 'entries' is full - remove the first element to make room
+		// Zero the removed element to allow garbage collection
+		c.entries[0] = syslogEntry{}
+		c.entries = c.entries[1:]
+		c.numDropped++
+	}
+
+	if len(c.entries) >= cap(c.entries) {
+		// Copy all the elements to the start of the buffer
+		copy(c.buffer, c.entries)
+
+		// Reset the view into the buffer
+		c.entries = c.buffer[:len(c.entries):len(c.buffer)]
+
+		// Zero removed elements to allow garbage collection
+		for i := len(c.entries); i < len(c.buffer); i++ {
+			c.buffer[i] = syslogEntry{}
+		}
+	}
+
+	c.entries = append(c.entries, syslogEntry{
+		message: c.encodeEntry(entry),
+	})
+	return nil
+}
+
+// encodeEntry formats entry as an RFC 5424 syslog message:
+//
+//	<PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG
+func (c *Client) encodeEntry(entry servicelog.Entry) []byte {
+	sd := c.structuredData[entry.Service]
+	if sd == nil {
+		// SetLabels not yet called for this service - still identify it.
+		var buf bytes.Buffer
+		buf.WriteString("[" + sdID)
+		writeParam(&buf, "pebble_service", entry.Service)
+		buf.WriteByte(']')
+		sd = buf.Bytes()
+	}
+
+	severity, ok := severities[entry.Level]
+	if !ok {
+		severity = severityInfo
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s - - ",
+		facilityUser*8+severity,
+		entry.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		c.hostname,
+		headerField(entry.Service, maxAppNameLen),
+	)
+	if len(entry.Fields) == 0 && entry.Stream == "" {
+		buf.Write(sd)
+	} else {
+		// Add the log's output stream and fields as parameters of the SD
+		// element (before its closing bracket), with fields sorted to
+		// guarantee deterministic output.
+		buf.Write(sd[:len(sd)-1])
+		if entry.Stream != "" {
+			writeParam(&buf, "pebble_stream", entry.Stream)
+		}
+		names := make([]string, 0, len(entry.Fields))
+		for name := range entry.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			writeParam(&buf, name, entry.Fields[name])
+		}
+		buf.WriteByte(']')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strings.TrimSuffix(entry.Message, "\n"))
+	return buf.Bytes()
+}
+
+func (c *Client) Flush(ctx context.Context) error {
+	if len(c.entries) == 0 {
+		return nil // no-op
+	}
+
+	if c.conn == nil {
+		dialer := net.Dialer{Timeout: c.options.DialTimeout}
+		conn, err := dialer.DialContext(ctx, c.network, c.address)
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+	}
+
+	// Make sure a cancelled context interrupts a blocked write.
+	deadline := time.Now().Add(c.options.WriteTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	err := c.conn.SetWriteDeadline(deadline)
+	if err != nil {
+		c.closeConn()
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func(conn net.Conn) {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetWriteDeadline(time.Now())
+		case <-done:
+		}
+	}(c.conn)
+
+	for len(c.entries) > 0 {
+		n, err := c.conn.Write(c.frame(c.entries[0].message))
+		c.bytesSent += int64(n)
+		if err != nil {
+			// Keep the unsent logs and reconnect on the next flush.
+			c.closeConn()
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+		// Zero the sent element to allow garbage collection
+		c.entries[0] = syslogEntry{}
+		c.entries = c.entries[1:]
+		c.numSent++
+	}
+	c.entries = c.buffer[:0]
+	return nil
+}
+
+// Stats returns the number of log entries sent and dropped (because the
+// buffer was full), and the number of bytes written, since the client was
+// created.
+func (c *Client) Stats() (sent, dropped int, bytesSent int64) {
+	return c.numSent, c.numDropped, c.bytesSent
+}
+
+// frame returns the bytes to write for a single message. Stream transports
+// use octet-counting framing (RFC 6587 section 3.4.1); datagram transports
+// send one message per datagram, so need no framing.
+func (c *Client) frame(message []byte) []byte {
+	switch c.network {
+	case "udp", "unixgram":
+		return message
+	default:
+		framed := make([]byte, 0, len(message)+8)
+		framed = strconv.AppendInt(framed, int64(len(message)), 10)
+		framed = append(framed, ' ')
+		return append(framed, message...)
+	}
+}
+
+func (c *Client) closeConn() {
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// Close closes the connection to the syslog server, if any.
+func (c *Client) Close() error {
+	c.closeConn()
+	return nil
+}
+
+type syslogEntry struct {
+	message []byte
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package syslog_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internals/overlord/logstate/syslog"
+	"github.com/canonical/pebble/internals/plan"
+	"github.com/canonical/pebble/internals/servicelog"
+)
+
+type suite struct{}
+
+var _ = Suite(&suite{})
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+var testEntries = []servicelog.Entry{{
+	Time:    time.Date(2023, 12, 31, 12, 34, 50, 0, time.UTC),
+	Service: "svc1",
+	Message: "log line #1\n",
+}, {
+	Time:    time.Date(2023, 12, 31, 12, 34, 51, 123456000, time.UTC),
+	Service: "svc2",
+	Message: "log line #2\n",
+}, {
+	Time:    time.Date(2023, 12, 31, 12, 34, 52, 0, time.UTC),
+	Service: "svc2",
+	Message: "request failed\n",
+	Stream:  servicelog.StderrStream,
+	Level:   "error",
+	Fields:  map[string]string{"user": "bob", "code": "500"},
+}}
+
+var expectedMessages = []string{
+	`<14>1 2023-12-31T12:34:50.000000Z host svc1 - - [pebble@28978 pebble_service="svc1" env="prod" quoted="a\"b\\c\]d"] log line #1`,
+	`<14>1 2023-12-31T12:34:51.123456Z host svc2 - - [pebble@28978 pebble_service="svc2"] log line #2`,
+	`<11>1 2023-12-31T12:34:52.000000Z host svc2 - - [pebble@28978 pebble_service="svc2" pebble_stream="stderr" code="500" user="bob"] request failed`,
+}
+
+func newTestClient(c *C, location string) *syslog.Client {
+	client, err := syslog.NewClientWithOptions(
+		&plan.LogTarget{Name: "tgt1", Location: location},
+		&syslog.ClientOptions{Hostname: "host"},
+	)
+	c.Assert(err, IsNil)
+	client.SetLabels("svc1", map[string]string{
+		"env":    "prod",
+		"quoted": `a"b\c]d`,
+	})
+	client.SetLabels("svc2", map[string]string{})
+	for _, entry := range testEntries {
+		err := client.Add(entry)
+		c.Assert(err, IsNil)
+	}
+	return client
+}
+
+// readFramed reads n octet-counted syslog messages from r.
+func readFramed(c *C, r io.Reader, n int) []string {
+	br := bufio.NewReader(r)
+	var messages []string
+	for i := 0; i < n; i++ {
+		lenStr, err := br.ReadString(' ')
+		c.Assert(err, IsNil)
+		length, err := strconv.Atoi(lenStr[:len(lenStr)-1])
+		c.Assert(err, IsNil)
+		msg := make([]byte, length)
+		_, err = io.ReadFull(br, msg)
+		c.Assert(err, IsNil)
+		messages = append(messages, string(msg))
+	}
+	return messages
+}
+
+func (*suite) testStream(c *C, network, address, location string) {
+	listener, err := net.Listen(network, address)
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		c.Check(err, IsNil)
+		defer conn.Close()
+		received <- readFramed(c, conn, len(expectedMessages))
+	}()
+
+	if location == "" {
+		location = fmt.Sprintf("%s://%s", network, listener.Addr())
+	}
+	client := newTestClient(c, location)
+	defer client.Close()
+	err = client.Flush(context.Background())
+	c.Assert(err, IsNil)
+
+	select {
+	case messages := <-received:
+		c.Assert(messages, DeepEquals, expectedMessages)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for messages")
+	}
+}
+
+func (s *suite) TestTCP(c *C) {
+	s.testStream(c, "tcp", "127.0.0.1:0", "")
+}
+
+func (s *suite) TestUnix(c *C) {
+	path := filepath.Join(c.MkDir(), "syslog.sock")
+	s.testStream(c, "unix", path, "unix://"+path)
+}
+
+func (*suite) TestUDP(c *C) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	client := newTestClient(c, "udp://"+conn.LocalAddr().String())
+	defer client.Close()
+	err = client.Flush(context.Background())
+	c.Assert(err, IsNil)
+
+	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	c.Assert(err, IsNil)
+	buf := make([]byte, 1024)
+	for _, expected := range expectedMessages {
+		n, _, err := conn.ReadFrom(buf)
+		c.Assert(err, IsNil)
+		c.Assert(string(buf[:n]), Equals, expected)
+	}
+}
+
+func (*suite) TestFlushRetainsLogsOnError(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	address := listener.Addr().String()
+	listener.Close()
+
+	// Nothing is listening, so the flush fails and the logs are kept.
+	client := newTestClient(c, "tcp://"+address)
+	defer client.Close()
+	err = client.Flush(context.Background())
+	c.Assert(err, NotNil)
+
+	listener, err = net.Listen("tcp", address)
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		c.Check(err, IsNil)
+		defer conn.Close()
+		received <- readFramed(c, conn, len(expectedMessages))
+	}()
+
+	err = client.Flush(context.Background())
+	c.Assert(err, IsNil)
+	select {
+	case messages := <-received:
+		c.Assert(messages, DeepEquals, expectedMessages)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for messages")
+	}
+}
+
+func (*suite) TestBufferFull(c *C) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	client, err := syslog.NewClientWithOptions(
+		&plan.LogTarget{Name: "tgt1", Location: "udp://" + conn.LocalAddr().String()},
+		&syslog.ClientOptions{Hostname: "host", MaxRequestEntries: 3},
+	)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	for i := 1; i <= 5; i++ {
+		err := client.Add(servicelog.Entry{
+			Time:    time.Date(2023, 12, 31, 12, 34, 50, 0, time.UTC),
+			Service: "svc1",
+			Message: fmt.Sprintf("log line #%d\n", i),
+		})
+		c.Assert(err, IsNil)
+	}
+	err = client.Flush(context.Background())
+	c.Assert(err, IsNil)
+
+	// Only the most recent 3 entries are kept.
+	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	c.Assert(err, IsNil)
+	buf := make([]byte, 1024)
+	for i := 3; i <= 5; i++ {
+		n, _, err := conn.ReadFrom(buf)
+		c.Assert(err, IsNil)
+		c.Assert(string(buf[:n]), Equals, fmt.Sprintf(
+			`<14>1 2023-12-31T12:34:50.000000Z host svc1 - - [pebble@28978 pebble_service="svc1"] log line #%d`, i))
+	}
+}
+
+func (*suite) TestInvalidLocation(c *C) {
+	for _, location := range []string{
+		"http://localhost:514",
+		"tcp://localhost",
+		"udp://",
+		"unix://",
+		"::",
+	} {
+		_, err := syslog.NewClient(&plan.LogTarget{Location: location})
+		c.Check(err, ErrorMatches, "invalid syslog location .*", Commentf("location %q", location))
+	}
+}
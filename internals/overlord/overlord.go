@@ -147,11 +147,12 @@ func New(opts *Options) (*Overlord, error) {
 	}
 	o.stateEng.AddManager(o.planMgr)
 
-	o.logMgr = logstate.NewLogManager()
+	o.logMgr = logstate.NewLogManager(o.pebbleDir)
 
 	o.serviceMgr, err = servstate.NewManager(
 		s,
 		o.runner,
+		o.pebbleDir,
 		opts.ServiceOutput,
 		opts.RestartHandler,
 		o.logMgr)
@@ -183,6 +184,9 @@ func New(opts *Options) (*Overlord, error) {
 	// Tell service manager about check failures.
 	o.checkMgr.NotifyCheckFailed(o.serviceMgr.CheckFailed)
 
+	// Let service manager wait for checks to be up before starting services.
+	o.serviceMgr.SetWaitChecks(o.checkMgr.WaitChecksUp)
+
 	if o.extension != nil {
 		extraManagers, err := o.extension.ExtraManagers(o)
 		if err != nil {
@@ -510,6 +514,12 @@ func (o *Overlord) CheckManager() *checkstate.CheckManager {
 	return o.checkMgr
 }
 
+// LogManager returns the log manager responsible for forwarding service
+// logs to log targets under the overlord.
+func (o *Overlord) LogManager() *logstate.LogManager {
+	return o.logMgr
+}
+
 // PlanManager returns the plan manager responsible for managing the global
 // system configuration
 func (o *Overlord) PlanManager() *planstate.PlanManager {
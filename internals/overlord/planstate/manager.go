@@ -176,8 +176,17 @@ func (m *PlanManager) updatePlanLayers(layers []*plan.Layer) (*plan.Plan, error)
 	if err != nil {
 		return nil, err
 	}
+	err = plan.ExpandInstances(combined)
+	if err != nil {
+		return nil, err
+	}
+	err = plan.ExpandVariables(combined)
+	if err != nil {
+		return nil, err
+	}
 	p := &plan.Plan{
 		Layers:     layers,
+		Variables:  combined.Variables,
 		Services:   combined.Services,
 		Checks:     combined.Checks,
 		LogTargets: combined.LogTargets,
@@ -0,0 +1,106 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package servstate
+
+import (
+	"os"
+
+	"github.com/canonical/pebble/internals/cgroup"
+	"github.com/canonical/pebble/internals/logger"
+	"github.com/canonical/pebble/internals/plan"
+)
+
+// cgroupsEnabled reports whether services should be placed in their own
+// cgroups. By default, this is only done when Pebble is the init process (of
+// a container, typically), as it then owns the cgroup it was started in.
+func cgroupsEnabled() bool {
+	switch os.Getenv("PEBBLE_CGROUPS") {
+	case "1":
+		return true
+	case "0":
+		return false
+	}
+	return os.Getpid() == 1
+}
+
+// newCgroupTree sets up the cgroup tree for services, returning nil if
+// cgroups aren't enabled or can't be used.
+func newCgroupTree() *cgroup.Tree {
+	if !cgroupsEnabled() {
+		return nil
+	}
+	tree, err := cgroup.NewTree()
+	if err != nil {
+		logger.Noticef("Cannot use cgroups for services: %v", err)
+		return nil
+	}
+	return tree
+}
+
+// setUpCgroup creates the service's cgroup (if cgroups are enabled), sets
+// its limits, and sets up s.cmd to start in it. The returned function must be
+// called after s.cmd has been started.
+func (s *serviceData) setUpCgroup() (started func(), err error) {
+	if s.manager.cgroups == nil {
+		if hasCgroupLimits(s.config) {
+			logger.Noticef("Service %q has cgroup limits, but cgroups are not enabled", s.config.Name)
+		}
+		return func() {}, nil
+	}
+	group, err := s.manager.cgroups.Service(s.config.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = group.SetLimits(&cgroup.Limits{
+		MemoryMax: s.config.MemoryMax.Value,
+		CPUWeight: intValue(s.config.CPUWeight),
+		CPUMax:    s.config.CPUMax.Value,
+		PidsMax:   intValue(s.config.PidsMax),
+	})
+	if err != nil {
+		return nil, err
+	}
+	started, err = group.Command(s.cmd)
+	if err != nil {
+		return nil, err
+	}
+	s.cgroup = group
+	return started, nil
+}
+
+// cgroupStats returns the resource usage of the service's cgroup, or nil if
+// it doesn't have one.
+func (s *serviceData) cgroupStats() *cgroup.Stats {
+	if s.cgroup == nil {
+		return nil
+	}
+	stats, err := s.cgroup.Stats()
+	if err != nil {
+		logger.Noticef("Cannot get resource usage of service %q: %v", s.config.Name, err)
+		return nil
+	}
+	return stats
+}
+
+func hasCgroupLimits(config *plan.Service) bool {
+	return config.MemoryMax.IsSet || config.CPUWeight != nil || config.CPUMax.IsSet || config.PidsMax != nil
+}
+
+func intValue(p *int) int {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
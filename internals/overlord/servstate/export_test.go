@@ -60,6 +60,17 @@ func (m *ServiceManager) Config(serviceName string) *plan.Service {
 	return s.config
 }
 
+func (m *ServiceManager) LogBufferSize(serviceName string) int {
+	m.servicesLock.Lock()
+	defer m.servicesLock.Unlock()
+
+	s := m.services[serviceName]
+	if s == nil {
+		return -1
+	}
+	return s.logs.Size()
+}
+
 func (m *ServiceManager) GetJitter(duration time.Duration) time.Duration {
 	return m.getJitter(duration)
 }
@@ -82,6 +93,14 @@ func FakeKillFailDelay(newKillDelay, newFailDelay time.Duration) (restore func()
 	}
 }
 
+func FakeActivationDelay(delay time.Duration) (restore func()) {
+	old := activationDelay
+	activationDelay = delay
+	return func() {
+		activationDelay = old
+	}
+}
+
 func FakeSetCmdCredential(f func(cmd *exec.Cmd, credential *syscall.Credential)) (restore func()) {
 	old := setCmdCredential
 	setCmdCredential = f
@@ -89,3 +108,10 @@ func FakeSetCmdCredential(f func(cmd *exec.Cmd, credential *syscall.Credential))
 		setCmdCredential = old
 	}
 }
+
+func (m *ServiceManager) SetNextRun(serviceName string, next time.Time) {
+	m.scheduleLock.Lock()
+	defer m.scheduleLock.Unlock()
+
+	m.schedules[serviceName].next = next
+}
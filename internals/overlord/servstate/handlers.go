@@ -1,25 +1,34 @@
 package servstate
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/canonical/x-go/strutil/shlex"
 	"golang.org/x/sys/unix"
 	"gopkg.in/tomb.v2"
 
+	"github.com/canonical/pebble/internals/cgroup"
 	"github.com/canonical/pebble/internals/logger"
 	"github.com/canonical/pebble/internals/osutil"
 	"github.com/canonical/pebble/internals/overlord/restart"
 	"github.com/canonical/pebble/internals/overlord/state"
 	"github.com/canonical/pebble/internals/plan"
 	"github.com/canonical/pebble/internals/reaper"
+	"github.com/canonical/pebble/internals/sandbox"
 	"github.com/canonical/pebble/internals/servicelog"
 )
 
@@ -59,8 +68,8 @@ var (
 	okayDelay = 1 * time.Second
 
 	// killDelayDefault is the duration afforded to services for processing
-	// SIGTERM signals and shutting down cleanly if the service hasn't specified
-	// their own duration.
+	// their stop signal (SIGTERM by default) or stop command and shutting down
+	// cleanly if the service hasn't specified their own duration.
 	killDelayDefault = 5 * time.Second
 
 	// failDelay is the duration given to services for shutting down when Pebble
@@ -68,9 +77,20 @@ var (
 	failDelay = 5 * time.Second
 )
 
+// errStoppedWhileStarting is sent to a service's start if the service is
+// stopped before it has started.
+var errStoppedWhileStarting = errors.New("stopped while starting")
+
 const (
-	maxLogBytes  = 100 * 1024
 	lastLogLines = 20
+
+	// defaultLogStoreSize is the maximum size of a service's on-disk log
+	// store if only log-store-age is specified.
+	defaultLogStoreSize = 64 * 1024 * 1024
+
+	// logStoreDirName is the directory (under the Pebble directory) holding
+	// the services' on-disk log stores.
+	logStoreDirName = "log-store"
 )
 
 // serviceState represents the state a service's state machine is in.
@@ -88,6 +108,7 @@ const (
 	stateStopped     serviceState = "stopped"
 	stateBackoff     serviceState = "backoff"
 	stateExited      serviceState = "exited"
+	stateCompleted   serviceState = "completed"
 )
 
 // serviceData holds the state and other data for a service under our control.
@@ -96,6 +117,8 @@ type serviceData struct {
 	state        serviceState
 	config       *plan.Service
 	logs         *servicelog.RingBuffer
+	logStore     *servicelog.Store
+	logStoreOpts servicelog.StoreOptions
 	started      chan error
 	stopped      chan error
 	cmd          *exec.Cmd
@@ -104,6 +127,32 @@ type serviceData struct {
 	resetTimer   *time.Timer
 	restarting   bool
 	currentSince time.Time
+
+	// logLimiter limits the rate of the current process's logs, and
+	// logsSuppressed counts the lines dropped by previous processes.
+	logLimiter     *servicelog.RateLimitWriter
+	logsSuppressed int64
+
+	// ran receives the exit code of the current scheduled run, if any.
+	ran chan int
+
+	// stopping is closed if the service is stopped while its pre-start
+	// hook is running.
+	stopping chan struct{}
+
+	// cgroup is the service's cgroup, if Pebble manages cgroups.
+	cgroup *cgroup.Group
+
+	// notify receives the current process's sd_notify messages, if the
+	// service has notify set, from root or the user with notifyUID (nil for
+	// the current user). statusText is the last STATUS sent, and
+	// readyTimedOut is set if the process was killed for not being ready
+	// within the start timeout.
+	notify        *net.UnixConn
+	notifyUID     *int
+	watchdogTimer *time.Timer
+	statusText    string
+	readyTimedOut bool
 }
 
 func (m *ServiceManager) doStart(task *state.Task, tomb *tomb.Tomb) error {
@@ -120,8 +169,15 @@ func (m *ServiceManager) doStart(task *state.Task, tomb *tomb.Tomb) error {
 		return fmt.Errorf("cannot find service %q in plan", request.Name)
 	}
 
+	// Wait for the checks the service depends on, such as a database's
+	// readiness check, before starting it.
+	err = m.waitForChecks(task, tomb, currentPlan, config)
+	if err != nil {
+		return err
+	}
+
 	// Create the service object (or reuse the existing one by name).
-	service, taskLog := m.serviceForStart(config)
+	service, created, taskLog := m.serviceForStart(config)
 	if taskLog != "" {
 		addTaskLog(task, taskLog)
 	}
@@ -129,8 +185,31 @@ func (m *ServiceManager) doStart(task *state.Task, tomb *tomb.Tomb) error {
 		return nil
 	}
 
+	err = runHook(task, tomb, config, "pre-start", config.PreStart, 0, service.stopping)
+	select {
+	case <-service.stopping:
+		// The service was stopped while its pre-start hook was running, so
+		// keep its state and logs.
+		return fmt.Errorf("cannot start service: %w", errStoppedWhileStarting)
+	default:
+	}
+	if err != nil {
+		if created {
+			m.removeService(config.Name)
+		} else {
+			// Keep the existing service's logs.
+			m.servicesLock.Lock()
+			service.transition(stateStopped)
+			m.servicesLock.Unlock()
+		}
+		return err
+	}
+
 	// Start the service and transition to stateStarting.
 	err = service.start()
+	if err == errStoppedWhileStarting {
+		return fmt.Errorf("cannot start service: %w", err)
+	}
 	if err != nil {
 		m.removeService(config.Name)
 		return err
@@ -140,12 +219,24 @@ func (m *ServiceManager) doStart(task *state.Task, tomb *tomb.Tomb) error {
 	// consider it a success.
 	select {
 	case err := <-service.started:
+		if err == errStoppedWhileStarting {
+			// The service is being stopped, so keep its state and logs.
+			return fmt.Errorf("cannot start service: %w", err)
+		}
 		if err != nil {
 			addLastLogs(task, service.logs)
 			m.removeService(config.Name)
 			return fmt.Errorf("cannot start service: %w", err)
 		}
 		// Started successfully (ran for small amount of time without exiting).
+		err = runHook(task, tomb, config, "post-start", config.PostStart, 0, nil)
+		if err != nil {
+			// Don't leave the service running if its start failed.
+			if service.stop() == nil {
+				<-service.stopped
+			}
+			return err
+		}
 		return nil
 	case <-tomb.Dying():
 		// User tried to abort the start, sending SIGKILL to process is about
@@ -153,7 +244,7 @@ func (m *ServiceManager) doStart(task *state.Task, tomb *tomb.Tomb) error {
 		m.removeService(config.Name)
 		m.servicesLock.Lock()
 		defer m.servicesLock.Unlock()
-		err := syscall.Kill(-service.cmd.Process.Pid, syscall.SIGKILL)
+		err := service.kill()
 		if err != nil {
 			return fmt.Errorf("start aborted, but cannot send SIGKILL to process: %v", err)
 		}
@@ -161,13 +252,77 @@ func (m *ServiceManager) doStart(task *state.Task, tomb *tomb.Tomb) error {
 	}
 }
 
+// waitForChecks waits until the checks the service waits for are up, or the
+// service's start timeout has elapsed. It returns immediately if the service
+// is already active.
+func (m *ServiceManager) waitForChecks(task *state.Task, tomb *tomb.Tomb, p *plan.Plan, config *plan.Service) error {
+	names := startChecks(p, config)
+	if len(names) == 0 || m.waitChecks == nil {
+		return nil
+	}
+	m.servicesLock.Lock()
+	service := m.services[config.Name]
+	active := service != nil && stateToStatus(service.state) == StatusActive
+	m.servicesLock.Unlock()
+	if active {
+		return nil
+	}
+
+	timeout := startTimeout(config)
+	addTaskLog(task, fmt.Sprintf("Waiting for checks to be up: %s", strings.Join(names, ", ")))
+	ctx, cancel := context.WithTimeout(tomb.Context(nil), timeout)
+	defer cancel()
+	err := m.waitChecks(ctx, names)
+	if err != nil {
+		if !tomb.Alive() {
+			return fmt.Errorf("start aborted while waiting for checks")
+		}
+		return fmt.Errorf("cannot start service: timed out after %s (%v)", timeout, err)
+	}
+	return nil
+}
+
+// startChecks returns the names of the checks that must be up before the
+// service is started: those in its wait-checks, and if wait-ready is set,
+// the ready-level checks in the on-check-failure of the services it requires.
+func startChecks(p *plan.Plan, config *plan.Service) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, name := range config.WaitChecks {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if !config.WaitReady.Value {
+		return names
+	}
+	var ready []string
+	for _, required := range config.Requires {
+		requiredConfig, ok := p.Services[required]
+		if !ok {
+			continue
+		}
+		for name := range requiredConfig.OnCheckFailure {
+			check, ok := p.Checks[name]
+			if ok && check.Level == plan.ReadyLevel && !seen[name] {
+				seen[name] = true
+				ready = append(ready, name)
+			}
+		}
+	}
+	sort.Strings(ready)
+	return append(names, ready...)
+}
+
 // serviceForStart looks up the service by name in the services map; it
 // creates a new service object if one doesn't exist, returns the existing one
 // if it already exists but is stopped, or returns nil if it already exists
 // and is running.
 //
-// It also returns a message to add to the task's log, or empty string if none.
-func (m *ServiceManager) serviceForStart(config *plan.Service) (service *serviceData, taskLog string) {
+// It also returns whether it created the service object, and a message to
+// add to the task's log, or empty string if none.
+func (m *ServiceManager) serviceForStart(config *plan.Service) (service *serviceData, created bool, taskLog string) {
 	m.servicesLock.Lock()
 	defer m.servicesLock.Unlock()
 
@@ -175,15 +330,18 @@ func (m *ServiceManager) serviceForStart(config *plan.Service) (service *service
 	if service == nil {
 		// Not already started, create a new service object.
 		service = &serviceData{
-			manager: m,
-			state:   stateInitial,
-			config:  config.Copy(),
-			logs:    servicelog.NewRingBuffer(maxLogBytes),
-			started: make(chan error, 1),
-			stopped: make(chan error, 2), // enough for killTimeElapsed to send, and exit if it happens after
+			manager:      m,
+			state:        stateInitial,
+			currentSince: time.Now(),
+			config:       config.Copy(),
+			logs:         servicelog.NewRingBuffer(logBufferSize(config)),
+			started:      make(chan error, 1),
+			stopped:      make(chan error, 2), // enough for killTimeElapsed to send, and exit if it happens after
+			stopping:     make(chan struct{}),
 		}
 		m.services[config.Name] = service
-		return service, ""
+		m.updateLogStore(service)
+		return service, true, ""
 	}
 
 	// Ensure config is up-to-date from the plan whenever the user starts a service.
@@ -191,19 +349,99 @@ func (m *ServiceManager) serviceForStart(config *plan.Service) (service *service
 
 	switch service.state {
 	case stateInitial, stateStarting, stateRunning:
-		return nil, fmt.Sprintf("Service %q already started.", config.Name)
+		return nil, false, fmt.Sprintf("Service %q already started.", config.Name)
+	case stateCompleted:
+		return nil, false, fmt.Sprintf("Service %q already completed.", config.Name)
 	case stateBackoff, stateStopped, stateExited:
 		// Start allowed when service is backing off, was stopped, or has exited.
 		service.backoffNum = 0
 		service.backoffTime = 0
+		m.updateLogBuffer(service)
+		m.updateLogStore(service)
+		service.stopping = make(chan struct{})
 		service.transition(stateInitial)
-		return service, ""
+		return service, false, ""
 	default:
 		// Cannot start service while terminating or killing, handle in start().
-		return service, ""
+		return service, false, ""
 	}
 }
 
+func (m *ServiceManager) doRun(task *state.Task, tomb *tomb.Tomb) error {
+	m.state.Lock()
+	request, err := TaskServiceRequest(task)
+	m.state.Unlock()
+	if err != nil {
+		return err
+	}
+
+	currentPlan := m.getPlan()
+	config, ok := currentPlan.Services[request.Name]
+	if !ok {
+		return fmt.Errorf("cannot find service %q in plan", request.Name)
+	}
+
+	service, taskLog := m.serviceForRun(config)
+	if taskLog != "" {
+		addTaskLog(task, taskLog)
+	}
+	if service == nil {
+		return nil
+	}
+
+	// Run the command and wait for it to exit.
+	ran, err := service.run()
+	if err != nil {
+		m.removeService(config.Name)
+		return err
+	}
+	m.scheduledRunStarted(config.Name)
+
+	select {
+	case exitCode := <-ran:
+		m.scheduledRunExited(config.Name, exitCode)
+		if exitCode != 0 {
+			addLastLogs(task, service.logs)
+			return fmt.Errorf("service exited with code %d", exitCode)
+		}
+		return nil
+	case <-tomb.Dying():
+		// User tried to abort the run, sending SIGKILL to process is about
+		// the best we can do.
+		m.servicesLock.Lock()
+		defer m.servicesLock.Unlock()
+		err := service.kill()
+		if err != nil {
+			return fmt.Errorf("run aborted, but cannot send SIGKILL to process: %v", err)
+		}
+		return fmt.Errorf("run aborted, sent SIGKILL to process")
+	}
+}
+
+// serviceForRun is like serviceForStart, but it also returns nil if the
+// service is still stopping, so that a scheduled run doesn't overlap with
+// the previous one.
+func (m *ServiceManager) serviceForRun(config *plan.Service) (service *serviceData, taskLog string) {
+	m.servicesLock.Lock()
+	service = m.services[config.Name]
+	if service != nil {
+		switch service.state {
+		case stateTerminating, stateKilling:
+			m.servicesLock.Unlock()
+			return nil, fmt.Sprintf("Service %q is still stopping, skipping this run.", config.Name)
+		case stateCompleted:
+			// A oneshot service that has completed is run again.
+			service.transition(stateStopped)
+		}
+	}
+	m.servicesLock.Unlock()
+	service, _, taskLog = m.serviceForStart(config)
+	if service == nil {
+		taskLog = fmt.Sprintf("Service %q is still running, skipping this run.", config.Name)
+	}
+	return service, taskLog
+}
+
 func addTaskLog(task *state.Task, message string) {
 	st := task.State()
 	st.Lock()
@@ -228,8 +466,16 @@ func (m *ServiceManager) doStop(task *state.Task, tomb *tomb.Tomb) error {
 		return nil
 	}
 
-	// Stop service: send SIGTERM, and if that doesn't stop the process in a
-	// short time, send SIGKILL.
+	// The service is stopped even if its stop hooks fail, so just log
+	// their errors. Like the stop signal, they're given the kill delay
+	// to finish.
+	err = runHook(task, tomb, service.config, "pre-stop", service.config.PreStop, service.killDelay(), nil)
+	if err != nil {
+		logHookError(task, err)
+	}
+
+	// Stop service: send the stop signal (or run the stop command), and if
+	// that doesn't stop the process in a short time, send SIGKILL.
 	err = service.stop()
 	if err != nil {
 		return err
@@ -242,6 +488,10 @@ func (m *ServiceManager) doStop(task *state.Task, tomb *tomb.Tomb) error {
 				return fmt.Errorf("cannot stop service: %w", err)
 			}
 			// Stopped successfully.
+			err = runHook(task, tomb, service.config, "post-stop", service.config.PostStop, service.killDelay(), nil)
+			if err != nil {
+				logHookError(task, err)
+			}
 			return nil
 		case <-tomb.Dying():
 			// User tried to abort the stop, but SIGTERM and/or SIGKILL have
@@ -274,6 +524,9 @@ func (m *ServiceManager) serviceForStop(name string) (service *serviceData, task
 	case stateExited:
 		service.transition(stateStopped)
 		return nil, fmt.Sprintf("Service %q had already exited.", name)
+	case stateCompleted:
+		service.transition(stateStopped)
+		return nil, fmt.Sprintf("Service %q had already completed.", name)
 	default:
 		return service, ""
 	}
@@ -285,18 +538,159 @@ func (m *ServiceManager) removeService(name string) {
 	m.removeServiceInternal(name)
 }
 
+// updateLogBuffer replaces the service's log ring buffer if its size no
+// longer matches the service's configuration. Not concurrency-safe, please
+// lock m.servicesLock before calling.
+func (m *ServiceManager) updateLogBuffer(service *serviceData) {
+	size := logBufferSize(service.config)
+	if service.logs.Size() == size {
+		return
+	}
+	name := service.config.Name
+	if service.logStore != nil {
+		// The store writes to the ring buffer, so it's reopened with the
+		// new one by updateLogStore.
+		err := service.logStore.Close()
+		if err != nil {
+			logger.Noticef("Error closing service %q log store: %v", name, err)
+		}
+		service.logStore = nil
+	}
+	err := service.logs.Close()
+	if err != nil {
+		logger.Noticef("Error closing service %q ring buffer: %v", name, err)
+	}
+	service.logs = servicelog.NewRingBuffer(size)
+}
+
+// logBufferSize returns the size of the service's log ring buffer.
+func logBufferSize(config *plan.Service) int {
+	if config.LogBufferSize.IsSet {
+		return int(config.LogBufferSize.Value)
+	}
+	return plan.DefaultLogBufferSize
+}
+
+// updateLogStore opens, reopens, or closes the service's on-disk log store
+// so that it matches the service's configuration. Not concurrency-safe,
+// please lock m.servicesLock before calling.
+func (m *ServiceManager) updateLogStore(service *serviceData) {
+	name := service.config.Name
+	options := logStoreOptions(service.config)
+	if service.logStore != nil && (options == nil || *options != service.logStoreOpts) {
+		err := service.logStore.Close()
+		if err != nil {
+			logger.Noticef("Error closing service %q log store: %v", name, err)
+		}
+		service.logStore = nil
+	}
+	if options == nil || service.logStore != nil {
+		return
+	}
+	store, err := servicelog.OpenStore(filepath.Join(m.logStoreDir, name), service.logs, options)
+	if err != nil {
+		logger.Noticef("Cannot open log store for service %q, storing logs in memory only: %v", name, err)
+		return
+	}
+	service.logStore = store
+	service.logStoreOpts = *options
+}
+
+// logStoreOptions returns the options for the service's on-disk log store,
+// or nil if it doesn't have one.
+func logStoreOptions(config *plan.Service) *servicelog.StoreOptions {
+	if !config.LogStoreSize.IsSet && !config.LogStoreAge.IsSet {
+		return nil
+	}
+	options := &servicelog.StoreOptions{
+		MaxSize: defaultLogStoreSize,
+		MaxAge:  config.LogStoreAge.Value,
+	}
+	if config.LogStoreSize.IsSet {
+		options.MaxSize = config.LogStoreSize.Value
+	}
+	return options
+}
+
+// logMultilineOptions returns the options for merging multi-line logs as
+// configured in the service's plan, or nil if it has no log-multiline policy.
+func logMultilineOptions(config *plan.Service) *servicelog.MultilineOptions {
+	if config.LogMultiline == nil {
+		return nil
+	}
+	options := &servicelog.MultilineOptions{
+		Indented: config.LogMultiline.Indented.Value,
+		MaxWait:  plan.DefaultLogMultilineMaxWait,
+	}
+	if config.LogMultiline.Continuation != "" {
+		// The pattern has already been validated when the plan was loaded.
+		options.Continuation = regexp.MustCompile(config.LogMultiline.Continuation)
+	}
+	if config.LogMultiline.MaxWait.IsSet {
+		options.MaxWait = config.LogMultiline.MaxWait.Value
+	}
+	return options
+}
+
+// logRateLimitOptions returns the options for limiting the rate of the
+// service's logs, or nil if it has no log-rate-limit.
+func logRateLimitOptions(config *plan.Service) *servicelog.RateLimitOptions {
+	if config.LogRateLimit == nil {
+		return nil
+	}
+	options := &servicelog.RateLimitOptions{
+		Interval: plan.DefaultLogRateLimitInterval,
+		Lines:    config.LogRateLimit.Lines,
+		Bytes:    config.LogRateLimit.Bytes.Value,
+		Burst:    config.LogRateLimit.Burst,
+	}
+	if config.LogRateLimit.Interval.IsSet {
+		options.Interval = config.LogRateLimit.Interval.Value
+	}
+	return options
+}
+
+// closeLogLimiter stops the rate limiter's timer, writing the marker for any
+// lines it has dropped.
+func closeLogLimiter(serviceName string, limiter *servicelog.RateLimitWriter) {
+	err := limiter.Close()
+	if err != nil {
+		logger.Noticef("Error closing service %q log rate limiter: %v", serviceName, err)
+	}
+}
+
+// suppressedLogs returns the total number of lines of the service's output
+// dropped by its log rate limit. Not concurrency-safe, please lock
+// m.servicesLock before calling.
+func (s *serviceData) suppressedLogs() int64 {
+	suppressed := s.logsSuppressed
+	if s.logLimiter != nil {
+		suppressed += s.logLimiter.Suppressed()
+	}
+	return suppressed
+}
+
 // not concurrency-safe, please lock m.servicesLock before calling
 func (m *ServiceManager) removeServiceInternal(name string) {
 	svc, svcExists := m.services[name]
 	if !svcExists {
 		return
 	}
+	if svc.logLimiter != nil {
+		closeLogLimiter(name, svc.logLimiter)
+	}
 	if svc.logs != nil {
 		err := svc.logs.Close()
 		if err != nil {
 			logger.Noticef("Error closing service %q ring buffer: %v", name, err)
 		}
 	}
+	if svc.logStore != nil {
+		err := svc.logStore.Close()
+		if err != nil {
+			logger.Noticef("Error closing service %q log store: %v", name, err)
+		}
+	}
 
 	delete(m.services, name)
 }
@@ -332,7 +726,20 @@ func (s *serviceData) start() error {
 			return err
 		}
 		s.transition(stateStarting)
-		time.AfterFunc(okayDelay, func() { logError(s.okayWaitElapsed()) })
+		switch {
+		case s.config.Notify.Value:
+			// A notify service is started once it notifies that it's ready.
+			cmd, timeout := s.cmd, startTimeout(s.config)
+			time.AfterFunc(timeout, func() { logError(s.readyTimeElapsed(cmd, timeout)) })
+		case s.config.Type != plan.OneshotServiceType:
+			// A oneshot service is started once it has exited, so it
+			// doesn't have an okay-wait period.
+			time.AfterFunc(okayDelay, func() { logError(s.okayWaitElapsed()) })
+		}
+
+	case stateStopped:
+		// The service was stopped just as its pre-start hook finished.
+		return errStoppedWhileStarting
 
 	default:
 		return fmt.Errorf("cannot start service while %s", s.state)
@@ -340,6 +747,28 @@ func (s *serviceData) start() error {
 	return nil
 }
 
+// run is called to transition from the initial state and run the service's
+// command once. It returns a channel that receives the command's exit code.
+func (s *serviceData) run() (<-chan int, error) {
+	s.manager.servicesLock.Lock()
+	defer s.manager.servicesLock.Unlock()
+
+	switch s.state {
+	case stateInitial:
+		err := s.startInternal()
+		if err != nil {
+			return nil, err
+		}
+		// The command is expected to exit, so there's no okay-wait period.
+		s.ran = make(chan int, 1)
+		s.transition(stateRunning)
+		return s.ran, nil
+
+	default:
+		return nil, fmt.Errorf("cannot run service while %s", s.state)
+	}
+}
+
 func logError(err error) {
 	if err != nil {
 		logger.Noticef("%s", err)
@@ -349,60 +778,39 @@ func logError(err error) {
 // startInternal is an internal helper used to actually start (or restart) the
 // command. It assumes the caller has ensures the service is in a valid state,
 // and it sets s.cmd and other relevant fields.
-func (s *serviceData) startInternal() error {
+func (s *serviceData) startInternal() (err error) {
 	base, extra, err := s.config.ParseCommand()
 	if err != nil {
 		return err
 	}
-	args := append(base, extra...)
-	s.cmd = exec.Command(args[0], args[1:]...)
-	s.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-
-	// Copy environment to avoid updating original.
-	environment := make(map[string]string)
-	for k, v := range s.config.Environment {
-		environment[k] = v
-	}
-
-	s.cmd.Dir = s.config.WorkingDir
-
-	// Start as another user if specified in plan.
-	uid, gid, err := osutil.NormalizeUidGid(s.config.UserID, s.config.GroupID, s.config.User, s.config.Group)
+	var env []string
+	socketNames, socketFiles, err := s.manager.serviceSocketFiles(s.config.Name)
 	if err != nil {
 		return err
 	}
-	if uid != nil && gid != nil {
-		isCurrent, err := osutil.IsCurrent(*uid, *gid)
+	if len(socketFiles) > 0 {
+		env = append(env, socketEnvironment(socketNames)...)
+	}
+	if s.config.Notify.Value {
+		notifyEnv, err := s.openNotify()
 		if err != nil {
-			logger.Debugf("Cannot determine if uid %d gid %d is current user", *uid, *gid)
+			return fmt.Errorf("cannot create notify socket: %w", err)
 		}
-		if !isCurrent {
-			setCmdCredential(s.cmd, &syscall.Credential{
-				Uid: uint32(*uid),
-				Gid: uint32(*gid),
-			})
-		}
-
-		// Also set HOME and USER if not explicitly specified in config.
-		if environment["HOME"] == "" || environment["USER"] == "" {
-			u, err := user.LookupId(strconv.Itoa(*uid))
+		defer func() {
 			if err != nil {
-				logger.Noticef("Cannot look up user %d: %v", *uid, err)
-			} else {
-				if environment["HOME"] == "" {
-					environment["HOME"] = u.HomeDir
-				}
-				if environment["USER"] == "" {
-					environment["USER"] = u.Username
-				}
+				s.closeNotify()
 			}
-		}
+		}()
+		env = append(env, notifyEnv...)
 	}
-
-	// Pass service description's environment variables to child process.
-	s.cmd.Env = os.Environ()
-	for k, v := range environment {
-		s.cmd.Env = append(s.cmd.Env, k+"="+v)
+	cmd, err := serviceCommand(s.config, append(base, extra...), env, socketFiles)
+	if err != nil {
+		return err
+	}
+	s.cmd = cmd
+	cgroupStarted, err := s.setUpCgroup()
+	if err != nil {
+		return fmt.Errorf("cannot set up cgroup: %w", err)
 	}
 
 	// Set up stdout and stderr to write to log ring buffer.
@@ -413,9 +821,25 @@ func (s *serviceData) startInternal() error {
 		outputIterator = s.logs.HeadIterator(0)
 	}
 	serviceName := s.config.Name
-	logWriter := servicelog.NewFormatWriter(s.logs, serviceName)
-	s.cmd.Stdout = logWriter
-	s.cmd.Stderr = logWriter
+	var logDest io.Writer = s.logs
+	if s.logStore != nil {
+		// Write logs to disk as well as the ring buffer.
+		logDest = s.logStore
+	}
+	if s.logLimiter != nil {
+		closeLogLimiter(serviceName, s.logLimiter)
+		s.logsSuppressed += s.logLimiter.Suppressed()
+		s.logLimiter = nil
+	}
+	if options := logRateLimitOptions(s.config); options != nil {
+		s.logLimiter = servicelog.NewRateLimitWriter(logDest, serviceName, options)
+		logDest = s.logLimiter
+	}
+	if options := logMultilineOptions(s.config); options != nil {
+		s.cmd.Stdout, s.cmd.Stderr = servicelog.NewMultilineFormatWriters(logDest, serviceName, options)
+	} else {
+		s.cmd.Stdout, s.cmd.Stderr = servicelog.NewFormatWriters(logDest, serviceName)
+	}
 
 	// Add WaitDelay to ensure cmd.Wait() returns in a reasonable timeframe if
 	// the goroutines that cmd.Start() uses to copy Stdin/Stdout/Stderr are
@@ -435,6 +859,7 @@ func (s *serviceData) startInternal() error {
 	// Start the process!
 	logger.Noticef("Service %q starting: %s", serviceName, s.config.Command)
 	err = reaper.StartCommand(s.cmd)
+	cgroupStarted()
 	if err != nil {
 		if outputIterator != nil {
 			_ = outputIterator.Close()
@@ -444,10 +869,14 @@ func (s *serviceData) startInternal() error {
 	}
 	logger.Debugf("Service %q started with PID %d", serviceName, s.cmd.Process.Pid)
 	s.resetTimer = time.AfterFunc(s.config.BackoffLimit.Value, func() { logError(s.backoffResetElapsed()) })
+	if s.notify != nil {
+		go s.readNotify(s.notify, cmd, s.notifyUID)
+		s.resetWatchdog()
+	}
 
 	// Start a goroutine to wait for the process to finish.
 	done := make(chan struct{})
-	cmd := s.cmd
+	logLimiter := s.logLimiter
 	go func() {
 		exitCode, waitErr := reaper.WaitCommand(cmd)
 		if waitErr != nil {
@@ -455,6 +884,11 @@ func (s *serviceData) startInternal() error {
 		} else {
 			logger.Debugf("Service %q exited with code %d.", serviceName, exitCode)
 		}
+		if logLimiter != nil {
+			// The process's output has all been written, so report
+			// any dropped lines now rather than after the interval.
+			closeLogLimiter(serviceName, logLimiter)
+		}
 		close(done)
 		err := s.exited(exitCode)
 		if err != nil {
@@ -481,6 +915,83 @@ func (s *serviceData) startInternal() error {
 	return nil
 }
 
+// serviceCommand returns a command to run args with the service's user,
+// group, environment, working directory and resource limits, in its own
+// process group. The command is also given the extra environment variables
+// and passed the socket files, if any.
+func serviceCommand(config *plan.Service, args []string, extraEnv []string, socketFiles []*os.File) (*exec.Cmd, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// Read the environment files each time, so that changes to them apply
+	// when the service is restarted. This also copies the environment to
+	// avoid updating the original.
+	environment, err := plan.LoadEnvironment(config.Environment, config.EnvironmentFiles, config.EnvironmentFromFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd.Dir = config.WorkingDir
+
+	// Start as another user if specified in plan.
+	uid, gid, err := osutil.NormalizeUidGid(config.UserID, config.GroupID, config.User, config.Group)
+	if err != nil {
+		return nil, err
+	}
+	if uid != nil && gid != nil {
+		isCurrent, err := osutil.IsCurrent(*uid, *gid)
+		if err != nil {
+			logger.Debugf("Cannot determine if uid %d gid %d is current user", *uid, *gid)
+		}
+		if !isCurrent {
+			setCmdCredential(cmd, &syscall.Credential{
+				Uid: uint32(*uid),
+				Gid: uint32(*gid),
+			})
+		}
+
+		// Also set HOME and USER if not explicitly specified in config.
+		if environment["HOME"] == "" || environment["USER"] == "" {
+			u, err := user.LookupId(strconv.Itoa(*uid))
+			if err != nil {
+				logger.Noticef("Cannot look up user %d: %v", *uid, err)
+			} else {
+				if environment["HOME"] == "" {
+					environment["HOME"] = u.HomeDir
+				}
+				if environment["USER"] == "" {
+					environment["USER"] = u.Username
+				}
+			}
+		}
+	}
+
+	// Pass service description's environment variables to child process.
+	cmd.Env = os.Environ()
+	for k, v := range environment {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Env = append(cmd.Env, extraEnv...)
+	cmd.ExtraFiles = socketFiles
+
+	// Apply resource limits and sandboxing before the program is executed.
+	err = sandbox.Command(cmd, &sandbox.Options{
+		Limits:           config.Limits,
+		NoNewPrivileges:  config.NoNewPrivileges.Value,
+		KeepCapabilities: config.KeepCapabilities,
+		DropCapabilities: config.DropCapabilities,
+		ReadOnlyPaths:    config.ReadOnlyPaths,
+		PrivateTmp:       config.PrivateTmp.Value,
+		Umask:            config.Umask,
+		SetListenPID:     len(socketFiles) > 0,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
 // okayWaitElapsed is called when the okay-wait timer has elapsed (and the
 // service is considered running successfully).
 func (s *serviceData) okayWaitElapsed() error {
@@ -507,13 +1018,51 @@ func (s *serviceData) exited(exitCode int) error {
 	if s.resetTimer != nil {
 		s.resetTimer.Stop()
 	}
+	s.closeNotify()
+	if s.ran != nil {
+		s.ran <- exitCode
+		s.ran = nil
+	}
 
 	switch s.state {
 	case stateStarting:
+		if s.config.Type == plan.OneshotServiceType {
+			if exitCode != 0 {
+				s.started <- fmt.Errorf("exited with code %d", exitCode)
+				s.transition(stateExited)
+				break
+			}
+			logger.Noticef("Service %q completed", s.config.Name)
+			s.started <- nil
+			s.transition(stateCompleted)
+			break
+		}
+		if s.readyTimedOut {
+			s.started <- fmt.Errorf("not ready after %s", startTimeout(s.config))
+			s.transition(stateExited)
+			break
+		}
+		if s.config.Schedule != "" && exitCode == 0 {
+			// Scheduled services are expected to exit.
+			s.started <- nil
+			s.transition(stateStopped)
+			break
+		}
 		s.started <- fmt.Errorf("exited quickly with code %d", exitCode)
 		s.transition(stateExited) // not strictly necessary as doStart will return, but doesn't hurt
 
 	case stateRunning:
+		if s.config.Schedule != "" {
+			// Scheduled services are expected to exit, and are run again
+			// according to their schedule rather than restarted.
+			logger.Noticef("Service %q exited with code %d", s.config.Name, exitCode)
+			if exitCode == 0 {
+				s.transition(stateStopped)
+			} else {
+				s.transition(stateExited)
+			}
+			break
+		}
 		logger.Noticef("Service %q stopped unexpectedly with code %d", s.config.Name, exitCode)
 		action, onType := getAction(s.config, exitCode == 0)
 		switch action {
@@ -556,6 +1105,13 @@ func (s *serviceData) exited(exitCode int) error {
 		}
 
 	case stateTerminating, stateKilling:
+		if s.cgroup != nil {
+			// Don't leave behind any processes the service started.
+			err := s.cgroup.Kill()
+			if err != nil {
+				logger.Noticef("Cannot kill remaining processes of service %q: %v", s.config.Name, err)
+			}
+		}
 		if s.restarting {
 			logger.Noticef("Service %q exited after check failure, restarting", s.config.Name)
 			s.doBackoff(plan.ActionRestart, "on-check-failure")
@@ -656,7 +1212,7 @@ func (s *serviceData) sendSignal(signal string) error {
 			return err
 		}
 
-	case stateBackoff, stateTerminating, stateKilling, stateStopped, stateExited:
+	case stateBackoff, stateTerminating, stateKilling, stateStopped, stateExited, stateCompleted:
 		return fmt.Errorf("service is not running")
 
 	default:
@@ -676,19 +1232,39 @@ func (s *serviceData) killDelay() time.Duration {
 	return killDelayDefault
 }
 
-// stop is called to stop a running (or backing off) service.
+// stop is called to stop a starting, running (or backing off) service, or
+// one whose pre-start hook is running.
 func (s *serviceData) stop() error {
 	s.manager.servicesLock.Lock()
 	defer s.manager.servicesLock.Unlock()
 
 	switch s.state {
-	case stateRunning:
-		logger.Debugf("Attempting to stop service %q by sending SIGTERM", s.config.Name)
-		// First send SIGTERM to try to terminate it gracefully.
-		err := syscall.Kill(-s.cmd.Process.Pid, syscall.SIGTERM)
-		if err != nil {
-			logger.Noticef("Cannot send SIGTERM to process: %v", err)
+	case stateInitial:
+		// The service's pre-start hook is running (a service only stays
+		// initial while it runs), so stop the hook rather than starting
+		// the service.
+		logger.Noticef("Service %q stopped while running its pre-start hook", s.config.Name)
+		if s.stopping != nil {
+			close(s.stopping)
 		}
+		s.stopped <- nil
+		s.transition(stateStopped)
+
+	case stateStarting:
+		// A oneshot service is starting until it exits, and a notify
+		// service until it's ready, so either may be stopped while its
+		// start is waiting. Stop reading a notify service's messages so
+		// that it can't become ready while it's stopping.
+		logger.Noticef("Service %q stopped while starting", s.config.Name)
+		s.started <- errStoppedWhileStarting
+		s.closeNotify()
+		s.terminate()
+		s.transition(stateTerminating)
+		time.AfterFunc(s.killDelay(), func() { logError(s.terminateTimeElapsed()) })
+
+	case stateRunning:
+		// First try to terminate it gracefully.
+		s.terminate()
 		s.transition(stateTerminating)
 		time.AfterFunc(s.killDelay(), func() { logError(s.terminateTimeElapsed()) })
 
@@ -703,6 +1279,89 @@ func (s *serviceData) stop() error {
 	return nil
 }
 
+// terminate asks the service to stop gracefully, by running its stop command
+// if it has one, or otherwise sending its stop signal (SIGTERM by default) to
+// its process group. Not concurrency-safe, please lock m.servicesLock before
+// calling.
+func (s *serviceData) terminate() {
+	if s.config.StopCommand != "" {
+		logger.Debugf("Attempting to stop service %q by running its stop command", s.config.Name)
+		err := s.startStopCommand()
+		if err == nil {
+			return
+		}
+		logger.Noticef("Cannot run stop command for service %q: %v", s.config.Name, err)
+	}
+	s.sendStopSignal()
+}
+
+// sendStopSignal sends the service's stop signal to its process group. Not
+// concurrency-safe, please lock m.servicesLock before calling.
+func (s *serviceData) sendStopSignal() {
+	signal := s.config.StopSignal
+	if signal == "" {
+		signal = "SIGTERM"
+	}
+	logger.Debugf("Attempting to stop service %q by sending %s", s.config.Name, signal)
+	err := syscall.Kill(-s.cmd.Process.Pid, unix.SignalNum(signal))
+	if err != nil {
+		logger.Noticef("Cannot send %s to process: %v", signal, err)
+	}
+}
+
+// startStopCommand starts the service's stop command, with its output written
+// to the service's logs. If the command fails, the service's stop signal is
+// sent instead. The command is killed if it's still running after the kill
+// delay. Not concurrency-safe, please lock m.servicesLock before calling.
+func (s *serviceData) startStopCommand() error {
+	args, err := shlex.Split(s.config.StopCommand)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("stop-command must not be empty")
+	}
+	cmd, err := serviceCommand(s.config, args, nil, nil)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout, cmd.Stderr = servicelog.NewFormatWriters(s.logs, s.config.Name)
+	cmd.WaitDelay = hookWaitDelay
+	err = reaper.StartCommand(cmd)
+	if err != nil {
+		return err
+	}
+
+	serviceCmd := s.cmd
+	killDelay := s.killDelay()
+	go func() {
+		timer := time.AfterFunc(killDelay, func() {
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		exitCode, err := reaper.WaitCommand(cmd)
+		timer.Stop()
+		if err == nil && exitCode > 0 {
+			err = fmt.Errorf("exit status %d", exitCode)
+		}
+		if err != nil {
+			s.stopCommandFailed(serviceCmd, err)
+		}
+	}()
+	return nil
+}
+
+// stopCommandFailed is called when the stop command fails, to send the stop
+// signal instead if the service's process is still terminating.
+func (s *serviceData) stopCommandFailed(serviceCmd *exec.Cmd, err error) {
+	s.manager.servicesLock.Lock()
+	defer s.manager.servicesLock.Unlock()
+
+	logger.Noticef("Stop command for service %q failed: %v", s.config.Name, err)
+	if s.state == stateTerminating && s.cmd == serviceCmd {
+		s.sendStopSignal()
+	}
+}
+
 // backoffTimeElapsed is called when the current backoff's timer has elapsed,
 // to restart the service.
 func (s *serviceData) backoffTimeElapsed() error {
@@ -724,8 +1383,9 @@ func (s *serviceData) backoffTimeElapsed() error {
 	return nil
 }
 
-// terminateTimeElapsed is called after stop sends SIGTERM and the service
-// still hasn't exited (and we then send SIGTERM).
+// terminateTimeElapsed is called after stop sends the stop signal (or runs
+// the stop command) and the service still hasn't exited (and we then send
+// SIGKILL).
 func (s *serviceData) terminateTimeElapsed() error {
 	s.manager.servicesLock.Lock()
 	defer s.manager.servicesLock.Unlock()
@@ -733,8 +1393,8 @@ func (s *serviceData) terminateTimeElapsed() error {
 	switch s.state {
 	case stateTerminating:
 		logger.Debugf("Attempting to stop service %q again by sending SIGKILL", s.config.Name)
-		// Process hasn't exited after SIGTERM, try SIGKILL.
-		err := syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL)
+		// Process hasn't exited after the stop signal, try SIGKILL.
+		err := s.kill()
 		if err != nil {
 			logger.Noticef("Cannot send SIGKILL to process: %v", err)
 		}
@@ -749,6 +1409,17 @@ func (s *serviceData) terminateTimeElapsed() error {
 	return nil
 }
 
+// kill sends SIGKILL to the service's process group and, if it has a
+// cgroup, to all the processes in that (including any that have left the
+// process group).
+func (s *serviceData) kill() error {
+	err := syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL)
+	if s.cgroup != nil {
+		err = s.cgroup.Kill()
+	}
+	return err
+}
+
 // killTimeElapsed is called some time after we've send SIGKILL to acknowledge
 // to stop's caller that we can't seem to stop the service.
 func (s *serviceData) killTimeElapsed() error {
@@ -816,10 +1487,7 @@ func (s *serviceData) checkFailed(action plan.ServiceAction) {
 			case stateRunning:
 				logger.Noticef("Service %q %s action is %q, terminating process before restarting",
 					s.config.Name, onType, action)
-				err := syscall.Kill(-s.cmd.Process.Pid, syscall.SIGTERM)
-				if err != nil {
-					logger.Noticef("Cannot send SIGTERM to process: %v", err)
-				}
+				s.terminate()
 				s.transitionRestarting(stateTerminating, true)
 				time.AfterFunc(s.killDelay(), func() { logError(s.terminateTimeElapsed()) })
 			case stateBackoff:
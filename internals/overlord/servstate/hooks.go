@@ -0,0 +1,140 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package servstate
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/canonical/x-go/strutil/shlex"
+	"gopkg.in/tomb.v2"
+
+	"github.com/canonical/pebble/internals/logger"
+	"github.com/canonical/pebble/internals/overlord/state"
+	"github.com/canonical/pebble/internals/plan"
+	"github.com/canonical/pebble/internals/reaper"
+	"github.com/canonical/pebble/internals/servicelog"
+)
+
+const (
+	// maxHookOutput is the size of the buffer holding a hook's output, the
+	// last lines of which are added to the task's log if the hook fails.
+	maxHookOutput = 4 * 1024
+
+	// hookWaitDelay is how long to wait for a hook's output to be copied
+	// after it exits (see exec.Cmd.WaitDelay).
+	hookWaitDelay = time.Second
+)
+
+// runHook runs the service's hook command of the given kind, for example
+// "pre-start", and waits for it to finish. It does nothing if command is
+// empty. If the hook fails, the last lines of its output are added to the
+// task's log. If the task is aborted, cancel is closed, or the hook is still
+// running after the timeout (if not zero), the hook is killed.
+func runHook(task *state.Task, tomb *tomb.Tomb, config *plan.Service, kind, command string, timeout time.Duration, cancel <-chan struct{}) error {
+	if command == "" {
+		return nil
+	}
+	args, err := shlex.Split(command)
+	if err != nil {
+		return fmt.Errorf("cannot parse %s command: %w", kind, err)
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%s command must not be empty", kind)
+	}
+	cmd, err := serviceCommand(config, args, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	// Send output to a ring buffer so we can show the last few lines of
+	// output on error.
+	ringBuffer := servicelog.NewRingBuffer(maxHookOutput)
+	defer ringBuffer.Close()
+	cmd.Stdout = ringBuffer
+	cmd.Stderr = ringBuffer
+	cmd.WaitDelay = hookWaitDelay
+
+	logger.Noticef("Service %q running %s hook: %s", config.Name, kind, command)
+	err = reaper.StartCommand(cmd)
+	if err != nil {
+		return fmt.Errorf("cannot start %s hook: %w", kind, err)
+	}
+
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+	done := make(chan struct{})
+	timedOut := make(chan struct{})
+	go func() {
+		select {
+		case <-tomb.Dying():
+			// The change was aborted, so kill the hook's process group.
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-timeoutChan:
+			close(timedOut)
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-cancel:
+			// The service was stopped, so kill the hook's process group.
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	exitCode, err := reaper.WaitCommand(cmd)
+	close(done)
+	select {
+	case <-timedOut:
+		err = fmt.Errorf("timed out after %s", timeout)
+	default:
+		if err == nil && exitCode > 0 {
+			err = fmt.Errorf("exit status %d", exitCode)
+		}
+	}
+	if err != nil {
+		addHookOutput(task, kind, ringBuffer)
+		return fmt.Errorf("%s hook failed: %w", kind, err)
+	}
+	return nil
+}
+
+// addHookOutput adds the last few lines of a hook's output to the task's log.
+func addHookOutput(task *state.Task, kind string, ringBuffer *servicelog.RingBuffer) {
+	st := task.State()
+	st.Lock()
+	defer st.Unlock()
+
+	output, err := servicelog.LastLines(ringBuffer, lastLogLines, "    ", false)
+	if err != nil {
+		task.Errorf("Cannot read %s hook output: %v", kind, err)
+	}
+	if output != "" {
+		task.Logf("Output of %s hook:\n%s", kind, output)
+	}
+}
+
+// logHookError logs the error of a hook whose failure doesn't fail the task.
+func logHookError(task *state.Task, err error) {
+	logger.Noticef("Cannot run hook: %v", err)
+
+	st := task.State()
+	st.Lock()
+	defer st.Unlock()
+	task.Errorf("%v", err)
+}
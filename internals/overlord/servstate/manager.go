@@ -1,14 +1,20 @@
 package servstate
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/canonical/pebble/internals/cgroup"
 	"github.com/canonical/pebble/internals/overlord/restart"
 	"github.com/canonical/pebble/internals/overlord/state"
 	"github.com/canonical/pebble/internals/plan"
@@ -27,32 +33,61 @@ type ServiceManager struct {
 	serviceOutput io.Writer
 	restarter     Restarter
 
+	// Directory holding the on-disk log stores of services which have one.
+	logStoreDir string
+
 	randLock sync.Mutex
 	rand     *rand.Rand
 
 	logMgr LogManager
+
+	// Schedules of the services with a schedule in the plan, by name.
+	scheduleLock sync.Mutex
+	schedules    map[string]*serviceSchedule
+	ensureDone   atomic.Bool
+
+	waitChecks WaitChecksFunc
+
+	// Sockets Pebble listens on for the services with sockets in the plan,
+	// by name, and the lazy-start services a connection has arrived for.
+	socketsLock sync.Mutex
+	sockets     map[string]*serviceSockets
+	activated   map[string]bool
+
+	// cgroups is the cgroup tree holding the services' cgroups, or nil if
+	// Pebble doesn't manage cgroups.
+	cgroups *cgroup.Tree
 }
 
 type LogManager interface {
 	ServiceStarted(service *plan.Service, logs *servicelog.RingBuffer)
 }
 
+// WaitChecksFunc is the type of function called to wait until the named
+// health checks are up.
+type WaitChecksFunc func(ctx context.Context, names []string) error
+
 type Restarter interface {
 	HandleRestart(t restart.RestartType)
 }
 
-func NewManager(s *state.State, runner *state.TaskRunner, serviceOutput io.Writer, restarter Restarter, logMgr LogManager) (*ServiceManager, error) {
+// NewManager creates a ServiceManager, which keeps the on-disk log stores of
+// services (if configured) under the given pebble directory.
+func NewManager(s *state.State, runner *state.TaskRunner, pebbleDir string, serviceOutput io.Writer, restarter Restarter, logMgr LogManager) (*ServiceManager, error) {
 	manager := &ServiceManager{
 		state:         s,
 		services:      make(map[string]*serviceData),
 		serviceOutput: serviceOutput,
 		restarter:     restarter,
+		logStoreDir:   filepath.Join(pebbleDir, logStoreDirName),
 		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
 		logMgr:        logMgr,
+		cgroups:       newCgroupTree(),
 	}
 
 	runner.AddHandler("start", manager.doStart, nil)
 	runner.AddHandler("stop", manager.doStop, nil)
+	runner.AddHandler("run", manager.doRun, nil)
 
 	return manager, nil
 }
@@ -62,6 +97,8 @@ func (m *ServiceManager) PlanChanged(plan *plan.Plan) {
 	m.planLock.Lock()
 	defer m.planLock.Unlock()
 	m.plan = plan
+	m.updateSchedules(plan)
+	m.updateSockets(plan)
 }
 
 // getPlan returns the current plan pointer in a concurrency-safe way. The
@@ -88,10 +125,14 @@ func (m *ServiceManager) Stop() {
 	for name := range m.services {
 		m.removeServiceInternal(name)
 	}
+	m.closeSockets()
 }
 
 // Ensure implements StateManager.Ensure.
 func (m *ServiceManager) Ensure() error {
+	m.ensureDone.Store(true)
+	m.ensureScheduled()
+	m.ensureActivated()
 	return nil
 }
 
@@ -100,6 +141,24 @@ type ServiceInfo struct {
 	Startup      ServiceStartup
 	Current      ServiceStatus
 	CurrentSince time.Time
+
+	// LogsSuppressed is the number of lines of output dropped by the
+	// service's log-rate-limit.
+	LogsSuppressed int64
+
+	// LastRun, LastExitCode, and NextRun are only set for services with a
+	// schedule. LastExitCode is nil until the last run has finished.
+	LastRun      time.Time
+	LastExitCode *int
+	NextRun      time.Time
+
+	// Usage is the resource usage of the service's cgroup, or nil if it
+	// doesn't have one (Pebble only manages cgroups in some environments).
+	Usage *cgroup.Stats
+
+	// StatusText is the last status sent by a service with notify set
+	// (using "STATUS=...").
+	StatusText string
 }
 
 type ServiceStartup string
@@ -112,10 +171,11 @@ const (
 type ServiceStatus string
 
 const (
-	StatusActive   ServiceStatus = "active"
-	StatusBackoff  ServiceStatus = "backoff"
-	StatusError    ServiceStatus = "error"
-	StatusInactive ServiceStatus = "inactive"
+	StatusActive    ServiceStatus = "active"
+	StatusBackoff   ServiceStatus = "backoff"
+	StatusError     ServiceStatus = "error"
+	StatusInactive  ServiceStatus = "inactive"
+	StatusCompleted ServiceStatus = "completed"
 )
 
 // Services returns the list of configured services and their status, sorted
@@ -126,7 +186,7 @@ func (m *ServiceManager) Services(names []string) ([]*ServiceInfo, error) {
 	defer m.servicesLock.Unlock()
 
 	requested := make(map[string]bool, len(names))
-	for _, name := range names {
+	for _, name := range currentPlan.ExpandInstanceNames(names) {
 		requested[name] = true
 	}
 
@@ -147,7 +207,11 @@ func (m *ServiceManager) Services(names []string) ([]*ServiceInfo, error) {
 		if s, ok := m.services[name]; ok {
 			info.Current = stateToStatus(s.state)
 			info.CurrentSince = s.currentSince
+			info.LogsSuppressed = s.suppressedLogs()
+			info.Usage = s.cgroupStats()
+			info.StatusText = s.statusText
 		}
+		m.addScheduleInfo(info)
 		services = append(services, info)
 	}
 	sort.Slice(services, func(i, j int) bool {
@@ -182,24 +246,28 @@ func (m *ServiceManager) StopTimeout() time.Duration {
 
 func stateToStatus(state serviceState) ServiceStatus {
 	switch state {
-	case stateStarting, stateRunning:
+	case stateInitial, stateStarting, stateRunning:
+		// A service is in stateInitial while its pre-start hook runs.
 		return StatusActive
 	case stateTerminating, stateKilling, stateStopped:
 		return StatusInactive
 	case stateBackoff:
 		return StatusBackoff
-	default: // stateInitial (should never happen) and stateExited
+	case stateCompleted:
+		return StatusCompleted
+	default: // stateExited
 		return StatusError
 	}
 }
 
 // DefaultServiceNames returns the name of the services set to start
-// by default.
+// by default. Lazy-start services are started when a connection arrives
+// on one of their sockets instead.
 func (m *ServiceManager) DefaultServiceNames() ([]string, error) {
 	currentPlan := m.getPlan()
 	var names []string
 	for name, service := range currentPlan.Services {
-		if service.Startup == plan.StartupEnabled {
+		if service.Startup == plan.StartupEnabled && !service.LazyStart.Value {
 			names = append(names, name)
 		}
 	}
@@ -226,7 +294,7 @@ func (m *ServiceManager) StopOrder(services []string) ([]string, error) {
 // going back last elements. Each iterator must be closed via the Close method.
 func (m *ServiceManager) ServiceLogs(services []string, last int) (map[string]servicelog.Iterator, error) {
 	requested := make(map[string]bool, len(services))
-	for _, name := range services {
+	for _, name := range m.getPlan().ExpandInstanceNames(services) {
 		requested[name] = true
 	}
 
@@ -251,6 +319,70 @@ func (m *ServiceManager) ServiceLogs(services []string, last int) (map[string]se
 	return iterators, nil
 }
 
+// ServiceLogsSince returns iterators to the provided services, which read
+// the logs written since the given time (and then follow any new logs). For
+// services with an on-disk log store, this reads the logs from disk and then
+// from memory, including services which haven't been started since the
+// Pebble daemon started. Otherwise, all the logs in memory are read, so the
+// caller must skip any logs before since. Each iterator must be closed via
+// the Close method.
+func (m *ServiceManager) ServiceLogsSince(services []string, since time.Time) (map[string]servicelog.Iterator, error) {
+	currentPlan := m.getPlan()
+
+	m.servicesLock.Lock()
+	defer m.servicesLock.Unlock()
+
+	iterators := make(map[string]servicelog.Iterator)
+	for _, name := range currentPlan.ExpandInstanceNames(services) {
+		service := m.services[name]
+		switch {
+		case service != nil && service.logStore != nil:
+			iterators[name] = service.logStore.Iterator(since)
+		case service != nil && service.logs != nil:
+			iterators[name] = service.logs.TailIterator()
+		case service == nil:
+			config, ok := currentPlan.Services[name]
+			if !ok {
+				continue
+			}
+			options := logStoreOptions(config)
+			if options == nil {
+				continue
+			}
+			it, err := servicelog.ReadStore(filepath.Join(m.logStoreDir, name), options, since)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				for _, it := range iterators {
+					_ = it.Close()
+				}
+				return nil, fmt.Errorf("cannot read log store for service %q: %w", name, err)
+			}
+			iterators[name] = it
+		}
+	}
+	return iterators, nil
+}
+
+// LogParsers returns the structured log parsers for those of the given
+// services which have a structured log-format configured in the plan.
+func (m *ServiceManager) LogParsers(services []string) map[string]*servicelog.StructuredParser {
+	currentPlan := m.getPlan()
+	parsers := make(map[string]*servicelog.StructuredParser)
+	for _, name := range currentPlan.ExpandInstanceNames(services) {
+		config, ok := currentPlan.Services[name]
+		if !ok {
+			continue
+		}
+		parser := servicelog.NewStructuredParser(string(config.LogFormat), config.LogFields)
+		if parser != nil {
+			parsers[name] = parser
+		}
+	}
+	return parsers
+}
+
 // Replan returns a list of services to stop and services to start because
 // their plans had changed between when they started and this call.
 func (m *ServiceManager) Replan() ([]string, []string, error) {
@@ -258,33 +390,54 @@ func (m *ServiceManager) Replan() ([]string, []string, error) {
 	m.servicesLock.Lock()
 	defer m.servicesLock.Unlock()
 
+	// The services are stopped in order of the dependencies they were
+	// started with, which also apply to the services that are no longer in
+	// the plan.
+	stopServices := make(map[string]*plan.Service, len(currentPlan.Services))
+	for name, config := range currentPlan.Services {
+		stopServices[name] = config
+	}
+
 	needsRestart := make(map[string]bool)
+	needsStop := make(map[string]bool)
 	var stop []string
 	for name, s := range m.services {
-		if config, ok := currentPlan.Services[name]; ok {
-			if config.Equal(s.config) {
-				continue
+		stopServices[name] = s.config
+		config, ok := currentPlan.Services[name]
+		if !ok {
+			// Such as an instance of a service whose instances were
+			// reduced, which is only stopped.
+			if s.state != stateStopped && s.state != stateExited && s.state != stateCompleted {
+				needsStop[name] = true
+				stop = append(stop, name)
 			}
-			s.config = config.Copy() // update service config from plan
+			continue
+		}
+		if config.Equal(s.config) {
+			continue
 		}
+		s.config = config.Copy() // update service config from plan
 		needsRestart[name] = true
+		needsStop[name] = true
 		stop = append(stop, name)
 	}
 
 	var start []string
 	for name, config := range currentPlan.Services {
-		if needsRestart[name] || config.Startup == plan.StartupEnabled {
+		if needsRestart[name] || (config.Startup == plan.StartupEnabled && !config.LazyStart.Value) {
 			start = append(start, name)
 		}
 	}
 
-	stop, err := currentPlan.StopOrder(stop)
+	stopPlan := &plan.Plan{Services: stopServices}
+	order, err := stopPlan.StopOrder(stop)
 	if err != nil {
 		return nil, nil, err
 	}
-	for i, name := range stop {
-		if !needsRestart[name] {
-			stop = append(stop[:i], stop[i+1:]...)
+	stop = stop[:0]
+	for _, name := range order {
+		if needsStop[name] {
+			stop = append(stop, name)
 		}
 	}
 
@@ -297,6 +450,7 @@ func (m *ServiceManager) Replan() ([]string, []string, error) {
 }
 
 func (m *ServiceManager) SendSignal(services []string, signal string) error {
+	services = m.getPlan().ExpandInstanceNames(services)
 	m.servicesLock.Lock()
 	defer m.servicesLock.Unlock()
 
@@ -319,6 +473,12 @@ func (m *ServiceManager) SendSignal(services []string, signal string) error {
 	return nil
 }
 
+// SetWaitChecks sets the function used to wait for the checks a service waits
+// for (see plan.Service.WaitChecks and WaitReady) before it's started.
+func (m *ServiceManager) SetWaitChecks(f WaitChecksFunc) {
+	m.waitChecks = f
+}
+
 // CheckFailed response to a health check failure. If the given check name is
 // in the on-check-failure map for a service, tell the service to perform the
 // configured action (for example, "restart").
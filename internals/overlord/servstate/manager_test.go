@@ -16,8 +16,10 @@ package servstate_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
@@ -34,6 +36,7 @@ import (
 	"golang.org/x/sys/unix"
 	. "gopkg.in/check.v1"
 
+	"github.com/canonical/pebble/internals/cgroup"
 	"github.com/canonical/pebble/internals/logger"
 	"github.com/canonical/pebble/internals/overlord/checkstate"
 	"github.com/canonical/pebble/internals/overlord/restart"
@@ -42,6 +45,7 @@ import (
 	"github.com/canonical/pebble/internals/plan"
 	"github.com/canonical/pebble/internals/reaper"
 	"github.com/canonical/pebble/internals/servicelog"
+	"github.com/canonical/pebble/internals/systemd"
 	"github.com/canonical/pebble/internals/testutil"
 )
 
@@ -52,6 +56,23 @@ const (
 )
 
 func TestMain(m *testing.M) {
+	// Used by the notify tests: send each argument as an sd_notify message,
+	// or sleep if it's a duration, and then wait to be killed.
+	if os.Getenv("PEBBLE_TEST_NOTIFY") == "1" {
+		for _, arg := range os.Args[1:] {
+			if d, err := time.ParseDuration(arg); err == nil {
+				time.Sleep(d)
+				continue
+			}
+			err := systemd.SdNotify(strings.ReplaceAll(arg, ",", "\n"))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot notify: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		select {}
+	}
+
 	// Used by TestReapZombies
 	if os.Getenv("PEBBLE_TEST_CREATE_CHILD") == "1" {
 		err := createZombie()
@@ -228,212 +249,1513 @@ func (s *S) TestDefaultServiceNames(c *C) {
 	s.planAddLayer(c, testPlanLayer)
 	s.planChanged(c)
 
-	services, err := s.manager.DefaultServiceNames()
+	services, err := s.manager.DefaultServiceNames()
+	c.Assert(err, IsNil)
+	c.Assert(services, DeepEquals, []string{"test1", "test2"})
+}
+
+func (s *S) TestStartStopServices(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, testPlanLayer)
+	s.planChanged(c)
+
+	s.startTestServices(c, true)
+
+	if c.Failed() {
+		return
+	}
+
+	s.stopTestServices(c)
+}
+
+func (s *S) TestStartStopServicesIdempotency(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, testPlanLayer)
+	s.planChanged(c)
+
+	s.startTestServices(c, true)
+	if c.Failed() {
+		return
+	}
+
+	// Do not check the logs again, the service
+	// is not actually restarted here.
+	s.startTestServices(c, false)
+	if c.Failed() {
+		return
+	}
+
+	s.stopTestServices(c)
+	if c.Failed() {
+		return
+	}
+
+	s.stopTestServicesAlreadyDead(c)
+}
+
+func (s *S) TestStopTimeout(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, testPlanLayer)
+	s.planAddLayer(c, `
+services:
+    test9:
+        override: merge
+        command: /bin/bash -c "sleep 20;"
+        kill-delay: 1h
+    test10:
+        override: merge
+        command: /bin/bash -c "sleep 20;"
+        kill-delay: 2h
+`)
+	s.planChanged(c)
+
+	_, _, err := s.manager.Replan()
+	c.Assert(err, IsNil)
+	s.startServices(c, []string{"test9"})
+	s.waitUntilService(c, "test9", func(service *servstate.ServiceInfo) bool {
+		return service.Current == servstate.StatusActive
+	})
+	c.Assert(s.manager.StopTimeout(), Equals, time.Minute*60+time.Millisecond*200)
+}
+
+func (s *S) TestKillDelayIsUsed(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, testPlanLayer)
+	s.planAddLayer(c, `
+services:
+    test6:
+        override: merge
+        command: /bin/bash -c "trap 'sleep 10' SIGTERM; sleep 20;"
+        kill-delay: 300ms
+`)
+	s.planChanged(c)
+
+	_, _, err := s.manager.Replan()
+	c.Assert(err, IsNil)
+
+	s.startServices(c, []string{"test6"})
+	s.waitUntilService(c, "test6", func(service *servstate.ServiceInfo) bool {
+		return service.Current == servstate.StatusActive
+	})
+
+	startTime := time.Now()
+	chg := s.stopServices(c, []string{"test6"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	s.waitUntilService(c, "test6", func(service *servstate.ServiceInfo) bool {
+		if service.Current == servstate.StatusInactive {
+			c.Assert(time.Now().Sub(startTime) > time.Millisecond*300, Equals, true)
+			return true
+		}
+		return false
+	})
+}
+
+func (s *S) TestReplanServices(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, testPlanLayer)
+	s.planChanged(c)
+
+	s.startTestServices(c, true)
+	if c.Failed() {
+		return
+	}
+
+	s.planAddLayer(c, `
+services:
+    test2:
+        override: merge
+        command: /bin/sh -c "echo test2b; sleep 10"
+`)
+	s.planChanged(c)
+
+	stops, starts, err := s.manager.Replan()
+	c.Assert(err, IsNil)
+	c.Check(stops, DeepEquals, []string{"test2"})
+	c.Check(starts, DeepEquals, []string{"test1", "test2"})
+
+	s.stopTestServices(c)
+}
+
+func (s *S) TestReplanUpdatesConfig(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, testPlanLayer)
+	s.planChanged(c)
+
+	s.startTestServices(c, true)
+	defer s.stopTestServices(c)
+
+	// Ensure the ServiceManager's config reflects the plan config.
+	config := s.manager.Config("test2")
+	c.Assert(config, NotNil)
+	c.Assert(config.OnSuccess, Equals, plan.ActionUnset)
+	c.Assert(config.Summary, Equals, "")
+	command := config.Command
+
+	// Add a layer and override a couple of values.
+	s.planAddLayer(c, `
+services:
+    test2:
+        override: merge
+        summary: A summary!
+        on-success: ignore
+`)
+	s.planChanged(c)
+
+	// Call Replan and ensure the ServiceManager's config has updated.
+	_, _, err := s.manager.Replan()
+	c.Assert(err, IsNil)
+	config = s.manager.Config("test2")
+	c.Assert(config, NotNil)
+	c.Check(config.OnSuccess, Equals, plan.ActionIgnore)
+	c.Check(config.Summary, Equals, "A summary!")
+	c.Check(config.Command, Equals, command)
+}
+
+func (s *S) TestStopStartUpdatesConfig(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, testPlanLayer)
+	s.planChanged(c)
+
+	s.startTestServices(c, true)
+	defer s.stopTestServices(c)
+
+	// Add a layer and override a couple of values.
+	s.planAddLayer(c, `
+services:
+    test2:
+        override: merge
+        summary: A summary!
+        on-success: ignore
+`)
+	s.planChanged(c)
+
+	// Call Stop and Start and ensure the ServiceManager's config has updated.
+	s.stopTestServices(c)
+	s.startTestServices(c, true)
+	config := s.manager.Config("test2")
+	c.Assert(config, NotNil)
+	c.Check(config.OnSuccess, Equals, plan.ActionIgnore)
+	c.Check(config.Summary, Equals, "A summary!")
+}
+
+func (s *S) TestServiceLogs(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, testPlanLayer)
+	s.planChanged(c)
+
+	outputs := map[string]string{
+		"test1": `2.* \[test1\] test1\n`,
+		"test2": `2.* \[test2\] test2\n`,
+	}
+	s.testServiceLogs(c, outputs)
+
+	// Run test again, but ensure the logs from the previous run are still in the ring buffer.
+	outputs["test1"] += outputs["test1"]
+	outputs["test2"] += outputs["test2"]
+	s.testServiceLogs(c, outputs)
+}
+
+func (s *S) TestServiceLogStore(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, testPlanLayer)
+	s.planAddLayer(c, `
+services:
+    test1:
+        override: merge
+        log-store-size: 1MiB
+`)
+	s.planChanged(c)
+
+	outputs := map[string]string{
+		"test1": `2.* \[test1\] test1\n`,
+		"test2": `2.* \[test2\] test2\n`,
+	}
+	s.testServiceLogs(c, outputs)
+
+	// The logs of test1 are stored on disk.
+	matches, err := filepath.Glob(filepath.Join(s.dir, "log-store", "test1", "*.log"))
+	c.Assert(err, IsNil)
+	c.Assert(matches, Not(HasLen), 0)
+	_, err = os.Stat(filepath.Join(s.dir, "log-store", "test2"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// After a restart of the daemon, the stored logs are still available.
+	s.manager.Stop()
+	s.newServiceManager(c)
+	s.planChanged(c)
+	iterators, err := s.manager.ServiceLogsSince([]string{"test1", "test2"}, time.Time{})
+	c.Assert(err, IsNil)
+	c.Assert(iterators, HasLen, 1)
+	it := iterators["test1"]
+	buf := &bytes.Buffer{}
+	for it.Next(nil) {
+		_, err = io.Copy(buf, it)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(buf.String(), Matches, outputs["test1"])
+	c.Assert(it.Close(), IsNil)
+
+	// Once started again, the stored logs are read before the new logs.
+	outputs["test1"] += outputs["test1"]
+	s.startTestServices(c, true)
+	iterators, err = s.manager.ServiceLogsSince([]string{"test1"}, time.Time{})
+	c.Assert(err, IsNil)
+	it = iterators["test1"]
+	buf.Reset()
+	for it.Next(nil) {
+		_, err = io.Copy(buf, it)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(buf.String(), Matches, outputs["test1"])
+	c.Assert(it.Close(), IsNil)
+	s.stopTestServices(c)
+}
+
+func (s *S) TestServiceLogMultiline(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, testPlanLayer)
+	s.planAddLayer(c, `
+services:
+    test1:
+        override: merge
+        command: /bin/sh -c "printf 'error\\n  at a\\n  at b\\ntest1\\n'; {{.NotifyDoneCheck}}; sleep 10"
+        log-multiline:
+            indented: true
+            max-wait: 10ms
+`)
+	s.planChanged(c)
+
+	s.startTestServices(c, true)
+	defer s.stopTestServices(c)
+
+	var messages []string
+	for i := 0; i < 100; i++ {
+		iterators, err := s.manager.ServiceLogs([]string{"test1"}, -1)
+		c.Assert(err, IsNil)
+		it := iterators["test1"]
+		parser := servicelog.NewParser(it, 1024)
+		messages = nil
+		for it.Next(nil) {
+			for parser.Next() {
+				messages = append(messages, parser.Entry().Message)
+			}
+		}
+		c.Assert(it.Close(), IsNil)
+		if len(messages) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(messages, DeepEquals, []string{"error\n  at a\n  at b\n", "test1\n"})
+}
+
+func (s *S) TestServiceLogRateLimit(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, testPlanLayer)
+	s.planAddLayer(c, `
+services:
+    test1:
+        override: merge
+        command: /bin/sh -c "echo test1; for i in 1 2 3 4 5; do echo \\$i; done; {{.NotifyDoneCheck}}; sleep 10"
+        log-buffer-size: 8KiB
+        log-rate-limit:
+            lines: 1
+            interval: 1h
+`)
+	s.planChanged(c)
+
+	s.startTestServices(c, true)
+
+	c.Check(s.manager.LogBufferSize("test1"), Equals, 8*1024)
+	c.Check(s.manager.LogBufferSize("test2"), Equals, 100*1024)
+
+	// The dropped lines aren't reported until the interval passes ...
+	c.Check(s.serviceLogMessages(c, "test1"), DeepEquals, []string{"test1\n"})
+
+	// ... or the process exits.
+	s.stopTestServices(c)
+	c.Check(s.serviceLogMessages(c, "test1"), DeepEquals, []string{"test1\n", "(5 lines suppressed)\n"})
+
+	services, err := s.manager.Services([]string{"test1"})
+	c.Assert(err, IsNil)
+	c.Assert(services, HasLen, 1)
+	c.Check(services[0].LogsSuppressed, Equals, int64(5))
+}
+
+// serviceLogMessages returns the messages in the service's log buffer.
+func (s *S) serviceLogMessages(c *C, name string) []string {
+	iterators, err := s.manager.ServiceLogs([]string{name}, -1)
+	c.Assert(err, IsNil)
+	it := iterators[name]
+	defer it.Close()
+	parser := servicelog.NewParser(it, 1024)
+	var messages []string
+	for it.Next(nil) {
+		for parser.Next() {
+			messages = append(messages, parser.Entry().Message)
+		}
+	}
+	return messages
+}
+
+func (s *S) TestWaitChecks(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, `
+services:
+    db:
+        override: replace
+        command: /bin/sh -c "sleep 10"
+        on-check-failure:
+            db-alive: restart
+            db-ready: restart
+    web:
+        override: replace
+        command: /bin/sh -c "sleep 10"
+        requires:
+            - db
+        wait-checks:
+            - cache-ready
+        wait-ready: true
+checks:
+    db-alive:
+        override: replace
+        level: alive
+        tcp:
+            port: 5432
+    db-ready:
+        override: replace
+        level: ready
+        tcp:
+            port: 5432
+    cache-ready:
+        override: replace
+        tcp:
+            port: 6379
+`)
+	s.planChanged(c)
+
+	checksUp := make(chan struct{})
+	var waitedFor []string
+	s.manager.SetWaitChecks(func(ctx context.Context, names []string) error {
+		waitedFor = names
+		select {
+		case <-checksUp:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("checks not up: %s", strings.Join(names, ", "))
+		}
+	})
+
+	s.st.Lock()
+	ts, err := servstate.Start(s.st, []string{"web"})
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("test", "Start test")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	// The service isn't started until the checks are up.
+	for i := 0; i < 10; i++ {
+		s.runner.Ensure()
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(s.serviceByName(c, "web").Current, Equals, servstate.StatusInactive)
+	close(checksUp)
+	waitChangeReady(c, s.runner, chg, "service to start")
+	defer s.stopServices(c, []string{"web"})
+
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	c.Check(chg.Tasks()[0].Log()[0], Matches, `.* Waiting for checks to be up: cache-ready, db-ready`)
+	s.st.Unlock()
+	c.Check(waitedFor, DeepEquals, []string{"cache-ready", "db-ready"})
+	c.Check(s.serviceByName(c, "web").Current, Equals, servstate.StatusActive)
+}
+
+func (s *S) TestWaitChecksTimeout(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, `
+services:
+    web:
+        override: replace
+        command: /bin/sh -c "sleep 10"
+        wait-checks:
+            - db-ready
+        start-timeout: 50ms
+checks:
+    db-ready:
+        override: replace
+        tcp:
+            port: 5432
+`)
+	s.planChanged(c)
+	s.manager.SetWaitChecks(func(ctx context.Context, names []string) error {
+		<-ctx.Done()
+		return fmt.Errorf("checks not up: %s", strings.Join(names, ", "))
+	})
+
+	chg := s.startServices(c, []string{"web"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.ErrorStatus)
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot start service: timed out after 50ms \(checks not up: db-ready\).*`)
+	s.st.Unlock()
+	c.Check(s.serviceByName(c, "web").Current, Equals, servstate.StatusInactive)
+}
+
+func (s *S) TestOneshotService(c *C) {
+	s.newServiceManager(c)
+	migrated := filepath.Join(s.dir, "migrated")
+	ok := filepath.Join(s.dir, "ok")
+	s.planAddLayer(c, fmt.Sprintf(`
+services:
+    migrate:
+        override: replace
+        command: /bin/sh -c "sleep 0.2; touch %[1]s"
+        type: oneshot
+    app:
+        override: replace
+        command: /bin/sh -c "[ -f %[1]s ] && touch %[2]s; sleep 10"
+        after:
+            - migrate
+        requires:
+            - migrate
+`, migrated, ok))
+	s.planChanged(c)
+
+	// The app is only started once the migration has completed.
+	order, err := s.manager.StartOrder([]string{"app"})
+	c.Assert(err, IsNil)
+	c.Assert(order, DeepEquals, []string{"migrate", "app"})
+	chg := s.startServices(c, order)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	defer s.stopServices(c, []string{"app"})
+
+	c.Check(s.serviceByName(c, "migrate").Current, Equals, servstate.StatusCompleted)
+	c.Check(s.serviceByName(c, "app").Current, Equals, servstate.StatusActive)
+	waitForDone(ok, func() {
+		c.Fatal("timeout waiting for app to see completed migration")
+	})
+
+	// Starting it again does nothing, as it has already completed.
+	chg = s.startServices(c, []string{"migrate"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus)
+	c.Check(chg.Tasks()[0].Log()[0], Matches, `.* Service "migrate" already completed.`)
+	s.st.Unlock()
+}
+
+func (s *S) TestOneshotServiceFailure(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, `
+services:
+    migrate:
+        override: replace
+        command: /bin/sh -c "sleep 0.1; echo failed; exit 2"
+        type: oneshot
+`)
+	s.planChanged(c)
+
+	chg := s.startServices(c, []string{"migrate"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.ErrorStatus)
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot start service: exited with code 2.*`)
+	s.st.Unlock()
+
+	c.Check(s.serviceByName(c, "migrate").Current, Equals, servstate.StatusInactive)
+}
+
+func (s *S) TestStopOneshotService(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, `
+services:
+    migrate:
+        override: replace
+        command: /bin/sh -c "sleep 10"
+        type: oneshot
+`)
+	s.planChanged(c)
+
+	// The oneshot service is starting until it exits, so stop it while
+	// its start is still waiting.
+	s.st.Lock()
+	ts, err := servstate.Start(s.st, []string{"migrate"})
+	c.Assert(err, IsNil)
+	startChg := s.st.NewChange("test", "Start test")
+	startChg.AddAll(ts)
+	s.st.Unlock()
+	s.runner.Ensure()
+	s.waitUntilService(c, "migrate", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusActive
+	})
+
+	stopChg := s.stopServices(c, []string{"migrate"})
+	s.st.Lock()
+	c.Check(stopChg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", stopChg.Err()))
+	s.st.Unlock()
+	waitChangeReady(c, s.runner, startChg, "service start to fail")
+	s.st.Lock()
+	c.Check(startChg.Err(), ErrorMatches, `(?s).*cannot start service: stopped while starting.*`)
+	s.st.Unlock()
+
+	c.Check(s.serviceByName(c, "migrate").Current, Equals, servstate.StatusInactive)
+}
+
+func (s *S) TestHooks(c *C) {
+	s.newServiceManager(c)
+	hooksLog := filepath.Join(s.dir, "hooks.log")
+	s.planAddLayer(c, fmt.Sprintf(`
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "sleep 10"
+        environment:
+            HOOK_VAR: var
+        pre-start: /bin/sh -c "sleep 0.1; echo pre-start $HOOK_VAR >>%[1]s"
+        post-start: /bin/sh -c "echo post-start >>%[1]s"
+        pre-stop: /bin/sh -c "echo pre-stop >>%[1]s"
+        post-stop: /bin/sh -c "echo post-stop >>%[1]s"
+`, hooksLog))
+	s.planChanged(c)
+
+	chg := s.startServices(c, []string{"test"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	data, err := os.ReadFile(hooksLog)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "pre-start var\npost-start\n")
+
+	chg = s.stopServices(c, []string{"test"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	data, err = os.ReadFile(hooksLog)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "pre-start var\npost-start\npre-stop\npost-stop\n")
+}
+
+func (s *S) TestPreStartHookFailure(c *C) {
+	s.newServiceManager(c)
+	started := filepath.Join(s.dir, "started")
+	s.planAddLayer(c, fmt.Sprintf(`
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "touch %s; sleep 10"
+        pre-start: /bin/sh -c "sleep 0.1; echo not ready; exit 3"
+`, started))
+	s.planChanged(c)
+
+	chg := s.startServices(c, []string{"test"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.ErrorStatus)
+	c.Check(chg.Err(), ErrorMatches, `(?s).*pre-start hook failed: exit status 3.*`)
+	c.Check(strings.Join(chg.Tasks()[0].Log(), "\n"), Matches, `(?s).*Output of pre-start hook:\n    not ready.*`)
+	s.st.Unlock()
+
+	c.Check(started, testutil.FileAbsent)
+	c.Check(s.serviceByName(c, "test").Current, Equals, servstate.StatusInactive)
+}
+
+func (s *S) TestPostStartHookFailure(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, `
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "sleep 10"
+        post-start: /bin/sh -c "exit 1"
+`)
+	s.planChanged(c)
+
+	chg := s.startServices(c, []string{"test"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.ErrorStatus)
+	c.Check(chg.Err(), ErrorMatches, `(?s).*post-start hook failed: exit status 1.*`)
+	s.st.Unlock()
+
+	c.Check(s.serviceByName(c, "test").Current, Equals, servstate.StatusInactive)
+}
+
+func (s *S) TestPreStartHookFailureKeepsLogs(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, `
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "echo first run; sleep 10"
+`)
+	s.planChanged(c)
+	s.startServices(c, []string{"test"})
+	s.stopServices(c, []string{"test"})
+
+	// Starting the existing service fails, but it keeps its logs.
+	s.planAddLayer(c, `
+services:
+    test:
+        override: merge
+        pre-start: /bin/sh -c "exit 3"
+`)
+	s.planChanged(c)
+	chg := s.startServices(c, []string{"test"})
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*pre-start hook failed: exit status 3.*`)
+	s.st.Unlock()
+	c.Check(s.serviceByName(c, "test").Current, Equals, servstate.StatusInactive)
+
+	iterators, err := s.manager.ServiceLogs([]string{"test"}, -1)
+	c.Assert(err, IsNil)
+	c.Assert(iterators, HasLen, 1)
+	it := iterators["test"]
+	defer it.Close()
+	buf := &bytes.Buffer{}
+	for it.Next(nil) {
+		_, err = io.Copy(buf, it)
+		c.Assert(err, IsNil)
+	}
+	c.Check(buf.String(), Matches, `2.* \[test\] first run\n`)
+}
+
+func (s *S) TestStopHookTimeout(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, `
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "sleep 10"
+        pre-stop: /bin/sh -c "sleep 10"
+        kill-delay: 200ms
+`)
+	s.planChanged(c)
+	s.startServices(c, []string{"test"})
+
+	// The hung pre-stop hook is killed after the kill delay, and the service
+	// is still stopped.
+	start := time.Now()
+	chg := s.stopServices(c, []string{"test"})
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus)
+	c.Check(strings.Join(chg.Tasks()[0].Log(), "\n"), Matches, `(?s).*pre-stop hook failed: timed out after 200ms.*`)
+	s.st.Unlock()
+	c.Check(s.serviceByName(c, "test").Current, Equals, servstate.StatusInactive)
+}
+
+func (s *S) TestStopDuringPreStartHook(c *C) {
+	s.newServiceManager(c)
+	hookStarted := filepath.Join(s.dir, "hook-started")
+	started := filepath.Join(s.dir, "started")
+	s.planAddLayer(c, fmt.Sprintf(`
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "touch %s; sleep 10"
+        pre-start: /bin/sh -c "touch %s; sleep 10"
+`, started, hookStarted))
+	s.planChanged(c)
+
+	s.st.Lock()
+	ts, err := servstate.Start(s.st, []string{"test"})
+	c.Assert(err, IsNil)
+	startChg := s.st.NewChange("test", "Start test")
+	startChg.AddAll(ts)
+	s.st.Unlock()
+	s.runner.Ensure()
+	waitForDone(hookStarted, func() {
+		c.Fatal("timeout waiting for pre-start hook")
+	})
+
+	// Stopping the service kills its pre-start hook, and it isn't started.
+	start := time.Now()
+	stopChg := s.stopServices(c, []string{"test"})
+	s.st.Lock()
+	c.Check(stopChg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", stopChg.Err()))
+	s.st.Unlock()
+	waitChangeReady(c, s.runner, startChg, "service start to fail")
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+	s.st.Lock()
+	c.Check(startChg.Err(), ErrorMatches, `(?s).*cannot start service: stopped while starting.*`)
+	s.st.Unlock()
+
+	c.Check(started, testutil.FileAbsent)
+	c.Check(s.serviceByName(c, "test").Current, Equals, servstate.StatusInactive)
+
+	// The service can be started again.
+	s.planAddLayer(c, `
+services:
+    test:
+        override: merge
+        pre-start: /bin/sh -c "true"
+`)
+	s.planChanged(c)
+	chg := s.startServices(c, []string{"test"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	s.stopServices(c, []string{"test"})
+}
+
+func (s *S) TestHooksNotRunOnAutoRestart(c *C) {
+	s.newServiceManager(c)
+	hooksLog := filepath.Join(s.dir, "hooks.log")
+	s.planAddLayer(c, fmt.Sprintf(`
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "sleep 10"
+        backoff-delay: 1ms
+        pre-start: /bin/sh -c "echo pre-start >>%[1]s"
+        post-start: /bin/sh -c "echo post-start >>%[1]s"
+        pre-stop: /bin/sh -c "echo pre-stop >>%[1]s"
+        post-stop: /bin/sh -c "echo post-stop >>%[1]s"
+`, hooksLog))
+	s.planChanged(c)
+	s.startServices(c, []string{"test"})
+
+	// The hooks are only run for starts and stops requested by a change, so
+	// not when the service exits unexpectedly or is restarted by Pebble.
+	err := s.manager.SendSignal([]string{"test"}, "SIGTERM")
+	c.Assert(err, IsNil)
+	s.waitUntilService(c, "test", func(svc *servstate.ServiceInfo) bool {
+		return s.manager.BackoffNum("test") == 1 && svc.Current == servstate.StatusActive
+	})
+	data, err := os.ReadFile(hooksLog)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "pre-start\npost-start\n")
+
+	s.stopServices(c, []string{"test"})
+	data, err = os.ReadFile(hooksLog)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "pre-start\npost-start\npre-stop\npost-stop\n")
+}
+
+func (s *S) TestStopSignal(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, `
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "trap 'echo got USR1; exit 0' USR1; sleep 10 & wait"
+        stop-signal: SIGUSR1
+`)
+	s.planChanged(c)
+
+	s.startServices(c, []string{"test"})
+	chg := s.stopServices(c, []string{"test"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+
+	c.Check(s.serviceByName(c, "test").Current, Equals, servstate.StatusInactive)
+	c.Check(s.readAndClearLogBuffer(), Matches, `(?s).*\[test\] got USR1\n.*`)
+}
+
+func (s *S) TestStopCommand(c *C) {
+	s.newServiceManager(c)
+	pidFile := filepath.Join(s.dir, "pid")
+	s.planAddLayer(c, fmt.Sprintf(`
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "echo $$ >%[1]s; exec sleep 10"
+        stop-command: /bin/sh -c "echo shutting down; kill $(cat %[1]s)"
+`, pidFile))
+	s.planChanged(c)
+
+	s.startServices(c, []string{"test"})
+	chg := s.stopServices(c, []string{"test"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+
+	c.Check(s.serviceByName(c, "test").Current, Equals, servstate.StatusInactive)
+	c.Check(s.readAndClearLogBuffer(), Matches, `(?s).*\[test\] shutting down\n.*`)
+}
+
+func (s *S) TestStopCommandFailure(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, `
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "trap 'echo got USR1; exit 0' USR1; sleep 10 & wait"
+        stop-signal: SIGUSR1
+        stop-command: /bin/sh -c "exit 1"
+`)
+	s.planChanged(c)
+
+	// The stop signal is sent when the stop command fails.
+	s.startServices(c, []string{"test"})
+	chg := s.stopServices(c, []string{"test"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+
+	c.Check(s.serviceByName(c, "test").Current, Equals, servstate.StatusInactive)
+	c.Check(s.readAndClearLogBuffer(), Matches, `(?s).*\[test\] got USR1\n.*`)
+}
+
+func (s *S) TestLimits(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, `
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "echo limits $(ulimit -Sn) $(ulimit -Hn); sleep 10"
+        limits:
+            nofile: 100:200
+`)
+	s.planChanged(c)
+
+	s.startServices(c, []string{"test"})
+	c.Check(s.readAndClearLogBuffer(), Matches, `(?s).*\[test\] limits 100 200\n.*`)
+}
+
+func (s *S) TestSandbox(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, `
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "echo sandbox $(umask) $(grep NoNewPrivs /proc/self/status); sleep 10"
+        no-new-privileges: true
+        umask: "0027"
+`)
+	s.planChanged(c)
+
+	s.startServices(c, []string{"test"})
+	c.Check(s.readAndClearLogBuffer(), Matches, `(?s).*\[test\] sandbox 0027 NoNewPrivs: 1\n.*`)
+}
+
+func (s *S) TestSockets(c *C) {
+	s.newServiceManager(c)
+	socketPath := filepath.Join(s.dir, "run", "test.sock")
+	s.planAddLayer(c, fmt.Sprintf(`
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "echo sockets $LISTEN_FDS $LISTEN_FDNAMES $LISTEN_PID $$ $(readlink /proc/self/fd/3); sleep 10"
+        sockets:
+            api:
+                listen: %s
+                mode: "0600"
+`, socketPath))
+	s.planChanged(c)
+
+	// The socket is listening before the service starts.
+	st, err := os.Stat(socketPath)
+	c.Assert(err, IsNil)
+	c.Check(st.Mode(), Equals, os.ModeSocket|0600)
+	conn, err := net.Dial("unix", socketPath)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	s.startServices(c, []string{"test"})
+	s.waitUntilService(c, "test", func(svc *servstate.ServiceInfo) bool {
+		return strings.Contains(s.readLogBuffer(), "sockets")
+	})
+	pid := s.manager.RunningCmds()["test"].Process.Pid
+	c.Check(s.readAndClearLogBuffer(), Matches, fmt.Sprintf(`(?s).*\[test\] sockets 1 api %[1]d %[1]d socket:\[\d+\]\n.*`, pid))
+
+	// The socket stays open while the service is stopped and restarted.
+	s.stopServices(c, []string{"test"})
+	conn2, err := net.Dial("unix", socketPath)
+	c.Assert(err, IsNil)
+	defer conn2.Close()
+	s.startServices(c, []string{"test"})
+	c.Check(s.serviceByName(c, "test").Current, Equals, servstate.StatusActive)
+
+	// The socket is closed and its file removed when it's removed from the plan.
+	s.planAddLayer(c, `
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "sleep 10"
+`)
+	s.planChanged(c)
+	c.Check(socketPath, testutil.FileAbsent)
+}
+
+func (s *S) TestLazyStart(c *C) {
+	restore := servstate.FakeActivationDelay(10 * time.Millisecond)
+	defer restore()
+	s.newServiceManager(c)
+	socketPath := filepath.Join(s.dir, "test.sock")
+	s.planAddLayer(c, fmt.Sprintf(`
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "sleep 10"
+        startup: enabled
+        lazy-start: true
+        sockets:
+            api:
+                listen: %s
+`, socketPath))
+	s.planChanged(c)
+
+	names, err := s.manager.DefaultServiceNames()
+	c.Assert(err, IsNil)
+	c.Check(names, HasLen, 0)
+	c.Check(s.serviceByName(c, "test").Current, Equals, servstate.StatusInactive)
+
+	// A connection starts the service.
+	conn, err := net.Dial("unix", socketPath)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	for i := 0; i < 300; i++ {
+		c.Assert(s.manager.Ensure(), IsNil)
+		s.runner.Ensure()
+		if s.serviceByName(c, "test").Current == servstate.StatusActive {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(s.serviceByName(c, "test").Current, Equals, servstate.StatusActive)
+
+	s.st.Lock()
+	changes := s.st.Changes()
+	s.st.Unlock()
+	c.Assert(changes, HasLen, 1)
+	c.Check(changes[0].Summary(), Equals, `Start service "test" on connection`)
+}
+
+func (s *S) TestNotify(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, fmt.Sprintf(`
+services:
+    test:
+        override: replace
+        command: %s 0.1s STATUS=Starting 0.3s READY=1,STATUS=Serving
+        notify: true
+        environment:
+            PEBBLE_TEST_NOTIFY: "1"
+`, os.Args[0]))
+	s.planChanged(c)
+
+	// The service isn't started until it notifies that it's ready, well
+	// after the okay-wait delay.
+	start := time.Now()
+	chg := s.startServices(c, []string{"test"})
+	c.Check(time.Since(start) >= 400*time.Millisecond, Equals, true)
+	s.st.Lock()
+	c.Check(chg.Err(), IsNil)
+	s.st.Unlock()
+	svc := s.serviceByName(c, "test")
+	c.Check(svc.Current, Equals, servstate.StatusActive)
+	c.Check(svc.StatusText, Equals, "Serving")
+}
+
+func (s *S) TestNotifyNotReady(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, fmt.Sprintf(`
+services:
+    test:
+        override: replace
+        command: %s 0.1s STATUS=Starting
+        notify: true
+        start-timeout: 300ms
+        environment:
+            PEBBLE_TEST_NOTIFY: "1"
+`, os.Args[0]))
+	s.planChanged(c)
+
+	chg := s.startServices(c, []string{"test"})
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot start service: not ready after 300ms.*`)
+	s.st.Unlock()
+}
+
+func (s *S) TestStopNotifyServiceWhileStarting(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, fmt.Sprintf(`
+services:
+    test:
+        override: replace
+        command: %s STATUS=Starting
+        notify: true
+        start-timeout: 10s
+        environment:
+            PEBBLE_TEST_NOTIFY: "1"
+`, os.Args[0]))
+	s.planChanged(c)
+
+	// The service never notifies that it's ready, so stop it while its
+	// start is waiting, well before the start timeout.
+	s.st.Lock()
+	ts, err := servstate.Start(s.st, []string{"test"})
 	c.Assert(err, IsNil)
-	c.Assert(services, DeepEquals, []string{"test1", "test2"})
+	startChg := s.st.NewChange("test", "Start test")
+	startChg.AddAll(ts)
+	s.st.Unlock()
+	s.runner.Ensure()
+	s.waitUntilService(c, "test", func(svc *servstate.ServiceInfo) bool {
+		return svc.StatusText == "Starting"
+	})
+
+	start := time.Now()
+	stopChg := s.stopServices(c, []string{"test"})
+	s.st.Lock()
+	c.Check(stopChg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", stopChg.Err()))
+	s.st.Unlock()
+	waitChangeReady(c, s.runner, startChg, "service start to fail")
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+	s.st.Lock()
+	c.Check(startChg.Err(), ErrorMatches, `(?s).*cannot start service: stopped while starting.*`)
+	s.st.Unlock()
+
+	c.Check(s.serviceByName(c, "test").Current, Equals, servstate.StatusInactive)
 }
 
-func (s *S) TestStartStopServices(c *C) {
+func (s *S) TestNotifyWatchdog(c *C) {
 	s.newServiceManager(c)
-	s.planAddLayer(c, testPlanLayer)
+	s.planAddLayer(c, fmt.Sprintf(`
+services:
+    test:
+        override: replace
+        command: %s 0.1s READY=1 0.1s WATCHDOG=1
+        notify: true
+        watchdog-timeout: 300ms
+        on-failure: ignore
+        environment:
+            PEBBLE_TEST_NOTIFY: "1"
+`, os.Args[0]))
 	s.planChanged(c)
 
-	s.startTestServices(c, true)
-
-	if c.Failed() {
-		return
-	}
+	start := time.Now()
+	s.startServices(c, []string{"test"})
+	c.Check(s.serviceByName(c, "test").Current, Equals, servstate.StatusActive)
 
-	s.stopTestServices(c)
+	// The service stops sending watchdog notifications, so it's killed (a
+	// watchdog-timeout after the last one) and handled as a failure.
+	s.waitUntilService(c, "test", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusError
+	})
+	c.Check(time.Since(start) >= 500*time.Millisecond, Equals, true)
 }
 
-func (s *S) TestStartStopServicesIdempotency(c *C) {
+func (s *S) TestInstances(c *C) {
 	s.newServiceManager(c)
-	s.planAddLayer(c, testPlanLayer)
+	s.planAddLayer(c, `
+services:
+    worker:
+        override: replace
+        command: /bin/sh -c "echo worker ${INSTANCE}; sleep 10"
+        startup: enabled
+        instances: 2
+`)
 	s.planChanged(c)
 
-	s.startTestServices(c, true)
-	if c.Failed() {
-		return
-	}
-
-	// Do not check the logs again, the service
-	// is not actually restarted here.
-	s.startTestServices(c, false)
-	if c.Failed() {
-		return
+	// Starting the template starts all its instances.
+	order, err := s.manager.StartOrder([]string{"worker"})
+	c.Assert(err, IsNil)
+	c.Check(order, DeepEquals, []string{"worker@1", "worker@2"})
+	s.startServices(c, order)
+	services, err := s.manager.Services([]string{"worker"})
+	c.Assert(err, IsNil)
+	c.Assert(services, HasLen, 2)
+	for _, svc := range services {
+		c.Check(svc.Current, Equals, servstate.StatusActive)
 	}
-
-	s.stopTestServices(c)
-	if c.Failed() {
-		return
+	for i := 0; i < 50; i++ {
+		if strings.Contains(s.readLogBuffer(), "[worker@2] worker 2\n") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
+	c.Check(s.readAndClearLogBuffer(), Matches, `(?s)(.*\[worker@1\] worker 1\n.*\[worker@2\] worker 2\n.*|.*\[worker@2\] worker 2\n.*\[worker@1\] worker 1\n.*)`)
+	pid := s.manager.RunningCmds()["worker@1"].Process.Pid
 
-	s.stopTestServicesAlreadyDead(c)
-}
-
-func (s *S) TestStopTimeout(c *C) {
-	s.newServiceManager(c)
-	s.planAddLayer(c, testPlanLayer)
+	// Scaling up only starts the new instance.
 	s.planAddLayer(c, `
 services:
-    test9:
-        override: merge
-        command: /bin/bash -c "sleep 20;"
-        kill-delay: 1h
-    test10:
+    worker:
         override: merge
-        command: /bin/bash -c "sleep 20;"
-        kill-delay: 2h
+        instances: 3
 `)
 	s.planChanged(c)
+	stops, starts, err := s.manager.Replan()
+	c.Assert(err, IsNil)
+	c.Check(stops, HasLen, 0)
+	c.Check(starts, DeepEquals, []string{"worker@1", "worker@2", "worker@3"})
+	s.startServices(c, starts)
+	c.Check(s.serviceByName(c, "worker@3").Current, Equals, servstate.StatusActive)
+	c.Check(s.manager.RunningCmds()["worker@1"].Process.Pid, Equals, pid)
 
-	_, _, err := s.manager.Replan()
+	// Scaling down only stops the removed instances.
+	s.planAddLayer(c, `
+services:
+    worker:
+        override: merge
+        instances: 1
+`)
+	s.planChanged(c)
+	stops, starts, err = s.manager.Replan()
 	c.Assert(err, IsNil)
-	s.startServices(c, []string{"test9"})
-	s.waitUntilService(c, "test9", func(service *servstate.ServiceInfo) bool {
-		return service.Current == servstate.StatusActive
-	})
-	c.Assert(s.manager.StopTimeout(), Equals, time.Minute*60+time.Millisecond*200)
+	c.Check(stops, DeepEquals, []string{"worker@2", "worker@3"})
+	c.Check(starts, DeepEquals, []string{"worker@1"})
+	s.stopServices(c, stops)
+	c.Check(s.manager.RunningCmds(), HasLen, 1)
+	c.Check(s.manager.RunningCmds()["worker@1"].Process.Pid, Equals, pid)
+
+	s.stopServices(c, []string{"worker@1"})
 }
 
-func (s *S) TestKillDelayIsUsed(c *C) {
+func (s *S) TestInstancesReplanStopOrder(c *C) {
 	s.newServiceManager(c)
-	s.planAddLayer(c, testPlanLayer)
 	s.planAddLayer(c, `
 services:
-    test6:
+    worker:
+        override: replace
+        command: /bin/sh -c "sleep 10"
+        startup: enabled
+        instances: 3
+    web:
+        override: replace
+        command: /bin/sh -c "sleep 10"
+        startup: enabled
+        requires: [worker]
+        after: [worker]
+`)
+	s.planChanged(c)
+	order, err := s.manager.StartOrder([]string{"web"})
+	c.Assert(err, IsNil)
+	c.Check(order, DeepEquals, []string{"worker@1", "worker@2", "worker@3", "web"})
+	s.startServices(c, order)
+
+	// The web service is restarted as its dependencies have changed, and
+	// it's stopped before the removed instances it was started after.
+	s.planAddLayer(c, `
+services:
+    worker:
         override: merge
-        command: /bin/bash -c "trap 'sleep 10' SIGTERM; sleep 20;"
-        kill-delay: 300ms
+        instances: 1
 `)
 	s.planChanged(c)
+	stops, starts, err := s.manager.Replan()
+	c.Assert(err, IsNil)
+	c.Check(stops, DeepEquals, []string{"web", "worker@2", "worker@3"})
+	c.Check(starts, DeepEquals, []string{"worker@1", "web"})
+	s.stopServices(c, stops)
+	s.startServices(c, starts)
 
-	_, _, err := s.manager.Replan()
+	s.stopServices(c, []string{"web", "worker@1"})
+}
+
+func (s *S) TestEnvironmentFiles(c *C) {
+	envFile := filepath.Join(s.dir, "env")
+	err := os.WriteFile(envFile, []byte("NAME=one\n"), 0644)
+	c.Assert(err, IsNil)
+	secretFile := filepath.Join(s.dir, "secret")
+	err = os.WriteFile(secretFile, []byte("s3cret\n"), 0600)
 	c.Assert(err, IsNil)
 
-	s.startServices(c, []string{"test6"})
-	s.waitUntilService(c, "test6", func(service *servstate.ServiceInfo) bool {
-		return service.Current == servstate.StatusActive
+	s.newServiceManager(c)
+	s.planAddLayer(c, fmt.Sprintf(`
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "sleep 0.1; echo env $NAME $SECRET; sleep 10"
+        environment-files:
+            - %s
+        environment-from-file:
+            SECRET: %s
+`, envFile, secretFile))
+	s.planChanged(c)
+
+	s.startServices(c, []string{"test"})
+	s.waitUntilService(c, "test", func(svc *servstate.ServiceInfo) bool {
+		return strings.Contains(s.readLogBuffer(), "[test] env")
 	})
+	c.Check(s.readAndClearLogBuffer(), Matches, `(?s).*\[test\] env one s3cret\n.*`)
+	s.stopServices(c, []string{"test"})
 
-	startTime := time.Now()
-	chg := s.stopServices(c, []string{"test6"})
+	// The files are read again when the service is restarted.
+	err = os.WriteFile(envFile, []byte("NAME=two\n"), 0644)
+	c.Assert(err, IsNil)
+	s.startServices(c, []string{"test"})
+	s.waitUntilService(c, "test", func(svc *servstate.ServiceInfo) bool {
+		return strings.Contains(s.readLogBuffer(), "[test] env")
+	})
+	c.Check(s.readAndClearLogBuffer(), Matches, `(?s).*\[test\] env two s3cret\n.*`)
+	s.stopServices(c, []string{"test"})
+
+	// The service can't start if a file can't be read.
+	err = os.Remove(secretFile)
+	c.Assert(err, IsNil)
+	chg := s.startServices(c, []string{"test"})
 	s.st.Lock()
-	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot read environment variable "SECRET" from file ".*": no such file or directory.*`)
 	s.st.Unlock()
-	s.waitUntilService(c, "test6", func(service *servstate.ServiceInfo) bool {
-		if service.Current == servstate.StatusInactive {
-			c.Assert(time.Now().Sub(startTime) > time.Millisecond*300, Equals, true)
-			return true
-		}
-		return false
-	})
 }
 
-func (s *S) TestReplanServices(c *C) {
+func (s *S) TestCgroups(c *C) {
+	root := c.MkDir()
+	restore := cgroup.FakeRoot(root, "/")
+	defer restore()
+	err := os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory pids"), 0644)
+	c.Assert(err, IsNil)
+	os.Setenv("PEBBLE_CGROUPS", "1")
+	defer os.Unsetenv("PEBBLE_CGROUPS")
+
 	s.newServiceManager(c)
-	s.planAddLayer(c, testPlanLayer)
+	groupDir := filepath.Join(root, "services", "test")
+	pidFile := filepath.Join(s.dir, "pid")
+	// The fake cgroup filesystem doesn't track the service's processes, so
+	// add the one started in another process group manually.
+	s.planAddLayer(c, fmt.Sprintf(`
+services:
+    test:
+        override: replace
+        command: /bin/sh -c "sleep 0.1; setsid /bin/sh -c 'echo $$ >> %[2]s/cgroup.procs; echo $$ > %[1]s; exec sleep 100' & sleep 100"
+        memory-max: 64MiB
+        cpu-max: 0.5
+        pids-max: 10
+`, pidFile, groupDir))
 	s.planChanged(c)
 
-	s.startTestServices(c, true)
-	if c.Failed() {
-		return
+	s.startServices(c, []string{"test"})
+	c.Check(filepath.Join(groupDir, "memory.max"), testutil.FileEquals, "67108864")
+	c.Check(filepath.Join(groupDir, "cpu.weight"), testutil.FileEquals, "100")
+	c.Check(filepath.Join(groupDir, "cpu.max"), testutil.FileEquals, "50000 100000")
+	c.Check(filepath.Join(groupDir, "pids.max"), testutil.FileEquals, "10")
+
+	err = os.WriteFile(filepath.Join(groupDir, "memory.current"), []byte("1024\n"), 0644)
+	c.Assert(err, IsNil)
+	svc := s.serviceByName(c, "test")
+	c.Check(svc.Usage, DeepEquals, &cgroup.Stats{MemoryCurrent: 1024})
+
+	var pid int
+	for i := 0; ; i++ {
+		data, err := os.ReadFile(pidFile)
+		if err == nil && len(data) > 0 {
+			pid, err = strconv.Atoi(strings.TrimSpace(string(data)))
+			c.Assert(err, IsNil)
+			break
+		}
+		if i >= 100 {
+			c.Fatalf("timed out waiting for pid file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stopping the service kills all the processes in its cgroup.
+	s.stopServices(c, []string{"test"})
+	for i := 0; syscall.Kill(pid, 0) == nil; i++ {
+		if i >= 500 {
+			c.Fatalf("timed out waiting for process in service's cgroup to be killed")
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
+}
 
+func (s *S) TestScheduledRun(c *C) {
+	s.newServiceManager(c)
 	s.planAddLayer(c, `
 services:
-    test2:
-        override: merge
-        command: /bin/sh -c "echo test2b; sleep 10"
+    job:
+        override: replace
+        command: /bin/sh -c "sleep 0.1; echo ran"
+        schedule: "03:00"
 `)
 	s.planChanged(c)
 
-	stops, starts, err := s.manager.Replan()
-	c.Assert(err, IsNil)
-	c.Check(stops, DeepEquals, []string{"test2"})
-	c.Check(starts, DeepEquals, []string{"test1", "test2"})
+	svc := s.serviceByName(c, "job")
+	c.Check(svc.LastRun.IsZero(), Equals, true)
+	c.Check(svc.LastExitCode, IsNil)
+	c.Check(svc.NextRun.After(time.Now()), Equals, true)
+	c.Check(svc.NextRun.Before(time.Now().Add(24*time.Hour)), Equals, true)
 
-	s.stopTestServices(c)
+	// Nothing is run until the service is due.
+	c.Assert(s.manager.Ensure(), IsNil)
+	s.st.Lock()
+	c.Check(s.st.Changes(), HasLen, 0)
+	s.st.Unlock()
+
+	s.manager.SetNextRun("job", time.Now())
+	c.Assert(s.manager.Ensure(), IsNil)
+	s.st.Lock()
+	changes := s.st.Changes()
+	c.Assert(changes, HasLen, 1)
+	chg := changes[0]
+	c.Check(chg.Kind(), Equals, "run")
+	c.Check(chg.Summary(), Equals, `Run service "job" on schedule`)
+	s.st.Unlock()
+
+	waitChangeReady(c, s.runner, chg, "service to run")
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+
+	svc = s.serviceByName(c, "job")
+	c.Check(svc.Current, Equals, servstate.StatusInactive)
+	c.Check(time.Since(svc.LastRun) < 10*time.Second, Equals, true)
+	c.Assert(svc.LastExitCode, NotNil)
+	c.Check(*svc.LastExitCode, Equals, 0)
+	c.Check(svc.NextRun.After(time.Now()), Equals, true)
 }
 
-func (s *S) TestReplanUpdatesConfig(c *C) {
+func (s *S) TestScheduledRunFailure(c *C) {
 	s.newServiceManager(c)
-	s.planAddLayer(c, testPlanLayer)
+	s.planAddLayer(c, `
+services:
+    job:
+        override: replace
+        command: /bin/sh -c "sleep 0.1; echo failing; exit 3"
+        schedule: "03:00"
+`)
 	s.planChanged(c)
 
-	s.startTestServices(c, true)
-	defer s.stopTestServices(c)
+	s.st.Lock()
+	ts, err := servstate.Run(s.st, []string{"job"})
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("run", "Run test")
+	chg.AddAll(ts)
+	s.st.Unlock()
+	waitChangeReady(c, s.runner, chg, "service to run")
 
-	// Ensure the ServiceManager's config reflects the plan config.
-	config := s.manager.Config("test2")
-	c.Assert(config, NotNil)
-	c.Assert(config.OnSuccess, Equals, plan.ActionUnset)
-	c.Assert(config.Summary, Equals, "")
-	command := config.Command
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.ErrorStatus)
+	c.Check(chg.Err(), ErrorMatches, `(?s).*service exited with code 3.*`)
+	c.Check(strings.Join(chg.Tasks()[0].Log(), "\n"), Matches, `(?s).*Most recent service output:\n    failing.*`)
+	s.st.Unlock()
 
-	// Add a layer and override a couple of values.
-	s.planAddLayer(c, `
+	svc := s.serviceByName(c, "job")
+	c.Check(svc.Current, Equals, servstate.StatusError)
+	c.Assert(svc.LastExitCode, NotNil)
+	c.Check(*svc.LastExitCode, Equals, 3)
+}
+
+func (s *S) TestScheduledRunOverlap(c *C) {
+	s.newServiceManager(c)
+	donePath := filepath.Join(s.dir, "done")
+	s.planAddLayer(c, fmt.Sprintf(`
 services:
-    test2:
-        override: merge
-        summary: A summary!
-        on-success: ignore
-`)
+    job:
+        override: replace
+        command: /bin/sh -c "while [ ! -f %s ]; do sleep 0.01; done"
+        schedule: "03:00"
+`, donePath))
 	s.planChanged(c)
 
-	// Call Replan and ensure the ServiceManager's config has updated.
-	_, _, err := s.manager.Replan()
+	run := func() *state.Change {
+		s.st.Lock()
+		defer s.st.Unlock()
+		ts, err := servstate.Run(s.st, []string{"job"})
+		c.Assert(err, IsNil)
+		chg := s.st.NewChange("run", "Run test")
+		chg.AddAll(ts)
+		return chg
+	}
+	chg1 := run()
+	for i := 0; i < 100 && s.serviceByName(c, "job").Current != servstate.StatusActive; i++ {
+		s.runner.Ensure()
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.serviceByName(c, "job").Current, Equals, servstate.StatusActive)
+
+	// The previous run hasn't finished, so this one is skipped.
+	chg2 := run()
+	waitChangeReady(c, s.runner, chg2, "run to be skipped")
+	s.st.Lock()
+	c.Check(chg2.Status(), Equals, state.DoneStatus)
+	c.Check(chg2.Tasks()[0].Log(), HasLen, 1)
+	c.Check(chg2.Tasks()[0].Log()[0], Matches, `.* Service "job" is still running, skipping this run.`)
+	c.Check(chg1.IsReady(), Equals, false)
+	s.st.Unlock()
+
+	err := os.WriteFile(donePath, nil, 0644)
 	c.Assert(err, IsNil)
-	config = s.manager.Config("test2")
-	c.Assert(config, NotNil)
-	c.Check(config.OnSuccess, Equals, plan.ActionIgnore)
-	c.Check(config.Summary, Equals, "A summary!")
-	c.Check(config.Command, Equals, command)
+	waitChangeReady(c, s.runner, chg1, "service to run")
+	s.st.Lock()
+	c.Check(chg1.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg1.Err()))
+	s.st.Unlock()
 }
 
-func (s *S) TestStopStartUpdatesConfig(c *C) {
+func (s *S) TestServiceLogStreams(c *C) {
 	s.newServiceManager(c)
 	s.planAddLayer(c, testPlanLayer)
+	s.planAddLayer(c, `
+services:
+    test1:
+        override: merge
+        command: /bin/sh -c "echo err >&2; echo test1; {{.NotifyDoneCheck}}; sleep 10"
+`)
 	s.planChanged(c)
 
 	s.startTestServices(c, true)
 	defer s.stopTestServices(c)
 
-	// Add a layer and override a couple of values.
+	iterators, err := s.manager.ServiceLogs([]string{"test1"}, -1)
+	c.Assert(err, IsNil)
+	it := iterators["test1"]
+	defer it.Close()
+	parser := servicelog.NewParser(it, 1024)
+	// The two streams are read concurrently, so their order isn't defined.
+	streams := make(map[string]string)
+	for it.Next(nil) {
+		for parser.Next() {
+			streams[parser.Entry().Message] = parser.Entry().Stream
+		}
+	}
+	c.Check(streams, DeepEquals, map[string]string{
+		"err\n":   servicelog.StderrStream,
+		"test1\n": servicelog.StdoutStream,
+	})
+}
+
+func (s *S) TestLogParsers(c *C) {
+	s.newServiceManager(c)
+	s.planAddLayer(c, testPlanLayer)
 	s.planAddLayer(c, `
 services:
+    test1:
+        override: merge
+        log-format: json
+        log-fields: [user]
     test2:
         override: merge
-        summary: A summary!
-        on-success: ignore
+        log-format: text
 `)
 	s.planChanged(c)
 
-	// Call Stop and Start and ensure the ServiceManager's config has updated.
-	s.stopTestServices(c)
-	s.startTestServices(c, true)
-	config := s.manager.Config("test2")
-	c.Assert(config, NotNil)
-	c.Check(config.OnSuccess, Equals, plan.ActionIgnore)
-	c.Check(config.Summary, Equals, "A summary!")
+	parsers := s.manager.LogParsers([]string{"test1", "test2", "unknown"})
+	c.Assert(parsers, HasLen, 1)
+	entry := servicelog.Entry{Message: `{"msg":"hi","level":"info","user":"bob"}` + "\n"}
+	parsers["test1"].Parse(&entry)
+	c.Check(entry.Message, Equals, "hi\n")
+	c.Check(entry.Level, Equals, "info")
+	c.Check(entry.Fields, DeepEquals, map[string]string{"user": "bob"})
 }
 
-func (s *S) TestServiceLogs(c *C) {
+func (s *S) TestLogParsersInstances(c *C) {
 	s.newServiceManager(c)
-	s.planAddLayer(c, testPlanLayer)
+	s.planAddLayer(c, `
+services:
+    worker:
+        override: replace
+        command: /bin/sh -c "sleep 10"
+        log-format: logfmt
+        instances: 2
+`)
 	s.planChanged(c)
 
-	outputs := map[string]string{
-		"test1": `2.* \[test1\] test1\n`,
-		"test2": `2.* \[test2\] test2\n`,
-	}
-	s.testServiceLogs(c, outputs)
+	// The parsers are keyed by the names of the instances, as the logs are.
+	parsers := s.manager.LogParsers([]string{"worker"})
+	c.Assert(parsers, HasLen, 2)
+	c.Assert(parsers["worker@1"], NotNil)
+	c.Assert(parsers["worker@2"], NotNil)
+	entry := servicelog.Entry{Message: "level=warn msg=hi\n"}
+	parsers["worker@2"].Parse(&entry)
+	c.Check(entry.Message, Equals, "hi\n")
+	c.Check(entry.Level, Equals, "warning")
 
-	// Run test again, but ensure the logs from the previous run are still in the ring buffer.
-	outputs["test1"] += outputs["test1"]
-	outputs["test2"] += outputs["test2"]
-	s.testServiceLogs(c, outputs)
+	parsers = s.manager.LogParsers([]string{"worker@1"})
+	c.Check(parsers, HasLen, 1)
+	c.Check(parsers["worker@1"], NotNil)
 }
 
 func (s *S) TestStartBadCommand(c *C) {
@@ -1696,7 +3018,7 @@ services:
 
 func (s *S) newServiceManager(c *C) {
 	var err error
-	s.manager, err = servstate.NewManager(s.st, s.runner, s.logOutput, testRestarter{s.stopDaemon}, fakeLogManager{})
+	s.manager, err = servstate.NewManager(s.st, s.runner, s.dir, s.logOutput, testRestarter{s.stopDaemon}, fakeLogManager{})
 	c.Assert(err, IsNil)
 }
 
@@ -1715,6 +3037,10 @@ func (s *S) planAddLayer(c *C, layerYAML string) {
 	layers := append(s.plan.Layers, layer)
 	combined, err := plan.CombineLayers(layers...)
 	c.Assert(err, IsNil)
+	err = plan.ExpandInstances(combined)
+	c.Assert(err, IsNil)
+	err = plan.ExpandVariables(combined)
+	c.Assert(err, IsNil)
 	s.plan = &plan.Plan{
 		Layers:     layers,
 		Services:   combined.Services,
@@ -0,0 +1,253 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package servstate
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/pebble/internals/logger"
+	"github.com/canonical/pebble/internals/osutil"
+	"github.com/canonical/pebble/internals/plan"
+)
+
+// openNotify creates the socket that the service's next process sends
+// sd_notify messages to (see sd_notify(3)), and returns the environment
+// variables that tell the process about it.
+//
+// The socket is in the abstract namespace, so that it can be reached from
+// a service with a private /tmp or read-only paths. Only messages from root
+// or the service's user are accepted.
+func (s *serviceData) openNotify() ([]string, error) {
+	uid, _, err := osutil.NormalizeUidGid(s.config.UserID, s.config.GroupID, s.config.User, s.config.Group)
+	if err != nil {
+		return nil, err
+	}
+	s.manager.randLock.Lock()
+	name := fmt.Sprintf("@pebble-notify-%016x", s.manager.rand.Uint64())
+	s.manager.randLock.Unlock()
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	rawConn, err := conn.SyscallConn()
+	if err == nil {
+		// Receive the sender's credentials with each message.
+		controlErr := rawConn.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PASSCRED, 1)
+		})
+		if controlErr != nil {
+			err = controlErr
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.notify = conn
+	s.notifyUID = uid
+	s.readyTimedOut = false
+	s.statusText = ""
+
+	env := []string{"NOTIFY_SOCKET=" + name}
+	if s.config.WatchdogTimeout.IsSet {
+		usec := s.config.WatchdogTimeout.Value.Microseconds()
+		env = append(env, "WATCHDOG_USEC="+strconv.FormatInt(usec, 10))
+	}
+	return env, nil
+}
+
+// closeNotify closes the service's notify socket, if any, and stops its
+// watchdog timer.
+func (s *serviceData) closeNotify() {
+	if s.notify != nil {
+		s.notify.Close()
+		s.notify = nil
+	}
+	if s.watchdogTimer != nil {
+		s.watchdogTimer.Stop()
+		s.watchdogTimer = nil
+	}
+}
+
+// readNotify reads the messages sent to the notify socket by the service's
+// process, until the socket is closed.
+func (s *serviceData) readNotify(conn *net.UnixConn, cmd *exec.Cmd, uid *int) {
+	buf := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(unix.SizeofUcred))
+	for {
+		n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Noticef("Cannot read notification from service %q: %v", s.config.Name, err)
+			}
+			return
+		}
+		if !notifyAllowed(oob[:oobn], uid) {
+			logger.Debugf("Ignoring notification for service %q from another user", s.config.Name)
+			continue
+		}
+		s.notified(cmd, string(buf[:n]))
+	}
+}
+
+// notifyAllowed reports whether a message with the given control data was
+// sent by root or the user with the given UID (or the current user, if nil).
+func notifyAllowed(oob []byte, uid *int) bool {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil || len(messages) == 0 {
+		return false
+	}
+	cred, err := unix.ParseUnixCredentials(&messages[0])
+	if err != nil {
+		return false
+	}
+	allowed := unix.Getuid()
+	if uid != nil {
+		allowed = *uid
+	}
+	return cred.Uid == 0 || int(cred.Uid) == allowed
+}
+
+// notified handles a message sent by the service's process to its notify
+// socket, which has a variable assignment such as "READY=1" on each line.
+func (s *serviceData) notified(cmd *exec.Cmd, message string) {
+	s.manager.servicesLock.Lock()
+	defer s.manager.servicesLock.Unlock()
+
+	if s.cmd != cmd {
+		// Sent by a previous process of the service.
+		return
+	}
+	for _, line := range strings.Split(message, "\n") {
+		name, value, _ := strings.Cut(line, "=")
+		switch name {
+		case "READY":
+			if value == "1" {
+				s.ready()
+			}
+		case "STATUS":
+			s.statusText = value
+		case "WATCHDOG":
+			switch value {
+			case "1":
+				s.resetWatchdog()
+			case "trigger":
+				s.watchdogFailed()
+			}
+		case "MAINPID":
+			// Pebble supervises the process it started, so the service
+			// can't change that.
+			logger.Debugf("Ignoring MAINPID notification from service %q", s.config.Name)
+		}
+	}
+}
+
+// ready is called when the service's process notifies that it's ready.
+func (s *serviceData) ready() {
+	switch s.state {
+	case stateStarting:
+		s.started <- nil
+		s.transition(stateRunning)
+		s.resetWatchdog()
+	}
+}
+
+// readyTimeElapsed is called when the start timeout has elapsed after the
+// service's process was started, to stop it if it hasn't notified that it's
+// ready.
+func (s *serviceData) readyTimeElapsed(cmd *exec.Cmd, timeout time.Duration) error {
+	s.manager.servicesLock.Lock()
+	defer s.manager.servicesLock.Unlock()
+
+	if s.cmd != cmd {
+		return nil
+	}
+	switch s.state {
+	case stateStarting:
+		logger.Noticef("Service %q not ready after %s, sending SIGKILL", s.config.Name, timeout)
+		s.readyTimedOut = true
+		err := s.kill()
+		if err != nil {
+			return fmt.Errorf("cannot send SIGKILL to process: %v", err)
+		}
+
+	default:
+		// Ignore if timer elapsed in any other state.
+		return nil
+	}
+	return nil
+}
+
+// resetWatchdog (re)starts the watchdog timer, if the service has a
+// watchdog-timeout.
+func (s *serviceData) resetWatchdog() {
+	if s.watchdogTimer != nil {
+		s.watchdogTimer.Stop()
+		s.watchdogTimer = nil
+	}
+	if !s.config.WatchdogTimeout.IsSet {
+		return
+	}
+	cmd := s.cmd
+	s.watchdogTimer = time.AfterFunc(s.config.WatchdogTimeout.Value, func() { logError(s.watchdogTimeElapsed(cmd)) })
+}
+
+// watchdogTimeElapsed is called when the service's process hasn't sent a
+// watchdog notification within its watchdog-timeout.
+func (s *serviceData) watchdogTimeElapsed(cmd *exec.Cmd) error {
+	s.manager.servicesLock.Lock()
+	defer s.manager.servicesLock.Unlock()
+
+	if s.cmd != cmd {
+		return nil
+	}
+	s.watchdogFailed()
+	return nil
+}
+
+// watchdogFailed kills the service's process, which is then handled as a
+// failure according to the service's on-failure action.
+func (s *serviceData) watchdogFailed() {
+	switch s.state {
+	case stateRunning:
+		logger.Noticef("Service %q watchdog timeout, sending SIGKILL", s.config.Name)
+		err := s.kill()
+		if err != nil {
+			logger.Noticef("Cannot send SIGKILL to process: %v", err)
+		}
+
+	default:
+		// The process isn't expected to send watchdog notifications while
+		// starting or stopping.
+		logger.Debugf("Service %q: ignoring watchdog timeout in state %s", s.config.Name, s.state)
+	}
+}
+
+// startTimeout returns how long to wait for the service to be ready.
+func startTimeout(config *plan.Service) time.Duration {
+	if config.StartTimeout.IsSet {
+		return config.StartTimeout.Value
+	}
+	return plan.DefaultStartTimeout
+}
@@ -47,6 +47,22 @@ func Stop(s *state.State, services []string) (*state.TaskSet, error) {
 	return state.NewTaskSet(tasks...), nil
 }
 
+// Run creates and returns a task set for running the given services' commands
+// once, as is done when they're due according to their schedules. Unlike
+// Start, the tasks wait for the commands to exit.
+func Run(s *state.State, services []string) (*state.TaskSet, error) {
+	var tasks []*state.Task
+	for _, name := range services {
+		task := s.NewTask("run", fmt.Sprintf("Run service %q", name))
+		req := ServiceRequest{
+			Name: name,
+		}
+		task.Set("service-request", &req)
+		tasks = append(tasks, task)
+	}
+	return state.NewTaskSet(tasks...), nil
+}
+
 // StopRunning creates and returns a task set for stopping all running
 // services. It returns a nil *TaskSet if there are no services to stop.
 func StopRunning(s *state.State, m *ServiceManager) (*state.TaskSet, error) {
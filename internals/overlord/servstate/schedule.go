@@ -0,0 +1,160 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package servstate
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/canonical/pebble/internals/logger"
+	"github.com/canonical/pebble/internals/plan"
+	"github.com/canonical/pebble/internals/timeutil"
+)
+
+// maxScheduleWait is the furthest ahead a scheduled run is looked for. If a
+// schedule has no run in that time, it's looked for again then.
+const maxScheduleWait = 366 * 24 * time.Hour
+
+// serviceSchedule holds the parsed schedule of a service, and the times of
+// its last and next runs.
+type serviceSchedule struct {
+	spec     string
+	schedule []*timeutil.Schedule
+	next     time.Time
+
+	lastRun      time.Time
+	lastExitCode *int
+}
+
+// updateSchedules updates the services' schedules to match the plan, keeping
+// the next run of those whose schedule is unchanged.
+func (m *ServiceManager) updateSchedules(p *plan.Plan) {
+	m.scheduleLock.Lock()
+	defer m.scheduleLock.Unlock()
+
+	schedules := make(map[string]*serviceSchedule)
+	for name, config := range p.Services {
+		if config.Schedule == "" {
+			continue
+		}
+		old := m.schedules[name]
+		if old != nil && old.spec == config.Schedule {
+			schedules[name] = old
+			continue
+		}
+		schedule, err := timeutil.ParseSchedule(config.Schedule)
+		if err != nil {
+			// Should never happen, as the plan has been validated.
+			logger.Noticef("Cannot parse schedule for service %q: %v", name, err)
+			continue
+		}
+		sched := &serviceSchedule{
+			spec:     config.Schedule,
+			schedule: schedule,
+			next:     nextRun(schedule),
+		}
+		if old != nil {
+			sched.lastRun = old.lastRun
+			sched.lastExitCode = old.lastExitCode
+		}
+		schedules[name] = sched
+	}
+	m.schedules = schedules
+
+	if m.ensureDone.Load() {
+		// Can't call EnsureBefore before Overlord.Loop is running (which
+		// will call m.Ensure for the first time).
+		m.state.EnsureBefore(0)
+	}
+}
+
+// nextRun returns the time of the next run after now according to the
+// schedule.
+func nextRun(schedule []*timeutil.Schedule) time.Time {
+	now := time.Now()
+	return now.Add(timeutil.Next(schedule, now, maxScheduleWait))
+}
+
+// ensureScheduled creates a change to run each service that's due according
+// to its schedule, and ensures that Ensure is called again for the next run.
+func (m *ServiceManager) ensureScheduled() {
+	m.scheduleLock.Lock()
+	now := time.Now()
+	var due []string
+	var soonest time.Time
+	for name, sched := range m.schedules {
+		if !sched.next.After(now) {
+			due = append(due, name)
+			sched.next = nextRun(sched.schedule)
+		}
+		if soonest.IsZero() || sched.next.Before(soonest) {
+			soonest = sched.next
+		}
+	}
+	m.scheduleLock.Unlock()
+
+	if len(due) > 0 {
+		sort.Strings(due)
+		m.state.Lock()
+		for _, name := range due {
+			taskSet, err := Run(m.state, []string{name})
+			if err != nil {
+				logger.Noticef("Cannot run service %q on schedule: %v", name, err)
+				continue
+			}
+			change := m.state.NewChange("run", fmt.Sprintf("Run service %q on schedule", name))
+			change.AddAll(taskSet)
+		}
+		m.state.Unlock()
+	}
+
+	if !soonest.IsZero() {
+		m.state.EnsureBefore(soonest.Sub(now))
+	}
+}
+
+// scheduledRunStarted records the start of a run of the service.
+func (m *ServiceManager) scheduledRunStarted(name string) {
+	m.scheduleLock.Lock()
+	defer m.scheduleLock.Unlock()
+	if sched, ok := m.schedules[name]; ok {
+		sched.lastRun = time.Now()
+		sched.lastExitCode = nil
+	}
+}
+
+// scheduledRunExited records the exit code of a run of the service.
+func (m *ServiceManager) scheduledRunExited(name string, exitCode int) {
+	m.scheduleLock.Lock()
+	defer m.scheduleLock.Unlock()
+	if sched, ok := m.schedules[name]; ok {
+		sched.lastExitCode = &exitCode
+	}
+}
+
+// addScheduleInfo sets the schedule fields of the service's info, if it has
+// a schedule.
+func (m *ServiceManager) addScheduleInfo(info *ServiceInfo) {
+	m.scheduleLock.Lock()
+	defer m.scheduleLock.Unlock()
+	sched, ok := m.schedules[info.Name]
+	if !ok {
+		return
+	}
+	info.LastRun = sched.lastRun
+	info.LastExitCode = sched.lastExitCode
+	info.NextRun = sched.next
+}
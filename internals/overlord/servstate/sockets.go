@@ -0,0 +1,394 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package servstate
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/pebble/internals/logger"
+	"github.com/canonical/pebble/internals/osutil"
+	"github.com/canonical/pebble/internals/plan"
+)
+
+// activationDelay is how long the lazy-start watcher of a service waits
+// after a connection arrives before checking its sockets again, giving the
+// service time to start and accept the connection.
+var activationDelay = time.Second
+
+// serviceSockets holds the sockets Pebble listens on for a service, which
+// are passed to each process of the service (see serviceCommand).
+type serviceSockets struct {
+	sockets []*listenSocket // sorted by name
+	lazy    bool
+
+	// stopWatch is closed to stop the lazy-start watcher, if any.
+	stopWatch chan struct{}
+}
+
+// listenSocket is a socket Pebble listens on. The file is nil if the socket
+// couldn't be opened.
+type listenSocket struct {
+	name   string
+	config plan.Socket
+	file   *os.File
+}
+
+// updateSockets opens and closes the services' sockets to match the plan.
+// Sockets whose configuration is unchanged are kept open, so connections
+// that are waiting to be accepted aren't lost.
+func (m *ServiceManager) updateSockets(p *plan.Plan) {
+	m.socketsLock.Lock()
+	defer m.socketsLock.Unlock()
+
+	// Close the changed sockets first, in case the new ones use the same
+	// address.
+	keep := make(map[string]*listenSocket)
+	for name, ss := range m.sockets {
+		ss.stopWatching()
+		config := p.Services[name]
+		for _, sock := range ss.sockets {
+			var socketConfig *plan.Socket
+			if config != nil {
+				socketConfig = config.Sockets[sock.name]
+			}
+			if socketConfig != nil && *socketConfig == sock.config && sock.file != nil {
+				keep[name+":"+sock.name] = sock
+			} else {
+				sock.close()
+			}
+		}
+	}
+
+	sockets := make(map[string]*serviceSockets)
+	for name, config := range p.Services {
+		if len(config.Sockets) == 0 {
+			continue
+		}
+		ss := &serviceSockets{lazy: config.LazyStart.Value}
+		for socketName, socketConfig := range config.Sockets {
+			sock := keep[name+":"+socketName]
+			if sock == nil {
+				sock = &listenSocket{name: socketName, config: *socketConfig}
+				err := sock.open()
+				if err != nil {
+					// The service's start will fail if it still can't be opened.
+					logger.Noticef("Cannot open socket %q for service %q: %v", socketName, name, err)
+				}
+			}
+			ss.sockets = append(ss.sockets, sock)
+		}
+		sort.Slice(ss.sockets, func(i, j int) bool {
+			return ss.sockets[i].name < ss.sockets[j].name
+		})
+		if ss.lazy {
+			ss.watch(m, name)
+		}
+		sockets[name] = ss
+	}
+	m.sockets = sockets
+}
+
+// closeSockets closes all the services' sockets.
+func (m *ServiceManager) closeSockets() {
+	m.socketsLock.Lock()
+	defer m.socketsLock.Unlock()
+	for _, ss := range m.sockets {
+		ss.stopWatching()
+		for _, sock := range ss.sockets {
+			sock.close()
+		}
+	}
+	m.sockets = nil
+}
+
+// serviceSocketFiles returns the names and files of the service's sockets,
+// opening any that couldn't be opened before.
+func (m *ServiceManager) serviceSocketFiles(name string) (names []string, files []*os.File, err error) {
+	m.socketsLock.Lock()
+	defer m.socketsLock.Unlock()
+	ss := m.sockets[name]
+	if ss == nil {
+		return nil, nil, nil
+	}
+	for _, sock := range ss.sockets {
+		if sock.file == nil {
+			err := sock.open()
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot open socket %q: %w", sock.name, err)
+			}
+		}
+		names = append(names, sock.name)
+		files = append(files, sock.file)
+	}
+	return names, files, nil
+}
+
+// open opens the socket and sets its ownership and permissions.
+func (sock *listenSocket) open() error {
+	network := "tcp"
+	if sock.config.IsUnix() {
+		network = "unix"
+		err := removeStaleSocket(sock.config.Listen)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(sock.config.Listen), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	listener, err := net.Listen(network, sock.config.Listen)
+	if err != nil {
+		return err
+	}
+	if l, ok := listener.(*net.UnixListener); ok {
+		// The file is removed by close, not when the listener is closed
+		// below (which leaves the duplicated socket listening).
+		l.SetUnlinkOnClose(false)
+	}
+	file, err := listener.(interface{ File() (*os.File, error) }).File()
+	listener.Close()
+	if err != nil {
+		return err
+	}
+	// Services expect blocking sockets, as systemd passes them by default.
+	err = unix.SetNonblock(int(file.Fd()), false)
+	if err == nil && sock.config.IsUnix() {
+		err = setSocketOwnership(&sock.config)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(sock.config.Listen)
+		return err
+	}
+	sock.file = file
+	return nil
+}
+
+// close closes the socket, removing the file of a Unix socket.
+func (sock *listenSocket) close() {
+	if sock.file == nil {
+		return
+	}
+	sock.file.Close()
+	sock.file = nil
+	if sock.config.IsUnix() {
+		os.Remove(sock.config.Listen)
+	}
+}
+
+// removeStaleSocket removes the Unix socket file at path, if any, unless
+// something is listening on it.
+func removeStaleSocket(path string) error {
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("address %q already in use", path)
+	}
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// setSocketOwnership sets the ownership and permissions of a Unix socket's
+// file.
+func setSocketOwnership(config *plan.Socket) error {
+	uid, gid := -1, -1
+	if config.User != "" {
+		u, g, err := osutil.NormalizeUidGid(nil, nil, config.User, config.Group)
+		if err != nil {
+			return err
+		}
+		uid, gid = *u, *g
+	} else if config.Group != "" {
+		g, err := user.LookupGroup(config.Group)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if uid != -1 || gid != -1 {
+		err := os.Chown(config.Listen, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+	mode := uint64(0666)
+	if config.Mode != "" {
+		var err error
+		mode, err = strconv.ParseUint(config.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid mode %q", config.Mode)
+		}
+	}
+	return os.Chmod(config.Listen, os.FileMode(mode))
+}
+
+// socketEnvironment returns the environment variables that pass the sockets
+// with the given names to a service, as its file descriptors from 3 on.
+// LISTEN_PID is set by the sandbox helper, as the PID isn't known yet.
+func socketEnvironment(names []string) []string {
+	return []string{
+		"LISTEN_FDS=" + strconv.Itoa(len(names)),
+		"LISTEN_FDNAMES=" + strings.Join(names, ":"),
+	}
+}
+
+// watch starts a goroutine that activates the service when a connection
+// arrives on one of its sockets. Each socket's file descriptor is
+// duplicated, so the goroutine can't use a descriptor that's been closed
+// (and perhaps reused) after stopWatching is called.
+func (ss *serviceSockets) watch(m *ServiceManager, name string) {
+	var fds []unix.PollFd
+	for _, sock := range ss.sockets {
+		if sock.file == nil {
+			continue
+		}
+		fd, err := unix.Dup(int(sock.file.Fd()))
+		if err != nil {
+			logger.Noticef("Cannot watch socket %q for service %q: %v", sock.name, name, err)
+			continue
+		}
+		fds = append(fds, unix.PollFd{Fd: int32(fd), Events: unix.POLLIN})
+	}
+	if len(fds) == 0 {
+		return
+	}
+	// The watcher polls the read end of a pipe as well as the sockets, so
+	// that stopWatching can wake it up by closing the write end.
+	r, w, err := os.Pipe()
+	if err != nil {
+		logger.Noticef("Cannot watch sockets for service %q: %v", name, err)
+		for _, pfd := range fds {
+			unix.Close(int(pfd.Fd))
+		}
+		return
+	}
+	stop := make(chan struct{})
+	ss.stopWatch = stop
+	go func() {
+		<-stop
+		w.Close()
+	}()
+	fds = append(fds, unix.PollFd{Fd: int32(r.Fd()), Events: unix.POLLIN})
+
+	go func() {
+		defer func() {
+			r.Close()
+			for _, pfd := range fds[:len(fds)-1] {
+				unix.Close(int(pfd.Fd))
+			}
+		}()
+		for {
+			_, err := unix.Poll(fds, -1)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				logger.Noticef("Cannot watch sockets for service %q: %v", name, err)
+				return
+			}
+			if fds[len(fds)-1].Revents != 0 {
+				return
+			}
+			m.socketActivated(name)
+			select {
+			case <-stop:
+				return
+			case <-time.After(activationDelay):
+			}
+		}
+	}()
+}
+
+// stopWatching stops the lazy-start watcher, if any.
+func (ss *serviceSockets) stopWatching() {
+	if ss.stopWatch != nil {
+		close(ss.stopWatch)
+		ss.stopWatch = nil
+	}
+}
+
+// socketActivated is called when a connection arrives on a socket of a
+// lazy-start service. It arranges for the service to be started, unless
+// it's already running (or being stopped or restarted).
+func (m *ServiceManager) socketActivated(name string) {
+	m.servicesLock.Lock()
+	s := m.services[name]
+	start := s == nil || s.state == stateStopped || s.state == stateExited
+	m.servicesLock.Unlock()
+	if !start {
+		return
+	}
+
+	m.socketsLock.Lock()
+	if m.activated == nil {
+		m.activated = make(map[string]bool)
+	}
+	m.activated[name] = true
+	m.socketsLock.Unlock()
+
+	if m.ensureDone.Load() {
+		m.state.EnsureBefore(0)
+	}
+}
+
+// ensureActivated creates a change to start each lazy-start service that
+// a connection has arrived for, along with the services it requires.
+func (m *ServiceManager) ensureActivated() {
+	m.socketsLock.Lock()
+	var names []string
+	for name := range m.activated {
+		names = append(names, name)
+	}
+	m.activated = nil
+	m.socketsLock.Unlock()
+	if len(names) == 0 {
+		return
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		order, err := m.StartOrder([]string{name})
+		if err != nil {
+			logger.Noticef("Cannot start service %q on connection: %v", name, err)
+			continue
+		}
+		m.state.Lock()
+		taskSet, err := Start(m.state, order)
+		if err != nil {
+			m.state.Unlock()
+			logger.Noticef("Cannot start service %q on connection: %v", name, err)
+			continue
+		}
+		change := m.state.NewChange("start", fmt.Sprintf("Start service %q on connection", name))
+		change.AddAll(taskSet)
+		m.state.Unlock()
+	}
+}
@@ -16,20 +16,28 @@ package plan
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/canonical/x-go/strutil/shlex"
+	"golang.org/x/sys/unix"
 	"gopkg.in/yaml.v3"
 
 	"github.com/canonical/pebble/internals/logger"
 	"github.com/canonical/pebble/internals/osutil"
+	"github.com/canonical/pebble/internals/rlimit"
+	"github.com/canonical/pebble/internals/sandbox"
+	"github.com/canonical/pebble/internals/timeutil"
 )
 
 const (
@@ -44,6 +52,7 @@ const (
 
 type Plan struct {
 	Layers     []*Layer              `yaml:"-"`
+	Variables  map[string]string     `yaml:"variables,omitempty"`
 	Services   map[string]*Service   `yaml:"services,omitempty"`
 	Checks     map[string]*Check     `yaml:"checks,omitempty"`
 	LogTargets map[string]*LogTarget `yaml:"log-targets,omitempty"`
@@ -54,6 +63,7 @@ type Layer struct {
 	Label       string                `yaml:"-"`
 	Summary     string                `yaml:"summary,omitempty"`
 	Description string                `yaml:"description,omitempty"`
+	Variables   map[string]string     `yaml:"variables,omitempty"`
 	Services    map[string]*Service   `yaml:"services,omitempty"`
 	Checks      map[string]*Check     `yaml:"checks,omitempty"`
 	LogTargets  map[string]*LogTarget `yaml:"log-targets,omitempty"`
@@ -67,12 +77,18 @@ type Service struct {
 	Startup     ServiceStartup `yaml:"startup,omitempty"`
 	Override    Override       `yaml:"override,omitempty"`
 	Command     string         `yaml:"command,omitempty"`
+	Type        ServiceType    `yaml:"type,omitempty"`
 
 	// Service dependencies
 	After    []string `yaml:"after,omitempty"`
 	Before   []string `yaml:"before,omitempty"`
 	Requires []string `yaml:"requires,omitempty"`
 
+	// Health checks to wait for before starting
+	WaitChecks   []string         `yaml:"wait-checks,omitempty"`
+	WaitReady    OptionalBool     `yaml:"wait-ready,omitempty"`
+	StartTimeout OptionalDuration `yaml:"start-timeout,omitempty"`
+
 	// Options for command execution
 	Environment map[string]string `yaml:"environment,omitempty"`
 	UserID      *int              `yaml:"user-id,omitempty"`
@@ -80,6 +96,36 @@ type Service struct {
 	GroupID     *int              `yaml:"group-id,omitempty"`
 	Group       string            `yaml:"group,omitempty"`
 	WorkingDir  string            `yaml:"working-dir,omitempty"`
+	Limits      map[string]string `yaml:"limits,omitempty"`
+
+	// Environment variables read from files when the service is started
+	// (see LoadEnvironment)
+	EnvironmentFiles    []string          `yaml:"environment-files,omitempty"`
+	EnvironmentFromFile map[string]string `yaml:"environment-from-file,omitempty"`
+
+	// Names of environment variables whose values are redacted from the
+	// plan shown to non-admin users (see Plan.Redacted)
+	SensitiveEnvironment []string `yaml:"sensitive-environment,omitempty"`
+
+	// Resource control using the service's cgroup, if Pebble manages cgroups
+	MemoryMax OptionalSize  `yaml:"memory-max,omitempty"`
+	CPUWeight *int          `yaml:"cpu-weight,omitempty"`
+	CPUMax    OptionalFloat `yaml:"cpu-max,omitempty"`
+	PidsMax   *int          `yaml:"pids-max,omitempty"`
+
+	// Sandboxing of the service's processes
+	NoNewPrivileges  OptionalBool `yaml:"no-new-privileges,omitempty"`
+	KeepCapabilities []string     `yaml:"keep-capabilities,omitempty"`
+	DropCapabilities []string     `yaml:"drop-capabilities,omitempty"`
+	ReadOnlyPaths    []string     `yaml:"read-only-paths,omitempty"`
+	PrivateTmp       OptionalBool `yaml:"private-tmp,omitempty"`
+	Umask            string       `yaml:"umask,omitempty"`
+
+	// Hook commands run before and after the service is started and stopped
+	PreStart  string `yaml:"pre-start,omitempty"`
+	PostStart string `yaml:"post-start,omitempty"`
+	PreStop   string `yaml:"pre-stop,omitempty"`
+	PostStop  string `yaml:"post-stop,omitempty"`
 
 	// Auto-restart and backoff functionality
 	OnSuccess      ServiceAction            `yaml:"on-success,omitempty"`
@@ -89,32 +135,118 @@ type Service struct {
 	BackoffFactor  OptionalFloat            `yaml:"backoff-factor,omitempty"`
 	BackoffLimit   OptionalDuration         `yaml:"backoff-limit,omitempty"`
 	KillDelay      OptionalDuration         `yaml:"kill-delay,omitempty"`
+
+	// Graceful stop: the signal sent, or the command run, to stop the service
+	StopSignal  string `yaml:"stop-signal,omitempty"`
+	StopCommand string `yaml:"stop-command,omitempty"`
+
+	// Persistent log storage
+	LogStoreSize OptionalSize     `yaml:"log-store-size,omitempty"`
+	LogStoreAge  OptionalDuration `yaml:"log-store-age,omitempty"`
+
+	// Structured log parsing
+	LogFormat LogFormat `yaml:"log-format,omitempty"`
+	LogFields []string  `yaml:"log-fields,omitempty"`
+
+	// Merging of multi-line logs, such as stack traces
+	LogMultiline *LogMultiline `yaml:"log-multiline,omitempty"`
+
+	// Log buffering and rate limiting
+	LogBufferSize OptionalSize  `yaml:"log-buffer-size,omitempty"`
+	LogRateLimit  *LogRateLimit `yaml:"log-rate-limit,omitempty"`
+
+	// Running the command periodically, such as "mon-fri,03:00"
+	Schedule string `yaml:"schedule,omitempty"`
+
+	// Sockets that Pebble listens on and passes to the service
+	Sockets   map[string]*Socket `yaml:"sockets,omitempty"`
+	LazyStart OptionalBool       `yaml:"lazy-start,omitempty"`
+
+	// Readiness and watchdog notifications using the sd_notify protocol
+	Notify          OptionalBool     `yaml:"notify,omitempty"`
+	WatchdogTimeout OptionalDuration `yaml:"watchdog-timeout,omitempty"`
+
+	// Running several instances of the service, named "<name>@<instance>"
+	Instances ServiceInstances `yaml:"instances,omitempty"`
+
+	// Template and Instance are set on each instance of a service with
+	// instances when they're expanded (see ExpandInstances).
+	Template string `yaml:"-"`
+	Instance string `yaml:"-"`
 }
 
+// DefaultStartTimeout is the default time to wait for the checks a service
+// waits for (see WaitChecks and WaitReady) to be up before it's started, and
+// for a service with Notify set to notify that it's ready.
+const DefaultStartTimeout = 30 * time.Second
+
 // Copy returns a deep copy of the service.
 func (s *Service) Copy() *Service {
 	copied := *s
 	copied.After = append([]string(nil), s.After...)
 	copied.Before = append([]string(nil), s.Before...)
 	copied.Requires = append([]string(nil), s.Requires...)
+	copied.WaitChecks = append([]string(nil), s.WaitChecks...)
+	copied.LogFields = append([]string(nil), s.LogFields...)
+	copied.KeepCapabilities = append([]string(nil), s.KeepCapabilities...)
+	copied.DropCapabilities = append([]string(nil), s.DropCapabilities...)
+	copied.ReadOnlyPaths = append([]string(nil), s.ReadOnlyPaths...)
+	if s.LogMultiline != nil {
+		multilineCopy := *s.LogMultiline
+		copied.LogMultiline = &multilineCopy
+	}
+	if s.LogRateLimit != nil {
+		rateLimitCopy := *s.LogRateLimit
+		copied.LogRateLimit = &rateLimitCopy
+	}
 	if s.Environment != nil {
 		copied.Environment = make(map[string]string)
 		for k, v := range s.Environment {
 			copied.Environment[k] = v
 		}
 	}
+	copied.EnvironmentFiles = append([]string(nil), s.EnvironmentFiles...)
+	if s.EnvironmentFromFile != nil {
+		copied.EnvironmentFromFile = make(map[string]string)
+		for k, v := range s.EnvironmentFromFile {
+			copied.EnvironmentFromFile[k] = v
+		}
+	}
+	copied.SensitiveEnvironment = append([]string(nil), s.SensitiveEnvironment...)
+	if s.Limits != nil {
+		copied.Limits = make(map[string]string)
+		for k, v := range s.Limits {
+			copied.Limits[k] = v
+		}
+	}
 	if s.UserID != nil {
 		copied.UserID = copyIntPtr(s.UserID)
 	}
 	if s.GroupID != nil {
 		copied.GroupID = copyIntPtr(s.GroupID)
 	}
+	if s.CPUWeight != nil {
+		copied.CPUWeight = copyIntPtr(s.CPUWeight)
+	}
+	if s.PidsMax != nil {
+		copied.PidsMax = copyIntPtr(s.PidsMax)
+	}
 	if s.OnCheckFailure != nil {
 		copied.OnCheckFailure = make(map[string]ServiceAction)
 		for k, v := range s.OnCheckFailure {
 			copied.OnCheckFailure[k] = v
 		}
 	}
+	if s.Instances.Names != nil {
+		copied.Instances.Names = append([]string(nil), s.Instances.Names...)
+	}
+	if s.Sockets != nil {
+		copied.Sockets = make(map[string]*Socket, len(s.Sockets))
+		for k, v := range s.Sockets {
+			socketCopy := *v
+			copied.Sockets[k] = &socketCopy
+		}
+	}
 	return &copied
 }
 
@@ -129,12 +261,21 @@ func (s *Service) Merge(other *Service) {
 	if other.Startup != StartupUnknown {
 		s.Startup = other.Startup
 	}
+	if other.Type != UnsetServiceType {
+		s.Type = other.Type
+	}
 	if other.Command != "" {
 		s.Command = other.Command
 	}
 	if other.KillDelay.IsSet {
 		s.KillDelay = other.KillDelay
 	}
+	if other.StopSignal != "" {
+		s.StopSignal = other.StopSignal
+	}
+	if other.StopCommand != "" {
+		s.StopCommand = other.StopCommand
+	}
 	if other.UserID != nil {
 		s.UserID = copyIntPtr(other.UserID)
 	}
@@ -150,15 +291,61 @@ func (s *Service) Merge(other *Service) {
 	if other.WorkingDir != "" {
 		s.WorkingDir = other.WorkingDir
 	}
+	for k, v := range other.Limits {
+		if s.Limits == nil {
+			s.Limits = make(map[string]string)
+		}
+		s.Limits[k] = v
+	}
+	if other.MemoryMax.IsSet {
+		s.MemoryMax = other.MemoryMax
+	}
+	if other.CPUWeight != nil {
+		s.CPUWeight = copyIntPtr(other.CPUWeight)
+	}
+	if other.CPUMax.IsSet {
+		s.CPUMax = other.CPUMax
+	}
+	if other.PidsMax != nil {
+		s.PidsMax = copyIntPtr(other.PidsMax)
+	}
+	if other.NoNewPrivileges.IsSet {
+		s.NoNewPrivileges = other.NoNewPrivileges
+	}
+	s.KeepCapabilities = append(s.KeepCapabilities, other.KeepCapabilities...)
+	s.DropCapabilities = append(s.DropCapabilities, other.DropCapabilities...)
+	s.ReadOnlyPaths = append(s.ReadOnlyPaths, other.ReadOnlyPaths...)
+	if other.PrivateTmp.IsSet {
+		s.PrivateTmp = other.PrivateTmp
+	}
+	if other.Umask != "" {
+		s.Umask = other.Umask
+	}
+	if other.PreStart != "" {
+		s.PreStart = other.PreStart
+	}
+	if other.PostStart != "" {
+		s.PostStart = other.PostStart
+	}
+	if other.PreStop != "" {
+		s.PreStop = other.PreStop
+	}
+	if other.PostStop != "" {
+		s.PostStop = other.PostStop
+	}
 	s.After = append(s.After, other.After...)
 	s.Before = append(s.Before, other.Before...)
 	s.Requires = append(s.Requires, other.Requires...)
-	for k, v := range other.Environment {
-		if s.Environment == nil {
-			s.Environment = make(map[string]string)
-		}
-		s.Environment[k] = v
+	s.WaitChecks = append(s.WaitChecks, other.WaitChecks...)
+	if other.WaitReady.IsSet {
+		s.WaitReady = other.WaitReady
 	}
+	if other.StartTimeout.IsSet {
+		s.StartTimeout = other.StartTimeout
+	}
+	mergeEnvironment(&s.Environment, &s.EnvironmentFromFile, other.Environment, other.EnvironmentFromFile)
+	s.EnvironmentFiles = append(s.EnvironmentFiles, other.EnvironmentFiles...)
+	s.SensitiveEnvironment = append(s.SensitiveEnvironment, other.SensitiveEnvironment...)
 	if other.OnSuccess != "" {
 		s.OnSuccess = other.OnSuccess
 	}
@@ -180,6 +367,56 @@ func (s *Service) Merge(other *Service) {
 	if other.BackoffLimit.IsSet {
 		s.BackoffLimit = other.BackoffLimit
 	}
+	if other.LogStoreSize.IsSet {
+		s.LogStoreSize = other.LogStoreSize
+	}
+	if other.LogStoreAge.IsSet {
+		s.LogStoreAge = other.LogStoreAge
+	}
+	if other.LogFormat != "" {
+		s.LogFormat = other.LogFormat
+	}
+	s.LogFields = append(s.LogFields, other.LogFields...)
+	if other.LogMultiline != nil {
+		if s.LogMultiline == nil {
+			s.LogMultiline = &LogMultiline{}
+		}
+		s.LogMultiline.Merge(other.LogMultiline)
+	}
+	if other.LogBufferSize.IsSet {
+		s.LogBufferSize = other.LogBufferSize
+	}
+	if other.LogRateLimit != nil {
+		if s.LogRateLimit == nil {
+			s.LogRateLimit = &LogRateLimit{}
+		}
+		s.LogRateLimit.Merge(other.LogRateLimit)
+	}
+	if other.Schedule != "" {
+		s.Schedule = other.Schedule
+	}
+	for k, v := range other.Sockets {
+		if s.Sockets == nil {
+			s.Sockets = make(map[string]*Socket)
+		}
+		if s.Sockets[k] == nil {
+			s.Sockets[k] = &Socket{}
+		}
+		s.Sockets[k].Merge(v)
+	}
+	if other.LazyStart.IsSet {
+		s.LazyStart = other.LazyStart
+	}
+	if other.Notify.IsSet {
+		s.Notify = other.Notify
+	}
+	if other.WatchdogTimeout.IsSet {
+		s.WatchdogTimeout = other.WatchdogTimeout
+	}
+	if !other.Instances.IsZero() {
+		s.Instances = other.Instances
+		s.Instances.Names = append([]string(nil), other.Instances.Names...)
+	}
 }
 
 // Equal returns true when the two services are equal in value.
@@ -251,13 +488,18 @@ func CommandString(base, extra []string) string {
 
 // LogsTo returns true if the logs from s should be forwarded to target t.
 func (s *Service) LogsTo(t *LogTarget) bool {
+	// An instance's logs are also forwarded if its template is specified.
+	template := s.Name
+	if s.Template != "" {
+		template = s.Template
+	}
 	// Iterate backwards through t.Services until we find something matching
 	// s.Name.
 	for i := len(t.Services) - 1; i >= 0; i-- {
 		switch t.Services[i] {
-		case s.Name:
+		case s.Name, template:
 			return true
-		case ("-" + s.Name):
+		case ("-" + s.Name), ("-" + template):
 			return false
 		case "all":
 			return true
@@ -277,6 +519,136 @@ const (
 	StartupDisabled ServiceStartup = "disabled"
 )
 
+// ServiceType determines when a service is considered started.
+type ServiceType string
+
+const (
+	UnsetServiceType ServiceType = ""
+
+	// A simple service is long-running, and is considered started once it
+	// has been running for a short time.
+	SimpleServiceType ServiceType = "simple"
+
+	// A oneshot service is expected to exit, and is considered started
+	// once it has exited successfully.
+	OneshotServiceType ServiceType = "oneshot"
+)
+
+// LogFormat is the format of a service's output, which determines how its
+// logs are parsed.
+type LogFormat string
+
+const (
+	UnsetLogFormat  LogFormat = ""
+	TextLogFormat   LogFormat = "text"
+	JSONLogFormat   LogFormat = "json"
+	LogfmtLogFormat LogFormat = "logfmt"
+)
+
+// LogMultiline specifies how lines of a service's output are merged into
+// multi-line log entries. A line continues the previous line's entry if it
+// matches the Continuation regex, or if Indented is true and it starts with
+// whitespace. If neither is set, all lines written within MaxWait of an
+// entry's first line are merged into it.
+type LogMultiline struct {
+	Continuation string           `yaml:"continuation,omitempty"`
+	Indented     OptionalBool     `yaml:"indented,omitempty"`
+	MaxWait      OptionalDuration `yaml:"max-wait,omitempty"`
+}
+
+// DefaultLogMultilineMaxWait is the default time to wait for continuation
+// lines before a multi-line log entry is written.
+const DefaultLogMultilineMaxWait = 500 * time.Millisecond
+
+// Merge merges the fields set in other into m.
+func (m *LogMultiline) Merge(other *LogMultiline) {
+	if other.Continuation != "" {
+		m.Continuation = other.Continuation
+	}
+	if other.Indented.IsSet {
+		m.Indented = other.Indented
+	}
+	if other.MaxWait.IsSet {
+		m.MaxWait = other.MaxWait
+	}
+}
+
+// LogRateLimit limits how many lines and bytes of a service's output are
+// logged in each Interval. Burst is the number of intervals' worth of unused
+// quota that may be saved up and used at once. Lines over the limit are
+// dropped, and a marker with the number of lines suppressed is logged
+// instead.
+type LogRateLimit struct {
+	Lines    int              `yaml:"lines,omitempty"`
+	Bytes    OptionalSize     `yaml:"bytes,omitempty"`
+	Interval OptionalDuration `yaml:"interval,omitempty"`
+	Burst    int              `yaml:"burst,omitempty"`
+}
+
+const (
+	// DefaultLogRateLimitInterval is the default interval that a service's
+	// log rate limit applies to.
+	DefaultLogRateLimitInterval = time.Second
+
+	// DefaultLogBufferSize is the default size of the in-memory buffer
+	// holding each service's most recent output.
+	DefaultLogBufferSize = 100 * 1024
+
+	// MinLogBufferSize is the minimum value of log-buffer-size.
+	MinLogBufferSize = 4 * 1024
+)
+
+// Merge merges the fields set in other into r.
+func (r *LogRateLimit) Merge(other *LogRateLimit) {
+	if other.Lines != 0 {
+		r.Lines = other.Lines
+	}
+	if other.Bytes.IsSet {
+		r.Bytes = other.Bytes
+	}
+	if other.Interval.IsSet {
+		r.Interval = other.Interval
+	}
+	if other.Burst != 0 {
+		r.Burst = other.Burst
+	}
+}
+
+// Socket is a socket that Pebble listens on and passes to a service, using
+// the LISTEN_FDS protocol (see sd_listen_fds(3)).
+type Socket struct {
+	// Listen is the address to listen on: an absolute path for a Unix
+	// socket, or "host:port" (or ":port") for a TCP socket.
+	Listen string `yaml:"listen,omitempty"`
+
+	// User, Group and Mode are the ownership and permissions of a Unix
+	// socket's file. Mode is in octal, and defaults to "0666".
+	User  string `yaml:"user,omitempty"`
+	Group string `yaml:"group,omitempty"`
+	Mode  string `yaml:"mode,omitempty"`
+}
+
+// IsUnix reports whether the socket is a Unix socket, rather than TCP.
+func (s *Socket) IsUnix() bool {
+	return strings.HasPrefix(s.Listen, "/")
+}
+
+// Merge merges the fields set in other into s.
+func (s *Socket) Merge(other *Socket) {
+	if other.Listen != "" {
+		s.Listen = other.Listen
+	}
+	if other.User != "" {
+		s.User = other.User
+	}
+	if other.Group != "" {
+		s.Group = other.Group
+	}
+	if other.Mode != "" {
+		s.Mode = other.Mode
+	}
+}
+
 // Override specifies the layer override mechanism for an object.
 type Override string
 
@@ -380,6 +752,11 @@ const (
 type HTTPCheck struct {
 	URL     string            `yaml:"url,omitempty"`
 	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// SensitiveHeaders are the names of headers (in addition to
+	// Authorization) whose values are redacted from the plan shown to
+	// non-admin users.
+	SensitiveHeaders []string `yaml:"sensitive-headers,omitempty"`
 }
 
 // Copy returns a deep copy of the HTTP check configuration.
@@ -391,6 +768,7 @@ func (c *HTTPCheck) Copy() *HTTPCheck {
 			copied.Headers[k] = v
 		}
 	}
+	copied.SensitiveHeaders = append([]string(nil), c.SensitiveHeaders...)
 	return &copied
 }
 
@@ -405,6 +783,7 @@ func (c *HTTPCheck) Merge(other *HTTPCheck) {
 		}
 		c.Headers[k] = v
 	}
+	c.SensitiveHeaders = append(c.SensitiveHeaders, other.SensitiveHeaders...)
 }
 
 // TCPCheck holds the configuration for an HTTP health check.
@@ -439,6 +818,11 @@ type ExecCheck struct {
 	GroupID        *int              `yaml:"group-id,omitempty"`
 	Group          string            `yaml:"group,omitempty"`
 	WorkingDir     string            `yaml:"working-dir,omitempty"`
+
+	EnvironmentFiles    []string          `yaml:"environment-files,omitempty"`
+	EnvironmentFromFile map[string]string `yaml:"environment-from-file,omitempty"`
+
+	SensitiveEnvironment []string `yaml:"sensitive-environment,omitempty"`
 }
 
 // Copy returns a deep copy of the exec check configuration.
@@ -450,6 +834,14 @@ func (c *ExecCheck) Copy() *ExecCheck {
 			copied.Environment[k] = v
 		}
 	}
+	copied.EnvironmentFiles = append([]string(nil), c.EnvironmentFiles...)
+	if c.EnvironmentFromFile != nil {
+		copied.EnvironmentFromFile = make(map[string]string, len(c.EnvironmentFromFile))
+		for k, v := range c.EnvironmentFromFile {
+			copied.EnvironmentFromFile[k] = v
+		}
+	}
+	copied.SensitiveEnvironment = append([]string(nil), c.SensitiveEnvironment...)
 	if c.UserID != nil {
 		copied.UserID = copyIntPtr(c.UserID)
 	}
@@ -467,12 +859,9 @@ func (c *ExecCheck) Merge(other *ExecCheck) {
 	if other.ServiceContext != "" {
 		c.ServiceContext = other.ServiceContext
 	}
-	for k, v := range other.Environment {
-		if c.Environment == nil {
-			c.Environment = make(map[string]string)
-		}
-		c.Environment[k] = v
-	}
+	mergeEnvironment(&c.Environment, &c.EnvironmentFromFile, other.Environment, other.EnvironmentFromFile)
+	c.EnvironmentFiles = append(c.EnvironmentFiles, other.EnvironmentFiles...)
+	c.SensitiveEnvironment = append(c.SensitiveEnvironment, other.SensitiveEnvironment...)
 	if other.UserID != nil {
 		c.UserID = copyIntPtr(other.UserID)
 	}
@@ -498,15 +887,83 @@ type LogTarget struct {
 	Services []string          `yaml:"services"`
 	Override Override          `yaml:"override,omitempty"`
 	Labels   map[string]string `yaml:"labels,omitempty"`
+
+	// Encoding, if set, selects the encoding of the logs sent to an
+	// OpenTelemetry target (JSON by default).
+	Encoding LogTargetEncoding `yaml:"encoding,omitempty"`
+
+	// SpoolSize, if set, enables buffering of logs on disk (up to this size)
+	// while the target is unreachable.
+	SpoolSize OptionalSize `yaml:"spool-size,omitempty"`
+
+	// Filters, if set, selects which logs are forwarded to the target, and
+	// redacts sensitive data from them before they're forwarded.
+	Filters *LogFilters `yaml:"filters,omitempty"`
+}
+
+// LogFilters specifies how logs are filtered before being forwarded to a log
+// target. Logs matching any of the Drop regexes are discarded; if Keep is
+// non-empty, only logs matching at least one of its regexes are forwarded.
+// Each Redact rule is then applied to the remaining logs in order.
+type LogFilters struct {
+	Drop   []string        `yaml:"drop,omitempty"`
+	Keep   []string        `yaml:"keep,omitempty"`
+	Redact []*LogRedaction `yaml:"redact,omitempty"`
+}
+
+// LogRedaction replaces all matches of the Pattern regex in a log with
+// Replacement, which may refer to submatches using $1 or ${name} (see
+// regexp.Regexp.Expand). If Replacement is empty, DefaultLogRedaction is
+// used.
+type LogRedaction struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement,omitempty"`
+}
+
+// DefaultLogRedaction is the text redacted parts of logs are replaced with if
+// a redaction rule doesn't specify a replacement.
+const DefaultLogRedaction = "[REDACTED]"
+
+// Copy returns a deep copy of the log filters.
+func (f *LogFilters) Copy() *LogFilters {
+	copied := &LogFilters{
+		Drop: append([]string(nil), f.Drop...),
+		Keep: append([]string(nil), f.Keep...),
+	}
+	for _, redaction := range f.Redact {
+		redactionCopy := *redaction
+		copied.Redact = append(copied.Redact, &redactionCopy)
+	}
+	return copied
+}
+
+// Merge appends the filters in other to f.
+func (f *LogFilters) Merge(other *LogFilters) {
+	f.Drop = append(f.Drop, other.Drop...)
+	f.Keep = append(f.Keep, other.Keep...)
+	for _, redaction := range other.Redact {
+		redactionCopy := *redaction
+		f.Redact = append(f.Redact, &redactionCopy)
+	}
 }
 
 // LogTargetType defines the protocol to use to forward logs.
 type LogTargetType string
 
 const (
-	LokiTarget     LogTargetType = "loki"
-	SyslogTarget   LogTargetType = "syslog"
-	UnsetLogTarget LogTargetType = ""
+	LokiTarget          LogTargetType = "loki"
+	OpenTelemetryTarget LogTargetType = "opentelemetry"
+	SyslogTarget        LogTargetType = "syslog"
+	UnsetLogTarget      LogTargetType = ""
+)
+
+// LogTargetEncoding defines the encoding of the logs sent to a log target.
+type LogTargetEncoding string
+
+const (
+	JSONEncoding     LogTargetEncoding = "json"
+	ProtobufEncoding LogTargetEncoding = "protobuf"
+	UnsetEncoding    LogTargetEncoding = ""
 )
 
 // Copy returns a deep copy of the log target configuration.
@@ -519,6 +976,9 @@ func (t *LogTarget) Copy() *LogTarget {
 			copied.Labels[k] = v
 		}
 	}
+	if t.Filters != nil {
+		copied.Filters = t.Filters.Copy()
+	}
 	return &copied
 }
 
@@ -537,6 +997,18 @@ func (t *LogTarget) Merge(other *LogTarget) {
 		}
 		t.Labels[k] = v
 	}
+	if other.Encoding != UnsetEncoding {
+		t.Encoding = other.Encoding
+	}
+	if other.SpoolSize.IsSet {
+		t.SpoolSize = other.SpoolSize
+	}
+	if other.Filters != nil {
+		if t.Filters == nil {
+			t.Filters = &LogFilters{}
+		}
+		t.Filters.Merge(other.Filters)
+	}
 }
 
 // FormatError is the error returned when a layer has a format error, such as
@@ -567,6 +1039,13 @@ func CombineLayers(layers ...*Layer) (*Layer, error) {
 	combined.Summary = last.Summary
 	combined.Description = last.Description
 	for _, layer := range layers {
+		for name, value := range layer.Variables {
+			if combined.Variables == nil {
+				combined.Variables = make(map[string]string)
+			}
+			combined.Variables[name] = value
+		}
+
 		for name, service := range layer.Services {
 			switch service.Override {
 			case MergeOverride:
@@ -682,6 +1161,69 @@ func CombineLayers(layers ...*Layer) (*Layer, error) {
 	return combined, nil
 }
 
+// ExpandInstances replaces each service in the combined layer that has
+// instances with a service for each instance, named "<service>@<instance>".
+// The other services' dependencies on a service with instances are replaced
+// with dependencies on all of them. ExpandVariables replaces "${INSTANCE}"
+// in each instance with the instance name.
+func ExpandInstances(combined *Layer) error {
+	instances := make(map[string][]string)
+	for name, service := range combined.Services {
+		for _, instance := range service.Instances.List() {
+			instances[name] = append(instances[name], name+"@"+instance)
+		}
+	}
+	if len(instances) == 0 {
+		return nil
+	}
+	expandNames := func(names []string) []string {
+		var expanded []string
+		for _, name := range names {
+			if instanceNames, ok := instances[name]; ok {
+				expanded = append(expanded, instanceNames...)
+			} else {
+				expanded = append(expanded, name)
+			}
+		}
+		return expanded
+	}
+
+	services := make(map[string]*Service, len(combined.Services))
+	for name, service := range combined.Services {
+		if service.Instances.IsZero() {
+			service.After = expandNames(service.After)
+			service.Before = expandNames(service.Before)
+			service.Requires = expandNames(service.Requires)
+			services[name] = service
+		}
+	}
+	for name, service := range combined.Services {
+		if service.Instances.IsZero() {
+			continue
+		}
+		for _, instance := range service.Instances.List() {
+			instanceName := name + "@" + instance
+			if _, ok := services[instanceName]; ok {
+				return &FormatError{
+					Message: fmt.Sprintf("plan service %q has the same name as instance %q of service %q",
+						instanceName, instance, name),
+				}
+			}
+			copied := service.Copy()
+			copied.Name = instanceName
+			copied.Instances = ServiceInstances{}
+			copied.Template = name
+			copied.Instance = instance
+			copied.After = expandNames(copied.After)
+			copied.Before = expandNames(copied.Before)
+			copied.Requires = expandNames(copied.Requires)
+			services[instanceName] = copied
+		}
+	}
+	combined.Services = services
+	return nil
+}
+
 // Validate checks that the layer is valid. It returns nil if all the checks pass, or
 // an error if there are validation errors.
 // See also Plan.Validate, which does additional checks based on the combined
@@ -693,6 +1235,14 @@ func (layer *Layer) Validate() error {
 		}
 	}
 
+	for name := range layer.Variables {
+		if !variableNameRegexp.MatchString(name) {
+			return &FormatError{
+				Message: fmt.Sprintf("invalid variable name %q: must contain only letters, digits and underscores, and not start with a digit", name),
+			}
+		}
+	}
+
 	for name, service := range layer.Services {
 		if name == "" {
 			return &FormatError{
@@ -715,17 +1265,110 @@ func (layer *Layer) Validate() error {
 				Message: fmt.Sprintf(`cannot use service name %q: starting with "-" not allowed`, name),
 			}
 		}
+		if !validFileName(name) {
+			return &FormatError{
+				Message: fmt.Sprintf(`cannot use service name %q: "." and ".." and names containing "/" not allowed`, name),
+			}
+		}
 		if service == nil {
 			return &FormatError{
 				Message: fmt.Sprintf("service object cannot be null for service %q", name),
 			}
 		}
+		if !service.Instances.IsZero() {
+			err := validateInstances(name, service.Instances)
+			if err != nil {
+				return err
+			}
+		}
 		_, _, err := service.ParseCommand()
 		if err != nil {
 			return &FormatError{
 				Message: fmt.Sprintf("plan service %q command invalid: %v", name, err),
 			}
 		}
+		commands := []struct{ what, command string }{
+			{"pre-start command", service.PreStart},
+			{"post-start command", service.PostStart},
+			{"pre-stop command", service.PreStop},
+			{"post-stop command", service.PostStop},
+			{"stop-command", service.StopCommand},
+		}
+		for _, command := range commands {
+			_, err := shlex.Split(command.command)
+			if err != nil {
+				return &FormatError{
+					Message: fmt.Sprintf("plan service %q %s invalid: %v", name, command.what, err),
+				}
+			}
+		}
+		err = rlimit.Validate(service.Limits)
+		if err != nil {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q limits invalid: %v", name, err),
+			}
+		}
+		if service.MemoryMax.IsSet && service.MemoryMax.Value <= 0 {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q memory-max must be greater than zero", name),
+			}
+		}
+		if service.CPUWeight != nil && (*service.CPUWeight < 1 || *service.CPUWeight > 10000) {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q cpu-weight must be between 1 and 10000", name),
+			}
+		}
+		if service.CPUMax.IsSet && service.CPUMax.Value <= 0 {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q cpu-max must be greater than zero", name),
+			}
+		}
+		if service.PidsMax != nil && *service.PidsMax < 1 {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q pids-max must be greater than zero", name),
+			}
+		}
+		if len(service.KeepCapabilities) > 0 && len(service.DropCapabilities) > 0 {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q cannot have both keep-capabilities and drop-capabilities", name),
+			}
+		}
+		for _, capabilities := range [][]string{service.KeepCapabilities, service.DropCapabilities} {
+			_, err := sandbox.ParseCapabilities(capabilities)
+			if err != nil {
+				return &FormatError{
+					Message: fmt.Sprintf("plan service %q capabilities invalid: %v", name, err),
+				}
+			}
+		}
+		for _, path := range service.ReadOnlyPaths {
+			if !filepath.IsAbs(path) {
+				return &FormatError{
+					Message: fmt.Sprintf("plan service %q read-only path %q must be absolute", name, path),
+				}
+			}
+		}
+		if service.Umask != "" {
+			_, err := sandbox.ParseUmask(service.Umask)
+			if err != nil {
+				return &FormatError{
+					Message: fmt.Sprintf("plan service %q %v", name, err),
+				}
+			}
+		}
+		if service.StopSignal != "" && (!strings.HasPrefix(service.StopSignal, "SIG") || unix.SignalNum(service.StopSignal) == 0) {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q stop-signal %q is not a valid signal name", name, service.StopSignal),
+			}
+		}
+		switch service.Type {
+		case UnsetServiceType, SimpleServiceType, OneshotServiceType:
+		default:
+			return &FormatError{
+				Message: fmt.Sprintf(`plan service %q type must be %q or %q`,
+					name, SimpleServiceType, OneshotServiceType),
+			}
+		}
 		if !validServiceAction(service.OnSuccess, ActionFailureShutdown) {
 			return &FormatError{
 				Message: fmt.Sprintf("plan service %q on-success action %q invalid", name, service.OnSuccess),
@@ -748,6 +1391,81 @@ func (layer *Layer) Validate() error {
 				Message: fmt.Sprintf("plan service %q backoff-factor must be 1.0 or greater, not %g", name, service.BackoffFactor.Value),
 			}
 		}
+		if service.StartTimeout.IsSet && service.StartTimeout.Value <= 0 {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q start-timeout must be greater than zero", name),
+			}
+		}
+		if service.WatchdogTimeout.IsSet && service.WatchdogTimeout.Value <= 0 {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q watchdog-timeout must be greater than zero", name),
+			}
+		}
+		if service.LogStoreSize.IsSet && service.LogStoreSize.Value == 0 {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q log-store-size must not be zero", name),
+			}
+		}
+		if service.LogStoreAge.IsSet && service.LogStoreAge.Value == 0 {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q log-store-age must not be zero", name),
+			}
+		}
+		switch service.LogFormat {
+		case UnsetLogFormat, TextLogFormat, JSONLogFormat, LogfmtLogFormat:
+		default:
+			return &FormatError{
+				Message: fmt.Sprintf(`plan service %q log-format must be %q, %q or %q`,
+					name, TextLogFormat, JSONLogFormat, LogfmtLogFormat),
+			}
+		}
+		if service.LogMultiline != nil {
+			_, err := regexp.Compile(service.LogMultiline.Continuation)
+			if err != nil {
+				return &FormatError{
+					Message: fmt.Sprintf("plan service %q has invalid log-multiline continuation pattern %q: %v",
+						name, service.LogMultiline.Continuation, err),
+				}
+			}
+			if service.LogMultiline.MaxWait.IsSet && service.LogMultiline.MaxWait.Value <= 0 {
+				return &FormatError{
+					Message: fmt.Sprintf("plan service %q log-multiline max-wait must be greater than zero", name),
+				}
+			}
+		}
+		if service.LogBufferSize.IsSet && service.LogBufferSize.Value < MinLogBufferSize {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q log-buffer-size must be at least %s", name, formatSize(MinLogBufferSize)),
+			}
+		}
+		if service.LogRateLimit != nil {
+			err := validateLogRateLimit(name, service.LogRateLimit)
+			if err != nil {
+				return err
+			}
+		}
+		err = validateEnvironmentFiles(service.Environment, service.EnvironmentFiles, service.EnvironmentFromFile)
+		if err != nil {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q %v", name, err),
+			}
+		}
+		for socketName, socket := range service.Sockets {
+			err := validateSocket(socketName, socket)
+			if err != nil {
+				return &FormatError{
+					Message: fmt.Sprintf("plan service %q %v", name, err),
+				}
+			}
+		}
+		if service.Schedule != "" {
+			_, err := timeutil.ParseSchedule(service.Schedule)
+			if err != nil {
+				return &FormatError{
+					Message: fmt.Sprintf("plan service %q schedule invalid: %v", name, err),
+				}
+			}
+		}
 	}
 
 	for name, check := range layer.Checks {
@@ -795,6 +1513,12 @@ func (layer *Layer) Validate() error {
 					Message: fmt.Sprintf("plan check %q has invalid user/group: %v", name, err),
 				}
 			}
+			err = validateEnvironmentFiles(check.Exec.Environment, check.Exec.EnvironmentFiles, check.Exec.EnvironmentFromFile)
+			if err != nil {
+				return &FormatError{
+					Message: fmt.Sprintf("plan check %q %v", name, err),
+				}
+			}
 		}
 	}
 
@@ -804,6 +1528,11 @@ func (layer *Layer) Validate() error {
 				Message: fmt.Sprintf("log target object cannot be null for log target %q", name),
 			}
 		}
+		if !validFileName(name) {
+			return &FormatError{
+				Message: fmt.Sprintf(`cannot use log target name %q: "." and ".." and names containing "/" not allowed`, name),
+			}
+		}
 		for labelName := range target.Labels {
 			// 'pebble_*' labels are reserved
 			if strings.HasPrefix(labelName, "pebble_") {
@@ -812,19 +1541,186 @@ func (layer *Layer) Validate() error {
 				}
 			}
 		}
+		switch target.Encoding {
+		case JSONEncoding, ProtobufEncoding, UnsetEncoding:
+			// valid, continue
+		default:
+			return &FormatError{
+				Message: fmt.Sprintf(`log target %q has unsupported encoding %q, must be %q or %q`,
+					name, target.Encoding, JSONEncoding, ProtobufEncoding),
+			}
+		}
+		if target.SpoolSize.IsSet && target.SpoolSize.Value == 0 {
+			return &FormatError{
+				Message: fmt.Sprintf("log target %q spool-size must not be zero", name),
+			}
+		}
+		if target.Filters != nil {
+			err := validateLogFilters(name, target.Filters)
+			if err != nil {
+				return err
+			}
+		}
 		switch target.Type {
-		case LokiTarget, SyslogTarget:
+		case LokiTarget, OpenTelemetryTarget, SyslogTarget:
 			// valid, continue
 		case UnsetLogTarget:
 			// will be checked when the layers are combined
 		default:
 			return &FormatError{
-				Message: fmt.Sprintf(`log target %q has unsupported type %q, must be %q or %q`,
-					name, target.Type, LokiTarget, SyslogTarget),
+				Message: fmt.Sprintf(`log target %q has unsupported type %q, must be %q, %q or %q`,
+					name, target.Type, LokiTarget, OpenTelemetryTarget, SyslogTarget),
+			}
+		}
+	}
+
+	return nil
+}
+
+// validFileName reports whether name can be used as a file name. Service and
+// log target names are used to name their log store, cgroup and spool
+// directories, so they must not be able to refer to other directories.
+func validFileName(name string) bool {
+	return name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
+func validateInstances(service string, instances ServiceInstances) error {
+	if strings.Contains(service, "@") {
+		return &FormatError{
+			Message: fmt.Sprintf(`plan service %q cannot have instances as its name contains "@"`, service),
+		}
+	}
+	seen := make(map[string]bool)
+	for _, instance := range instances.Names {
+		if instance == "" || strings.ContainsAny(instance, "@/ ") {
+			return &FormatError{
+				Message: fmt.Sprintf(`plan service %q instance name %q must not be empty or contain "@", "/" or spaces`, service, instance),
 			}
 		}
+		if seen[instance] {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q has duplicate instance %q", service, instance),
+			}
+		}
+		seen[instance] = true
 	}
+	return nil
+}
 
+func validateEnvironmentFiles(environment map[string]string, files []string, fromFile map[string]string) error {
+	for _, path := range files {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("environment file %q must be an absolute path", path)
+		}
+	}
+	for name, path := range fromFile {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("environment variable %q file %q must be an absolute path", name, path)
+		}
+		if _, ok := environment[name]; ok {
+			return fmt.Errorf("cannot have environment variable %q in both environment and environment-from-file", name)
+		}
+	}
+	return nil
+}
+
+func validateSocket(name string, socket *Socket) error {
+	if name == "" || strings.ContainsAny(name, ": ") {
+		return fmt.Errorf("socket name %q must not be empty or contain colons or spaces", name)
+	}
+	if socket == nil {
+		return fmt.Errorf("socket %q must not be empty", name)
+	}
+	if socket.Listen != "" && !socket.IsUnix() {
+		_, port, err := net.SplitHostPort(socket.Listen)
+		if err == nil {
+			_, err = strconv.ParseUint(port, 10, 16)
+		}
+		if err != nil {
+			return fmt.Errorf("socket %q listen address %q must be an absolute path or \"host:port\"", name, socket.Listen)
+		}
+	}
+	if socket.Mode != "" {
+		mode, err := strconv.ParseUint(socket.Mode, 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("socket %q mode %q must be an octal number from 0000 to 0777", name, socket.Mode)
+		}
+	}
+	return nil
+}
+
+func validateLogRateLimit(service string, limit *LogRateLimit) error {
+	if limit.Lines < 0 {
+		return &FormatError{
+			Message: fmt.Sprintf("plan service %q log-rate-limit lines must not be negative", service),
+		}
+	}
+	if limit.Lines == 0 && (!limit.Bytes.IsSet || limit.Bytes.Value == 0) {
+		return &FormatError{
+			Message: fmt.Sprintf("plan service %q log-rate-limit must specify lines or bytes", service),
+		}
+	}
+	if limit.Interval.IsSet && limit.Interval.Value <= 0 {
+		return &FormatError{
+			Message: fmt.Sprintf("plan service %q log-rate-limit interval must be greater than zero", service),
+		}
+	}
+	if limit.Burst < 0 {
+		return &FormatError{
+			Message: fmt.Sprintf("plan service %q log-rate-limit burst must not be negative", service),
+		}
+	}
+	return nil
+}
+
+func validateLogFilters(target string, filters *LogFilters) error {
+	patterns := append(append([]string(nil), filters.Drop...), filters.Keep...)
+	for _, redaction := range filters.Redact {
+		if redaction == nil || redaction.Pattern == "" {
+			return &FormatError{
+				Message: fmt.Sprintf("log target %q redact filter must specify a pattern", target),
+			}
+		}
+		patterns = append(patterns, redaction.Pattern)
+	}
+	for _, pattern := range patterns {
+		_, err := regexp.Compile(pattern)
+		if err != nil {
+			return &FormatError{
+				Message: fmt.Sprintf("log target %q has invalid filter pattern %q: %v", target, pattern, err),
+			}
+		}
+	}
+	return nil
+}
+
+// checkSocketAddresses checks that no two sockets listen on the same address.
+func (p *Plan) checkSocketAddresses() error {
+	type socketID struct{ service, socket string }
+	var ids []socketID
+	for serviceName, service := range p.Services {
+		for socketName := range service.Sockets {
+			ids = append(ids, socketID{serviceName, socketName})
+		}
+	}
+	// Sort so that the error is deterministic.
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].service != ids[j].service {
+			return ids[i].service < ids[j].service
+		}
+		return ids[i].socket < ids[j].socket
+	})
+	seen := make(map[string]socketID)
+	for _, id := range ids {
+		listen := p.Services[id.service].Sockets[id.socket].Listen
+		if other, ok := seen[listen]; ok {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q socket %q has the same address as service %q socket %q",
+					id.service, id.socket, other.service, other.socket),
+			}
+		}
+		seen[listen] = id
+	}
 	return nil
 }
 
@@ -837,6 +1733,51 @@ func (p *Plan) Validate() error {
 				Message: fmt.Sprintf(`plan must define "command" for service %q`, name),
 			}
 		}
+		if service.Schedule != "" && service.Startup == StartupEnabled {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q cannot have both a schedule and startup enabled", name),
+			}
+		}
+		for _, checkName := range service.WaitChecks {
+			if _, ok := p.Checks[checkName]; !ok {
+				return &FormatError{
+					Message: fmt.Sprintf("plan service %q wait-checks specifies non-existent check %q",
+						name, checkName),
+				}
+			}
+		}
+		if service.Notify.Value && service.Type == OneshotServiceType {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q cannot have notify with type %q", name, OneshotServiceType),
+			}
+		}
+		if service.WatchdogTimeout.IsSet && !service.Notify.Value {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q cannot have watchdog-timeout without notify", name),
+			}
+		}
+		if service.LazyStart.Value && len(service.Sockets) == 0 {
+			return &FormatError{
+				Message: fmt.Sprintf("plan service %q cannot have lazy-start without sockets", name),
+			}
+		}
+		for socketName, socket := range service.Sockets {
+			if socket.Listen == "" {
+				return &FormatError{
+					Message: fmt.Sprintf(`plan must define "listen" for service %q socket %q`, name, socketName),
+				}
+			}
+			if !socket.IsUnix() && (socket.User != "" || socket.Group != "" || socket.Mode != "") {
+				return &FormatError{
+					Message: fmt.Sprintf("plan service %q socket %q cannot have user, group or mode as it's not a Unix socket", name, socketName),
+				}
+			}
+		}
+	}
+
+	err := p.checkSocketAddresses()
+	if err != nil {
+		return err
 	}
 
 	for name, check := range p.Checks {
@@ -881,12 +1822,12 @@ func (p *Plan) Validate() error {
 
 	for name, target := range p.LogTargets {
 		switch target.Type {
-		case LokiTarget, SyslogTarget:
+		case LokiTarget, OpenTelemetryTarget, SyslogTarget:
 			// valid, continue
 		case UnsetLogTarget:
 			return &FormatError{
-				Message: fmt.Sprintf(`plan must define "type" (%q or %q) for log target %q`,
-					LokiTarget, SyslogTarget, name),
+				Message: fmt.Sprintf(`plan must define "type" (%q, %q or %q) for log target %q`,
+					LokiTarget, OpenTelemetryTarget, SyslogTarget, name),
 			}
 		}
 
@@ -899,6 +1840,9 @@ func (p *Plan) Validate() error {
 			if _, ok := p.Services[serviceName]; ok {
 				continue
 			}
+			if len(p.instances(serviceName)) > 0 {
+				continue
+			}
 			return &FormatError{
 				Message: fmt.Sprintf(`log target %q specifies unknown service %q`,
 					target.Name, serviceName),
@@ -910,10 +1854,17 @@ func (p *Plan) Validate() error {
 				Message: fmt.Sprintf(`plan must define "location" for log target %q`, name),
 			}
 		}
+
+		if target.Encoding != UnsetEncoding && target.Type != OpenTelemetryTarget {
+			return &FormatError{
+				Message: fmt.Sprintf(`log target %q cannot set "encoding" for type %q, only for %q`,
+					name, target.Type, OpenTelemetryTarget),
+			}
+		}
 	}
 
 	// Ensure combined layers don't have cycles.
-	err := p.checkCycles()
+	err = p.checkCycles()
 	if err != nil {
 		return err
 	}
@@ -925,7 +1876,7 @@ func (p *Plan) Validate() error {
 // An error is returned when a provided service name does not exist, or there
 // is an order cycle involving the provided service or its dependencies.
 func (p *Plan) StartOrder(names []string) ([]string, error) {
-	return order(p.Services, names, false)
+	return order(p.Services, p.ExpandInstanceNames(names), false)
 }
 
 // StopOrder returns the required services that must be stopped for the named
@@ -933,7 +1884,240 @@ func (p *Plan) StartOrder(names []string) ([]string, error) {
 // An error is returned when a provided service name does not exist, or there
 // is an order cycle involving the provided service or its dependencies.
 func (p *Plan) StopOrder(names []string) ([]string, error) {
-	return order(p.Services, names, true)
+	return order(p.Services, p.ExpandInstanceNames(names), true)
+}
+
+// RedactedValue replaces the values of variables, sensitive environment
+// variables and headers, and credentials in URLs, in the plan returned by
+// Redacted.
+const RedactedValue = "*****"
+
+// Redacted returns a copy of the plan, for showing to non-admin users, with
+// the values that may be secrets replaced by RedactedValue. These are:
+//
+//   - The values of the variables, including where they're referred to in
+//     the plan's services, checks and log targets.
+//   - The values of the environment variables in a service's or exec
+//     check's sensitive-environment.
+//   - The values of the headers in an HTTP check's sensitive-headers, and
+//     of its Authorization header.
+//   - The user information and query parameter values in HTTP check URLs
+//     and log target locations.
+func (p *Plan) Redacted() *Plan {
+	redacted := *p
+	services, checks, logTargets := p.Services, p.Checks, p.LogTargets
+	if len(p.Variables) > 0 || p.hasVariableReferences() {
+		redacted.Variables = make(map[string]string, len(p.Variables))
+		for name := range p.Variables {
+			redacted.Variables[name] = RedactedValue
+		}
+		// The variables' values, and those of Pebble's environment
+		// variables, are already in the plan, so combine the layers again
+		// with the values redacted.
+		combined, err := CombineLayers(p.Layers...)
+		if err == nil && p.hasInstances() {
+			err = ExpandInstances(combined)
+		}
+		if err == nil {
+			err = interpolate(combined, func(name string) (string, bool) {
+				if _, ok := p.Variables[name]; ok {
+					return RedactedValue, true
+				}
+				if _, ok := os.LookupEnv(name); ok {
+					return RedactedValue, true
+				}
+				return "", false
+			})
+		}
+		if err != nil {
+			// This can't happen, as the plan was combined from the same
+			// layers, but don't show the values if it does.
+			logger.Noticef("Cannot redact plan: %v", err)
+			combined = &Layer{}
+		}
+		services, checks, logTargets = combined.Services, combined.Checks, combined.LogTargets
+	}
+
+	redacted.Services = make(map[string]*Service, len(services))
+	for name, service := range services {
+		if len(service.SensitiveEnvironment) > 0 {
+			service = service.Copy()
+			redactValues(service.Environment, service.SensitiveEnvironment, false)
+		}
+		redacted.Services[name] = service
+	}
+	redacted.Checks = make(map[string]*Check, len(checks))
+	for name, check := range checks {
+		switch {
+		case check.HTTP != nil:
+			check = check.Copy()
+			sensitive := append([]string{"Authorization"}, check.HTTP.SensitiveHeaders...)
+			redactValues(check.HTTP.Headers, sensitive, true)
+			check.HTTP.URL = redactURL(check.HTTP.URL)
+		case check.Exec != nil && len(check.Exec.SensitiveEnvironment) > 0:
+			check = check.Copy()
+			redactValues(check.Exec.Environment, check.Exec.SensitiveEnvironment, false)
+		}
+		redacted.Checks[name] = check
+	}
+	redacted.LogTargets = make(map[string]*LogTarget, len(logTargets))
+	for name, target := range logTargets {
+		if location := redactURL(target.Location); location != target.Location {
+			target = target.Copy()
+			target.Location = location
+		}
+		redacted.LogTargets[name] = target
+	}
+	return &redacted
+}
+
+// redactValues replaces the values of the sensitive keys in m with
+// RedactedValue, ignoring the keys' case if foldCase is true.
+func redactValues(m map[string]string, sensitive []string, foldCase bool) {
+	for k := range m {
+		for _, name := range sensitive {
+			if k == name || (foldCase && strings.EqualFold(k, name)) {
+				m[k] = RedactedValue
+				break
+			}
+		}
+	}
+}
+
+// WithTemplates returns a copy of the plan with the instances of each
+// service that has instances replaced by the service as it's defined in the
+// layers, so that the plan can be used as a layer. If the plan has no
+// instances, it returns the plan itself.
+func (p *Plan) WithTemplates() *Plan {
+	if !p.hasInstances() {
+		return p
+	}
+	combined, err := CombineLayers(p.Layers...)
+	if err == nil {
+		err = ExpandVariables(combined)
+	}
+	if err != nil {
+		// This can't happen, as the plan was combined from the same layers.
+		logger.Noticef("Cannot show plan with services' instances: %v", err)
+		return p
+	}
+	withTemplates := *p
+	withTemplates.Services = combined.Services
+	return &withTemplates
+}
+
+// hasVariableReferences reports whether the plan's layers refer to any
+// variables in the fields that ExpandVariables expands.
+func (p *Plan) hasVariableReferences() bool {
+	for _, layer := range p.Layers {
+		for _, service := range layer.Services {
+			if strings.Contains(service.Command, "${") || strings.Contains(service.WorkingDir, "${") {
+				return true
+			}
+			for _, v := range service.Environment {
+				if strings.Contains(v, "${") {
+					return true
+				}
+			}
+		}
+		for _, check := range layer.Checks {
+			if check.HTTP != nil && strings.Contains(check.HTTP.URL, "${") {
+				return true
+			}
+		}
+		for _, target := range layer.LogTargets {
+			if strings.Contains(target.Location, "${") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasInstances reports whether the plan has instances of services with
+// instances.
+func (p *Plan) hasInstances() bool {
+	for _, service := range p.Services {
+		if service.Template != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL returns the URL with its user information, such as a password,
+// and its query parameters' values replaced by RedactedValue. If the URL
+// can't be parsed, it's replaced entirely.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return RedactedValue
+	}
+	if u.User == nil && u.RawQuery == "" {
+		return rawURL
+	}
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			name, _, _ := strings.Cut(param, "=")
+			params[i] = name + "=" + RedactedValue
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+	if u.User == nil {
+		return u.String()
+	}
+	// Add the redacted user information directly, as url.User would
+	// escape it.
+	u.User = nil
+	prefix := "//"
+	if u.Scheme != "" {
+		prefix = u.Scheme + ":" + prefix
+	}
+	return prefix + RedactedValue + "@" + strings.TrimPrefix(u.String(), prefix)
+}
+
+// ExpandInstanceNames returns the service names with the name of each
+// service that has instances replaced by the names of its instances.
+func (p *Plan) ExpandInstanceNames(names []string) []string {
+	var expanded []string
+	for _, name := range names {
+		if _, ok := p.Services[name]; !ok {
+			if instances := p.instances(name); len(instances) > 0 {
+				expanded = append(expanded, instances...)
+				continue
+			}
+		}
+		expanded = append(expanded, name)
+	}
+	return expanded
+}
+
+// instances returns the names of the instances of the named service, in
+// order of instance name (numerically, for numbered instances).
+func (p *Plan) instances(template string) []string {
+	if template == "" {
+		return nil
+	}
+	var instances []string
+	for name, service := range p.Services {
+		if service.Template == template {
+			instances = append(instances, name)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instanceLess(p.Services[instances[i]], p.Services[instances[j]])
+	})
+	return instances
+}
+
+func instanceLess(a, b *Service) bool {
+	na, errA := strconv.Atoi(a.Instance)
+	nb, errB := strconv.Atoi(b.Instance)
+	if errA == nil && errB == nil {
+		return na < nb
+	}
+	return a.Instance < b.Instance
 }
 
 func order(services map[string]*Service, names []string, stop bool) ([]string, error) {
@@ -1159,8 +2343,17 @@ func ReadDir(dir string) (*Plan, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = ExpandInstances(combined)
+	if err != nil {
+		return nil, err
+	}
+	err = ExpandVariables(combined)
+	if err != nil {
+		return nil, err
+	}
 	plan := &Plan{
 		Layers:     layers,
+		Variables:  combined.Variables,
 		Services:   combined.Services,
 		Checks:     combined.Checks,
 		LogTargets: combined.LogTargets,
@@ -1197,6 +2390,13 @@ func MergeServiceContext(p *Plan, serviceName string, overrides ContextOptions)
 	for k, v := range service.Environment {
 		merged.Environment[k] = v
 	}
+	merged.EnvironmentFiles = append([]string(nil), service.EnvironmentFiles...)
+	for k, v := range service.EnvironmentFromFile {
+		if merged.EnvironmentFromFile == nil {
+			merged.EnvironmentFromFile = make(map[string]string)
+		}
+		merged.EnvironmentFromFile[k] = v
+	}
 	if service.UserID != nil {
 		merged.UserID = copyIntPtr(service.UserID)
 	}
@@ -1206,11 +2406,16 @@ func MergeServiceContext(p *Plan, serviceName string, overrides ContextOptions)
 	}
 	merged.Group = service.Group
 	merged.WorkingDir = service.WorkingDir
+	if service.Limits != nil {
+		merged.Limits = make(map[string]string)
+		for k, v := range service.Limits {
+			merged.Limits[k] = v
+		}
+	}
 
 	// Merge in fields from the overrides, if set.
-	for k, v := range overrides.Environment {
-		merged.Environment[k] = v
-	}
+	mergeEnvironment(&merged.Environment, &merged.EnvironmentFromFile, overrides.Environment, overrides.EnvironmentFromFile)
+	merged.EnvironmentFiles = append(merged.EnvironmentFiles, overrides.EnvironmentFiles...)
 	if overrides.UserID != nil {
 		merged.UserID = copyIntPtr(overrides.UserID)
 	}
@@ -1226,6 +2431,12 @@ func MergeServiceContext(p *Plan, serviceName string, overrides ContextOptions)
 	if overrides.WorkingDir != "" {
 		merged.WorkingDir = overrides.WorkingDir
 	}
+	for k, v := range overrides.Limits {
+		if merged.Limits == nil {
+			merged.Limits = make(map[string]string)
+		}
+		merged.Limits[k] = v
+	}
 
 	return merged, nil
 }
@@ -1238,6 +2449,72 @@ type ContextOptions struct {
 	GroupID     *int
 	Group       string
 	WorkingDir  string
+	Limits      map[string]string
+
+	EnvironmentFiles    []string
+	EnvironmentFromFile map[string]string
+}
+
+// mergeEnvironment merges the environment variables and the variables read
+// from files given by other into those given by environment and fromFile.
+// Setting a variable in one removes it from the other, so a layer can
+// override a variable read from a file with a value, and vice versa.
+func mergeEnvironment(environment, fromFile *map[string]string, otherEnvironment, otherFromFile map[string]string) {
+	for k, v := range otherEnvironment {
+		if *environment == nil {
+			*environment = make(map[string]string)
+		}
+		(*environment)[k] = v
+		delete(*fromFile, k)
+	}
+	for k, v := range otherFromFile {
+		if *fromFile == nil {
+			*fromFile = make(map[string]string)
+		}
+		(*fromFile)[k] = v
+		delete(*environment, k)
+	}
+}
+
+// LoadEnvironment returns the environment variables for a service or exec
+// check: those read from the environment files, in order, overridden by
+// the given environment and the variables read from the files in fromFile
+// (each of which holds a variable's value, without a trailing newline).
+//
+// The files are read each time this is called, so changes to them apply
+// the next time the service is started or the check is run.
+func LoadEnvironment(environment map[string]string, files []string, fromFile map[string]string) (map[string]string, error) {
+	loaded := make(map[string]string)
+	for _, path := range files {
+		env, err := osutil.ReadEnvironmentFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read environment file %q: %w", path, unwrapPathError(err))
+		}
+		for k, v := range env {
+			loaded[k] = v
+		}
+	}
+	for k, v := range environment {
+		loaded[k] = v
+	}
+	for name, path := range fromFile {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read environment variable %q from file %q: %w", name, path, unwrapPathError(err))
+		}
+		loaded[name] = strings.TrimSuffix(string(data), "\n")
+	}
+	return loaded, nil
+}
+
+// unwrapPathError returns the error underlying an *os.PathError, for
+// messages that already include the path.
+func unwrapPathError(err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
 }
 
 func copyIntPtr(p *int) *int {
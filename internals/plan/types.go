@@ -2,7 +2,9 @@ package plan
 
 import (
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -65,3 +67,168 @@ func (o *OptionalFloat) UnmarshalYAML(value *yaml.Node) error {
 	o.IsSet = true
 	return nil
 }
+
+// OptionalBool is a boolean that may be left unset, so that a layer can
+// set it to false over a true value from a previous layer.
+type OptionalBool struct {
+	Value bool
+	IsSet bool
+}
+
+func (o OptionalBool) IsZero() bool {
+	return !o.IsSet
+}
+
+func (o OptionalBool) MarshalYAML() (interface{}, error) {
+	if !o.IsSet {
+		return nil, nil
+	}
+	return o.Value, nil
+}
+
+func (o *OptionalBool) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("value must be a YAML boolean")
+	}
+	var b bool
+	err := value.Decode(&b)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", value.Value)
+	}
+	o.Value = b
+	o.IsSet = true
+	return nil
+}
+
+// OptionalSize is a size in bytes, which may be written in YAML as a plain
+// number of bytes or with a unit suffix, for example "512KiB" or "10MB".
+type OptionalSize struct {
+	Value int64
+	IsSet bool
+}
+
+func (o OptionalSize) IsZero() bool {
+	return !o.IsSet
+}
+
+func (o OptionalSize) MarshalYAML() (interface{}, error) {
+	if !o.IsSet {
+		return nil, nil
+	}
+	return formatSize(o.Value), nil
+}
+
+func (o *OptionalSize) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("size must be a YAML string or number")
+	}
+	size, err := parseSize(value.Value)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", value.Value)
+	}
+	o.Value = size
+	o.IsSet = true
+	return nil
+}
+
+type sizeUnit struct {
+	suffix     string
+	multiplier int64
+}
+
+// sizeUnits lists the accepted size suffixes, longest first so that "KiB"
+// isn't matched as "B", and binary units largest first for formatSize.
+var sizeUnits = []sizeUnit{
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"GB", 1000 * 1000 * 1000},
+	{"MB", 1000 * 1000},
+	{"KB", 1000},
+	{"B", 1},
+}
+
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSuffix(s, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size out of range")
+	}
+	return n * multiplier, nil
+}
+
+// formatSize formats n using the largest binary unit that divides it
+// exactly, so that it round-trips through parseSize.
+func formatSize(n int64) string {
+	for _, unit := range sizeUnits[:3] {
+		if n != 0 && n%unit.multiplier == 0 {
+			return strconv.FormatInt(n/unit.multiplier, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
+
+// ServiceInstances is the instances of a service, which may be written in
+// YAML as a number N, meaning instances "1" to "N", or a list of instance
+// names.
+type ServiceInstances struct {
+	Count int
+	Names []string
+}
+
+func (i ServiceInstances) IsZero() bool {
+	return i.Count == 0 && i.Names == nil
+}
+
+func (i ServiceInstances) MarshalYAML() (interface{}, error) {
+	if i.Names != nil {
+		return i.Names, nil
+	}
+	if i.Count == 0 {
+		return nil, nil
+	}
+	return i.Count, nil
+}
+
+func (i *ServiceInstances) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		n, err := strconv.Atoi(value.Value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("instances must be a positive number or a list of names")
+		}
+		*i = ServiceInstances{Count: n}
+	case yaml.SequenceNode:
+		var names []string
+		err := value.Decode(&names)
+		if err != nil || len(names) == 0 {
+			return fmt.Errorf("instances must be a positive number or a list of names")
+		}
+		*i = ServiceInstances{Names: names}
+	default:
+		return fmt.Errorf("instances must be a positive number or a list of names")
+	}
+	return nil
+}
+
+// List returns the instance names.
+func (i ServiceInstances) List() []string {
+	if i.Names != nil {
+		return i.Names
+	}
+	names := make([]string, i.Count)
+	for n := range names {
+		names[n] = strconv.Itoa(n + 1)
+	}
+	return names
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plan
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var variableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// instanceVariable is the variable whose value is the instance name, in a
+// service that's an instance of a service with instances.
+const instanceVariable = "INSTANCE"
+
+// ExpandVariables replaces the references to variables in the combined
+// layer's service commands, environment values and working directories,
+// check URLs and log target locations. A reference is written "${NAME}",
+// or "${NAME:-default}" to use the default if the variable is unset or
+// empty, and "$${" is written for a literal "${", for example for a shell
+// in a command.
+//
+// A variable's value comes from the combined layer's variables if it's
+// defined there, and otherwise from Pebble's environment. It's an error to
+// refer to a variable that's undefined without giving a default. The
+// layer's variables may themselves refer to Pebble's environment variables
+// in the same way. INSTANCE is the instance name in an instance of a
+// service with instances, so this must be called after ExpandInstances.
+func ExpandVariables(combined *Layer) error {
+	variables := make(map[string]string, len(combined.Variables))
+	for name, value := range combined.Variables {
+		expanded, err := expandVariables(value, os.LookupEnv)
+		if err != nil {
+			return variablesError(fmt.Sprintf("plan variable %q", name), err)
+		}
+		variables[name] = expanded
+	}
+	return interpolate(combined, func(name string) (string, bool) {
+		if value, ok := variables[name]; ok {
+			return value, true
+		}
+		return os.LookupEnv(name)
+	})
+}
+
+// interpolate replaces the references to the variables that lookup knows in
+// the combined layer, as described in ExpandVariables.
+func interpolate(combined *Layer, lookup func(name string) (string, bool)) error {
+	for name, service := range combined.Services {
+		serviceLookup := lookup
+		switch {
+		case service.Instance != "":
+			serviceLookup = func(name string) (string, bool) {
+				if name == instanceVariable {
+					return service.Instance, true
+				}
+				return lookup(name)
+			}
+		case !service.Instances.IsZero():
+			// The service itself, rather than its instances, is only
+			// expanded to show it (see Plan.WithTemplates), so INSTANCE
+			// is left as it is.
+			serviceLookup = func(name string) (string, bool) {
+				if name == instanceVariable {
+					return "${" + instanceVariable + "}", true
+				}
+				return lookup(name)
+			}
+		}
+		var err error
+		service.Command, err = expandVariables(service.Command, serviceLookup)
+		if err != nil {
+			return variablesError(fmt.Sprintf("plan service %q command", name), err)
+		}
+		for k, v := range service.Environment {
+			service.Environment[k], err = expandVariables(v, serviceLookup)
+			if err != nil {
+				return variablesError(fmt.Sprintf("plan service %q environment variable %q", name, k), err)
+			}
+		}
+		service.WorkingDir, err = expandVariables(service.WorkingDir, serviceLookup)
+		if err != nil {
+			return variablesError(fmt.Sprintf("plan service %q working-dir", name), err)
+		}
+	}
+
+	for name, check := range combined.Checks {
+		if check.HTTP == nil {
+			continue
+		}
+		var err error
+		check.HTTP.URL, err = expandVariables(check.HTTP.URL, lookup)
+		if err != nil {
+			return variablesError(fmt.Sprintf("plan check %q HTTP URL", name), err)
+		}
+	}
+
+	for name, target := range combined.LogTargets {
+		var err error
+		target.Location, err = expandVariables(target.Location, lookup)
+		if err != nil {
+			return variablesError(fmt.Sprintf("plan log target %q location", name), err)
+		}
+	}
+	return nil
+}
+
+func variablesError(field string, err error) error {
+	return &FormatError{
+		Message: fmt.Sprintf("%s %v", field, err),
+	}
+}
+
+// expandVariables returns s with the references to variables replaced by
+// their values.
+func expandVariables(s string, lookup func(name string) (string, bool)) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			// "$${" is an escaped "${", and s[:i] already ends with the
+			// first "$".
+			b.WriteString(s[:i])
+			b.WriteString("{")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("has unterminated variable reference %q", s[i:])
+		}
+		name, defaultValue, hasDefault := strings.Cut(s[i+2:i+end], ":-")
+		if !variableNameRegexp.MatchString(name) {
+			return "", fmt.Errorf("has invalid variable reference %q", s[i:i+end+1])
+		}
+		value, ok := lookup(name)
+		switch {
+		case hasDefault && value == "":
+			value = defaultValue
+		case !ok:
+			return "", fmt.Errorf("refers to undefined variable %q", name)
+		}
+		b.WriteString(value)
+		s = s[i+end+1:]
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package plan_test
+
+import (
+	"os"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internals/plan"
+)
+
+func (s *S) TestExpandVariables(c *C) {
+	os.Setenv("PEBBLE_TEST_HOST", "example.com")
+	defer os.Unsetenv("PEBBLE_TEST_HOST")
+	os.Setenv("PEBBLE_TEST_PORT", "1234")
+	defer os.Unsetenv("PEBBLE_TEST_PORT")
+
+	layer, err := plan.ParseLayer(0, "label", reindent(`
+		variables:
+			HOST: ${PEBBLE_TEST_HOST}
+			PORT: "8080"
+			LOG_LEVEL: ${PEBBLE_TEST_LOG_LEVEL:-info}
+			DATA_DIR: /var/lib/srv
+			EMPTY: ""
+			LITERAL: $${PEBBLE_TEST_HOST}
+		services:
+			srv1:
+				override: replace
+				command: server --port ${PORT} --log ${LOG_LEVEL} --empty=${EMPTY:-x} --literal=${LITERAL}
+				working-dir: ${DATA_DIR}/work
+				environment:
+					HOST: ${HOST}
+					ESCAPED: $${DATA_DIR}
+			worker:
+				override: replace
+				command: worker --dir ${DATA_DIR}/${INSTANCE}
+				instances: [a, b]
+		checks:
+			chk1:
+				override: replace
+				http:
+					url: http://${HOST}:${PORT}/health
+		log-targets:
+			tgt1:
+				override: replace
+				type: loki
+				location: https://${HOST}/loki
+`))
+	c.Assert(err, IsNil)
+	combined, err := plan.CombineLayers(layer)
+	c.Assert(err, IsNil)
+	err = plan.ExpandInstances(combined)
+	c.Assert(err, IsNil)
+	err = plan.ExpandVariables(combined)
+	c.Assert(err, IsNil)
+
+	srv1 := combined.Services["srv1"]
+	c.Check(srv1.Command, Equals, "server --port 8080 --log info --empty=x --literal=${PEBBLE_TEST_HOST}")
+	c.Check(srv1.WorkingDir, Equals, "/var/lib/srv/work")
+	c.Check(srv1.Environment, DeepEquals, map[string]string{
+		"HOST":    "example.com",
+		"ESCAPED": "${DATA_DIR}",
+	})
+	c.Check(combined.Services["worker@a"].Command, Equals, "worker --dir /var/lib/srv/a")
+	c.Check(combined.Services["worker@b"].Command, Equals, "worker --dir /var/lib/srv/b")
+	c.Check(combined.Checks["chk1"].HTTP.URL, Equals, "http://example.com:8080/health")
+	c.Check(combined.LogTargets["tgt1"].Location, Equals, "https://example.com/loki")
+
+	// The variables are shown as they're defined, and the layer itself
+	// isn't changed.
+	c.Check(combined.Variables["HOST"], Equals, "${PEBBLE_TEST_HOST}")
+	c.Check(layer.Services["srv1"].Command, Equals,
+		"server --port ${PORT} --log ${LOG_LEVEL} --empty=${EMPTY:-x} --literal=${LITERAL}")
+}
+
+func (s *S) TestExpandVariablesEnvironment(c *C) {
+	os.Setenv("PEBBLE_TEST_HOST", "example.com")
+	defer os.Unsetenv("PEBBLE_TEST_HOST")
+	os.Setenv("PEBBLE_TEST_EMPTY", "")
+	defer os.Unsetenv("PEBBLE_TEST_EMPTY")
+
+	// References to names that aren't in the variables come from Pebble's
+	// environment, or use their default if unset or empty. A shell's
+	// references are escaped with "$${".
+	layer, err := plan.ParseLayer(0, "label", reindent(`
+		services:
+			srv1:
+				override: replace
+				command: server --host ${PEBBLE_TEST_HOST} --port ${PEBBLE_TEST_PORT:-8080} --mode ${PEBBLE_TEST_EMPTY:-default}
+				environment:
+					PATH: /opt/bin:${PEBBLE_TEST_PATH:-/usr/bin}
+			srv2:
+				override: replace
+				command: sh -c 'for i in 1 2; do echo $${i} $${HOME:-/}; done'
+`))
+	c.Assert(err, IsNil)
+	combined, err := plan.CombineLayers(layer)
+	c.Assert(err, IsNil)
+	err = plan.ExpandVariables(combined)
+	c.Assert(err, IsNil)
+	c.Check(combined.Services["srv1"].Command, Equals, "server --host example.com --port 8080 --mode default")
+	c.Check(combined.Services["srv1"].Environment["PATH"], Equals, "/opt/bin:/usr/bin")
+	c.Check(combined.Services["srv2"].Command, Equals, "sh -c 'for i in 1 2; do echo ${i} ${HOME:-/}; done'")
+
+	// The layers' variables take precedence over Pebble's environment.
+	layer.Variables = map[string]string{"PEBBLE_TEST_HOST": "localhost"}
+	combined, err = plan.CombineLayers(layer)
+	c.Assert(err, IsNil)
+	err = plan.ExpandVariables(combined)
+	c.Assert(err, IsNil)
+	c.Check(combined.Services["srv1"].Command, Equals, "server --host localhost --port 8080 --mode default")
+}
+
+var expandVariablesErrorTests = []struct {
+	layer string
+	error string
+}{{
+	layer: `
+		variables:
+			PORT: ${PEBBLE_TEST_UNDEFINED}
+`,
+	error: `plan variable "PORT" refers to undefined variable "PEBBLE_TEST_UNDEFINED"`,
+}, {
+	layer: `
+		variables:
+			DIR: /srv/${DIR
+`,
+	error: `plan variable "DIR" has unterminated variable reference "\$\{DIR"`,
+}, {
+	layer: `
+		variables:
+			PORT: ${1}
+`,
+	error: `plan variable "PORT" has invalid variable reference "\$\{1\}"`,
+}, {
+	layer: `
+		services:
+			srv1:
+				override: replace
+				command: server --port ${PEBBLE_TEST_UNDEFINED}
+`,
+	error: `plan service "srv1" command refers to undefined variable "PEBBLE_TEST_UNDEFINED"`,
+}, {
+	layer: `
+		services:
+			srv1:
+				override: replace
+				command: sh -c 'echo ${#PATH}'
+`,
+	error: `plan service "srv1" command has invalid variable reference "\$\{#PATH\}"`,
+}, {
+	layer: `
+		services:
+			srv1:
+				override: replace
+				command: server
+				environment:
+					DIR: ${PEBBLE_TEST_UNDEFINED}/data
+`,
+	error: `plan service "srv1" environment variable "DIR" refers to undefined variable "PEBBLE_TEST_UNDEFINED"`,
+}, {
+	layer: `
+		checks:
+			chk1:
+				override: replace
+				http:
+					url: http://localhost:${PEBBLE_TEST_UNDEFINED}/health
+`,
+	error: `plan check "chk1" HTTP URL refers to undefined variable "PEBBLE_TEST_UNDEFINED"`,
+}, {
+	layer: `
+		log-targets:
+			tgt1:
+				override: replace
+				type: loki
+				location: ${PEBBLE_TEST_UNDEFINED}
+`,
+	error: `plan log target "tgt1" location refers to undefined variable "PEBBLE_TEST_UNDEFINED"`,
+}}
+
+func (s *S) TestExpandVariablesErrors(c *C) {
+	for _, test := range expandVariablesErrorTests {
+		layer, err := plan.ParseLayer(0, "label", reindent(test.layer))
+		c.Assert(err, IsNil)
+		combined, err := plan.CombineLayers(layer)
+		c.Assert(err, IsNil)
+		err = plan.ExpandVariables(combined)
+		c.Check(err, ErrorMatches, test.error)
+		_, ok := err.(*plan.FormatError)
+		c.Check(ok, Equals, true)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package rlimit parses and sets resource limits (see setrlimit(2)).
+//
+// Go's os/exec has no way to set resource limits in the child process
+// between fork and exec, so they're applied to commands by the sandbox
+// package's helper, which calls Set before executing the command's program.
+package rlimit
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// resources maps the limit names used in layers and the API to resources.
+var resources = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// Limit is the soft and hard values of a resource limit.
+type Limit struct {
+	Soft uint64 `json:"soft"`
+	Hard uint64 `json:"hard"`
+}
+
+// Validate checks that the limits, which map resource names such as
+// "nofile" to limits such as "1024", "1024:4096" or "unlimited", are valid.
+func Validate(limits map[string]string) error {
+	_, err := Parse(limits)
+	return err
+}
+
+// Parse parses limits (see Validate), returning the limits by resource name.
+func Parse(limits map[string]string) (map[string]Limit, error) {
+	// Check in sorted order so that the error is deterministic.
+	names := make([]string, 0, len(limits))
+	for name := range limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parsed := make(map[string]Limit, len(limits))
+	for _, name := range names {
+		if _, ok := resources[name]; !ok {
+			return nil, fmt.Errorf("unknown resource %q", name)
+		}
+		l, err := parseLimit(limits[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s limit %q: %w", name, limits[name], err)
+		}
+		parsed[name] = l
+	}
+	return parsed, nil
+}
+
+// parseLimit parses a limit in the form "soft:hard" or "value" (which sets
+// both soft and hard limits), where each value is a non-negative integer or
+// "unlimited".
+func parseLimit(s string) (Limit, error) {
+	softStr, hardStr, ok := strings.Cut(s, ":")
+	if !ok {
+		hardStr = softStr
+	}
+	soft, err := parseValue(softStr)
+	if err != nil {
+		return Limit{}, err
+	}
+	hard, err := parseValue(hardStr)
+	if err != nil {
+		return Limit{}, err
+	}
+	if soft > hard {
+		return Limit{}, fmt.Errorf("soft limit must not be greater than hard limit")
+	}
+	return Limit{Soft: soft, Hard: hard}, nil
+}
+
+func parseValue(s string) (uint64, error) {
+	if s == "unlimited" {
+		return unix.RLIM_INFINITY, nil
+	}
+	value, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf(`must be a non-negative integer or "unlimited"`)
+	}
+	return value, nil
+}
+
+// Set sets the calling process's limits, as returned by Parse.
+func Set(limits map[string]Limit) error {
+	for name, l := range limits {
+		// Use syscall.Setrlimit, so that Go doesn't restore its original
+		// RLIMIT_NOFILE when executing a program.
+		err := syscall.Setrlimit(resources[name], &syscall.Rlimit{Cur: l.Soft, Max: l.Hard})
+		if err != nil {
+			return fmt.Errorf("cannot set %s limit: %w", name, err)
+		}
+	}
+	return nil
+}
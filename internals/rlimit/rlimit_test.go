@@ -0,0 +1,64 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rlimit_test
+
+import (
+	"math"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internals/rlimit"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type rlimitSuite struct{}
+
+var _ = Suite(&rlimitSuite{})
+
+func (s *rlimitSuite) TestValidate(c *C) {
+	tests := []struct {
+		limits map[string]string
+		err    string
+	}{
+		{nil, ""},
+		{map[string]string{"nofile": "1024"}, ""},
+		{map[string]string{"nofile": "1024:4096", "core": "unlimited", "stack": "0:unlimited"}, ""},
+		{map[string]string{"files": "1024"}, `unknown resource "files"`},
+		{map[string]string{"nofile": "lots"}, `invalid nofile limit "lots": must be a non-negative integer or "unlimited"`},
+		{map[string]string{"nofile": "-1"}, `invalid nofile limit "-1": .*`},
+		{map[string]string{"nofile": "1024:"}, `invalid nofile limit "1024:": .*`},
+		{map[string]string{"nofile": "4096:1024"}, `invalid nofile limit "4096:1024": soft limit must not be greater than hard limit`},
+		{map[string]string{"nproc": "10", "as": "x"}, `invalid as limit "x": .*`},
+	}
+	for _, test := range tests {
+		err := rlimit.Validate(test.limits)
+		if test.err == "" {
+			c.Check(err, IsNil, Commentf("%v", test.limits))
+		} else {
+			c.Check(err, ErrorMatches, test.err, Commentf("%v", test.limits))
+		}
+	}
+}
+
+func (s *rlimitSuite) TestParse(c *C) {
+	limits, err := rlimit.Parse(map[string]string{"nofile": "1024:4096", "core": "unlimited"})
+	c.Assert(err, IsNil)
+	c.Check(limits, DeepEquals, map[string]rlimit.Limit{
+		"nofile": {Soft: 1024, Hard: 4096},
+		"core":   {Soft: math.MaxUint64, Hard: math.MaxUint64},
+	})
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/pebble/internals/rlimit"
+)
+
+// helperExitCode is the exit code of the helper if it can't execute the
+// program (the same as a shell's when a command can't be executed).
+const helperExitCode = 127
+
+func init() {
+	data, ok := os.LookupEnv(helperEnv)
+	if !ok {
+		return
+	}
+	// runHelper only returns if it can't execute the program.
+	err := runHelper(data)
+	fmt.Fprintf(os.Stderr, "cannot execute %q: %v\n", os.Args[0], err)
+	os.Exit(helperExitCode)
+}
+
+// runHelper sets up the sandbox (and credential) and executes the program,
+// in place of this process.
+func runHelper(data string) error {
+	var args helperArgs
+	err := json.Unmarshal([]byte(data), &args)
+	if err != nil {
+		return fmt.Errorf("cannot decode helper arguments: %w", err)
+	}
+
+	// The credential is set on this thread only (unlike syscall.Setuid,
+	// which doesn't work when cgo is used), so the program must be executed
+	// from this thread too.
+	runtime.LockOSThread()
+
+	// Mounts are done first, while the process is privileged. The process
+	// is already in its own mount namespace (see Command).
+	if args.PrivateTmp {
+		err := unix.Mount("tmpfs", "/tmp", "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777")
+		if err != nil {
+			return fmt.Errorf("cannot mount private /tmp: %w", err)
+		}
+	}
+	for _, path := range args.ReadOnlyPaths {
+		err := makeReadOnly(path)
+		if err != nil {
+			return fmt.Errorf("cannot make %q read-only: %w", path, err)
+		}
+	}
+
+	if args.Umask != nil {
+		syscall.Umask(*args.Umask)
+	}
+
+	err = rlimit.Set(args.Limits)
+	if err != nil {
+		return err
+	}
+
+	if len(args.KeepCapabilities) > 0 || len(args.DropCapabilities) > 0 {
+		err := dropCapabilities(args.KeepCapabilities, args.DropCapabilities)
+		if err != nil {
+			return err
+		}
+	}
+
+	if args.NoNewPrivileges {
+		err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+		if err != nil {
+			return fmt.Errorf("cannot set no_new_privs: %w", err)
+		}
+	}
+
+	if args.Uid != nil && args.Gid != nil {
+		err := setCredential(*args.Uid, *args.Gid, args.Groups, args.NoSetGroups)
+		if err != nil {
+			return err
+		}
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, helperEnv+"=") && !strings.HasPrefix(kv, "LISTEN_PID=") {
+			env = append(env, kv)
+		}
+	}
+	if args.SetListenPID {
+		// The PID is the same after the program is executed.
+		env = append(env, "LISTEN_PID="+strconv.Itoa(os.Getpid()))
+	}
+	return syscall.Exec(args.Path, os.Args, env)
+}
+
+// makeReadOnly bind-mounts path onto itself, and then makes the bind mount
+// read-only (which can't be done in one step).
+func makeReadOnly(path string) error {
+	err := unix.Mount(path, path, "", unix.MS_BIND|unix.MS_REC, "")
+	if err != nil {
+		return err
+	}
+	// Keep the flags of the mount the path is on, as some of them can't be
+	// cleared when the mount namespace is owned by a user namespace.
+	var st unix.Statfs_t
+	err = unix.Statfs(path, &st)
+	if err != nil {
+		return err
+	}
+	flags := uintptr(st.Flags) & (unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME)
+	return unix.Mount("", path, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY|flags, "")
+}
+
+// dropCapabilities removes capabilities from the bounding set: all except
+// those in keep if it's not empty, otherwise those in drop.
+func dropCapabilities(keep, drop []int) error {
+	if len(keep) > 0 {
+		kept := make(map[int]bool, len(keep))
+		for _, c := range keep {
+			kept[c] = true
+		}
+		drop = nil
+		// PR_CAPBSET_READ fails with EINVAL for capabilities the kernel
+		// doesn't support.
+		for c := 0; ; c++ {
+			_, err := unix.PrctlRetInt(unix.PR_CAPBSET_READ, uintptr(c), 0, 0, 0)
+			if err != nil {
+				break
+			}
+			if !kept[c] {
+				drop = append(drop, c)
+			}
+		}
+	}
+	for _, c := range drop {
+		err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0)
+		if err != nil && err != unix.EINVAL {
+			return fmt.Errorf("cannot drop capability %d: %w", c, err)
+		}
+	}
+	return nil
+}
+
+// setCredential sets the calling thread's group list, group ID and user ID,
+// in the same way as os/exec does for SysProcAttr.Credential.
+func setCredential(uid, gid uint32, groups []uint32, noSetGroups bool) error {
+	if !noSetGroups {
+		var groupsPtr uintptr
+		if len(groups) > 0 {
+			groupsPtr = uintptr(unsafe.Pointer(&groups[0]))
+		}
+		_, _, errno := syscall.RawSyscall(_SYS_SETGROUPS, uintptr(len(groups)), groupsPtr, 0)
+		if errno != 0 {
+			return fmt.Errorf("cannot set groups: %w", errno)
+		}
+	}
+	_, _, errno := syscall.RawSyscall(_SYS_SETGID, uintptr(gid), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("cannot set group ID: %w", errno)
+	}
+	_, _, errno = syscall.RawSyscall(_SYS_SETUID, uintptr(uid), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("cannot set user ID: %w", errno)
+	}
+	return nil
+}
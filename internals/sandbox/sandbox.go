@@ -0,0 +1,258 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package sandbox confines commands: it applies resource limits, drops
+// capabilities, sets the no_new_privs flag and umask, and makes paths
+// read-only or /tmp private in a mount namespace of the command's own.
+//
+// Go's os/exec has no way to do most of this in the child process between
+// fork and exec, so Command arranges for the command to be started via a
+// helper: the current executable, re-executed with an environment variable
+// that makes this package's init function set up the sandbox and then
+// execute the command's program in the same process. This means the program
+// runs in the sandbox from its first instruction, and has the PID (and
+// process group) that the caller expects.
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/pebble/internals/rlimit"
+)
+
+// helperEnv is the environment variable that makes a process started by
+// Command set up the sandbox and execute the program (see init).
+const helperEnv = "PEBBLE_SANDBOX_HELPER"
+
+// selfExe is the path used to re-execute the current executable.
+var selfExe = "/proc/self/exe"
+
+// capabilities maps capability names to their numbers (see capabilities(7)).
+var capabilities = map[string]int{
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// Options specify the sandbox a command runs in.
+type Options struct {
+	// Limits are resource limits, as validated by rlimit.Validate.
+	Limits map[string]string
+
+	// NoNewPrivileges sets the no_new_privs flag, so that the command (and
+	// its children) can't gain privileges, for example by executing setuid
+	// programs.
+	NoNewPrivileges bool
+
+	// KeepCapabilities, if not empty, are the only capabilities kept in the
+	// command's capability bounding set. DropCapabilities are removed from
+	// it. Only one of them may be set.
+	KeepCapabilities []string
+	DropCapabilities []string
+
+	// ReadOnlyPaths are made read-only for the command, in its own mount
+	// namespace.
+	ReadOnlyPaths []string
+
+	// PrivateTmp mounts an empty tmpfs on /tmp for the command, in its own
+	// mount namespace.
+	PrivateTmp bool
+
+	// Umask is the command's file mode creation mask, in octal, such as
+	// "0027". If empty, the command inherits Pebble's umask.
+	Umask string
+
+	// SetListenPID sets the LISTEN_PID environment variable to the
+	// command's PID, for commands passed sockets using the LISTEN_FDS
+	// protocol (see sd_listen_fds(3)).
+	SetListenPID bool
+}
+
+func (opts *Options) isEmpty() bool {
+	return len(opts.Limits) == 0 && !opts.NoNewPrivileges &&
+		len(opts.KeepCapabilities) == 0 && len(opts.DropCapabilities) == 0 &&
+		len(opts.ReadOnlyPaths) == 0 && !opts.PrivateTmp && opts.Umask == "" &&
+		!opts.SetListenPID
+}
+
+// helperArgs tells the helper what to do before executing the program.
+type helperArgs struct {
+	Path   string                  `json:"path"`
+	Limits map[string]rlimit.Limit `json:"limits,omitempty"`
+
+	NoNewPrivileges  bool     `json:"no-new-privileges,omitempty"`
+	KeepCapabilities []int    `json:"keep-capabilities,omitempty"`
+	DropCapabilities []int    `json:"drop-capabilities,omitempty"`
+	ReadOnlyPaths    []string `json:"read-only-paths,omitempty"`
+	PrivateTmp       bool     `json:"private-tmp,omitempty"`
+	Umask            *int     `json:"umask,omitempty"`
+	SetListenPID     bool     `json:"set-listen-pid,omitempty"`
+
+	// Credential is set in the helper rather than when the helper is
+	// started, as the rest of the setup requires privileges.
+	Uid         *uint32  `json:"uid,omitempty"`
+	Gid         *uint32  `json:"gid,omitempty"`
+	Groups      []uint32 `json:"groups,omitempty"`
+	NoSetGroups bool     `json:"no-set-groups,omitempty"`
+}
+
+func parseOptions(opts *Options) (*helperArgs, error) {
+	var args helperArgs
+	var err error
+	args.Limits, err = rlimit.Parse(opts.Limits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid limits: %w", err)
+	}
+	args.NoNewPrivileges = opts.NoNewPrivileges
+	if len(opts.KeepCapabilities) > 0 && len(opts.DropCapabilities) > 0 {
+		return nil, fmt.Errorf("cannot both keep and drop capabilities")
+	}
+	args.KeepCapabilities, err = ParseCapabilities(opts.KeepCapabilities)
+	if err != nil {
+		return nil, err
+	}
+	args.DropCapabilities, err = ParseCapabilities(opts.DropCapabilities)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range opts.ReadOnlyPaths {
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("read-only path %q must be absolute", path)
+		}
+		args.ReadOnlyPaths = append(args.ReadOnlyPaths, filepath.Clean(path))
+	}
+	args.PrivateTmp = opts.PrivateTmp
+	args.SetListenPID = opts.SetListenPID
+	if opts.Umask != "" {
+		umask, err := ParseUmask(opts.Umask)
+		if err != nil {
+			return nil, err
+		}
+		args.Umask = &umask
+	}
+	return &args, nil
+}
+
+// ParseCapabilities returns the numbers of the named capabilities, such as
+// "CAP_NET_ADMIN".
+func ParseCapabilities(names []string) ([]int, error) {
+	var caps []int
+	for _, name := range names {
+		c, ok := capabilities[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+// ParseUmask parses an octal umask such as "0027".
+func ParseUmask(s string) (int, error) {
+	umask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || umask > 0777 {
+		return 0, fmt.Errorf("invalid umask %q: must be an octal number from 0000 to 0777", s)
+	}
+	return int(umask), nil
+}
+
+// Command modifies cmd so that its program is executed in the sandbox the
+// options specify. It must be called after cmd's environment and
+// SysProcAttr have been set up, and before it's started.
+func Command(cmd *exec.Cmd, opts *Options) error {
+	if opts.isEmpty() || cmd.Err != nil {
+		// No sandbox, or Start will fail anyway.
+		return nil
+	}
+	args, err := parseOptions(opts)
+	if err != nil {
+		return err
+	}
+	args.Path = cmd.Path
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if cmd.SysProcAttr.Credential != nil {
+		credential := cmd.SysProcAttr.Credential
+		args.Uid = &credential.Uid
+		args.Gid = &credential.Gid
+		args.Groups = credential.Groups
+		args.NoSetGroups = credential.NoSetGroups
+		cmd.SysProcAttr.Credential = nil
+	}
+	if len(args.ReadOnlyPaths) > 0 || args.PrivateTmp {
+		// The Go runtime also makes all mounts private in the new mount
+		// namespace, so the helper's mounts don't propagate to Pebble's.
+		cmd.SysProcAttr.Unshareflags |= syscall.CLONE_NEWNS
+	}
+	data, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env[:len(env):len(env)], helperEnv+"="+string(data))
+	cmd.Path = selfExe
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internals/sandbox"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type sandboxSuite struct{}
+
+var _ = Suite(&sandboxSuite{})
+
+func (s *sandboxSuite) TestParseCapabilities(c *C) {
+	caps, err := sandbox.ParseCapabilities([]string{"CAP_CHOWN", "CAP_NET_BIND_SERVICE"})
+	c.Assert(err, IsNil)
+	c.Check(caps, DeepEquals, []int{0, 10})
+
+	_, err = sandbox.ParseCapabilities([]string{"CAP_CHOWN", "NET_ADMIN"})
+	c.Check(err, ErrorMatches, `unknown capability "NET_ADMIN"`)
+}
+
+func (s *sandboxSuite) TestParseUmask(c *C) {
+	umask, err := sandbox.ParseUmask("0027")
+	c.Assert(err, IsNil)
+	c.Check(umask, Equals, 027)
+
+	for _, s := range []string{"", "8", "01000", "-1", "u=rwx"} {
+		_, err = sandbox.ParseUmask(s)
+		c.Check(err, ErrorMatches, `invalid umask ".*": must be an octal number from 0000 to 0777`)
+	}
+}
+
+func (s *sandboxSuite) TestCommandLimits(c *C) {
+	cmd := exec.Command("/bin/sh", "-c", `echo "$(ulimit -Sn) $(ulimit -Hn) $(ulimit -c) $0 ${PEBBLE_SANDBOX_HELPER:-unset}"`)
+	err := sandbox.Command(cmd, &sandbox.Options{Limits: map[string]string{"nofile": "123:456", "core": "0"}})
+	c.Assert(err, IsNil)
+	output, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Check(string(output), Equals, "123 456 0 /bin/sh unset\n")
+}
+
+func (s *sandboxSuite) TestCommandNoOptions(c *C) {
+	cmd := exec.Command("/bin/sh", "-c", "echo ok")
+	err := sandbox.Command(cmd, &sandbox.Options{})
+	c.Assert(err, IsNil)
+	c.Check(cmd.Path, Equals, "/bin/sh")
+	c.Check(cmd.Env, IsNil)
+}
+
+func (s *sandboxSuite) TestCommandInvalid(c *C) {
+	cmd := exec.Command("/bin/sh", "-c", "echo never")
+	err := sandbox.Command(cmd, &sandbox.Options{ReadOnlyPaths: []string{"etc"}})
+	c.Assert(err, ErrorMatches, `read-only path "etc" must be absolute`)
+}
+
+func (s *sandboxSuite) TestCommandError(c *C) {
+	// The nofile limit can't be raised above fs.nr_open, even by root.
+	cmd := exec.Command("/bin/sh", "-c", "echo never")
+	err := sandbox.Command(cmd, &sandbox.Options{Limits: map[string]string{"nofile": "unlimited"}})
+	c.Assert(err, IsNil)
+	output, err := cmd.CombinedOutput()
+	c.Assert(err, NotNil)
+	c.Check(cmd.ProcessState.ExitCode(), Equals, 127)
+	c.Check(string(output), Matches, `cannot execute "/bin/sh": cannot set nofile limit: .*\n`)
+}
+
+func (s *sandboxSuite) TestUmask(c *C) {
+	cmd := exec.Command("/bin/sh", "-c", "umask")
+	err := sandbox.Command(cmd, &sandbox.Options{Umask: "0027"})
+	c.Assert(err, IsNil)
+	output, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Check(string(output), Equals, "0027\n")
+}
+
+func (s *sandboxSuite) TestSetListenPID(c *C) {
+	cmd := exec.Command("/bin/sh", "-c", `echo "$LISTEN_PID"`)
+	cmd.Env = []string{"LISTEN_PID=1"}
+	err := sandbox.Command(cmd, &sandbox.Options{SetListenPID: true})
+	c.Assert(err, IsNil)
+	output, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Check(string(output), Equals, strconv.Itoa(cmd.Process.Pid)+"\n")
+}
+
+func (s *sandboxSuite) TestNoNewPrivileges(c *C) {
+	cmd := exec.Command("/bin/grep", "NoNewPrivs", "/proc/self/status")
+	err := sandbox.Command(cmd, &sandbox.Options{NoNewPrivileges: true})
+	c.Assert(err, IsNil)
+	output, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Check(string(output), Equals, "NoNewPrivs:\t1\n")
+}
+
+func (s *sandboxSuite) TestCapabilities(c *C) {
+	if os.Getuid() != 0 {
+		c.Skip("requires running as root")
+	}
+
+	cmd := exec.Command("/bin/grep", "CapBnd", "/proc/self/status")
+	err := sandbox.Command(cmd, &sandbox.Options{KeepCapabilities: []string{"CAP_CHOWN", "CAP_NET_BIND_SERVICE"}})
+	c.Assert(err, IsNil)
+	output, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Check(string(output), Equals, "CapBnd:\t0000000000000401\n")
+
+	cmd = exec.Command("/bin/grep", "CapEff", "/proc/self/status")
+	err = sandbox.Command(cmd, &sandbox.Options{DropCapabilities: []string{"CAP_CHOWN"}})
+	c.Assert(err, IsNil)
+	output, err = cmd.Output()
+	c.Assert(err, IsNil)
+	c.Check(string(output), Matches, "CapEff:\t[0-9a-f]*[02468ace]\n")
+}
+
+func (s *sandboxSuite) TestReadOnlyPaths(c *C) {
+	if os.Getuid() != 0 {
+		c.Skip("requires running as root")
+	}
+
+	dir := c.MkDir()
+	cmd := exec.Command("/bin/sh", "-c", "touch "+filepath.Join(dir, "file"))
+	err := sandbox.Command(cmd, &sandbox.Options{ReadOnlyPaths: []string{dir}})
+	c.Assert(err, IsNil)
+	output, err := cmd.CombinedOutput()
+	c.Assert(err, NotNil)
+	c.Check(string(output), Matches, "(?i).*read-only file system\n")
+
+	// The mount is only in the command's mount namespace.
+	err = os.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	c.Assert(err, IsNil)
+}
+
+func (s *sandboxSuite) TestPrivateTmp(c *C) {
+	if os.Getuid() != 0 {
+		c.Skip("requires running as root")
+	}
+
+	f, err := os.CreateTemp("/tmp", "sandbox-test-")
+	c.Assert(err, IsNil)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	cmd := exec.Command("/bin/sh", "-c", "ls -A /tmp; touch /tmp/private")
+	err = sandbox.Command(cmd, &sandbox.Options{PrivateTmp: true})
+	c.Assert(err, IsNil)
+	output, err := cmd.CombinedOutput()
+	c.Assert(err, IsNil)
+	c.Check(string(output), Equals, "")
+	c.Check(osExists("/tmp/private"), Equals, false)
+	c.Check(osExists(f.Name()), Equals, true)
+}
+
+func osExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -20,15 +20,28 @@ import (
 	"time"
 )
 
+// Streams that service output is written to, recorded in each log entry.
+const (
+	StdoutStream = "stdout"
+	StderrStream = "stderr"
+)
+
 type formatter struct {
 	mut             sync.Mutex
 	serviceName     string
 	dest            io.Writer
 	writeTimestamp  bool
+	stream          string // stream of the current line
 	timestampBuffer []byte
 	timestamp       []byte
 }
 
+// formatterStream is the io.Writer for one of the formatter's streams.
+type formatterStream struct {
+	f      *formatter
+	stream string
+}
+
 const (
 	// outputTimeFormat is RFC3339 with millisecond precision.
 	outputTimeFormat = "2006-01-02T15:04:05.000Z07:00"
@@ -48,24 +61,51 @@ const (
 //	2021-05-13T03:16:52.002Z [test] second\n
 //	2021-05-13T03:16:53.003Z [test] third\n
 func NewFormatWriter(dest io.Writer, serviceName string) io.Writer {
-	return &formatter{
+	stdout, _ := NewFormatWriters(dest, serviceName)
+	return stdout
+}
+
+// NewFormatWriters returns io.Writers for a service's stdout and stderr,
+// which insert timestamp and service name for every line like
+// NewFormatWriter. Lines written to stderr are marked with a "!" after the
+// service name:
+//
+//	2021-05-13T03:16:51.001Z [test] to stdout\n
+//	2021-05-13T03:16:52.002Z [test]! to stderr\n
+//
+// If a line is only partially written to one stream when the other stream
+// is written to, the partial line is ended with a newline, so that lines
+// from the two streams are never mixed.
+func NewFormatWriters(dest io.Writer, serviceName string) (stdout, stderr io.Writer) {
+	f := &formatter{
 		serviceName:    serviceName,
 		dest:           dest,
 		writeTimestamp: true,
 	}
+	return &formatterStream{f, StdoutStream}, &formatterStream{f, StderrStream}
 }
 
-func (f *formatter) Write(p []byte) (nn int, ee error) {
+func (w *formatterStream) Write(p []byte) (int, error) {
+	return w.f.write(p, w.stream)
+}
+
+func (f *formatter) write(p []byte, stream string) (nn int, ee error) {
 	f.mut.Lock()
 	defer f.mut.Unlock()
+	if !f.writeTimestamp && stream != f.stream && len(p) > 0 {
+		// End the other stream's partial line.
+		_, err := f.dest.Write([]byte{'\n'})
+		if err != nil {
+			return 0, err
+		}
+		f.writeTimestamp = true
+	}
 	written := 0
 	for len(p) > 0 {
 		if f.writeTimestamp {
 			f.writeTimestamp = false
-			f.timestampBuffer = time.Now().UTC().AppendFormat(f.timestampBuffer[:0], outputTimeFormat)
-			f.timestampBuffer = append(f.timestampBuffer, " ["...)
-			f.timestampBuffer = append(f.timestampBuffer, f.serviceName...)
-			f.timestampBuffer = append(f.timestampBuffer, "] "...)
+			f.stream = stream
+			f.timestampBuffer = appendPrefix(f.timestampBuffer[:0], f.serviceName, stream)
 			f.timestamp = f.timestampBuffer
 		}
 
@@ -98,3 +138,17 @@ func (f *formatter) Write(p []byte) (nn int, ee error) {
 	}
 	return written, nil
 }
+
+// appendPrefix appends the "timestamp [service] " prefix of a log line to b,
+// with a "!" after the service name for the stderr stream.
+func appendPrefix(b []byte, serviceName, stream string) []byte {
+	b = time.Now().UTC().AppendFormat(b, outputTimeFormat)
+	b = append(b, " ["...)
+	b = append(b, serviceName...)
+	b = append(b, ']')
+	if stream == StderrStream {
+		b = append(b, '!')
+	}
+	b = append(b, ' ')
+	return b
+}
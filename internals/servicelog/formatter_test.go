@@ -58,3 +58,22 @@ func (s *formatterSuite) TestFormatSingleWrite(c *C) {
 %[1]s \[test\] third
 `[1:], timeFormatRegex))
 }
+
+func (s *formatterSuite) TestFormatStreams(c *C) {
+	b := &bytes.Buffer{}
+	stdout, stderr := servicelog.NewFormatWriters(b, "test")
+
+	fmt.Fprintln(stdout, "out")
+	fmt.Fprintln(stderr, "err")
+	fmt.Fprint(stdout, "partial ")
+	fmt.Fprint(stderr, "err2\n")
+	fmt.Fprint(stdout, "rest\n")
+
+	c.Assert(b.String(), Matches, fmt.Sprintf(`
+%[1]s \[test\] out
+%[1]s \[test\]! err
+%[1]s \[test\] partial 
+%[1]s \[test\]! err2
+%[1]s \[test\] rest
+`[1:], timeFormatRegex))
+}
@@ -21,8 +21,9 @@ import (
 )
 
 // Used to strip the Pebble log prefix, for example: "2006-01-02T15:04:05.000Z [service] "
+// (or "[service]! " for stderr).
 // Timestamp must match format in logger.timestampFormat.
-var timestampServiceRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}Z \[[^]]+\] `)
+var timestampServiceRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}Z \[[^]]+\]!? `)
 
 // LastLines fetches the last n lines of output and, if stripPrefix is true,
 // strips the timestamp and service name prefix from each line. If there are
@@ -57,7 +57,8 @@ func (s *lastLinesSuite) TestLastLinesStripPrefix(c *C) {
 	fmt.Fprintf(buffer, "foo\n")
 	fmt.Fprintf(buffer, "2000-01-01T00:00:00.000Z [svc1] bar\n")
 	fmt.Fprintf(buffer, "2022-12-25T23:59:59.999Z [service2] log msg\n")
+	fmt.Fprintf(buffer, "2022-12-25T23:59:59.999Z [service2]! error msg\n")
 	lines, err := servicelog.LastLines(buffer, 10, "", true)
 	c.Assert(err, IsNil)
-	c.Assert(lines, Equals, "foo\nbar\nlog msg")
+	c.Assert(lines, Equals, "foo\nbar\nlog msg\nerror msg")
 }
@@ -0,0 +1,266 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package servicelog
+
+import (
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// maxMultilineSize is the maximum size of a merged multi-line entry. Once
+	// an entry reaches this size, further continuation lines start a new entry.
+	maxMultilineSize = 16 * 1024
+)
+
+// MultilineOptions configures how NewMultilineFormatWriter merges lines into
+// multi-line entries.
+type MultilineOptions struct {
+	// Continuation, if set, matches lines which continue the previous line,
+	// for example `^\s+at ` for Java stack traces.
+	Continuation *regexp.Regexp
+
+	// Indented, if true, treats lines starting with a space or tab as
+	// continuations of the previous line.
+	Indented bool
+
+	// MaxWait is the maximum time to wait for a continuation line before
+	// the pending entry is written out. If neither Continuation nor Indented
+	// is set, all lines written within MaxWait of an entry's first line are
+	// merged into that entry.
+	MaxWait time.Duration
+}
+
+type multilineFormatter struct {
+	mut         sync.Mutex
+	serviceName string
+	dest        io.Writer
+	options     MultilineOptions
+
+	// midLine is the stream whose partial line was last written out (after
+	// a timeout), or nil; the rest of that line is written as is.
+	midLine *multilineStream
+}
+
+// multilineStream holds the pending entry of one of the formatter's streams.
+type multilineStream struct {
+	f        *multilineFormatter
+	stream   string
+	entry    []byte // pending entry, including its "timestamp [service] " prefix
+	line     []byte // current incomplete line
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// NewMultilineFormatWriters returns io.Writers for a service's stdout and
+// stderr, which insert timestamp and service name like NewFormatWriters, but
+// merge continuation lines into the preceding line's entry, so that (for
+// example) a stack trace is written as a single entry. Only the first line
+// of each entry has the timestamp and service prefix; Parser merges the
+// continuation lines back into one Entry. For the input (with Indented set):
+//
+//	Traceback (most recent call last):\n
+//	  File "main.py", line 1, in <module>\n
+//	next\n
+//
+// The expected output is:
+//
+//	2021-05-13T03:16:51.001Z [test] Traceback (most recent call last):\n
+//	  File "main.py", line 1, in <module>\n
+//	2021-05-13T03:16:52.002Z [test] next\n
+//
+// A pending entry is written once a line that doesn't continue it arrives,
+// or after options.MaxWait. Each stream has its own pending entry.
+func NewMultilineFormatWriters(dest io.Writer, serviceName string, options *MultilineOptions) (stdout, stderr io.Writer) {
+	f := &multilineFormatter{
+		serviceName: serviceName,
+		dest:        dest,
+		options:     *options,
+	}
+	return &multilineStream{f: f, stream: StdoutStream}, &multilineStream{f: f, stream: StderrStream}
+}
+
+func (s *multilineStream) Write(p []byte) (int, error) {
+	f := s.f
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if f.midLine != nil && f.midLine != s && len(p) > 0 {
+		// End the other stream's partial line.
+		_, err := f.dest.Write([]byte{'\n'})
+		if err != nil {
+			return 0, err
+		}
+		f.midLine = nil
+	}
+
+	written := 0
+	for len(p) > 0 {
+		length := 0
+		for length < len(p) {
+			length++
+			if p[length-1] == '\n' {
+				break
+			}
+		}
+		chunk := p[:length]
+		complete := chunk[len(chunk)-1] == '\n'
+
+		if f.midLine == s {
+			// The start of this line was already written by a timeout flush.
+			n, err := f.dest.Write(chunk)
+			written += n
+			if err != nil {
+				return written, err
+			}
+			if complete {
+				f.midLine = nil
+			}
+			p = p[length:]
+			continue
+		}
+
+		if len(s.line) == 0 && len(s.entry) == 0 {
+			s.deadline = time.Now().Add(f.options.MaxWait)
+		}
+		s.line = append(s.line, chunk...)
+		if complete {
+			err := s.addLine(s.line)
+			s.line = s.line[:0]
+			if err != nil {
+				return written, err
+			}
+		} else if len(s.line) >= maxMultilineSize {
+			err := s.flushLine()
+			if err != nil {
+				return written, err
+			}
+		}
+		written += length
+		p = p[length:]
+	}
+
+	if len(s.entry) > 0 || len(s.line) > 0 {
+		s.startTimer()
+	}
+	return written, nil
+}
+
+// addLine adds a complete line to the pending entry if it's a continuation,
+// otherwise it writes out the pending entry and starts a new one.
+func (s *multilineStream) addLine(line []byte) error {
+	options := &s.f.options
+	if len(s.entry) > 0 && s.isContinuation(line) && len(s.entry)+len(line) <= maxMultilineSize {
+		s.entry = append(s.entry, line...)
+		if options.Continuation != nil || options.Indented {
+			s.deadline = time.Now().Add(options.MaxWait)
+		}
+		return nil
+	}
+	err := s.flush()
+	if err != nil {
+		return err
+	}
+	s.entry = appendPrefix(s.entry, s.f.serviceName, s.stream)
+	s.entry = append(s.entry, line...)
+	s.deadline = time.Now().Add(options.MaxWait)
+	return nil
+}
+
+func (s *multilineStream) isContinuation(line []byte) bool {
+	options := &s.f.options
+	if options.Continuation == nil && !options.Indented {
+		// Timeout-based merging: merge lines until the entry's deadline.
+		return time.Now().Before(s.deadline)
+	}
+	if options.Indented && (line[0] == ' ' || line[0] == '\t') {
+		return true
+	}
+	if options.Continuation != nil {
+		content := line[:len(line)-1]
+		if options.Continuation.Match(content) {
+			return true
+		}
+	}
+	return false
+}
+
+// flush writes out the pending entry (in a single write, so that readers
+// always see complete entries).
+func (s *multilineStream) flush() error {
+	if len(s.entry) == 0 {
+		return nil
+	}
+	if s.f.midLine != nil {
+		// End the other stream's partial line.
+		_, err := s.f.dest.Write([]byte{'\n'})
+		if err != nil {
+			return err
+		}
+		s.f.midLine = nil
+	}
+	_, err := s.f.dest.Write(s.entry)
+	s.entry = s.entry[:0]
+	return err
+}
+
+func (s *multilineStream) startTimer() {
+	wait := time.Until(s.deadline)
+	if s.timer == nil {
+		s.timer = time.AfterFunc(wait, s.timeout)
+	} else {
+		s.timer.Reset(wait)
+	}
+}
+
+// timeout writes out the pending entry and any incomplete line once the
+// deadline has passed.
+func (s *multilineStream) timeout() {
+	s.f.mut.Lock()
+	defer s.f.mut.Unlock()
+
+	if len(s.entry) == 0 && len(s.line) == 0 {
+		return
+	}
+	if wait := time.Until(s.deadline); wait > 0 {
+		s.timer.Reset(wait)
+		return
+	}
+	if len(s.line) > 0 {
+		_ = s.flushLine()
+	} else {
+		_ = s.flush()
+	}
+}
+
+// flushLine writes out the pending entry along with the current incomplete
+// line (as part of the entry if it's a continuation, otherwise as a new
+// entry). The rest of the line is written as is when it arrives.
+func (s *multilineStream) flushLine() error {
+	if len(s.entry) == 0 || !s.isContinuation(append(s.line, '\n')) {
+		err := s.flush()
+		if err != nil {
+			return err
+		}
+		s.entry = appendPrefix(s.entry, s.f.serviceName, s.stream)
+	}
+	s.entry = append(s.entry, s.line...)
+	s.line = s.line[:0]
+	err := s.flush()
+	s.f.midLine = s
+	return err
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package servicelog_test
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internals/servicelog"
+)
+
+type multilineSuite struct{}
+
+var _ = Suite(&multilineSuite{})
+
+// syncBuffer is a bytes.Buffer that's safe to write to from the formatter's
+// timer goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitFor(c *C, b *syncBuffer, pattern string) {
+	re := regexp.MustCompile("^" + pattern + "$")
+	for i := 0; i < 100; i++ {
+		if re.MatchString(b.String()) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for output to match %q, got %q", pattern, b.String())
+}
+
+func (s *multilineSuite) TestIndented(c *C) {
+	b := &syncBuffer{}
+	w, _ := servicelog.NewMultilineFormatWriters(b, "test", &servicelog.MultilineOptions{
+		Indented: true,
+		MaxWait:  time.Minute,
+	})
+
+	fmt.Fprintf(w, "Traceback (most recent call last):\n")
+	fmt.Fprintf(w, "  File \"main.py\", line 1\n\tfoo\n")
+	c.Check(b.String(), Equals, "")
+	fmt.Fprintf(w, "next\n")
+
+	c.Check(b.String(), Matches, fmt.Sprintf(`
+%[1]s \[test\] Traceback \(most recent call last\):
+  File "main.py", line 1
+	foo
+`[1:], timeFormatRegex))
+}
+
+func (s *multilineSuite) TestStreams(c *C) {
+	b := &syncBuffer{}
+	stdout, stderr := servicelog.NewMultilineFormatWriters(b, "test", &servicelog.MultilineOptions{
+		Indented: true,
+		MaxWait:  time.Minute,
+	})
+
+	// Each stream has its own pending entry.
+	fmt.Fprintf(stderr, "Traceback:\n")
+	fmt.Fprintf(stdout, "out\n")
+	fmt.Fprintf(stderr, "  File \"main.py\"\n")
+	fmt.Fprintf(stdout, "  more out\n")
+	fmt.Fprintf(stderr, "next\n")
+	fmt.Fprintf(stdout, "next\n")
+
+	c.Check(b.String(), Matches, fmt.Sprintf(`
+%[1]s \[test\]! Traceback:
+  File "main.py"
+%[1]s \[test\] out
+  more out
+`[1:], timeFormatRegex))
+}
+
+func (s *multilineSuite) TestContinuation(c *C) {
+	b := &syncBuffer{}
+	w, _ := servicelog.NewMultilineFormatWriters(b, "test", &servicelog.MultilineOptions{
+		Continuation: regexp.MustCompile(`^(\s+at |Caused by:)`),
+		MaxWait:      time.Minute,
+	})
+
+	fmt.Fprintf(w, "Exception in thread \"main\"\n    at Main.main\nCaused by: boom\n")
+	fmt.Fprintf(w, "  unindented\n")
+	fmt.Fprintf(w, "second\n")
+
+	c.Check(b.String(), Matches, fmt.Sprintf(`
+%[1]s \[test\] Exception in thread "main"
+    at Main.main
+Caused by: boom
+%[1]s \[test\]   unindented
+`[1:], timeFormatRegex))
+}
+
+func (s *multilineSuite) TestMaxWait(c *C) {
+	b := &syncBuffer{}
+	w, _ := servicelog.NewMultilineFormatWriters(b, "test", &servicelog.MultilineOptions{
+		Indented: true,
+		MaxWait:  20 * time.Millisecond,
+	})
+
+	fmt.Fprintf(w, "first\n  more\n")
+	waitFor(c, b, fmt.Sprintf("%s \\[test\\] first\n  more\n", timeFormatRegex))
+
+	// Continuation lines after the timeout start a new entry.
+	fmt.Fprintf(w, "  late\n")
+	waitFor(c, b, fmt.Sprintf("%[1]s \\[test\\] first\n  more\n%[1]s \\[test\\]   late\n", timeFormatRegex))
+
+	// An incomplete line is written out, and the rest is written as is.
+	fmt.Fprintf(w, "partial")
+	waitFor(c, b, fmt.Sprintf("(?s).*\n%s \\[test\\] partial", timeFormatRegex))
+	fmt.Fprintf(w, " line\n")
+	waitFor(c, b, fmt.Sprintf("(?s).*\n%s \\[test\\] partial line\n", timeFormatRegex))
+}
+
+func (s *multilineSuite) TestTimeoutOnly(c *C) {
+	b := &syncBuffer{}
+	w, _ := servicelog.NewMultilineFormatWriters(b, "test", &servicelog.MultilineOptions{
+		MaxWait: 50 * time.Millisecond,
+	})
+
+	fmt.Fprintf(w, "one\n")
+	fmt.Fprintf(w, "two\n")
+	waitFor(c, b, fmt.Sprintf("%s \\[test\\] one\ntwo\n", timeFormatRegex))
+	fmt.Fprintf(w, "three\n")
+	waitFor(c, b, fmt.Sprintf("%[1]s \\[test\\] one\ntwo\n%[1]s \\[test\\] three\n", timeFormatRegex))
+}
+
+func (s *multilineSuite) TestRoundTrip(c *C) {
+	b := &syncBuffer{}
+	w, _ := servicelog.NewMultilineFormatWriters(b, "svc", &servicelog.MultilineOptions{
+		Indented: true,
+		MaxWait:  10 * time.Millisecond,
+	})
+	fmt.Fprintf(w, "error\n  at a\n  at b\ninfo\n")
+	waitFor(c, b, fmt.Sprintf("(?s).*%s \\[svc\\] info\n", timeFormatRegex))
+
+	parser := servicelog.NewParser(bytes.NewBufferString(b.String()), 1024)
+	var messages []string
+	for parser.Next() {
+		c.Check(parser.Entry().Service, Equals, "svc")
+		messages = append(messages, parser.Entry().Message)
+	}
+	c.Check(parser.Err(), IsNil)
+	c.Check(messages, DeepEquals, []string{"error\n  at a\n  at b\n", "info\n"})
+}
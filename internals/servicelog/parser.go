@@ -39,6 +39,14 @@ type Entry struct {
 	Time    time.Time
 	Service string
 	Message string
+
+	// Stream is the stream the log was written to, StdoutStream or
+	// StderrStream.
+	Stream string
+
+	// Level and Fields are set by StructuredParser for structured logs.
+	Level  string
+	Fields map[string]string
 }
 
 // Parser parses and iterates over logs from a Reader until EOF (or another
@@ -86,7 +94,11 @@ func (p *Parser) Next() bool {
 				// this p.entry's timestamp and service name.
 				return false
 			}
-			// Normal log line
+			// Normal log line, possibly followed by continuation lines of
+			// a multi-line entry.
+			if line[len(line)-1] == '\n' {
+				p.mergeContinuations()
+			}
 			return true
 		}
 		if !p.entry.Time.IsZero() {
@@ -99,6 +111,44 @@ func (p *Parser) Next() bool {
 	return false
 }
 
+// mergeContinuations appends any continuation lines of a multi-line entry
+// (lines without a timestamp and service prefix, as written by
+// NewMultilineFormatWriter) to the current entry's message. Only complete
+// lines already available from the reader are merged: the multi-line
+// formatter writes each entry in a single write, so they're all available
+// by the time the entry's first line is.
+func (p *Parser) mergeContinuations() {
+	var message []byte
+	for {
+		// Peek to fill the buffer if it's empty, then look at everything
+		// buffered without reading further.
+		_, err := p.br.Peek(1)
+		if err != nil {
+			break
+		}
+		buffered, _ := p.br.Peek(p.br.Buffered())
+		length := bytes.IndexByte(buffered, '\n') + 1
+		if length == 0 {
+			break
+		}
+		line := buffered[:length]
+		if bytes.Equal(line, truncBytes[1:]) {
+			break
+		}
+		if _, err := Parse(line); err == nil {
+			break
+		}
+		if message == nil {
+			message = append(message, p.entry.Message...)
+		}
+		message = append(message, line...)
+		p.br.Discard(length)
+	}
+	if message != nil {
+		p.entry.Message = string(message)
+	}
+}
+
 // Entry returns the current log entry (should only be called after Next
 // returns true).
 func (p *Parser) Entry() Entry {
@@ -111,7 +161,9 @@ func (p *Parser) Err() error {
 }
 
 // Parse parses a log entry of the form
-// "2021-05-20T15:39:12.345Z [service] log message".
+// "2021-05-20T15:39:12.345Z [service] log message", or
+// "2021-05-20T15:39:12.345Z [service]! log message" for logs written to
+// stderr.
 func Parse(line []byte) (Entry, error) {
 	fields := bytes.SplitN(line, []byte(" "), 3)
 	if len(fields) != 3 {
@@ -121,10 +173,16 @@ func Parse(line []byte) (Entry, error) {
 	if err != nil {
 		return Entry{}, errParseTime
 	}
-	if len(fields[1]) < 3 || fields[1][0] != '[' || fields[1][len(fields[1])-1] != ']' {
+	serviceField := fields[1]
+	stream := StdoutStream
+	if bytes.HasSuffix(serviceField, []byte("]!")) {
+		serviceField = serviceField[:len(serviceField)-1]
+		stream = StderrStream
+	}
+	if len(serviceField) < 3 || serviceField[0] != '[' || serviceField[len(serviceField)-1] != ']' {
 		return Entry{}, errParseService
 	}
-	service := string(fields[1][1 : len(fields[1])-1]) // Trim [ and ] from "[service]"
+	service := string(serviceField[1 : len(serviceField)-1]) // Trim [ and ] from "[service]"
 	message := string(fields[2])
-	return Entry{timestamp, service, message}, nil
+	return Entry{Time: timestamp, Service: service, Message: message, Stream: stream}, nil
 }
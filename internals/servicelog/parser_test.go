@@ -57,7 +57,20 @@ func (s *parserSuite) TestParse(c *C) {
 		Time:    time.Date(2020, 12, 25, 0, 1, 2, 123456000, time.UTC),
 		Service: "x",
 		Message: "a longer message\n",
+		Stream:  servicelog.StdoutStream,
 	})
+
+	entry, err = servicelog.Parse([]byte("2021-05-26T12:37:00Z [bar]! an error\n"))
+	c.Check(err, IsNil)
+	checkEntry(c, entry, servicelog.Entry{
+		Time:    time.Date(2021, 5, 26, 12, 37, 0, 0, time.UTC),
+		Service: "bar",
+		Message: "an error\n",
+		Stream:  servicelog.StderrStream,
+	})
+
+	_, err = servicelog.Parse([]byte("2021-05-26T12:37:00Z []! baz"))
+	c.Check(err, ErrorMatches, "invalid log service name")
 }
 
 func checkEntry(c *C, got, expected servicelog.Entry) {
@@ -65,6 +78,9 @@ func checkEntry(c *C, got, expected servicelog.Entry) {
 		Commentf("expected timestamp %v, got %v", expected.Time, got.Time))
 	c.Check(got.Service, Equals, expected.Service)
 	c.Check(got.Message, Equals, expected.Message)
+	if expected.Stream != "" {
+		c.Check(got.Stream, Equals, expected.Stream)
+	}
 }
 
 func (s *parserSuite) TestParser(c *C) {
@@ -109,6 +125,28 @@ func (s *parserSuite) TestParser(c *C) {
 	c.Check(parser.Next(), Equals, false)
 	c.Check(parser.Err(), IsNil)
 
+	// multi-line entries (continuation lines have no prefix)
+	parser = servicelog.NewParser(strings.NewReader(`
+2021-05-26T12:37:00Z [s] error
+  at foo
+  at bar
+2021-05-26T12:37:01Z [s] msg
+`), 1024)
+	c.Check(parser.Next(), Equals, true)
+	checkEntry(c, parser.Entry(), servicelog.Entry{
+		Time:    time.Date(2021, 5, 26, 12, 37, 0, 0, time.UTC),
+		Service: "s",
+		Message: "error\n  at foo\n  at bar\n",
+	})
+	c.Check(parser.Next(), Equals, true)
+	checkEntry(c, parser.Entry(), servicelog.Entry{
+		Time:    time.Date(2021, 5, 26, 12, 37, 1, 0, time.UTC),
+		Service: "s",
+		Message: "msg\n",
+	})
+	c.Check(parser.Next(), Equals, false)
+	c.Check(parser.Err(), IsNil)
+
 	// too-small buffer
 	parser = servicelog.NewParser(strings.NewReader(`
 2021-05-26T12:37:00Z [s] msg
@@ -0,0 +1,241 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package servicelog
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitOptions configures a RateLimitWriter.
+type RateLimitOptions struct {
+	// Interval is the period that Lines and Bytes apply to.
+	Interval time.Duration
+
+	// Lines is the maximum number of log entries written per interval, or
+	// zero for no limit. A multi-line entry counts as a single line.
+	Lines int
+
+	// Bytes is the maximum number of bytes written per interval, or zero
+	// for no limit.
+	Bytes int64
+
+	// Burst is the number of intervals' worth of unused quota that can be
+	// saved up and written at once. Zero means 1.
+	Burst int
+}
+
+// RateLimitWriter is an io.Writer that writes formatted log lines (as
+// written by the format writers) to its destination, dropping lines when
+// they're written faster than the configured rate.
+//
+// When lines have been dropped, a marker line such as
+//
+//	2021-05-13T03:16:51.001Z [test] (42 lines suppressed)
+//
+// is written before the next line that isn't dropped, or after the interval
+// if the service writes nothing more.
+type RateLimitWriter struct {
+	mut         sync.Mutex
+	dest        io.Writer
+	serviceName string
+	options     RateLimitOptions
+
+	lines     float64 // available line tokens
+	bytes     float64 // available byte tokens (may be negative)
+	refilled  time.Time
+	lineStart bool
+	dropping  bool
+
+	pending    int   // lines dropped since the last marker
+	suppressed int64 // total lines dropped
+	timer      *time.Timer
+	closed     bool
+}
+
+var _ io.WriteCloser = (*RateLimitWriter)(nil)
+
+var timeNow = time.Now
+
+// NewRateLimitWriter returns a RateLimitWriter which writes to dest.
+func NewRateLimitWriter(dest io.Writer, serviceName string, options *RateLimitOptions) *RateLimitWriter {
+	w := &RateLimitWriter{
+		dest:        dest,
+		serviceName: serviceName,
+		options:     *options,
+		refilled:    timeNow(),
+		lineStart:   true,
+	}
+	if w.options.Burst < 1 {
+		w.options.Burst = 1
+	}
+	// Start with a full quota.
+	w.lines = float64(w.options.Lines * w.options.Burst)
+	w.bytes = float64(w.options.Bytes * int64(w.options.Burst))
+	return w
+}
+
+// Suppressed returns the total number of lines dropped so far.
+func (w *RateLimitWriter) Suppressed() int64 {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	return w.suppressed
+}
+
+// Write writes the lines in p to the destination, dropping those over the
+// rate limit. Dropped lines are reported as written.
+func (w *RateLimitWriter) Write(p []byte) (int, error) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		length := bytes.IndexByte(p, '\n') + 1
+		if length == 0 {
+			length = len(p)
+		}
+		line := p[:length]
+
+		// Continuation lines of multi-line entries are dropped (or not)
+		// along with the first line of their entry.
+		if w.lineStart && isEntryStart(line) {
+			w.dropping = !w.allow()
+			if w.dropping {
+				w.pending++
+				w.suppressed++
+				w.startTimer()
+			} else if w.pending > 0 {
+				err := w.writeMarker()
+				if err != nil {
+					return written, err
+				}
+			}
+		}
+
+		if !w.dropping {
+			n, err := w.dest.Write(line)
+			w.bytes -= float64(n)
+			if err != nil {
+				return written + n, err
+			}
+		}
+		w.lineStart = line[len(line)-1] == '\n'
+		written += length
+		p = p[length:]
+	}
+	return written, nil
+}
+
+// allow refills the quota for the time elapsed, and reports whether there's
+// enough quota left to write another line.
+func (w *RateLimitWriter) allow() bool {
+	now := timeNow()
+	intervals := float64(now.Sub(w.refilled)) / float64(w.options.Interval)
+	w.refilled = now
+	burst := float64(w.options.Burst)
+	if w.options.Lines > 0 {
+		limit := float64(w.options.Lines)
+		w.lines = minFloat(w.lines+intervals*limit, limit*burst)
+		if w.lines < 1 {
+			return false
+		}
+	}
+	if w.options.Bytes > 0 {
+		limit := float64(w.options.Bytes)
+		w.bytes = minFloat(w.bytes+intervals*limit, limit*burst)
+		if w.bytes <= 0 {
+			return false
+		}
+	}
+	w.lines--
+	return true
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// writeMarker writes a line reporting the number of lines dropped since the
+// last marker.
+func (w *RateLimitWriter) writeMarker() error {
+	marker := appendPrefix(nil, w.serviceName, StdoutStream)
+	marker = append(marker, '(')
+	marker = strconv.AppendInt(marker, int64(w.pending), 10)
+	if w.pending == 1 {
+		marker = append(marker, " line suppressed)\n"...)
+	} else {
+		marker = append(marker, " lines suppressed)\n"...)
+	}
+	w.pending = 0
+	_, err := w.dest.Write(marker)
+	return err
+}
+
+// Close stops the writer's timer, first writing the marker for any lines
+// dropped since the last one. Lines written after Close are still rate
+// limited, but their marker is only written before the next line allowed.
+func (w *RateLimitWriter) Close() error {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	return w.flushMarker()
+}
+
+func (w *RateLimitWriter) startTimer() {
+	if w.closed {
+		return
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.options.Interval, w.timeout)
+	} else {
+		w.timer.Reset(w.options.Interval)
+	}
+}
+
+// timeout writes the marker for lines dropped in the last interval, so that
+// the marker is written even if the service writes no further lines.
+func (w *RateLimitWriter) timeout() {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	_ = w.flushMarker()
+}
+
+// flushMarker writes the marker for any lines dropped since the last one,
+// unless that would be in the middle of a line.
+func (w *RateLimitWriter) flushMarker() error {
+	if w.pending == 0 {
+		return nil
+	}
+	if !w.lineStart && !w.dropping {
+		// Don't write the marker in the middle of a line; it'll be
+		// written before the next line.
+		return nil
+	}
+	return w.writeMarker()
+}
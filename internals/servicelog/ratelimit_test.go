@@ -0,0 +1,189 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package servicelog_test
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internals/servicelog"
+)
+
+type rateLimitSuite struct{}
+
+var _ = Suite(&rateLimitSuite{})
+
+func (s *rateLimitSuite) TestLines(c *C) {
+	b := &syncBuffer{}
+	rl := servicelog.NewRateLimitWriter(b, "test", &servicelog.RateLimitOptions{
+		Interval: time.Hour,
+		Lines:    2,
+	})
+	w := servicelog.NewFormatWriter(rl, "test")
+
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+	c.Check(b.String(), Matches, fmt.Sprintf(`
+%[1]s \[test\] line 0
+%[1]s \[test\] line 1
+`[1:], timeFormatRegex))
+	c.Check(rl.Suppressed(), Equals, int64(3))
+}
+
+func (s *rateLimitSuite) TestBytes(c *C) {
+	b := &syncBuffer{}
+	rl := servicelog.NewRateLimitWriter(b, "test", &servicelog.RateLimitOptions{
+		Interval: time.Hour,
+		Bytes:    50,
+	})
+	w := servicelog.NewFormatWriter(rl, "test")
+
+	// Each line (with its prefix) is 38 bytes, so the second line is
+	// written using the remaining quota, but not the third.
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+	c.Check(b.String(), Matches, fmt.Sprintf(`
+%[1]s \[test\] line 0
+%[1]s \[test\] line 1
+`[1:], timeFormatRegex))
+	c.Check(rl.Suppressed(), Equals, int64(1))
+}
+
+func (s *rateLimitSuite) TestMarker(c *C) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	restore := servicelog.FakeTimeNow(func() time.Time { return now })
+	defer restore()
+
+	b := &syncBuffer{}
+	rl := servicelog.NewRateLimitWriter(b, "test", &servicelog.RateLimitOptions{
+		Interval: time.Minute,
+		Lines:    1,
+		Burst:    2,
+	})
+	defer rl.Close()
+	w := servicelog.NewFormatWriter(rl, "test")
+
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+	c.Check(b.String(), Matches, fmt.Sprintf(`
+%[1]s \[test\] line 0
+%[1]s \[test\] line 1
+`[1:], timeFormatRegex))
+
+	// The marker is written once the interval has passed.
+	now = now.Add(time.Minute)
+	rl.Timeout()
+	c.Check(b.String(), Matches, fmt.Sprintf(`
+%[1]s \[test\] line 0
+%[1]s \[test\] line 1
+%[1]s \[test\] \(3 lines suppressed\)
+`[1:], timeFormatRegex))
+
+	// The quota has been refilled, so the next line is written.
+	fmt.Fprintf(w, "line 5\n")
+	c.Check(b.String(), Matches, fmt.Sprintf(`(?s).*\n%[1]s \[test\] line 5\n`, timeFormatRegex))
+	c.Check(rl.Suppressed(), Equals, int64(3))
+}
+
+func (s *rateLimitSuite) TestMarkerBeforeLine(c *C) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	restore := servicelog.FakeTimeNow(func() time.Time { return now })
+	defer restore()
+
+	b := &syncBuffer{}
+	rl := servicelog.NewRateLimitWriter(b, "test", &servicelog.RateLimitOptions{
+		Interval: time.Minute,
+		Lines:    1,
+	})
+	defer rl.Close()
+	w := servicelog.NewFormatWriter(rl, "test")
+
+	// The marker is written before the next line that's allowed, if that
+	// comes before the timer fires.
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+		now = now.Add(20 * time.Second)
+	}
+	fmt.Fprintf(w, "line 4\n")
+	c.Check(b.String(), Matches, fmt.Sprintf(`
+%[1]s \[test\] line 0
+%[1]s \[test\] \(2 lines suppressed\)
+%[1]s \[test\] line 3
+`[1:], timeFormatRegex))
+	c.Check(rl.Suppressed(), Equals, int64(3))
+
+	// Line 4 is reported when the timer fires.
+	rl.Timeout()
+	c.Check(b.String(), Matches, fmt.Sprintf(`(?s).*\n%[1]s \[test\] line 3
+%[1]s \[test\] \(1 line suppressed\)
+`, timeFormatRegex))
+}
+
+func (s *rateLimitSuite) TestClose(c *C) {
+	b := &syncBuffer{}
+	rl := servicelog.NewRateLimitWriter(b, "test", &servicelog.RateLimitOptions{
+		Interval: time.Hour,
+		Lines:    1,
+	})
+	w := servicelog.NewFormatWriter(rl, "test")
+
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+
+	// Closing the writer writes the marker without waiting for the timer.
+	err := rl.Close()
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Matches, fmt.Sprintf(`
+%[1]s \[test\] line 0
+%[1]s \[test\] \(2 lines suppressed\)
+`[1:], timeFormatRegex))
+
+	err = rl.Close()
+	c.Assert(err, IsNil)
+	c.Check(rl.Suppressed(), Equals, int64(2))
+}
+
+func (s *rateLimitSuite) TestMultiline(c *C) {
+	b := &syncBuffer{}
+	rl := servicelog.NewRateLimitWriter(b, "test", &servicelog.RateLimitOptions{
+		Interval: time.Hour,
+		Lines:    1,
+	})
+	w, _ := servicelog.NewMultilineFormatWriters(rl, "test", &servicelog.MultilineOptions{
+		Indented: true,
+		MaxWait:  time.Minute,
+	})
+
+	// Continuation lines are kept or dropped along with their entry.
+	fmt.Fprintf(w, "first\n  more first\nsecond\n  more second\n  and more\nthird\n")
+	c.Check(b.String(), Matches, fmt.Sprintf(`
+%[1]s \[test\] first
+  more first
+`[1:], timeFormatRegex))
+	c.Check(rl.Suppressed(), Equals, int64(1))
+
+	// The parser sees only the entries written.
+	p := servicelog.NewParser(strings.NewReader(b.String()), 1024)
+	c.Assert(p.Next(), Equals, true)
+	c.Check(p.Entry().Message, Equals, "first\n  more first\n")
+	c.Check(p.Next(), Equals, false)
+}
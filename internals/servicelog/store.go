@@ -0,0 +1,602 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package servicelog
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/canonical/pebble/internals/logger"
+)
+
+const (
+	// storeSegments is the approximate number of segment files the store's
+	// maximum size is divided into. When the store is full, the oldest
+	// segment is removed.
+	storeSegments = 8
+
+	// storeIndexInterval is the approximate number of bytes between index
+	// entries in a segment.
+	storeIndexInterval = 16 * 1024
+
+	storeSegmentSuffix = ".log"
+	storeIndexSuffix   = ".idx"
+)
+
+// StoreOptions holds the limits for a Store.
+type StoreOptions struct {
+	// MaxSize is the maximum total size in bytes of the store's segment
+	// files. It must be greater than zero.
+	MaxSize int64
+
+	// MaxAge is how long logs are kept for, or zero to keep them until the
+	// store is full.
+	MaxAge time.Duration
+}
+
+// Store is a persistent, on-disk store of a service's logs, used alongside
+// the service's RingBuffer so that logs outlive the buffer (and restarts of
+// the Pebble daemon).
+//
+// Logs are written through the Store to both the RingBuffer and a series of
+// numbered segment files in the store's directory, in the same format as in
+// the RingBuffer. Each segment has an index file, holding the time of the
+// log line at every storeIndexInterval bytes or so, which is used to find
+// where to start reading logs from a given time. Segments are removed,
+// oldest first, when the store exceeds its maximum size or they're older
+// than its maximum age.
+type Store struct {
+	mu      sync.Mutex
+	dir     string
+	options StoreOptions
+	rb      *RingBuffer
+
+	segmentSize int64
+	segments    []*storeSegment // oldest first; the last one is being written
+	writer      *os.File
+	indexWriter *os.File
+
+	// Whether the next byte written starts a new log line, and the number of
+	// bytes written since the last index entry.
+	lineStart  bool
+	sinceIndex int64
+
+	// First error writing to disk. Once set, logs are only written to the
+	// RingBuffer.
+	err error
+}
+
+type storeSegment struct {
+	seq     uint64
+	size    int64
+	modTime time.Time
+	index   []storeIndexEntry
+}
+
+type storeIndexEntry struct {
+	time   time.Time
+	offset int64
+}
+
+// OpenStore opens the log store in dir, creating it if necessary, which
+// will write logs to both disk and the given RingBuffer. Logs left in the
+// store by a previous run are kept, subject to the limits in options.
+func OpenStore(dir string, rb *RingBuffer, options *StoreOptions) (*Store, error) {
+	if options.MaxSize <= 0 {
+		return nil, fmt.Errorf("log store maximum size must be greater than zero")
+	}
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := loadStoreSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	segmentSize := options.MaxSize / storeSegments
+	if segmentSize < 1 {
+		segmentSize = 1
+	}
+	s := &Store{
+		dir:         dir,
+		options:     *options,
+		rb:          rb,
+		segmentSize: segmentSize,
+		segments:    segments,
+		lineStart:   true,
+	}
+	// Always start writing to a new segment, so that a partial line left by
+	// a crash is never followed by more logs in the same file.
+	err = s.rotate()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadStoreSegments returns the segments in dir, oldest first.
+func loadStoreSegments(dir string) ([]*storeSegment, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []*storeSegment
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if !strings.HasSuffix(name, storeSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, storeSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue // removed by the writer since listing the directory
+		}
+		if err != nil {
+			return nil, err
+		}
+		segment := &storeSegment{seq: seq, size: info.Size(), modTime: info.ModTime()}
+		segment.index, err = readStoreIndex(storePath(dir, seq, storeIndexSuffix))
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].seq < segments[j].seq
+	})
+	return segments, nil
+}
+
+func storePath(dir string, seq uint64, suffix string) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", seq, suffix))
+}
+
+// readStoreIndex reads a segment's index file, which has one
+// "<unix-nanoseconds> <offset>" line per entry.
+func readStoreIndex(path string) ([]storeIndexEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var index []storeIndexEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var nanos, offset int64
+		_, err := fmt.Sscanf(scanner.Text(), "%d %d", &nanos, &offset)
+		if err != nil {
+			// Ignore a partial entry left by a crash.
+			continue
+		}
+		index = append(index, storeIndexEntry{time: time.Unix(0, nanos), offset: offset})
+	}
+	return index, scanner.Err()
+}
+
+// rotate closes the current segment, starts writing to a new one, and
+// removes old segments to keep within the store's limits.
+func (s *Store) rotate() error {
+	var seq uint64 = 1
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1].seq + 1
+	}
+	writer, err := os.OpenFile(storePath(s.dir, seq, storeSegmentSuffix), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	indexWriter, err := os.OpenFile(storePath(s.dir, seq, storeIndexSuffix), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		_ = writer.Close()
+		return err
+	}
+	now := time.Now()
+	if s.writer != nil {
+		s.segments[len(s.segments)-1].modTime = now
+	}
+	s.closeWriters()
+	s.writer = writer
+	s.indexWriter = indexWriter
+	s.segments = append(s.segments, &storeSegment{seq: seq, modTime: now})
+	s.sinceIndex = 0
+
+	// Leave room for the new segment to fill up.
+	for len(s.segments) > 1 && (s.size()+s.segmentSize > s.options.MaxSize || s.expired(s.segments[0], now)) {
+		err := s.removeOldest()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) closeWriters() {
+	if s.writer != nil {
+		_ = s.writer.Close()
+		s.writer = nil
+	}
+	if s.indexWriter != nil {
+		_ = s.indexWriter.Close()
+		s.indexWriter = nil
+	}
+}
+
+func (s *Store) size() int64 {
+	var total int64
+	for _, segment := range s.segments {
+		total += segment.size
+	}
+	return total
+}
+
+func (s *Store) expired(segment *storeSegment, now time.Time) bool {
+	return s.options.MaxAge > 0 && segment.modTime.Before(now.Add(-s.options.MaxAge))
+}
+
+func (s *Store) removeOldest() error {
+	oldest := s.segments[0]
+	s.segments = s.segments[1:]
+	for _, suffix := range []string{storeSegmentSuffix, storeIndexSuffix} {
+		err := os.Remove(storePath(s.dir, oldest.seq, suffix))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write writes p to the RingBuffer and to disk. Errors writing to disk are
+// logged, and stop further writes to disk, but aren't returned.
+func (s *Store) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.rb.Write(p)
+	if s.err == nil && n > 0 {
+		s.err = s.writeDisk(p[:n])
+		if s.err != nil {
+			logger.Noticef("Cannot write to log store %q, storing logs in memory only: %v", s.dir, s.err)
+			s.closeWriters()
+		}
+	}
+	return n, err
+}
+
+func (s *Store) writeDisk(p []byte) error {
+	for len(p) > 0 {
+		// Split into lines, so that segments always start on a new line.
+		length := bytes.IndexByte(p, '\n') + 1
+		if length == 0 {
+			length = len(p)
+		}
+		line := p[:length]
+
+		// Continuation lines of multi-line entries have no timestamp, and
+		// segments and index entries must start at the start of an entry.
+		if s.lineStart && isEntryStart(line) {
+			current := s.segments[len(s.segments)-1]
+			if current.size > 0 && current.size+int64(len(line)) > s.segmentSize {
+				err := s.rotate()
+				if err != nil {
+					return err
+				}
+				current = s.segments[len(s.segments)-1]
+			}
+			if current.size == 0 || s.sinceIndex >= storeIndexInterval {
+				err := s.writeIndex(current, line)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		n, err := s.writer.Write(line)
+		current := s.segments[len(s.segments)-1]
+		current.size += int64(n)
+		s.sinceIndex += int64(n)
+		if err != nil {
+			return err
+		}
+		s.lineStart = line[len(line)-1] == '\n'
+		p = p[length:]
+	}
+	return nil
+}
+
+// writeIndex adds an index entry for the log line starting at the current
+// end of segment. The time is taken from the line's timestamp if present.
+func (s *Store) writeIndex(segment *storeSegment, line []byte) error {
+	t, ok := lineTime(line)
+	if !ok {
+		t = time.Now()
+	}
+	entry := storeIndexEntry{time: t, offset: segment.size}
+	_, err := fmt.Fprintf(s.indexWriter, "%d %d\n", entry.time.UnixNano(), entry.offset)
+	if err != nil {
+		return err
+	}
+	segment.index = append(segment.index, entry)
+	s.sinceIndex = 0
+	return nil
+}
+
+// lineTime returns the timestamp at the start of the given log line.
+func lineTime(line []byte) (time.Time, bool) {
+	i := bytes.IndexByte(line, ' ')
+	if i <= 0 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(parseTimeFormat, string(line[:i]))
+	return t, err == nil
+}
+
+// isEntryStart reports whether the line starts a log entry, rather than
+// being a continuation line of a multi-line entry.
+func isEntryStart(line []byte) bool {
+	_, ok := lineTime(line)
+	return ok
+}
+
+// Iterator returns an iterator which reads logs from the store, starting at
+// (or shortly before) the given time, and then continues reading from the
+// RingBuffer, so that the logs on disk and in memory are read as a single
+// stream. Use a zero time to read all logs in the store.
+func (s *Store) Iterator(since time.Time) Iterator {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments := make([]storeSegment, len(s.segments))
+	for i, segment := range s.segments {
+		segments[i] = *segment
+	}
+	it := newStoreIterator(s.dir, segments, &s.options, since)
+	// All writes to the RingBuffer go through the store while holding the
+	// lock, so the RingBuffer's head is exactly where the disk logs end.
+	it.rbIt = s.rb.HeadIterator(0)
+	return it
+}
+
+// Close closes the store's files. The RingBuffer is not closed.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeWriters()
+	if s.err == nil {
+		s.err = errors.New("log store closed")
+	}
+	return nil
+}
+
+// ReadStore returns an iterator which reads the logs in the store in dir
+// (which needn't be open), starting at (or shortly before) the given time.
+// Use a zero time to read all logs in the store.
+func ReadStore(dir string, options *StoreOptions, since time.Time) (Iterator, error) {
+	segments, err := loadStoreSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]storeSegment, len(segments))
+	for i, segment := range segments {
+		values[i] = *segment
+	}
+	return newStoreIterator(dir, values, options, since), nil
+}
+
+// storeIterator reads logs from a snapshot of a store's segments, then from
+// the RingBuffer iterator rbIt (if not nil).
+type storeIterator struct {
+	dir      string
+	segments []storeSegment // segments left to read
+	offset   int64          // read offset in segments[0]
+	file     *os.File       // open file for segments[0], if any
+	trunc    []byte
+	rbIt     Iterator
+	closed   bool
+}
+
+var _ Iterator = (*storeIterator)(nil)
+
+func newStoreIterator(dir string, segments []storeSegment, options *StoreOptions, since time.Time) *storeIterator {
+	it := &storeIterator{dir: dir}
+
+	// Skip segments which have expired, but haven't been removed yet.
+	if options.MaxAge > 0 {
+		cutoff := time.Now().Add(-options.MaxAge)
+		for len(segments) > 1 && segments[0].modTime.Before(cutoff) {
+			segments = segments[1:]
+		}
+	}
+
+	if !since.IsZero() {
+		// Start from the last segment starting before since, if any.
+		first := 0
+		for i, segment := range segments {
+			if len(segment.index) > 0 && !segment.index[0].time.After(since) {
+				first = i
+			}
+		}
+		segments = segments[first:]
+		if len(segments) > 0 {
+			for _, entry := range segments[0].index {
+				if entry.time.After(since) {
+					break
+				}
+				it.offset = entry.offset
+			}
+		}
+	}
+	it.segments = segments
+	return it
+}
+
+func (it *storeIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.closeFile()
+	if it.rbIt != nil {
+		return it.rbIt.Close()
+	}
+	return nil
+}
+
+func (it *storeIterator) closeFile() {
+	if it.file != nil {
+		_ = it.file.Close()
+		it.file = nil
+	}
+}
+
+// nextSegment moves on to reading the next segment.
+func (it *storeIterator) nextSegment() {
+	it.closeFile()
+	it.segments = it.segments[1:]
+	it.offset = 0
+}
+
+// diskBuffered returns the number of bytes left to read from disk.
+func (it *storeIterator) diskBuffered() int64 {
+	var total int64
+	for _, segment := range it.segments {
+		total += segment.size
+	}
+	return total - it.offset
+}
+
+func (it *storeIterator) Next(cancel <-chan struct{}) bool {
+	if it.closed {
+		return false
+	}
+	if len(it.trunc) > 0 || it.diskBuffered() > 0 {
+		return true
+	}
+	if it.rbIt == nil {
+		return false
+	}
+	return it.rbIt.Next(cancel)
+}
+
+func (it *storeIterator) Notify(ch chan bool) {
+	if it.rbIt != nil {
+		it.rbIt.Notify(ch)
+	}
+}
+
+func (it *storeIterator) Buffered() int {
+	n := len(it.trunc) + int(it.diskBuffered())
+	if it.rbIt != nil {
+		n += it.rbIt.Buffered()
+	}
+	return n
+}
+
+// Read implements io.Reader
+func (it *storeIterator) Read(dest []byte) (int, error) {
+	if it.closed {
+		return 0, io.EOF
+	}
+	if len(it.trunc) > 0 {
+		n := copy(dest, it.trunc)
+		it.trunc = it.trunc[n:]
+		return n, nil
+	}
+	for len(it.segments) > 0 {
+		segment := it.segments[0]
+		remaining := segment.size - it.offset
+		if remaining <= 0 {
+			it.nextSegment()
+			continue
+		}
+		if it.file == nil {
+			f, err := os.Open(storePath(it.dir, segment.seq, storeSegmentSuffix))
+			if errors.Is(err, os.ErrNotExist) {
+				// Segment was removed by the writer to make room, so note
+				// that some logs are missing.
+				it.nextSegment()
+				it.trunc = truncBytes
+				return it.Read(dest)
+			}
+			if err != nil {
+				return 0, err
+			}
+			_, err = f.Seek(it.offset, io.SeekStart)
+			if err != nil {
+				_ = f.Close()
+				return 0, err
+			}
+			it.file = f
+		}
+		if int64(len(dest)) > remaining {
+			dest = dest[:remaining]
+		}
+		n, err := it.file.Read(dest)
+		it.offset += int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if errors.Is(err, io.EOF) {
+			// Segment is shorter than expected; skip the rest.
+			it.nextSegment()
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if it.rbIt == nil {
+		return 0, io.EOF
+	}
+	return it.rbIt.Read(dest)
+}
+
+// WriteTo implements io.WriterTo
+func (it *storeIterator) WriteTo(writer io.Writer) (int64, error) {
+	var written int64
+	buf := make([]byte, 32*1024)
+	for !it.closed && (len(it.trunc) > 0 || it.diskBuffered() > 0) {
+		n, err := it.Read(buf)
+		if n > 0 {
+			m, err := writer.Write(buf[:n])
+			written += int64(m)
+			if err != nil {
+				return written, err
+			}
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	if it.closed || it.rbIt == nil {
+		return written, nil
+	}
+	n, err := it.rbIt.WriteTo(writer)
+	return written + n, err
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package servicelog_test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internals/servicelog"
+)
+
+type storeSuite struct{}
+
+var _ = Suite(&storeSuite{})
+
+var storeTestStart = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// writeStoreLines writes numbered log lines (from first to last inclusive),
+// one second apart, in the format written by the FormatWriter.
+func writeStoreLines(c *C, s *servicelog.Store, first, last int) {
+	for i := first; i <= last; i++ {
+		timestamp := storeTestStart.Add(time.Duration(i) * time.Second).Format("2006-01-02T15:04:05.000Z07:00")
+		_, err := fmt.Fprintf(s, "%s [svc1] log line #%d\n", timestamp, i)
+		c.Assert(err, IsNil)
+	}
+}
+
+// readStoreLines reads the available logs from it, returning the line
+// numbers of the logs.
+func readStoreLines(c *C, it servicelog.Iterator) []int {
+	var lines []int
+	parser := servicelog.NewParser(it, 1024)
+	for {
+		for parser.Next() {
+			var n int
+			_, err := fmt.Sscanf(parser.Entry().Message, "log line #%d\n", &n)
+			c.Assert(err, IsNil)
+			lines = append(lines, n)
+		}
+		c.Assert(parser.Err(), IsNil)
+		if !it.Next(nil) {
+			return lines
+		}
+	}
+}
+
+func lineRange(first, last int) []int {
+	var lines []int
+	for i := first; i <= last; i++ {
+		lines = append(lines, i)
+	}
+	return lines
+}
+
+func (*storeSuite) TestIterator(c *C) {
+	rb := servicelog.NewRingBuffer(1024)
+	s, err := servicelog.OpenStore(c.MkDir(), rb, &servicelog.StoreOptions{MaxSize: 1024 * 1024})
+	c.Assert(err, IsNil)
+	defer s.Close()
+
+	// More logs than fit in the ring buffer.
+	writeStoreLines(c, s, 1, 100)
+	it := rb.TailIterator()
+	c.Assert(readStoreLines(c, it)[0] > 1, Equals, true)
+	it.Close()
+
+	it = s.Iterator(time.Time{})
+	defer it.Close()
+	c.Assert(readStoreLines(c, it), DeepEquals, lineRange(1, 100))
+
+	// Later logs are read from the ring buffer.
+	writeStoreLines(c, s, 101, 102)
+	c.Assert(it.Next(nil), Equals, true)
+	c.Assert(readStoreLines(c, it), DeepEquals, []int{101, 102})
+}
+
+func (*storeSuite) TestNotify(c *C) {
+	rb := servicelog.NewRingBuffer(1024)
+	s, err := servicelog.OpenStore(c.MkDir(), rb, &servicelog.StoreOptions{MaxSize: 1024 * 1024})
+	c.Assert(err, IsNil)
+	defer s.Close()
+
+	it := s.Iterator(time.Time{})
+	defer it.Close()
+	notify := make(chan bool, 1)
+	it.Notify(notify)
+	writeStoreLines(c, s, 1, 1)
+	select {
+	case <-notify:
+	case <-time.After(time.Second):
+		c.Fatalf("timed out waiting for notification")
+	}
+	c.Assert(readStoreLines(c, it), DeepEquals, []int{1})
+}
+
+func (*storeSuite) TestReopen(c *C) {
+	dir := c.MkDir()
+	options := &servicelog.StoreOptions{MaxSize: 1024 * 1024}
+	s, err := servicelog.OpenStore(dir, servicelog.NewRingBuffer(1024), options)
+	c.Assert(err, IsNil)
+	writeStoreLines(c, s, 1, 10)
+	c.Assert(s.Close(), IsNil)
+
+	// Logs can be read while the store isn't open.
+	it, err := servicelog.ReadStore(dir, options, time.Time{})
+	c.Assert(err, IsNil)
+	c.Assert(readStoreLines(c, it), DeepEquals, lineRange(1, 10))
+	c.Assert(it.Next(nil), Equals, false)
+	it.Close()
+
+	s, err = servicelog.OpenStore(dir, servicelog.NewRingBuffer(1024), options)
+	c.Assert(err, IsNil)
+	defer s.Close()
+	writeStoreLines(c, s, 11, 20)
+	it = s.Iterator(time.Time{})
+	defer it.Close()
+	c.Assert(readStoreLines(c, it), DeepEquals, lineRange(1, 20))
+}
+
+func (*storeSuite) TestSince(c *C) {
+	dir := c.MkDir()
+	s, err := servicelog.OpenStore(dir, servicelog.NewRingBuffer(1024), &servicelog.StoreOptions{MaxSize: 1024 * 1024})
+	c.Assert(err, IsNil)
+	defer s.Close()
+	writeStoreLines(c, s, 1, 5000)
+
+	since := storeTestStart.Add(4000 * time.Second)
+	it := s.Iterator(since)
+	defer it.Close()
+	lines := readStoreLines(c, it)
+	c.Assert(lines[len(lines)-1], Equals, 5000)
+	// Reading starts at the index entry at or before since, which is at most
+	// one index interval (about 400 lines) before it.
+	c.Assert(lines[0] <= 4000, Equals, true)
+	c.Assert(lines[0] > 3500, Equals, true)
+	c.Assert(lines, DeepEquals, lineRange(lines[0], 5000))
+
+	// A time before the first log reads all the logs.
+	it2 := s.Iterator(storeTestStart)
+	defer it2.Close()
+	c.Assert(readStoreLines(c, it2), DeepEquals, lineRange(1, 5000))
+}
+
+func (*storeSuite) TestMaxSize(c *C) {
+	dir := c.MkDir()
+	s, err := servicelog.OpenStore(dir, servicelog.NewRingBuffer(1024), &servicelog.StoreOptions{MaxSize: 64 * 1024})
+	c.Assert(err, IsNil)
+	defer s.Close()
+	writeStoreLines(c, s, 1, 5000)
+
+	var total int64
+	matches, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	c.Assert(err, IsNil)
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		c.Assert(err, IsNil)
+		total += info.Size()
+	}
+	c.Assert(total <= 64*1024, Equals, true)
+
+	// The oldest logs were removed, and the rest are kept in order.
+	it := s.Iterator(time.Time{})
+	defer it.Close()
+	lines := readStoreLines(c, it)
+	c.Assert(lines[0] > 1, Equals, true)
+	c.Assert(lines, DeepEquals, lineRange(lines[0], 5000))
+}
+
+func (*storeSuite) TestMaxAge(c *C) {
+	dir := c.MkDir()
+	options := &servicelog.StoreOptions{MaxSize: 1024 * 1024, MaxAge: time.Hour}
+	s, err := servicelog.OpenStore(dir, servicelog.NewRingBuffer(1024), options)
+	c.Assert(err, IsNil)
+	writeStoreLines(c, s, 1, 10)
+	c.Assert(s.Close(), IsNil)
+
+	// Make the logs written so far look old.
+	matches, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	c.Assert(err, IsNil)
+	old := time.Now().Add(-2 * time.Hour)
+	for _, match := range matches {
+		c.Assert(os.Chtimes(match, old, old), IsNil)
+	}
+
+	s, err = servicelog.OpenStore(dir, servicelog.NewRingBuffer(1024), options)
+	c.Assert(err, IsNil)
+	defer s.Close()
+	writeStoreLines(c, s, 11, 20)
+	it := s.Iterator(time.Time{})
+	defer it.Close()
+	c.Assert(readStoreLines(c, it), DeepEquals, lineRange(11, 20))
+}
+
+func (*storeSuite) TestWriteTo(c *C) {
+	rb := servicelog.NewRingBuffer(1024)
+	s, err := servicelog.OpenStore(c.MkDir(), rb, &servicelog.StoreOptions{MaxSize: 1024 * 1024})
+	c.Assert(err, IsNil)
+	defer s.Close()
+	writeStoreLines(c, s, 1, 100)
+
+	it := s.Iterator(time.Time{})
+	defer it.Close()
+	r, w := io.Pipe()
+	go func() {
+		_, err := it.WriteTo(w)
+		w.CloseWithError(err)
+	}()
+	data, err := io.ReadAll(r)
+	c.Assert(err, IsNil)
+	copied := servicelog.NewRingBuffer(len(data))
+	_, err = copied.Write(data)
+	c.Assert(err, IsNil)
+	c.Assert(readStoreLines(c, copied.TailIterator()), DeepEquals, lineRange(1, 100))
+}
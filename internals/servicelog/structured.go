@@ -0,0 +1,228 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package servicelog
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Formats of structured log messages understood by StructuredParser.
+const (
+	JSONFormat   = "json"
+	LogfmtFormat = "logfmt"
+)
+
+// Normalized log levels, from least to most severe.
+const (
+	LevelTrace   = "trace"
+	LevelDebug   = "debug"
+	LevelInfo    = "info"
+	LevelWarning = "warning"
+	LevelError   = "error"
+	LevelFatal   = "fatal"
+)
+
+var levelRanks = map[string]int{
+	LevelTrace:   1,
+	LevelDebug:   2,
+	LevelInfo:    3,
+	LevelWarning: 4,
+	LevelError:   5,
+	LevelFatal:   6,
+}
+
+var levelAliases = map[string]string{
+	"trc":           LevelTrace,
+	"dbg":           LevelDebug,
+	"inf":           LevelInfo,
+	"information":   LevelInfo,
+	"informational": LevelInfo,
+	"notice":        LevelInfo,
+	"warn":          LevelWarning,
+	"wrn":           LevelWarning,
+	"err":           LevelError,
+	"crit":          LevelFatal,
+	"critical":      LevelFatal,
+	"alert":         LevelFatal,
+	"emerg":         LevelFatal,
+	"emergency":     LevelFatal,
+	"panic":         LevelFatal,
+}
+
+// Keys recognized as holding the level and message of a structured log, in
+// order of preference.
+var (
+	levelKeys   = []string{"level", "lvl", "severity", "log.level"}
+	messageKeys = []string{"msg", "message"}
+)
+
+// NormalizeLevel returns the normalized name of the given log level, for
+// example "warning" for "WARN". Unrecognized levels are returned in lower
+// case.
+func NormalizeLevel(level string) string {
+	level = strings.ToLower(strings.TrimSpace(level))
+	if alias, ok := levelAliases[level]; ok {
+		return alias
+	}
+	return level
+}
+
+// LevelRank returns the severity of the given normalized log level, higher
+// values being more severe, or 0 if the level is unrecognized.
+func LevelRank(level string) int {
+	return levelRanks[level]
+}
+
+// StructuredParser extracts the level, message and selected fields from
+// structured (JSON or logfmt) log messages.
+type StructuredParser struct {
+	format string
+	fields []string
+}
+
+// NewStructuredParser returns a parser for log messages in the given format,
+// which extracts the named fields in addition to the level and message. It
+// returns nil if format isn't a structured format, and a nil parser leaves
+// entries unchanged.
+func NewStructuredParser(format string, fields []string) *StructuredParser {
+	if format != JSONFormat && format != LogfmtFormat {
+		return nil
+	}
+	return &StructuredParser{
+		format: format,
+		fields: append([]string(nil), fields...),
+	}
+}
+
+// Parse parses entry.Message and, if it's in the parser's format, sets the
+// entry's Level, Message (if the log has a message key) and Fields. Messages
+// which can't be parsed are left unchanged.
+func (p *StructuredParser) Parse(entry *Entry) {
+	if p == nil {
+		return
+	}
+	line := strings.TrimSuffix(entry.Message, "\n")
+	var values map[string]string
+	var ok bool
+	switch p.format {
+	case JSONFormat:
+		values, ok = parseJSONLog(line)
+	case LogfmtFormat:
+		values, ok = parseLogfmt(line)
+	}
+	if !ok {
+		return
+	}
+
+	for _, key := range levelKeys {
+		if level, ok := values[key]; ok {
+			entry.Level = NormalizeLevel(level)
+			break
+		}
+	}
+	for _, key := range messageKeys {
+		if message, ok := values[key]; ok {
+			entry.Message = message + entry.Message[len(line):]
+			break
+		}
+	}
+	for _, field := range p.fields {
+		value, ok := values[field]
+		if !ok {
+			continue
+		}
+		if entry.Fields == nil {
+			entry.Fields = make(map[string]string)
+		}
+		entry.Fields[field] = value
+	}
+}
+
+// parseJSONLog parses a log line holding a JSON object, returning its
+// values as strings (non-string values are returned as JSON).
+func parseJSONLog(line string) (map[string]string, bool) {
+	if !strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return nil, false
+	}
+	var object map[string]json.RawMessage
+	err := json.Unmarshal([]byte(line), &object)
+	if err != nil {
+		return nil, false
+	}
+	values := make(map[string]string, len(object))
+	for key, raw := range object {
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			values[key] = s
+		} else {
+			values[key] = string(bytes.TrimSpace(raw))
+		}
+	}
+	return values, true
+}
+
+// parseLogfmt parses a log line in logfmt format (space-separated key=value
+// pairs, where values may be double-quoted). A line is only considered to be
+// logfmt if it has at least one key=value pair.
+func parseLogfmt(line string) (map[string]string, bool) {
+	values := make(map[string]string)
+	hasValue := false
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			break
+		}
+		end := strings.IndexAny(line, "= \t")
+		if end < 0 {
+			end = len(line)
+		}
+		key := line[:end]
+		if key == "" || strings.Contains(key, `"`) {
+			return nil, false
+		}
+		line = line[end:]
+		if !strings.HasPrefix(line, "=") {
+			// Key with no value.
+			values[key] = ""
+			continue
+		}
+		line = line[1:]
+		var value string
+		if strings.HasPrefix(line, `"`) {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, false
+			}
+			value, err = strconv.Unquote(quoted)
+			if err != nil {
+				return nil, false
+			}
+			line = line[len(quoted):]
+		} else {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			value = line[:end]
+			line = line[end:]
+		}
+		values[key] = value
+		hasValue = true
+	}
+	return values, hasValue
+}
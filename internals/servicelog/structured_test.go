@@ -0,0 +1,114 @@
+// Copyright (c) 2024 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package servicelog_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internals/servicelog"
+)
+
+type structuredSuite struct{}
+
+var _ = Suite(&structuredSuite{})
+
+var structuredTests = []struct {
+	format  string
+	fields  []string
+	message string
+	entry   servicelog.Entry
+}{{
+	format:  "json",
+	fields:  []string{"user", "status", "missing"},
+	message: `{"level":"ERROR","msg":"request failed","user":"bob","status":500,"other":true}` + "\n",
+	entry: servicelog.Entry{
+		Message: "request failed\n",
+		Level:   "error",
+		Fields:  map[string]string{"user": "bob", "status": "500"},
+	},
+}, {
+	format:  "json",
+	message: `{"severity":"Warn","message":"disk filling up"}`,
+	entry: servicelog.Entry{
+		Message: "disk filling up",
+		Level:   "warning",
+	},
+}, {
+	format:  "json",
+	fields:  []string{"a"},
+	message: `{"a":{"b":[1, 2]}}` + "\n",
+	entry: servicelog.Entry{
+		Message: `{"a":{"b":[1, 2]}}` + "\n",
+		Fields:  map[string]string{"a": `{"b":[1, 2]}`},
+	},
+}, {
+	format:  "json",
+	message: "plain text\n",
+	entry:   servicelog.Entry{Message: "plain text\n"},
+}, {
+	format:  "json",
+	message: `{"msg": "truncated` + "\n",
+	entry:   servicelog.Entry{Message: `{"msg": "truncated` + "\n"},
+}, {
+	format:  "logfmt",
+	fields:  []string{"path", "took"},
+	message: `time=2024-01-02T03:04:05Z lvl=dbg msg="GET \"/\" done" path=/ took=5ms` + "\n",
+	entry: servicelog.Entry{
+		Message: `GET "/" done` + "\n",
+		Level:   "debug",
+		Fields:  map[string]string{"path": "/", "took": "5ms"},
+	},
+}, {
+	format:  "logfmt",
+	fields:  []string{"flag"},
+	message: "level=custom flag\n",
+	entry: servicelog.Entry{
+		Message: "level=custom flag\n",
+		Level:   "custom",
+		Fields:  map[string]string{"flag": ""},
+	},
+}, {
+	format:  "logfmt",
+	message: "no pairs here\n",
+	entry:   servicelog.Entry{Message: "no pairs here\n"},
+}, {
+	format:  "logfmt",
+	message: `msg="unterminated` + "\n",
+	entry:   servicelog.Entry{Message: `msg="unterminated` + "\n"},
+}, {
+	format:  "text",
+	message: `{"level":"error"}` + "\n",
+	entry:   servicelog.Entry{Message: `{"level":"error"}` + "\n"},
+}}
+
+func (s *structuredSuite) TestParse(c *C) {
+	for _, test := range structuredTests {
+		parser := servicelog.NewStructuredParser(test.format, test.fields)
+		entry := servicelog.Entry{Message: test.message}
+		parser.Parse(&entry)
+		c.Check(entry, DeepEquals, test.entry, Commentf("%s: %q", test.format, test.message))
+	}
+}
+
+func (s *structuredSuite) TestLevels(c *C) {
+	c.Check(servicelog.NormalizeLevel(" WARN "), Equals, servicelog.LevelWarning)
+	c.Check(servicelog.NormalizeLevel("Critical"), Equals, servicelog.LevelFatal)
+	c.Check(servicelog.NormalizeLevel("info"), Equals, servicelog.LevelInfo)
+	c.Check(servicelog.NormalizeLevel("Verbose"), Equals, "verbose")
+
+	c.Check(servicelog.LevelRank(servicelog.LevelTrace) < servicelog.LevelRank(servicelog.LevelDebug), Equals, true)
+	c.Check(servicelog.LevelRank(servicelog.LevelError) < servicelog.LevelRank(servicelog.LevelFatal), Equals, true)
+	c.Check(servicelog.LevelRank("verbose"), Equals, 0)
+}